@@ -1,11 +1,21 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
@@ -23,6 +33,40 @@ type Config struct {
 	Authenticate         bool
 	ListenURL            string
 	MapboxAPIKey         string
+	TLSCertFile          string
+	TLSKeyFile           string
+	Timezone             string
+	SnapToRoute          bool
+	// MovingSpeed is the speed in mph above which a vehicle is moving.
+	MovingSpeed float64
+	// StoppedAfter is how long a vehicle must stay below MovingSpeed to be stopped, like "1m".
+	StoppedAfter string
+	// OfflineAfter is how long a vehicle may go without reporting before it's offline, like "5m".
+	OfflineAfter string
+	// MaxBodySize is the largest request body in bytes that is accepted. Zero means no limit.
+	MaxBodySize int64
+	// ShutdownTimeout is how long in-flight requests may take to finish when shutting down, like "30s".
+	ShutdownTimeout string
+	// CacheTTL is how long responses about routes and stops are cached, like "1m". They are also
+	// dropped whenever routes or stops are modified. Nothing is cached if empty.
+	CacheTTL string
+	// ServiceDayStart is the time of day, like "03:00", at which each day's service begins in
+	// Timezone. Service before then counts toward the previous day in daily reports.
+	ServiceDayStart string
+	// ProtectedEndpoints are paths of otherwise public endpoints, as registered like
+	// "/vehicles/{id}/trail", that also require a login.
+	ProtectedEndpoints []string
+	// ExcludeStopsWithoutCoords leaves stops at (0, 0), which are missing their coordinates, out of
+	// arrival estimates instead of treating them as real positions.
+	ExcludeStopsWithoutCoords bool
+	// RouteScheduleInterval is how often routes with service windows are enabled or disabled to
+	// match them, like "1m". Routes are never changed automatically if empty.
+	RouteScheduleInterval string
+}
+
+// FeedMonitor reports whether vehicle data is being received.
+type FeedMonitor interface {
+	FeedHealthy() bool
 }
 
 // App holds references to Mongo resources.
@@ -31,12 +75,38 @@ type API struct {
 	CasAUTH *cas.Client
 	CasMEM  *cas.MemoryStore
 	db      database.Database
+	feed    FeedMonitor
 	handler http.Handler
+	tls     *tls.Config
+	loc     *time.Location
+	// stoppedAfter is the parsed StoppedAfter.
+	stoppedAfter time.Duration
+	// offlineAfter is the parsed OfflineAfter.
+	offlineAfter time.Duration
+	// router holds the routes that handler serves, so that they can be listed.
+	router *mux.Router
+	// server serves handler once the API is run.
+	server          *http.Server
+	shutdownTimeout time.Duration
+	// cache holds responses about routes and stops, if CacheTTL is set.
+	cache *responseCache
+	// serviceDayStart is how long after midnight ServiceDayStart is.
+	serviceDayStart time.Duration
+	// hub streams updates from feed to WebSocket clients.
+	hub *updateHub
+	// protected holds ProtectedEndpoints.
+	protected map[string]bool
+	// routeScheduleInterval is the parsed RouteScheduleInterval.
+	routeScheduleInterval time.Duration
+	// ctx is canceled to stop background work when the API shuts down.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // InitApp initializes the application given a config and connects to backends.
-// It also seeds any needed information to the database.
-func New(cfg Config, db database.Database) (*API, error) {
+// It also seeds any needed information to the database. feed may be nil if no
+// data feed is being monitored.
+func New(cfg Config, db database.Database, feed FeedMonitor) (*API, error) {
 	// Set up CAS authentication
 	url, err := url.Parse(cfg.CasURL)
 	if err != nil {
@@ -44,6 +114,64 @@ func New(cfg Config, db database.Database) (*API, error) {
 	}
 	var tickets *cas.MemoryStore
 
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	var stoppedAfter time.Duration
+	if cfg.StoppedAfter != "" {
+		stoppedAfter, err = time.ParseDuration(cfg.StoppedAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offlineAfter := defaultOfflineAfter
+	if cfg.OfflineAfter != "" {
+		offlineAfter, err = time.ParseDuration(cfg.OfflineAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cache *responseCache
+	if cfg.CacheTTL != "" {
+		ttl, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		cache = newResponseCache(ttl)
+	}
+
+	var serviceDayStart time.Duration
+	if cfg.ServiceDayStart != "" {
+		start, err := time.Parse("15:04", cfg.ServiceDayStart)
+		if err != nil {
+			return nil, err
+		}
+		serviceDayStart = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	}
+
+	var routeScheduleInterval time.Duration
+	if cfg.RouteScheduleInterval != "" {
+		routeScheduleInterval, err = time.ParseDuration(cfg.RouteScheduleInterval)
+		if err != nil {
+			return nil, err
+		}
+		if routeScheduleInterval <= 0 {
+			return nil, errors.New("route schedule interval must be positive")
+		}
+	}
+
 	client := cas.NewClient(&cas.Options{
 		URL:   url,
 		Store: nil,
@@ -55,33 +183,102 @@ func New(cfg Config, db database.Database) (*API, error) {
 		CasAUTH: client,
 		CasMEM:  tickets,
 		db:      db,
+		feed:    feed,
+		loc:     loc,
+
+		stoppedAfter:    stoppedAfter,
+		offlineAfter:    offlineAfter,
+		shutdownTimeout: shutdownTimeout,
+		cache:           cache,
+		serviceDayStart: serviceDayStart,
+		hub:             newUpdateHub(),
+		protected:       map[string]bool{},
+
+		routeScheduleInterval: routeScheduleInterval,
+	}
+	api.ctx, api.cancel = context.WithCancel(context.Background())
+	for _, path := range cfg.ProtectedEndpoints {
+		api.protected[path] = true
+	}
+	if subscriber, ok := feed.(UpdateSubscriber); ok {
+		subscriber.Subscribe(api.hub.publish)
 	}
 
 	r := mux.NewRouter()
 
 	// Public
-	r.HandleFunc("/vehicles", api.VehiclesHandler).Methods("GET")
-	r.HandleFunc("/updates", api.UpdatesHandler).Methods("GET")
-	r.HandleFunc("/updates/message", api.UpdateMessageHandler).Methods("GET")
-	r.HandleFunc("/routes", api.RoutesHandler).Methods("GET")
-	r.HandleFunc("/stops", api.StopsHandler).Methods("GET")
+	api.handle(r, "/vehicles", authNone, api.VehiclesHandler).Methods("GET")
+	api.handle(r, "/vehicles/off-route", authNone, api.VehiclesOffRouteHandler).Methods("GET")
+	api.handle(r, "/vehicles/{id}/current", authNone, api.VehiclesCurrentHandler).Methods("GET")
+	api.handle(r, "/vehicles/{id}/trail", authNone, api.VehiclesTrailHandler).Methods("GET")
+	api.handle(r, "/vehicles/{id}/trips.geojson", authNone, api.VehiclesTripsGeoJSONHandler).Methods("GET")
+	api.handle(r, "/updates", authNone, api.UpdatesHandler).Methods("GET")
+	api.handle(r, "/updates/message", authNone, api.UpdateMessageHandler).Methods("GET")
+	api.handle(r, "/ws/updates", authNone, api.UpdatesWebSocketHandler).Methods("GET")
+	api.handle(r, "/routes", authNone, api.cache.cached(api.RoutesHandler, "modifiedSince")).Methods("GET")
+	api.handle(r, "/routes/vehicle-counts", authNone, api.RoutesVehicleCountsHandler).Methods("GET")
+	api.handle(r, "/routes/bounds", authNone, api.cache.cached(api.RoutesBoundsHandler, "stops")).Methods("GET")
+	api.handle(r, "/routes/{id}/occupancy", authNone, api.RoutesOccupancyHandler).Methods("GET")
+	api.handle(r, "/routes/{id}/length", authNone, api.cache.cached(api.RoutesLengthHandler, "units")).Methods("GET")
+	api.handle(r, "/routes/{id}/stops/validate", authNone, api.RoutesStopsValidateHandler).Methods("GET")
+	api.handle(r, "/routes/{id}/stops", authNone, api.RoutesLiveStopsHandler).Methods("GET")
+	api.handle(r, "/routes/{id}.gpx", authNone, api.cache.cached(api.RoutesGPXHandler)).Methods("GET")
+	api.handle(r, "/routes/{id}/adherence", authNone, api.RoutesAdherenceHandler).Methods("GET")
+	api.handle(r, "/routes/{id}/segment-speeds", authNone, api.RoutesSegmentSpeedsHandler).Methods("GET")
+	api.handle(r, "/stops", authNone, api.cache.cachedByMinute(api.StopsHandler, "all", "include")).Methods("GET")
+	api.handle(r, "/stops/nearest", authNone, api.StopsNearestHandler).Methods("GET")
+	api.handle(r, "/stops/{id}/headway", authNone, api.StopsHeadwayHandler).Methods("GET")
+	api.handle(r, "/stops/{id}/arrivals", authNone, api.StopsArrivalsHandler).Methods("GET")
+	api.handle(r, "/stops/{id}/next", authNone, api.StopsNextHandler).Methods("GET")
+	api.handle(r, "/stops/{id}/board", authNone, api.StopsBoardHandler).Methods("GET")
+	api.handle(r, "/health", authOptional, api.HealthHandler).Methods("GET")
+	api.handle(r, "/map/state", authNone, api.MapStateHandler).Methods("GET")
+	api.handle(r, "/time", authNone, api.TimeHandler).Methods("GET")
+	api.handle(r, "/gtfs-rt/vehicle-positions", authNone, api.GTFSRealtimeVehiclePositionsHandler).Methods("GET")
+	api.handle(r, "/gtfs/static.zip", authNone, api.GTFSStaticHandler).Methods("GET")
+	api.handle(r, "/openapi.json", authNone, api.OpenAPIHandler).Methods("GET")
 
 	// Admin
-	r.Handle("/admin/", api.CasAUTH.HandleFunc(api.AdminHandler)).Methods("GET")
-	r.Handle("/admin", api.CasAUTH.HandleFunc(api.AdminHandler)).Methods("GET")
-	r.Handle("/getKey/", api.CasAUTH.HandleFunc(api.KeyHandler)).Methods("GET")
-	r.Handle("/admin/success/", api.CasAUTH.HandleFunc(api.AdminPageServer)).Methods("GET")
-	r.Handle("/admin/success", api.CasAUTH.HandleFunc(api.AdminPageServer)).Methods("GET")
-	r.Handle("/admin/logout/", api.CasAUTH.HandleFunc(api.AdminLogout)).Methods("GET")
-	r.Handle("/admin/logout", api.CasAUTH.HandleFunc(api.AdminLogout)).Methods("GET")
-	r.Handle("/vehicles/create", api.CasAUTH.HandleFunc(api.VehiclesCreateHandler)).Methods("POST")
-	r.Handle("/vehicles/edit", api.CasAUTH.HandleFunc(api.VehiclesEditHandler)).Methods("POST")
-	r.Handle("/vehicles/{id:[0-9]+}", api.CasAUTH.HandleFunc(api.VehiclesDeleteHandler)).Methods("DELETE")
-	r.Handle("/routes/create", api.CasAUTH.HandleFunc(api.RoutesCreateHandler)).Methods("POST")
-	r.Handle("/routes/edit", api.CasAUTH.HandleFunc(api.RoutesEditHandler)).Methods("POST")
-	r.Handle("/routes/{id:.+}", api.CasAUTH.HandleFunc(api.RoutesDeleteHandler)).Methods("DELETE")
-	r.Handle("/stops/create", api.CasAUTH.HandleFunc(api.StopsCreateHandler)).Methods("POST")
-	r.Handle("/stops/{id:.+}", api.CasAUTH.HandleFunc(api.StopsDeleteHandler)).Methods("DELETE")
+	api.handle(r, "/admin/", authOptional, api.AdminHandler).Methods("GET")
+	api.handle(r, "/admin", authOptional, api.AdminHandler).Methods("GET")
+	api.handle(r, "/getKey/", authOptional, api.KeyHandler).Methods("GET")
+	api.handle(r, "/admin/success/", authOptional, api.AdminPageServer).Methods("GET")
+	api.handle(r, "/admin/success", authOptional, api.AdminPageServer).Methods("GET")
+	api.handle(r, "/admin/logout/", authNone, api.AdminLogout).Methods("GET")
+	api.handle(r, "/admin/logout", authNone, api.AdminLogout).Methods("GET")
+	api.handle(r, "/admin/vehicles/enabled", authRequired, api.VehiclesEnabledHandler).Methods("POST")
+	api.handle(r, "/admin/vehicles/silent", authRequired, api.VehiclesSilentHandler).Methods("GET")
+	api.handle(r, "/admin/routes/enabled", authRequired, api.cache.invalidates(api.RoutesEnabledHandler)).Methods("POST")
+	api.handle(r, "/admin/guess/preview", authRequired, api.GuessPreviewHandler).Methods("POST")
+	api.handle(r, "/admin/stats", authRequired, api.StatsHandler).Methods("GET")
+	api.handle(r, "/admin/heatmap", authRequired, api.HeatmapHandler).Methods("GET")
+	api.handle(r, "/admin/clients", authRequired, api.ClientsHandler).Methods("GET")
+	api.handle(r, "/admin/clients", authRequired, api.ClientsCreateHandler).Methods("POST")
+	api.handle(r, "/admin/clients/{id}", authRequired, api.ClientsDeleteHandler).Methods("DELETE")
+	api.handle(r, "/admin/clients/{id}/token", authRequired, api.ClientsTokenHandler).Methods("POST")
+	api.handle(r, "/admin/clients/{id}/token", authRequired, api.ClientsRevokeHandler).Methods("DELETE")
+	api.handle(r, "/vehicles/{id}/gaps", authRequired, api.VehiclesGapsHandler).Methods("GET")
+	api.handle(r, "/updates/export", authRequired, api.UpdatesExportHandler).Methods("GET")
+	api.handle(r, "/updates/area", authRequired, api.UpdatesAreaHandler).Methods("GET")
+	api.handle(r, "/updates/backfill-routes", authRequired, api.RouteBackfillHandler).Methods("POST")
+	api.handle(r, "/updates/backfill-routes", authRequired, api.RouteBackfillProgressHandler).Methods("GET")
+	api.handle(r, "/vehicles/create", authRequired, api.VehiclesCreateHandler).Methods("POST")
+	api.handle(r, "/vehicles/edit", authRequired, api.VehiclesEditHandler).Methods("POST")
+	api.handle(r, "/vehicles/merge", authRequired, api.VehiclesMergeHandler).Methods("POST")
+	api.handle(r, "/vehicles/{id:[0-9]+}", authRequired, api.VehiclesDeleteHandler).Methods("DELETE")
+	api.handle(r, "/vehicles/{id}/updates", authRequired, api.VehiclesUpdatesDeleteHandler).Methods("DELETE")
+	api.handle(r, "/routes/create", authRequired, api.cache.invalidates(api.RoutesCreateHandler)).Methods("POST")
+	api.handle(r, "/routes/edit", authRequired, api.cache.invalidates(api.RoutesEditHandler)).Methods("POST")
+	api.handle(r, "/routes/{id:.+}", authRequired, api.cache.invalidates(api.RoutesDeleteHandler)).Methods("DELETE")
+	api.handle(r, "/stops/create", authRequired, api.cache.invalidates(api.StopsCreateHandler)).Methods("POST")
+	api.handle(r, "/routes/{id}/geometry", authRequired, api.cache.invalidates(api.RoutesGeometryHandler)).Methods("POST")
+	api.handle(r, "/routes/{id}/schedule", authRequired, api.RoutesScheduleHandler).Methods("POST")
+	api.handle(r, "/routes/{id}/variants", authRequired, api.cache.invalidates(api.RoutesVariantsHandler)).Methods("POST")
+	api.handle(r, "/routes/{id}/service-windows", authRequired, api.cache.invalidates(api.RoutesServiceWindowsHandler)).Methods("POST")
+	api.handle(r, "/routes/{id}/stops/bulk", authRequired, api.cache.invalidates(api.StopsBulkCreateHandler)).Methods("POST")
+	api.handle(r, "/stops/{id}/windows", authRequired, api.cache.invalidates(api.StopsWindowsHandler)).Methods("POST")
+	api.handle(r, "/stops/{id}/attributes", authRequired, api.cache.invalidates(api.StopsAttributesHandler)).Methods("POST")
+	api.handle(r, "/stops/{id:.+}", authRequired, api.cache.invalidates(api.StopsDeleteHandler)).Methods("DELETE")
 	//r.HandleFunc("/import", api.ImportHandler).Methods("GET")
 
 	// Static files
@@ -89,8 +286,22 @@ func New(cfg Config, db database.Database) (*API, error) {
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
 	// Serve requests
+	api.router = r
 	hand := api.CasAUTH.Handle(r)
-	api.handler = hand
+	api.handler = api.limitBody(hand)
+	api.server = &http.Server{Handler: api.handler}
+
+	// Serve over HTTPS if we have been given a certificate
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, errors.New("both a TLS certificate and key are required to serve HTTPS")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		api.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
 	return &api, nil
 }
@@ -99,19 +310,117 @@ func NewConfig(v *viper.Viper) *Config {
 	cfg := &Config{
 		ListenURL:    "0.0.0.0:8080",
 		Authenticate: true,
+		Timezone:     "America/New_York",
+		MovingSpeed:  2,
+		StoppedAfter: "1m",
+		OfflineAfter: "5m",
+		MaxBodySize:  1 << 20,
+
+		ShutdownTimeout: "30s",
+		CacheTTL:        "1m",
+		ServiceDayStart: "00:00",
+
+		ExcludeStopsWithoutCoords: true,
+		RouteScheduleInterval:     "1m",
 	}
 	v.SetDefault("api.listenurl", cfg.ListenURL)
 	v.SetDefault("api.casurl", cfg.CasURL)
 	v.SetDefault("api.authenticate", cfg.Authenticate)
+	v.SetDefault("api.tlscertfile", cfg.TLSCertFile)
+	v.SetDefault("api.tlskeyfile", cfg.TLSKeyFile)
+	v.SetDefault("api.timezone", cfg.Timezone)
+	v.SetDefault("api.snaptoroute", cfg.SnapToRoute)
+	v.SetDefault("api.movingspeed", cfg.MovingSpeed)
+	v.SetDefault("api.stoppedafter", cfg.StoppedAfter)
+	v.SetDefault("api.offlineafter", cfg.OfflineAfter)
+	v.SetDefault("api.maxbodysize", cfg.MaxBodySize)
+	v.SetDefault("api.shutdowntimeout", cfg.ShutdownTimeout)
+	v.SetDefault("api.cachettl", cfg.CacheTTL)
+	v.SetDefault("api.servicedaystart", cfg.ServiceDayStart)
+	v.SetDefault("api.protectedendpoints", cfg.ProtectedEndpoints)
+	v.SetDefault("api.excludestopswithoutcoords", cfg.ExcludeStopsWithoutCoords)
+	v.SetDefault("api.routescheduleinterval", cfg.RouteScheduleInterval)
 	return cfg
 }
 
 func (api *API) Run() {
-	if err := http.ListenAndServe(api.cfg.ListenURL, api.handler); err != nil {
+	if api.routeScheduleInterval > 0 {
+		go api.runRouteSchedules()
+	}
+	ln, err := net.Listen("tcp", api.cfg.ListenURL)
+	if err != nil {
+		log.WithError(err).Error("Unable to listen.")
+		return
+	}
+	if err := api.serve(ln); err != nil {
 		log.WithError(err).Error("Unable to serve.")
 	}
 }
 
+// serve handles requests on a listener, over TLS if it has been configured.
+func (api *API) serve(ln net.Listener) error {
+	if api.tls != nil {
+		ln = tls.NewListener(ln, api.tls)
+	}
+	err := api.server.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// defaultShutdownTimeout is how long in-flight requests may take to finish when shutting down, if
+// ShutdownTimeout isn't set.
+const defaultShutdownTimeout = 30 * time.Second
+
+// ShutdownTimeout returns how long Shutdown waits for in-flight requests to finish.
+func (api *API) ShutdownTimeout() time.Duration {
+	return api.shutdownTimeout
+}
+
+// Shutdown stops accepting requests, closes WebSocket connections, and waits up to ShutdownTimeout
+// for in-flight requests to finish. It returns an error if they didn't finish in time.
+func (api *API) Shutdown() error {
+	api.cancel()
+	api.hub.closeAll()
+	ctx, cancel := context.WithTimeout(context.Background(), api.shutdownTimeout)
+	defer cancel()
+	return api.server.Shutdown(ctx)
+}
+
+// limitBody rejects POST, PUT, and DELETE requests with bodies larger than MaxBodySize with 413
+// Request Entity Too Large. Bodies are read before next is called, so that handlers decoding them
+// don't each need to check.
+func (api *API) limitBody(next http.Handler) http.Handler {
+	if api.cfg.MaxBodySize <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || (r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > api.cfg.MaxBodySize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Read one byte past the limit so that a body that is too large can be told apart from one
+		// that failed to read.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, api.cfg.MaxBodySize+1))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > api.cfg.MaxBodySize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
 // IndexHandler serves the index page.
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "index.html")
@@ -119,7 +428,7 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 // AdminHandler serves the admin page.
 func (api *API) AdminHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
+	if !isAuthenticated(r) {
 		cas.RedirectToLogin(w, r)
 		return
 	} else {
@@ -145,16 +454,16 @@ func (api *API) AdminHandler(w http.ResponseWriter, r *http.Request) {
 
 //KeyHandler sends Mapbox api key to authenticated user
 func (api *API) KeyHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
+	if !isAuthenticated(r) {
 		http.Redirect(w, r, "/admin/", 301)
 	} else {
-		WriteJSON(w, api.cfg.MapboxAPIKey)
+		WriteJSON(w, r, api.cfg.MapboxAPIKey)
 	}
 }
 
 func (api *API) AdminPageServer(w http.ResponseWriter, r *http.Request) {
 
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
+	if !isAuthenticated(r) {
 		http.Redirect(w, r, "/admin/", 301)
 		return
 	} else {
@@ -171,14 +480,57 @@ func (api *API) AdminLogout(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// WriteJSON writes the data as JSON.
-func WriteJSON(w http.ResponseWriter, data interface{}) error {
+// WriteJSON writes the data as JSON. The JSON is indented if the request has a "pretty" query parameter
+// such as ?pretty=1, which is handy for reading responses by hand. Coordinates are written as
+// {"lat": ..., "lng": ...} objects unless the "coordFormat" query parameter is "array", in which case
+// they are written as [lng, lat] arrays like GeoJSON. Stops and vehicle updates then have a
+// "position" array in place of their "lat" and "lng".
+func WriteJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	b, err := marshalJSON(r, data)
+	if err != nil {
+		marshalError(w, err)
+		return err
+	}
 	w.Header().Set("Content-Type", "application/json")
-	b, err := json.MarshalIndent(data, "", " ")
+	w.Write(b)
+	return nil
+}
+
+// WriteJSONWithETag writes the data as JSON like WriteJSON, and also sets an ETag computed from the JSON.
+// If the request's If-None-Match header already has that ETag, only 304 Not Modified is written.
+func WriteJSONWithETag(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	b, err := marshalJSON(r, data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		marshalError(w, err)
 		return err
 	}
+
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum(b))
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 	return nil
 }
+
+func marshalJSON(r *http.Request, data interface{}) ([]byte, error) {
+	query := r.URL.Query()
+	switch query.Get("coordFormat") {
+	case "", "object":
+	case "array":
+		data = coordsAsArrays(data)
+	default:
+		return nil, errInvalidCoordFormat
+	}
+
+	if pretty, _ := strconv.ParseBool(query.Get("pretty")); pretty {
+		return json.MarshalIndent(data, "", " ")
+	}
+	return json.Marshal(data)
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// writeSelfSignedCert writes a certificate and key for 127.0.0.1 into dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Shuttle Tracker"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Unable to write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Unable to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttletracker")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+
+	api, err := New(Config{TLSCertFile: certFile, TLSKeyFile: keyFile}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer ln.Close()
+	go api.serve(ln)
+
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("Unable to make HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %d, expected %d.", resp.StatusCode, http.StatusOK)
+	}
+	if resp.TLS == nil {
+		t.Error("Expected response over TLS.")
+	}
+}
+
+func TestNewRequiresTLSCertAndKey(t *testing.T) {
+	if _, err := New(Config{TLSCertFile: "cert.pem"}, &mockDatabase{}, nil); err == nil {
+		t.Error("Expected error with a certificate but no key.")
+	}
+	if _, err := New(Config{TLSKeyFile: "key.pem"}, &mockDatabase{}, nil); err == nil {
+		t.Error("Expected error with a key but no certificate.")
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	data := map[string]int{"shuttles": 3}
+	table := []struct {
+		url      string
+		expected string
+	}{
+		{"/", `{"shuttles":3}`},
+		{"/?pretty=0", `{"shuttles":3}`},
+		{"/?pretty=1", "{\n \"shuttles\": 3\n}"},
+		{"/?pretty=true", "{\n \"shuttles\": 3\n}"},
+	}
+
+	for _, testCase := range table {
+		w := httptest.NewRecorder()
+		if err := WriteJSON(w, httptest.NewRequest("GET", testCase.url, nil), data); err != nil {
+			t.Fatalf("Unable to write JSON: %v", err)
+		}
+		if body := w.Body.String(); body != testCase.expected {
+			t.Errorf("Got %q for %s, expected %q.", body, testCase.url, testCase.expected)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Got content type %q, expected application/json.", contentType)
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", Enabled: true}}}
+	api, err := New(Config{MaxBodySize: 64}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	small := `{"ids": ["1"], "enabled": false}`
+	large := `{"ids": ["` + strings.Repeat("1", 100) + `"], "enabled": false}`
+	for _, testCase := range []struct {
+		body     string
+		chunked  bool
+		expected int
+	}{
+		{small, false, http.StatusOK},
+		{small, true, http.StatusOK},
+		{large, false, http.StatusRequestEntityTooLarge},
+		// Without a Content-Length, the body must be read to find its size.
+		{large, true, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/admin/vehicles/enabled", strings.NewReader(testCase.body))
+		if testCase.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		if w.Code != testCase.expected {
+			t.Errorf("Got status %d for a %d byte body (chunked %v), expected %d.", w.Code, len(testCase.body), testCase.chunked, testCase.expected)
+		}
+	}
+}
+
+// failingReader returns err from every Read.
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestLimitBodyReadError(t *testing.T) {
+	api, err := New(Config{MaxBodySize: 64}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/vehicles/enabled", failingReader{errors.New("connection reset")})
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLimitBodyIgnoresGet(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", Enabled: true}}}
+	api, err := New(Config{MaxBodySize: 64}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/vehicles", strings.NewReader(strings.Repeat("1", 100)))
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	api, err := New(Config{ShutdownTimeout: "5s"}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	started := make(chan struct{})
+	api.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- api.serve(ln) }()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			t.Errorf("Slow request failed: %v", err)
+			responses <- ""
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	if err := api.Shutdown(); err != nil {
+		t.Errorf("Unable to shut down: %v", err)
+	}
+	if body := <-responses; body != "done" {
+		t.Errorf("Got response %q, expected the slow request to finish.", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Got serve error %v, expected none after shutdown.", err)
+	}
+}
+
+func TestShutdownTimeoutDefault(t *testing.T) {
+	api, err := New(Config{}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	if api.shutdownTimeout != defaultShutdownTimeout {
+		t.Errorf("Got shutdown timeout %v, expected %v.", api.shutdownTimeout, defaultShutdownTimeout)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	api, err := New(Config{ShutdownTimeout: "50ms"}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	api.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	go api.serve(ln)
+	go http.Get("http://" + ln.Addr().String() + "/stuck")
+
+	<-started
+	if err := api.Shutdown(); err == nil {
+		t.Error("Expected an error when requests don't finish in time.")
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/cas.v1"
+)
+
+// authMode is how an endpoint treats CAS logins and API client tokens.
+type authMode int
+
+const (
+	// authNone endpoints are public, unless they are listed in ProtectedEndpoints.
+	authNone authMode = iota
+	// authOptional endpoints are public, but may respond with more for logged-in users.
+	authOptional
+	// authRequired endpoints respond with 401 Unauthorized unless the user is logged in.
+	authRequired
+	// authProtected endpoints are public ones listed in ProtectedEndpoints. They respond with 401
+	// Unauthorized unless the user is logged in or an API client sends its token. Tokens aren't
+	// accepted anywhere else, so that a leaked token can only read.
+	authProtected
+)
+
+// authKey is the request context key holding whether the user is logged in.
+type authKey struct{}
+
+// casAuthenticated reports whether r has a CAS login. Tests replace it to log in.
+var casAuthenticated = cas.IsAuthenticated
+
+// handle registers h at path on r, guarded according to mode. Public endpoints listed in
+// ProtectedEndpoints become authProtected.
+func (api *API) handle(r *mux.Router, path string, mode authMode, h http.HandlerFunc) *mux.Route {
+	if api.protected[path] && mode < authRequired {
+		mode = authProtected
+	}
+	return r.HandleFunc(path, api.authenticate(mode, h))
+}
+
+// authenticate records whether the user is logged in for isAuthenticated, and rejects the request
+// if mode requires a login that the user doesn't have. API clients with a valid bearer token count
+// as logged in only at authProtected endpoints. Everyone counts as logged in when Authenticate is
+// off.
+func (api *API) authenticate(mode authMode, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authenticated := false
+		if mode != authNone {
+			authenticated = !api.cfg.Authenticate || casAuthenticated(r) || (mode == authProtected && api.clientAuthenticated(r))
+		}
+		if mode >= authRequired && !authenticated {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), authKey{}, authenticated)))
+	}
+}
+
+// isAuthenticated reports whether the user making r is logged in. It is always false for
+// authNone endpoints.
+func isAuthenticated(r *http.Request) bool {
+	authenticated, _ := r.Context().Value(authKey{}).(bool)
+	return authenticated
+}
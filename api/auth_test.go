@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// logIn makes CAS report that every request is logged in until the returned function is called.
+func logIn() func() {
+	original := casAuthenticated
+	casAuthenticated = func(*http.Request) bool { return true }
+	return func() {
+		casAuthenticated = original
+	}
+}
+
+func newAuthTestAPI(t *testing.T, cfg Config) *API {
+	cfg.Authenticate = true
+	api, err := New(cfg, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	return api
+}
+
+func TestProtectedEndpoints(t *testing.T) {
+	api := newAuthTestAPI(t, Config{})
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/vehicles/create", `{"vehicleID": "1", "vehicleName": "Bus"}`},
+		{"POST", "/vehicles/edit", `{"vehicleID": "1", "vehicleName": "Bus"}`},
+		{"POST", "/stops/create", `{"name": "Union"}`},
+		{"GET", "/updates/export", ""},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d for %s %s without a login, expected %d.", w.Code, c.method, c.path, http.StatusUnauthorized)
+		}
+	}
+
+	defer logIn()()
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/create", strings.NewReader(`{"vehicleID": "1", "vehicleName": "Bus"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d with a login, expected %d.", w.Code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/updates/export", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d with a login, expected %d.", w.Code, http.StatusOK)
+	}
+}
+
+func TestConfiguredProtectedEndpoints(t *testing.T) {
+	api := newAuthTestAPI(t, Config{ProtectedEndpoints: []string{"/vehicles"}})
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a login, expected %d.", w.Code, http.StatusUnauthorized)
+	}
+	// Other public endpoints stay public.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d for a public endpoint, expected %d.", w.Code, http.StatusOK)
+	}
+
+	defer logIn()()
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d with a login, expected %d.", w.Code, http.StatusOK)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	db := &mockDatabase{
+		latestUpdateTime: time.Now(),
+		updates:          []model.VehicleUpdate{{VehicleID: "1", Created: time.Now()}},
+	}
+	api, err := New(Config{Authenticate: true}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	health := func() Health {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+		}
+		health := Health{}
+		if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+			t.Fatalf("Unable to decode health: %v", err)
+		}
+		return health
+	}
+
+	if vehicles := health().OnlineVehicles; vehicles != nil {
+		t.Errorf("Got online vehicles %v without a login, expected none.", vehicles)
+	}
+	defer logIn()()
+	if vehicles := health().OnlineVehicles; len(vehicles) != 1 || vehicles[0].VehicleID != "1" {
+		t.Errorf("Got online vehicles %v with a login, expected vehicle 1.", vehicles)
+	}
+}
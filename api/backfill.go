@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/wtg/shuttletracker/model"
+	"github.com/wtg/shuttletracker/updater"
+)
+
+// RouteBackfiller guesses routes for stored updates that have none, in the background.
+type RouteBackfiller interface {
+	StartRouteBackfill(cursor string) error
+	RouteBackfillProgress() model.RouteBackfill
+}
+
+// BackfillRequest starts a route backfill, resuming after Cursor if it's given.
+type BackfillRequest struct {
+	Cursor string `json:"cursor"`
+}
+
+// RouteBackfillHandler starts a route backfill given by an optional BackfillRequest and responds
+// with its progress. It responds with 409 Conflict if a backfill is already running.
+func (api *API) RouteBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	backfiller, ok := api.feed.(RouteBackfiller)
+	if !ok {
+		http.Error(w, "route backfill isn't available", http.StatusNotImplemented)
+		return
+	}
+
+	req := BackfillRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := backfiller.StartRouteBackfill(req.Cursor)
+	if err == updater.ErrBackfillRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	WriteJSON(w, r, backfiller.RouteBackfillProgress())
+}
+
+// RouteBackfillProgressHandler reports the progress of the latest route backfill.
+func (api *API) RouteBackfillProgressHandler(w http.ResponseWriter, r *http.Request) {
+	backfiller, ok := api.feed.(RouteBackfiller)
+	if !ok {
+		http.Error(w, "route backfill isn't available", http.StatusNotImplemented)
+		return
+	}
+	WriteJSON(w, r, backfiller.RouteBackfillProgress())
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wtg/shuttletracker/model"
+	"github.com/wtg/shuttletracker/updater"
+)
+
+// mockBackfiller is a FeedMonitor that also backfills routes.
+type mockBackfiller struct {
+	mockFeedMonitor
+	progress model.RouteBackfill
+}
+
+func (b *mockBackfiller) StartRouteBackfill(cursor string) error {
+	if b.progress.Running {
+		return updater.ErrBackfillRunning
+	}
+	b.progress = model.RouteBackfill{Running: true, Cursor: cursor}
+	return nil
+}
+
+func (b *mockBackfiller) RouteBackfillProgress() model.RouteBackfill {
+	return b.progress
+}
+
+func TestRouteBackfillHandler(t *testing.T) {
+	backfiller := &mockBackfiller{}
+	api, err := New(Config{}, &mockDatabase{}, backfiller)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/updates/backfill-routes", strings.NewReader(`{"cursor": "abc"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusAccepted)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Got content type %q, expected application/json.", contentType)
+	}
+	progress := model.RouteBackfill{}
+	if err := json.NewDecoder(w.Body).Decode(&progress); err != nil {
+		t.Fatalf("Unable to decode progress: %v", err)
+	}
+	if !progress.Running || progress.Cursor != "abc" {
+		t.Errorf("Got %+v, expected running backfill resumed at abc.", progress)
+	}
+
+	// Only one backfill may run at a time.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/updates/backfill-routes", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusConflict)
+	}
+
+	backfiller.progress = model.RouteBackfill{Done: true, Scanned: 10, Attributed: 4}
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/updates/backfill-routes", nil))
+	progress = model.RouteBackfill{}
+	if err := json.NewDecoder(w.Body).Decode(&progress); err != nil {
+		t.Fatalf("Unable to decode progress: %v", err)
+	}
+	if progress != backfiller.progress {
+		t.Errorf("Got %+v, expected %+v.", progress, backfiller.progress)
+	}
+
+	// Starting from the beginning doesn't need a body.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/updates/backfill-routes", nil))
+	if w.Code != http.StatusAccepted || backfiller.progress.Cursor != "" {
+		t.Errorf("Got status %d and %+v, expected a backfill from the beginning.", w.Code, backfiller.progress)
+	}
+}
+
+func TestRouteBackfillHandlerUnavailable(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/updates/backfill-routes", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotImplemented)
+	}
+}
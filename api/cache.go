@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries is the most responses that a responseCache holds.
+const maxCacheEntries = 1000
+
+// cacheParams are query parameters that change every cached response, since WriteJSON reads them.
+var cacheParams = []string{"coordFormat", "pretty"}
+
+// responseCache keeps recent responses from endpoints whose data rarely changes, like routes and
+// stops. Responses are dropped when that data is modified, or after ttl in case it was modified
+// some other way. A nil responseCache caches nothing.
+type responseCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	// generation counts how many times the cache has been cleared, so that responses that were
+	// being made while it was cleared aren't stored.
+	generation int
+}
+
+// cachedResponse is a successful response to a GET request.
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{ttl: ttl, entries: map[string]cachedResponse{}}
+}
+
+// cached serves responses from h out of the cache, keyed by path and the query parameters in params,
+// which must be every one that h reads. Clients are told to revalidate with the response's ETag
+// each time, so that they also see modifications right away.
+func (c *responseCache) cached(h http.HandlerFunc, params ...string) http.HandlerFunc {
+	return c.cachedUntil(h, params, func(now time.Time) time.Time { return now.Add(c.ttl) })
+}
+
+// cachedByMinute is like cached, but responses also expire at the end of each minute. It wraps
+// handlers whose responses depend on the time of day, like stops with service windows.
+func (c *responseCache) cachedByMinute(h http.HandlerFunc, params ...string) http.HandlerFunc {
+	return c.cachedUntil(h, params, func(now time.Time) time.Time {
+		expires := now.Add(c.ttl)
+		if minute := now.Truncate(time.Minute).Add(time.Minute); minute.Before(expires) {
+			return minute
+		}
+		return expires
+	})
+}
+
+// cachedUntil is like cached, but each response expires at the time given by expires for when it
+// was made.
+func (c *responseCache) cachedUntil(h http.HandlerFunc, params []string, expires func(now time.Time) time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		if c == nil {
+			h(w, r)
+			return
+		}
+
+		key := cacheKey(r, params)
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		generation := c.generation
+		c.mu.Unlock()
+		if !ok || time.Now().After(entry.expires) {
+			// Don't let a conditional request keep the full response from being cached.
+			unconditional := *r
+			unconditional.Header = http.Header{}
+			for name, values := range r.Header {
+				if name != "If-None-Match" {
+					unconditional.Header[name] = values
+				}
+			}
+			rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+			h(rec, &unconditional)
+			if rec.status != http.StatusOK {
+				rec.writeTo(w)
+				return
+			}
+			entry = cachedResponse{header: rec.header, body: rec.body.Bytes(), expires: expires(time.Now())}
+			if entry.header.Get("ETag") == "" {
+				entry.header.Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(entry.body)))
+			}
+			c.store(key, entry, generation)
+		}
+		entry.serve(w, r)
+	}
+}
+
+// cacheKey identifies r by its path and the values of params and cacheParams, so that other query
+// parameters can't be used to fill the cache with copies of the same response.
+func cacheKey(r *http.Request, params []string) string {
+	query := r.URL.Query()
+	values := url.Values{}
+	for _, list := range [][]string{params, cacheParams} {
+		for _, param := range list {
+			if value, ok := query[param]; ok {
+				values[param] = value
+			}
+		}
+	}
+	return r.URL.Path + "?" + values.Encode()
+}
+
+// store saves entry under key, unless the cache has been cleared since generation. When the cache
+// is full, expired entries are removed first, and then others if that isn't enough.
+func (c *responseCache) store(key string, entry cachedResponse, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxCacheEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// invalidates empties the cache after h runs. It wraps handlers that modify cached data.
+func (c *responseCache) invalidates(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r)
+		c.clear()
+	}
+}
+
+// clear empties the cache.
+func (c *responseCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = map[string]cachedResponse{}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// serve writes the response, or only 304 Not Modified if the request already has its ETag.
+func (entry cachedResponse) serve(w http.ResponseWriter, r *http.Request) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	etag := entry.header.Get("ETag")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write(entry.body)
+}
+
+// responseRecorder captures a response so that it can be cached.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+// writeTo writes the captured response to w.
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestResponseCache(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west", Name: "West", Enabled: true}}}
+	api, err := New(Config{CacheTTL: "1h"}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	getRoutes := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/routes", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		return w
+	}
+	routeNames := func(w *httptest.ResponseRecorder) []string {
+		routes := []model.Route{}
+		if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+			t.Fatalf("Unable to decode routes: %v", err)
+		}
+		names := []string{}
+		for _, route := range routes {
+			names = append(names, route.Name)
+		}
+		return names
+	}
+
+	w := getRoutes("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-cache" {
+		t.Errorf("Got Cache-Control %q, expected no-cache.", cacheControl)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Error("Expected an ETag.")
+	}
+	if w := getRoutes(etag); w.Code != http.StatusNotModified {
+		t.Errorf("Got status %d for cached ETag, expected %d.", w.Code, http.StatusNotModified)
+	}
+
+	// Changes made behind the API's back aren't seen until the cache expires.
+	db.routes[0].Name = "Changed"
+	if names := routeNames(getRoutes("")); len(names) != 1 || names[0] != "West" {
+		t.Errorf("Got routes %v, expected the cached route.", names)
+	}
+
+	// Modifying a route through the API invalidates the cache.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/edit", strings.NewReader(`{"id": "west", "enabled": false}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d editing route, expected %d.", w.Code, http.StatusOK)
+	}
+	w = getRoutes(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d after edit, expected %d.", w.Code, http.StatusOK)
+	}
+	if names := routeNames(w); len(names) != 1 || names[0] != "Changed" {
+		t.Errorf("Got routes %v after edit, expected the modified route.", names)
+	}
+	if db.routes[0].Enabled {
+		t.Error("Expected route to be disabled.")
+	}
+}
+
+func TestResponseCacheKeys(t *testing.T) {
+	c := newResponseCache(time.Hour)
+	calls := 0
+	h := c.cached(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("ok"))
+	}, "units")
+	for _, uri := range []string{"/length?x=1", "/length?x=2", "/length", "/length?units=miles", "/length?units=miles&y=1", "/length?pretty=true"} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", uri, nil))
+	}
+	// Only units and pretty change the response.
+	if calls != 3 || len(c.entries) != 3 {
+		t.Errorf("Got %d calls and %d entries, expected 3 of each.", calls, len(c.entries))
+	}
+}
+
+func TestResponseCacheLimit(t *testing.T) {
+	c := newResponseCache(time.Hour)
+	for i := 0; i < maxCacheEntries+10; i++ {
+		c.store(strconv.Itoa(i), cachedResponse{expires: time.Now().Add(time.Hour)}, 0)
+	}
+	if len(c.entries) != maxCacheEntries {
+		t.Errorf("Got %d entries, expected %d.", len(c.entries), maxCacheEntries)
+	}
+
+	// Expired entries are removed first.
+	for key := range c.entries {
+		c.entries[key] = cachedResponse{expires: time.Now().Add(-time.Second)}
+	}
+	c.store("new", cachedResponse{expires: time.Now().Add(time.Hour)}, 0)
+	if _, ok := c.entries["new"]; !ok || len(c.entries) != 1 {
+		t.Errorf("Got %d entries, expected only the new one.", len(c.entries))
+	}
+}
+
+func TestResponseCacheClearedWhileFilling(t *testing.T) {
+	c := newResponseCache(time.Hour)
+	h := c.cached(func(w http.ResponseWriter, r *http.Request) {
+		// The data is modified while the response is being made.
+		c.clear()
+		w.Write([]byte("stale"))
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/routes", nil))
+	if w.Body.String() != "stale" {
+		t.Errorf("Got body %q, expected the response to still be served.", w.Body.String())
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("Got %d entries, expected the stale response not to be stored.", len(c.entries))
+	}
+}
+
+func TestResponseCacheByMinute(t *testing.T) {
+	c := newResponseCache(time.Hour)
+	h := c.cachedByMinute(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stops"))
+	})
+	before := time.Now()
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/stops", nil))
+	for _, entry := range c.entries {
+		if entry.expires.After(before.Truncate(time.Minute).Add(2 * time.Minute)) {
+			t.Errorf("Got expiry %v, expected it by the end of the minute.", entry.expires)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// ClientRequest creates an API client.
+type ClientRequest struct {
+	Name string `json:"name"`
+}
+
+// ClientToken is an API client along with its newly issued token. The token can't be retrieved
+// again, since only its hash is stored.
+type ClientToken struct {
+	Client model.APIClient `json:"client"`
+	Token  string          `json:"token"`
+}
+
+// ClientsHandler lists the API clients, including when each last used its token.
+func (api *API) ClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.db.GetAPIClients()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, clients)
+}
+
+// ClientsCreateHandler creates an API client named by a ClientRequest and issues it a token.
+func (api *API) ClientsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	req := ClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	client := model.APIClient{ID: bson.NewObjectId().Hex(), Name: req.Name, Created: time.Now()}
+	if err := api.db.CreateAPIClient(&client); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	api.issueToken(w, r, client.ID)
+}
+
+// ClientsTokenHandler issues an API client a new token. Any token it had before stops working.
+func (api *API) ClientsTokenHandler(w http.ResponseWriter, r *http.Request) {
+	api.issueToken(w, r, mux.Vars(r)["id"])
+}
+
+// ClientsRevokeHandler revokes an API client's token.
+func (api *API) ClientsRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := api.db.RevokeAPIClientToken(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, client)
+}
+
+// ClientsDeleteHandler deletes an API client, along with its token.
+func (api *API) ClientsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	err := api.db.DeleteAPIClient(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueToken generates a token for the API client with clientID, stores its hash, and responds
+// with a ClientToken.
+func (api *API) issueToken(w http.ResponseWriter, r *http.Request, clientID string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	client, err := api.db.IssueAPIClientToken(clientID, hashToken(token), time.Now())
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, ClientToken{Client: client, Token: token})
+}
+
+// clientAuthenticated reports whether r has an "Authorization: Bearer" header with an API
+// client's token, and records that the client used it.
+func (api *API) clientAuthenticated(r *http.Request) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	if token == "" {
+		return false
+	}
+	client, err := api.db.UseAPIClientToken(hashToken(token), time.Now())
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.WithError(err).Error("Unable to check API client token.")
+		return false
+	}
+	log.Debugf("Authenticated API client %s.", client.Name)
+	return true
+}
+
+// hashToken returns the hex-encoded SHA-256 hash of token. Tokens are random and long, so they
+// don't need to be salted or stretched like passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestClientTokens(t *testing.T) {
+	db := &mockDatabase{}
+	api, err := New(Config{Authenticate: true, ProtectedEndpoints: []string{"/vehicles"}}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	request := func(method, path, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		return w
+	}
+	issued := func(w *httptest.ResponseRecorder) ClientToken {
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		ct := ClientToken{}
+		if err := json.NewDecoder(w.Body).Decode(&ct); err != nil {
+			t.Fatalf("Unable to decode token: %v", err)
+		}
+		return ct
+	}
+
+	// Issuing tokens requires a CAS login.
+	if w := request("POST", "/admin/clients", `{"name": "Signage"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Got status %d without a login, expected %d.", w.Code, http.StatusUnauthorized)
+	}
+	logOut := logIn()
+	created := issued(request("POST", "/admin/clients", `{"name": "Signage"}`, ""))
+	if w := request("POST", "/admin/clients", `{"name": " "}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for a blank name, expected %d.", w.Code, http.StatusBadRequest)
+	}
+	logOut()
+
+	if created.Token == "" || created.Client.Name != "Signage" || created.Client.TokenIssued == nil {
+		t.Fatalf("Got %+v, expected a token for Signage.", created)
+	}
+	// Only the token's hash is stored.
+	if stored := db.clients[0].TokenHash; stored == "" || stored == created.Token {
+		t.Errorf("Got stored token %q, expected a hash of %q.", stored, created.Token)
+	}
+
+	// The token only reads protected endpoints.
+	if w := request("GET", "/vehicles", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a token, expected %d.", w.Code, http.StatusUnauthorized)
+	}
+	if w := request("GET", "/vehicles", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d with a wrong token, expected %d.", w.Code, http.StatusUnauthorized)
+	}
+	if w := request("GET", "/vehicles", "", created.Token); w.Code != http.StatusOK {
+		t.Errorf("Got status %d with the token, expected %d.", w.Code, http.StatusOK)
+	}
+	for _, c := range []struct{ method, path string }{
+		{"GET", "/admin/vehicles/silent"},
+		{"GET", "/admin/clients"},
+		{"DELETE", "/routes/west"},
+		{"DELETE", "/vehicles/1/updates?confirm=true"},
+	} {
+		if w := request(c.method, c.path, "", created.Token); w.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d for %s %s with the token, expected %d.", w.Code, c.method, c.path, http.StatusUnauthorized)
+		}
+	}
+
+	logOut = logIn()
+	w := request("GET", "/admin/clients", "", "")
+	clients := []model.APIClient{}
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatalf("Unable to decode clients: %v", err)
+	}
+	if len(clients) != 1 || clients[0].LastUsed == nil {
+		t.Errorf("Got %+v, expected Signage with a last used time.", clients)
+	}
+	if strings.Contains(w.Body.String(), db.clients[0].TokenHash) {
+		t.Error("Expected the token's hash not to be listed.")
+	}
+	if w := request("DELETE", "/admin/clients/"+created.Client.ID+"/token", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("Got status %d revoking the token, expected %d.", w.Code, http.StatusOK)
+	}
+	logOut()
+
+	// A revoked token is rejected.
+	if w := request("GET", "/vehicles", "", created.Token); w.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d with a revoked token, expected %d.", w.Code, http.StatusUnauthorized)
+	}
+
+	defer logIn()()
+	// Reissuing replaces the old token.
+	reissued := issued(request("POST", "/admin/clients/"+created.Client.ID+"/token", "", ""))
+	if reissued.Token == created.Token {
+		t.Error("Expected a new token.")
+	}
+
+	for _, c := range []struct{ method, path string }{
+		{"POST", "/admin/clients/unknown/token"},
+		{"DELETE", "/admin/clients/unknown/token"},
+		{"DELETE", "/admin/clients/unknown"},
+	} {
+		if w := request(c.method, c.path, "", ""); w.Code != http.StatusNotFound {
+			t.Errorf("Got status %d for %s %s, expected %d.", w.Code, c.method, c.path, http.StatusNotFound)
+		}
+	}
+	if w := request("DELETE", "/admin/clients/"+created.Client.ID, "", ""); w.Code != http.StatusNoContent || len(db.clients) != 0 {
+		t.Errorf("Got status %d and %d clients after deleting, expected %d and none.", w.Code, len(db.clients), http.StatusNoContent)
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// errInvalidCoordFormat indicates that the "coordFormat" query parameter isn't a known format.
+var errInvalidCoordFormat = errors.New(`coordFormat must be "object" or "array"`)
+
+// coordArrayer is a response whose coordinates can be written as [lng, lat] arrays instead.
+type coordArrayer interface {
+	coordsAsArrays() interface{}
+}
+
+// arrayCoord is a position written as a [lng, lat] array as in GeoJSON.
+type arrayCoord [2]float64
+
+func newArrayCoord(c model.Coord) arrayCoord {
+	return arrayCoord{c.Lng, c.Lat}
+}
+
+func newArrayCoords(coords []model.Coord) []arrayCoord {
+	arrays := make([]arrayCoord, len(coords))
+	for i, c := range coords {
+		arrays[i] = newArrayCoord(c)
+	}
+	return arrays
+}
+
+// arrayRoute is a model.Route with the coordinates of its paths written as arrays.
+type arrayRoute struct {
+	model.Route
+	Coords   []arrayCoord        `json:"coords"`
+	Variants []arrayRouteVariant `json:"variants"`
+}
+
+// arrayRouteVariant is a model.RouteVariant with the coordinates of its path written as arrays.
+type arrayRouteVariant struct {
+	model.RouteVariant
+	Coords []arrayCoord `json:"coords"`
+}
+
+func newArrayRoute(route model.Route) arrayRoute {
+	a := arrayRoute{Route: route, Coords: newArrayCoords(route.Coords)}
+	if route.Variants != nil {
+		a.Variants = make([]arrayRouteVariant, len(route.Variants))
+		for i, variant := range route.Variants {
+			a.Variants[i] = arrayRouteVariant{RouteVariant: variant, Coords: newArrayCoords(variant.Coords)}
+		}
+	}
+	return a
+}
+
+// arrayStop is a model.Stop with a position array in place of its "lat" and "lng".
+type arrayStop struct {
+	model.Stop
+	// Lat and Lng are always nil so that the Stop's own are left out.
+	Lat      *float64   `json:"lat,omitempty"`
+	Lng      *float64   `json:"lng,omitempty"`
+	Position arrayCoord `json:"position"`
+}
+
+func newArrayStop(stop model.Stop) arrayStop {
+	return arrayStop{Stop: stop, Position: newArrayCoord(model.Coord{Lat: stop.Lat, Lng: stop.Lng})}
+}
+
+func newArrayStops(stops []model.Stop) []arrayStop {
+	arrays := make([]arrayStop, len(stops))
+	for i, stop := range stops {
+		arrays[i] = newArrayStop(stop)
+	}
+	return arrays
+}
+
+// arrayUpdate is a model.VehicleUpdate with a position array in place of its "lat" and "lng".
+type arrayUpdate struct {
+	model.VehicleUpdate
+	// Lat and Lng are always nil so that the update's own are left out.
+	Lat *string `json:"lat,omitempty"`
+	Lng *string `json:"lng,omitempty"`
+	// Position is null if the update's position can't be parsed.
+	Position *arrayCoord `json:"position"`
+	Snapped  *arrayCoord `json:"snapped,omitempty"`
+}
+
+func newArrayUpdate(update model.VehicleUpdate) arrayUpdate {
+	a := arrayUpdate{VehicleUpdate: update}
+	if c, err := update.Coord(); err == nil {
+		position := newArrayCoord(c)
+		a.Position = &position
+	}
+	if update.Snapped != nil {
+		snapped := newArrayCoord(*update.Snapped)
+		a.Snapped = &snapped
+	}
+	return a
+}
+
+func newArrayUpdates(updates []model.VehicleUpdate) []arrayUpdate {
+	arrays := make([]arrayUpdate, len(updates))
+	for i, update := range updates {
+		arrays[i] = newArrayUpdate(update)
+	}
+	return arrays
+}
+
+// arrayStopWithRoutes is a model.StopWithRoutes with its position written as an array.
+type arrayStopWithRoutes struct {
+	arrayStop
+	Routes []model.StopRoute `json:"routes"`
+}
+
+// coordsAsArrays returns data with its coordinates written as [lng, lat] arrays if it is, or is
+// made of, routes, stops, vehicle updates, or coordinates, or if it is a coordArrayer. Anything
+// else is returned unchanged.
+func coordsAsArrays(data interface{}) interface{} {
+	switch data := data.(type) {
+	case coordArrayer:
+		return data.coordsAsArrays()
+	case model.Coord:
+		return newArrayCoord(data)
+	case []model.Coord:
+		return newArrayCoords(data)
+	case model.Route:
+		return newArrayRoute(data)
+	case []model.Route:
+		routes := make([]arrayRoute, len(data))
+		for i, route := range data {
+			routes[i] = newArrayRoute(route)
+		}
+		return routes
+	case model.Stop:
+		return newArrayStop(data)
+	case []model.Stop:
+		return newArrayStops(data)
+	case []model.StopWithRoutes:
+		stops := make([]arrayStopWithRoutes, len(data))
+		for i, stop := range data {
+			stops[i] = arrayStopWithRoutes{arrayStop: newArrayStop(stop.Stop), Routes: stop.Routes}
+		}
+		return stops
+	case model.VehicleUpdate:
+		return newArrayUpdate(data)
+	case []model.VehicleUpdate:
+		return newArrayUpdates(data)
+	}
+	return data
+}
+
+func (t Trail) coordsAsArrays() interface{} {
+	return struct {
+		Trail
+		Points []arrayCoord `json:"points"`
+	}{t, newArrayCoords(t.Points)}
+}
+
+func (p UpdatesPage) coordsAsArrays() interface{} {
+	return struct {
+		UpdatesPage
+		Updates []arrayUpdate `json:"updates"`
+	}{p, newArrayUpdates(p.Updates)}
+}
+
+func (s NearestStop) coordsAsArrays() interface{} {
+	return struct {
+		arrayStop
+		Distance float64 `json:"distance"`
+	}{newArrayStop(s.Stop), s.Distance}
+}
+
+func (c CurrentVehicle) coordsAsArrays() interface{} {
+	return struct {
+		CurrentVehicle
+		Update arrayUpdate `json:"update"`
+	}{c, newArrayUpdate(c.Update)}
+}
+
+// arrayMapVehicle is a MapVehicle with its latest update's coordinates written as arrays.
+type arrayMapVehicle struct {
+	MapVehicle
+	LastUpdate *arrayUpdate `json:"lastUpdate"`
+}
+
+// arrayMapRoute is a MapRoute with its coordinates written as arrays.
+type arrayMapRoute struct {
+	arrayRoute
+	Stops []arrayStop `json:"stops"`
+}
+
+func (s MapState) coordsAsArrays() interface{} {
+	vehicles := make([]arrayMapVehicle, len(s.Vehicles))
+	for i, vehicle := range s.Vehicles {
+		vehicles[i] = arrayMapVehicle{MapVehicle: vehicle}
+		if vehicle.LastUpdate != nil {
+			update := newArrayUpdate(*vehicle.LastUpdate)
+			vehicles[i].LastUpdate = &update
+		}
+	}
+	routes := make([]arrayMapRoute, len(s.Routes))
+	for i, route := range s.Routes {
+		routes[i] = arrayMapRoute{arrayRoute: newArrayRoute(route.Route), Stops: newArrayStops(route.Stops)}
+	}
+	return struct {
+		MapState
+		Vehicles []arrayMapVehicle `json:"vehicles"`
+		Routes   []arrayMapRoute   `json:"routes"`
+	}{s, vehicles, routes}
+}
+
+// marshalError responds to a failure to marshal a response with marshalJSON.
+func marshalError(w http.ResponseWriter, err error) {
+	if err == errInvalidCoordFormat {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// EnabledRequest asks for many vehicles or routes to be enabled or disabled at once.
+type EnabledRequest struct {
+	IDs     []string `json:"ids"`
+	Enabled bool     `json:"enabled"`
+	// Feed is the data feed of the vehicles, since vehicle IDs are only unique within a feed.
+	// Routes ignore it.
+	Feed string `json:"feed"`
+}
+
+// EnabledSummary reports the outcome of an EnabledRequest.
+type EnabledSummary struct {
+	Enabled   bool `json:"enabled"`
+	Requested int  `json:"requested"`
+	// Matched is how many of the requested IDs exist.
+	Matched int `json:"matched"`
+}
+
+// VehiclesEnabledHandler enables or disables many vehicles at once.
+func (api *API) VehiclesEnabledHandler(w http.ResponseWriter, r *http.Request) {
+	api.setEnabled(w, r, func(req EnabledRequest) (int, error) {
+		vehicles := make([]model.VehicleKey, len(req.IDs))
+		for i, id := range req.IDs {
+			vehicles[i] = model.VehicleKey{VehicleID: id, Feed: req.Feed}
+		}
+		return api.db.SetVehiclesEnabled(vehicles, req.Enabled)
+	})
+}
+
+// RoutesEnabledHandler enables or disables many routes at once.
+func (api *API) RoutesEnabledHandler(w http.ResponseWriter, r *http.Request) {
+	api.setEnabled(w, r, func(req EnabledRequest) (int, error) {
+		return api.db.SetRoutesEnabled(req.IDs, req.Enabled)
+	})
+}
+
+// setEnabled decodes an EnabledRequest, applies it with set, and responds with an EnabledSummary.
+func (api *API) setEnabled(w http.ResponseWriter, r *http.Request, set func(req EnabledRequest) (int, error)) {
+	req := EnabledRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "no IDs given", http.StatusBadRequest)
+		return
+	}
+
+	matched, err := set(req)
+	if err == database.ErrRouteTooFewCoords {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, EnabledSummary{Enabled: req.Enabled, Requested: len(req.IDs), Matched: matched})
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestVehiclesEnabledHandler(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{
+		{VehicleID: "1", Enabled: true},
+		{VehicleID: "2", Enabled: true},
+		{VehicleID: "3", Enabled: true},
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	body := `{"ids": ["1", "3", "4"], "enabled": false}`
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/vehicles/enabled", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	summary := EnabledSummary{}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatalf("Unable to decode summary: %v", err)
+	}
+	expected := EnabledSummary{Enabled: false, Requested: 3, Matched: 2}
+	if summary != expected {
+		t.Errorf("Got summary %+v, expected %+v.", summary, expected)
+	}
+
+	enabled, err := db.GetEnabledVehicles()
+	if err != nil {
+		t.Fatalf("Unable to get enabled vehicles: %v", err)
+	}
+	if len(enabled) != 1 || enabled[0].VehicleID != "2" {
+		t.Errorf("Got enabled vehicles %+v, expected only vehicle 2.", enabled)
+	}
+}
+
+func TestRoutesEnabledHandler(t *testing.T) {
+	coords := []model.Coord{{Lat: 42.73, Lng: -73.68}, {Lat: 42.74, Lng: -73.68}}
+	db := &mockDatabase{routes: []model.Route{
+		{ID: "west", Coords: coords},
+		{ID: "east", Coords: coords},
+		{ID: "empty"},
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	body := `{"ids": ["west", "east"], "enabled": true}`
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/routes/enabled", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if !db.routes[0].Enabled || !db.routes[1].Enabled {
+		t.Error("Expected west and east to be enabled.")
+	}
+
+	// Enabling a route without a path fails, and leaves the other routes alone.
+	w = httptest.NewRecorder()
+	body = `{"ids": ["west", "empty"], "enabled": false}`
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/routes/enabled", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	body = `{"ids": ["west", "empty"], "enabled": true}`
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/routes/enabled", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+	if db.routes[0].Enabled {
+		t.Error("Expected west to remain disabled.")
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// etaSpeed is the average speed in mph assumed when estimating arrival times. It accounts for
+// time spent at stops and traffic, so it's lower than a shuttle's typical moving speed.
+const etaSpeed = 10.0
+
+// NextVehicle is the vehicle that will arrive at a stop soonest.
+type NextVehicle struct {
+	StopID      string `json:"stopID"`
+	VehicleID   string `json:"vehicleID"`
+	VehicleName string `json:"vehicleName"`
+	RouteID     string `json:"routeID"`
+	RouteName   string `json:"routeName"`
+	// ETA is how many seconds from now the vehicle is expected to arrive.
+	ETA     float64   `json:"eta"`
+	Arrival time.Time `json:"arrival"`
+}
+
+// StopsNextHandler finds the online vehicle that will arrive at a stop soonest, across every enabled
+// route that serves it. It responds with null if no vehicle is on its way.
+func (api *API) StopsNextHandler(w http.ResponseWriter, r *http.Request) {
+	stops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var stop *model.Stop
+	for i := range stops {
+		if stops[i].ID == mux.Vars(r)["id"] {
+			stop = &stops[i]
+		}
+	}
+	if stop == nil {
+		http.Error(w, "stop not found", http.StatusNotFound)
+		return
+	}
+	if api.cfg.ExcludeStopsWithoutCoords && !stop.HasCoords() {
+		// No vehicle can be placed relative to a stop without a position.
+		WriteJSON(w, r, nil)
+		return
+	}
+
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, nextVehicle(state, *stop, time.Now()))
+}
+
+// StopBoard is a stop with each enabled route that serves it and the next vehicle on that route.
+type StopBoard struct {
+	model.Stop
+	Routes []StopBoardRoute `json:"routes"`
+}
+
+// StopBoardRoute is a route on a StopBoard.
+type StopBoardRoute struct {
+	RouteID   string `json:"routeID"`
+	RouteName string `json:"routeName"`
+	Color     string `json:"color"`
+	// Next is null if no vehicle on the route is on its way.
+	Next *NextVehicle `json:"next"`
+}
+
+// StopsBoardHandler returns a stop's details along with every enabled route serving it and the
+// online vehicle on each route that will arrive soonest. A stop that no route serves has no routes.
+func (api *API) StopsBoardHandler(w http.ResponseWriter, r *http.Request) {
+	stops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var stop *model.Stop
+	for i := range stops {
+		if stops[i].ID == mux.Vars(r)["id"] {
+			stop = &stops[i]
+		}
+	}
+	if stop == nil {
+		http.Error(w, "stop not found", http.StatusNotFound)
+		return
+	}
+
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// No vehicle can be placed relative to a stop without a position.
+	estimate := !api.cfg.ExcludeStopsWithoutCoords || stop.HasCoords()
+	now := time.Now()
+	board := StopBoard{Stop: *stop, Routes: []StopBoardRoute{}}
+	for _, route := range servingRoutes(state, *stop) {
+		boardRoute := StopBoardRoute{RouteID: route.ID, RouteName: route.Name, Color: route.Color}
+		if estimate {
+			boardRoute.Next = nextVehicleOn(state.Vehicles, []model.Route{route}, *stop, now)
+		}
+		board.Routes = append(board.Routes, boardRoute)
+	}
+	WriteJSON(w, r, board)
+}
+
+// servingRoutes returns the routes in state that serve stop, in state's order.
+func servingRoutes(state MapState, stop model.Stop) []model.Route {
+	routes := []model.Route{}
+	for _, route := range state.Routes {
+		for _, routeStop := range route.Stops {
+			if routeStop.ID == stop.ID {
+				routes = append(routes, route.Route)
+				break
+			}
+		}
+	}
+	return routes
+}
+
+// nextVehicle returns the online vehicle in state that will arrive at stop soonest after now, or
+// nil if no vehicle on a route serving stop can be placed along that route.
+func nextVehicle(state MapState, stop model.Stop, now time.Time) *NextVehicle {
+	return nextVehicleOn(state.Vehicles, servingRoutes(state, stop), stop, now)
+}
+
+// nextVehicleOn returns the online vehicle on one of routes that will arrive at stop soonest after
+// now, or nil if none of their vehicles can be placed along their route.
+func nextVehicleOn(vehicles []MapVehicle, candidates []model.Route, stop model.Stop, now time.Time) *NextVehicle {
+	routes := make(map[string]model.Route, len(candidates))
+	for _, route := range candidates {
+		routes[route.ID] = route
+	}
+
+	var next *NextVehicle
+	for _, vehicle := range vehicles {
+		if !vehicle.Online {
+			continue
+		}
+		route, ok := routes[vehicle.LastUpdate.Route]
+		if !ok {
+			continue
+		}
+		position, err := vehicle.LastUpdate.Coord()
+		if err != nil {
+			continue
+		}
+		eta, ok := estimateETA(&route, position, model.Coord{Lat: stop.Lat, Lng: stop.Lng})
+		if !ok {
+			continue
+		}
+		if next == nil || eta.Seconds() < next.ETA {
+			next = &NextVehicle{
+				StopID:      stop.ID,
+				VehicleID:   vehicle.VehicleID,
+				VehicleName: vehicle.VehicleName,
+				RouteID:     route.ID,
+				RouteName:   route.Name,
+				ETA:         eta.Seconds(),
+				Arrival:     now.Add(eta),
+			}
+		}
+	}
+	return next
+}
+
+// estimateETA estimates how long a vehicle at from will take to reach to by following the route's
+// path. It returns false if the route has no path.
+func estimateETA(route *model.Route, from, to model.Coord) (time.Duration, bool) {
+	distance, ok := alongRouteDistance(route, from, to)
+	if !ok {
+		return 0, false
+	}
+	return etaForDistance(distance), true
+}
+
+// etaForDistance estimates how long a vehicle will take to travel distance meters.
+func etaForDistance(distance float64) time.Duration {
+	hours := distance / model.MetersPerMile / etaSpeed
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// alongRouteDistance returns how far in meters a vehicle at from must travel along the route's path
+// to reach to. Routes are loops, so if to is behind from, the vehicle continues around to reach it.
+// It returns false if the route has no path.
+func alongRouteDistance(route *model.Route, from, to model.Coord) (float64, bool) {
+	start, ok := route.Project(from)
+	if !ok {
+		return 0, false
+	}
+	end, _ := route.Project(to)
+	distance := end.Progress - start.Progress
+	if distance < 0 {
+		distance += route.LengthMeters()
+	}
+	return distance, true
+}
+
+// ApproachingVehicle is a vehicle headed to a stop.
+type ApproachingVehicle struct {
+	VehicleID   string `json:"vehicleID"`
+	VehicleName string `json:"vehicleName"`
+	// Distance is how far the vehicle is from the stop along the route, in meters.
+	Distance float64 `json:"distance"`
+	// ETA is how many seconds from now the vehicle is expected to arrive.
+	ETA float64 `json:"eta"`
+}
+
+// LiveStop is a stop on a route and the nearest vehicle approaching it.
+type LiveStop struct {
+	model.Stop
+	// Approaching is null if no vehicle's next stop is this one.
+	Approaching *ApproachingVehicle `json:"approaching"`
+}
+
+// RoutesLiveStopsHandler returns a route's stops in order, each with the nearest online vehicle on
+// the route whose next stop it is. Stops that aren't served at this time of day are left out unless
+// the "all" query parameter is true.
+func (api *API) RoutesLiveStopsHandler(w http.ResponseWriter, r *http.Request) {
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	allStops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stopsByID := make(map[string]model.Stop, len(allStops))
+	for _, stop := range allStops {
+		stopsByID[stop.ID] = stop
+	}
+	stops := []model.Stop{}
+	for _, stopID := range route.StopsID {
+		if stop, ok := stopsByID[stopID]; ok {
+			stops = append(stops, stop)
+		}
+	}
+	if all, _ := strconv.ParseBool(r.URL.Query().Get("all")); !all {
+		stops, err = api.activeStops(stops, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, liveStops(&route, stops, state.Vehicles, api.cfg.ExcludeStopsWithoutCoords))
+}
+
+// liveStops annotates each of the route's stops with the nearest online vehicle on the route
+// whose next stop it is. If excludeMissing is set, stops without coordinates are listed but
+// never taken to be a vehicle's next stop.
+func liveStops(route *model.Route, stops []model.Stop, vehicles []MapVehicle, excludeMissing bool) []LiveStop {
+	live := make([]LiveStop, len(stops))
+	for i, stop := range stops {
+		live[i].Stop = stop
+	}
+	for _, vehicle := range vehicles {
+		if !vehicle.Online || vehicle.LastUpdate.Route != route.ID {
+			continue
+		}
+		position, err := vehicle.LastUpdate.Coord()
+		if err != nil {
+			continue
+		}
+
+		next := -1
+		nextDistance := 0.0
+		for i, stop := range stops {
+			if excludeMissing && !stop.HasCoords() {
+				continue
+			}
+			distance, ok := alongRouteDistance(route, position, model.Coord{Lat: stop.Lat, Lng: stop.Lng})
+			if !ok {
+				return live
+			}
+			if next == -1 || distance < nextDistance {
+				next, nextDistance = i, distance
+			}
+		}
+		if next == -1 {
+			continue
+		}
+		if approaching := live[next].Approaching; approaching == nil || nextDistance < approaching.Distance {
+			live[next].Approaching = &ApproachingVehicle{
+				VehicleID:   vehicle.VehicleID,
+				VehicleName: vehicle.VehicleName,
+				Distance:    nextDistance,
+				ETA:         etaForDistance(nextDistance).Seconds(),
+			}
+		}
+	}
+	return live
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestStopsBoardHandler(t *testing.T) {
+	now := time.Now()
+	path := []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.80, Lng: -73.68}}
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", VehicleName: "West Bus", Enabled: true},
+			{VehicleID: "2", VehicleName: "East Bus", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.74", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Lat: "42.72", Lng: "-73.68", Route: "east", Created: now.Add(-time.Minute)},
+		},
+		routes: []model.Route{
+			{ID: "west", Name: "West", Color: "#ff0000", Enabled: true, StopsID: []string{"union"}, Coords: path},
+			{ID: "east", Name: "East", Color: "#0000ff", Enabled: true, StopsID: []string{"union"}, Coords: path},
+		},
+		stops: []model.Stop{
+			{ID: "union", Name: "Union", Lat: 42.75, Lng: -73.68},
+			{ID: "unserved", Name: "Nowhere", Lat: 42.75, Lng: -73.68},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/union/board", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	board := StopBoard{}
+	if err := json.NewDecoder(w.Body).Decode(&board); err != nil {
+		t.Fatalf("Unable to decode board: %v", err)
+	}
+	if board.ID != "union" || board.Name != "Union" {
+		t.Errorf("Got stop %+v, expected Union.", board.Stop)
+	}
+	if len(board.Routes) != 2 {
+		t.Fatalf("Got %d routes, expected 2.", len(board.Routes))
+	}
+	for _, route := range board.Routes {
+		expected := map[string]string{"west": "1", "east": "2"}[route.RouteID]
+		if route.Next == nil || route.Next.VehicleID != expected || route.Next.ETA <= 0 {
+			t.Errorf("Got next %+v on %s, expected vehicle %s with an ETA.", route.Next, route.RouteID, expected)
+		}
+	}
+	if west, east := board.Routes[0].Next, board.Routes[1].Next; west != nil && east != nil && west.ETA >= east.ETA {
+		t.Errorf("Got west ETA %v and east ETA %v, expected the closer west bus sooner.", west.ETA, east.ETA)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/unserved/board", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `"routes":[]`) {
+		t.Errorf("Got %s for unserved stop, expected no routes.", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/nowhere/board", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestStopsNextHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", VehicleName: "Far", Enabled: true},
+			{VehicleID: "2", VehicleName: "Near", Enabled: true},
+			{VehicleID: "3", VehicleName: "Other Route", Enabled: true},
+			{VehicleID: "4", VehicleName: "Offline", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.70", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Lat: "42.74", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "3", Lat: "42.749", Lng: "-73.68", Route: "east", Created: now.Add(-time.Minute)},
+			{VehicleID: "4", Lat: "42.7499", Lng: "-73.68", Route: "west", Created: now.Add(-time.Hour)},
+		},
+		routes: []model.Route{
+			{ID: "west", Name: "West", Enabled: true, StopsID: []string{"union"}, Coords: []model.Coord{
+				{Lat: 42.70, Lng: -73.68},
+				{Lat: 42.80, Lng: -73.68},
+			}},
+			{ID: "east", Name: "East", Enabled: true, StopsID: []string{"sage"}, Coords: []model.Coord{
+				{Lat: 42.70, Lng: -73.68},
+				{Lat: 42.80, Lng: -73.68},
+			}},
+		},
+		stops: []model.Stop{
+			{ID: "union", Lat: 42.75, Lng: -73.68},
+			{ID: "sage", Lat: 42.75, Lng: -73.68},
+			{ID: "unserved", Lat: 42.75, Lng: -73.68},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/union/next", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var next *NextVehicle
+	if err := json.NewDecoder(w.Body).Decode(&next); err != nil {
+		t.Fatalf("Unable to decode next vehicle: %v", err)
+	}
+	if next == nil || next.VehicleID != "2" || next.RouteID != "west" {
+		t.Fatalf("Got %+v, expected the nearer vehicle on the west route.", next)
+	}
+	// A hundredth of a degree of latitude is about 1.11 km, or about four minutes at etaSpeed.
+	if next.ETA < 200 || next.ETA > 300 {
+		t.Errorf("Got ETA %v seconds, expected about four minutes.", next.ETA)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/unserved/next", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); body != "null" {
+		t.Errorf("Got %s for stop without vehicles, expected null.", body)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/nowhere/next", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for unknown stop, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestEstimateETAWrapsAroundLoop(t *testing.T) {
+	route := model.Route{Coords: []model.Coord{
+		{Lat: 42.70, Lng: -73.68},
+		{Lat: 42.80, Lng: -73.68},
+		{Lat: 42.70, Lng: -73.68},
+	}}
+	// Just past the stop, so the vehicle has to go all the way around.
+	behind, ok := estimateETA(&route, model.Coord{Lat: 42.72, Lng: -73.68}, model.Coord{Lat: 42.71, Lng: -73.68})
+	if !ok {
+		t.Fatal("Expected an ETA.")
+	}
+	ahead, _ := estimateETA(&route, model.Coord{Lat: 42.71, Lng: -73.68}, model.Coord{Lat: 42.72, Lng: -73.68})
+	if behind <= ahead {
+		t.Errorf("Got ETA %v for stop behind vehicle, expected more than %v.", behind, ahead)
+	}
+	if _, ok := estimateETA(&model.Route{}, model.Coord{}, model.Coord{}); ok {
+		t.Error("Expected no ETA for route without a path.")
+	}
+}
+
+func TestRoutesLiveStopsHandler(t *testing.T) {
+	now := time.Now()
+	path := []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.80, Lng: -73.68}}
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1", VehicleName: "Between", Enabled: true}},
+		updates: []model.VehicleUpdate{
+			// Between the first and second stops.
+			{VehicleID: "1", Lat: "42.72", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+		},
+		routes: []model.Route{
+			{ID: "west", Enabled: true, StopsID: []string{"a", "b", "c"}, Coords: path},
+			{ID: "idle", Enabled: true, StopsID: []string{"a"}, Coords: path},
+		},
+		stops: []model.Stop{
+			{ID: "a", Lat: 42.71, Lng: -73.68},
+			{ID: "b", Lat: 42.73, Lng: -73.68},
+			{ID: "c", Lat: 42.75, Lng: -73.68},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/west/stops", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	stops := []LiveStop{}
+	if err := json.NewDecoder(w.Body).Decode(&stops); err != nil {
+		t.Fatalf("Unable to decode stops: %v", err)
+	}
+	if len(stops) != 3 || stops[0].ID != "a" || stops[1].ID != "b" || stops[2].ID != "c" {
+		t.Fatalf("Got stops %+v, expected a, b, and c in order.", stops)
+	}
+	if approaching := stops[1].Approaching; approaching == nil || approaching.VehicleID != "1" {
+		t.Errorf("Got %+v approaching b, expected vehicle 1.", approaching)
+	} else if approaching.Distance < 1000 || approaching.Distance > 1200 {
+		t.Errorf("Got distance %v, expected about 1.1 km.", approaching.Distance)
+	}
+	if stops[0].Approaching != nil || stops[2].Approaching != nil {
+		t.Errorf("Got %+v approaching a and %+v approaching c, expected none.", stops[0].Approaching, stops[2].Approaching)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/idle/stops", nil))
+	stops = []LiveStop{}
+	if err := json.NewDecoder(w.Body).Decode(&stops); err != nil {
+		t.Fatalf("Unable to decode stops: %v", err)
+	}
+	if len(stops) != 1 || stops[0].Approaching != nil {
+		t.Errorf("Got stops %+v, expected one stop without an approaching vehicle.", stops)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/east/stops", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for unknown route, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLiveStopsExcludesStopsWithoutCoords(t *testing.T) {
+	route := model.Route{ID: "west", Coords: []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.80, Lng: -73.68}}}
+	// The stop without coordinates is nearest to the start of the path, so it would seem to come
+	// just before a for a vehicle heading back around the loop.
+	stops := []model.Stop{
+		{ID: "a", Lat: 42.71, Lng: -73.68},
+		{ID: "b", Lat: 42.73, Lng: -73.68},
+		{ID: "missing"},
+	}
+	vehicles := []MapVehicle{{
+		Vehicle:    model.Vehicle{VehicleID: "1"},
+		Online:     true,
+		LastUpdate: &model.VehicleUpdate{VehicleID: "1", Lat: "42.78", Lng: "-73.68", Route: "west"},
+	}}
+
+	if live := liveStops(&route, stops, vehicles, false); live[2].Approaching == nil {
+		t.Errorf("Got %+v, expected the vehicle to approach the stop at (0, 0) when it isn't excluded.", live)
+	}
+	live := liveStops(&route, stops, vehicles, true)
+	if live[2].Approaching != nil {
+		t.Errorf("Got %+v approaching the stop without coordinates, expected none.", live[2].Approaching)
+	}
+	if live[0].Approaching == nil || live[0].Approaching.VehicleID != "1" {
+		t.Errorf("Got %+v approaching a, expected vehicle 1.", live[0].Approaching)
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// geoJSON is the subset of a GeoJSON object needed to find a LineString. It may be a
+// geometry itself or a Feature containing one.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+}
+
+// lineStringCoords returns the coordinates of a GeoJSON LineString, or of a Feature whose
+// geometry is a LineString.
+func lineStringCoords(b []byte) ([]model.Coord, error) {
+	g := geoJSON{}
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, err
+	}
+	if g.Type == "Feature" {
+		if g.Geometry == nil {
+			return nil, errors.New("feature has no geometry")
+		}
+		g = *g.Geometry
+	}
+	if g.Type != "LineString" {
+		return nil, fmt.Errorf("geometry type %q is not supported; only LineString is", g.Type)
+	}
+
+	// GeoJSON positions are longitude first.
+	var positions [][]float64
+	if err := json.Unmarshal(g.Coordinates, &positions); err != nil {
+		return nil, err
+	}
+	coords := make([]model.Coord, 0, len(positions))
+	for _, position := range positions {
+		if len(position) < 2 {
+			return nil, errors.New("positions must have a longitude and latitude")
+		}
+		coords = append(coords, model.Coord{Lat: position[1], Lng: position[0]})
+	}
+	return coords, nil
+}
+
+// RoutesGeometryHandler replaces a route's path with the coordinates of an uploaded GeoJSON LineString.
+func (api *API) RoutesGeometryHandler(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	coords, err := lineStringCoords(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	route.Coords = coords
+	route.Updated = time.Now()
+	err = api.db.ModifyRoute(&route)
+	if err == database.ErrRouteTooFewCoords {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, route)
+}
+
+// geoJSONFeatureCollection is a GeoJSON FeatureCollection of trips.
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// geoJSONFeature is a GeoJSON Feature for one trip.
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONLineString `json:"geometry"`
+	Properties tripProperties    `json:"properties"`
+}
+
+// geoJSONLineString is a GeoJSON LineString. Positions are longitude first.
+type geoJSONLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// tripProperties describes a trip in its Feature.
+type tripProperties struct {
+	VehicleID string `json:"vehicleID"`
+	// RouteID is empty if the vehicle wasn't on a route.
+	RouteID string    `json:"routeID"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Distance is in meters.
+	Distance float64 `json:"distance"`
+}
+
+// VehiclesTripsGeoJSONHandler returns each trip a vehicle made during the day given by the "date"
+// query parameter as a LineString Feature in a GeoJSON FeatureCollection. A trip ends when the
+// vehicle changes routes or stops reporting for a while.
+func (api *API) VehiclesTripsGeoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	day, err := api.requestDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vehicle, err := api.requestVehicle(r)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updates, err := api.db.GetUpdatesForVehicleBetween(vehicle.VehicleID, vehicle.Feed, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, trip := range model.Trips(updates, model.TripGap) {
+		line := geoJSONLineString{Type: "LineString", Coordinates: make([][2]float64, len(trip.Coords))}
+		for i, c := range trip.Coords {
+			line.Coordinates[i] = [2]float64{c.Lng, c.Lat}
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: line,
+			Properties: tripProperties{
+				VehicleID: vehicle.VehicleID,
+				RouteID:   trip.RouteID,
+				Start:     trip.Start,
+				End:       trip.End,
+				Distance:  trip.Distance,
+			},
+		})
+	}
+
+	b, err := marshalJSON(r, collection)
+	if err != nil {
+		marshalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(b)
+}
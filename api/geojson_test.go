@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestRoutesGeometryHandler(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}}
+	api := newTestAPI(db)
+
+	lineString := `{"type": "Feature", "properties": {}, "geometry": {
+		"type": "LineString",
+		"coordinates": [[-73.680, 42.730], [-73.681, 42.731], [-73.682, 42.732]]
+	}}`
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/geometry", strings.NewReader(lineString)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	coords := db.routes[0].Coords
+	if len(coords) != 3 || coords[1] != (model.Coord{Lat: 42.731, Lng: -73.681}) {
+		t.Errorf("Got coordinates %+v, expected the LineString's.", coords)
+	}
+
+	polygon := `{"type": "Polygon", "coordinates": [[[-73.68, 42.73], [-73.67, 42.73], [-73.67, 42.74], [-73.68, 42.73]]]}`
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/geometry", strings.NewReader(polygon)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for Polygon, expected %d.", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Polygon") {
+		t.Errorf("Got error %q, expected it to mention the Polygon.", w.Body.String())
+	}
+	if len(db.routes[0].Coords) != 3 {
+		t.Error("Expected rejected geometry to leave the route unchanged.")
+	}
+}
+
+func TestVehiclesTripsGeoJSONHandler(t *testing.T) {
+	day := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute int, lat, route string) model.VehicleUpdate {
+		return model.VehicleUpdate{VehicleID: "1", Lat: lat, Lng: "-73.680", Route: route, Created: day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)}
+	}
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1"}},
+		updates: []model.VehicleUpdate{
+			at(8, 0, "42.730", "west"),
+			at(8, 1, "42.731", "west"),
+			at(9, 0, "42.740", "east"),
+			at(9, 1, "42.741", "east"),
+			at(9, 2, "42.742", "east"),
+			// The next day.
+			at(24, 0, "42.750", "east"),
+			at(24, 1, "42.751", "east"),
+		},
+	}
+	api := newTestAPI(db)
+
+	collection := func(date string) geoJSONFeatureCollection {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/1/trips.geojson?date="+date, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/geo+json" {
+			t.Errorf("Got Content-Type %q, expected application/geo+json.", contentType)
+		}
+		c := geoJSONFeatureCollection{}
+		if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+			t.Fatalf("Unable to decode GeoJSON: %v", err)
+		}
+		return c
+	}
+
+	c := collection("2017-09-01")
+	if c.Type != "FeatureCollection" || len(c.Features) != 2 {
+		t.Fatalf("Got %+v, expected a FeatureCollection with two features.", c)
+	}
+	for i, expected := range []struct {
+		route     string
+		positions int
+	}{{"west", 2}, {"east", 3}} {
+		feature := c.Features[i]
+		if feature.Properties.RouteID != expected.route || len(feature.Geometry.Coordinates) != expected.positions {
+			t.Errorf("Got %+v, expected %d positions on %s.", feature, expected.positions, expected.route)
+		}
+	}
+	if first := c.Features[0].Geometry.Coordinates[0]; first != [2]float64{-73.68, 42.73} {
+		t.Errorf("Got first position %v, expected longitude first.", first)
+	}
+
+	if c := collection("2017-08-31"); len(c.Features) != 0 {
+		t.Errorf("Got %d features on a day without trips, expected none.", len(c.Features))
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/2/trips.geojson", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// GPX is a GPX 1.1 document describing a route.
+type GPX struct {
+	XMLName   xml.Name      `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Waypoints []GPXWaypoint `xml:"wpt"`
+	Track     GPXTrack      `xml:"trk"`
+}
+
+// GPXWaypoint is a point of interest, like a stop. It is also used for track points.
+type GPXWaypoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+}
+
+// GPXTrack is a path made of ordered points.
+type GPXTrack struct {
+	Name     string            `xml:"name"`
+	Segments []GPXTrackSegment `xml:"trkseg"`
+}
+
+// GPXTrackSegment is a continuous part of a GPXTrack.
+type GPXTrackSegment struct {
+	Points []GPXWaypoint `xml:"trkpt"`
+}
+
+// RoutesGPXHandler sends a route's path as a GPX track, with its stops as waypoints.
+func (api *API) RoutesGPXHandler(w http.ResponseWriter, r *http.Request) {
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := xml.MarshalIndent(routeGPX(route, stops), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+route.ID+".gpx\"")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+// routeGPX builds a GPX document for a route and whichever of stops are on it, in the route's order.
+func routeGPX(route model.Route, stops []model.Stop) GPX {
+	stopsByID := make(map[string]model.Stop, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+
+	gpx := GPX{
+		Version:   "1.1",
+		Creator:   "Shuttle Tracker",
+		Waypoints: []GPXWaypoint{},
+		Track:     GPXTrack{Name: route.Name},
+	}
+	for _, stopID := range route.StopsID {
+		if stop, ok := stopsByID[stopID]; ok {
+			gpx.Waypoints = append(gpx.Waypoints, GPXWaypoint{Lat: stop.Lat, Lon: stop.Lng, Name: stop.Name, Desc: stop.Description})
+		}
+	}
+	segment := GPXTrackSegment{Points: make([]GPXWaypoint, 0, len(route.Coords))}
+	for _, coord := range route.Coords {
+		segment.Points = append(segment.Points, GPXWaypoint{Lat: coord.Lat, Lon: coord.Lng})
+	}
+	gpx.Track.Segments = []GPXTrackSegment{segment}
+	return gpx
+}
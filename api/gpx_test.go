@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestRoutesGPXHandler(t *testing.T) {
+	route := model.Route{
+		ID:   "west",
+		Name: "West",
+		Coords: []model.Coord{
+			{Lat: 42.730, Lng: -73.680},
+			{Lat: 42.731, Lng: -73.681},
+			{Lat: 42.732, Lng: -73.682},
+		},
+		StopsID: []string{"sage", "union"},
+	}
+	db := &mockDatabase{
+		routes: []model.Route{route},
+		stops: []model.Stop{
+			{ID: "union", Name: "Union", Lat: 42.730, Lng: -73.680},
+			{ID: "sage", Name: "Sage", Lat: 42.732, Lng: -73.682},
+			{ID: "elsewhere", Name: "Elsewhere"},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/west.gpx", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/gpx+xml" {
+		t.Errorf("Got content type %q, expected application/gpx+xml.", contentType)
+	}
+
+	var gpx GPX
+	if err := xml.Unmarshal(w.Body.Bytes(), &gpx); err != nil {
+		t.Fatalf("Unable to parse GPX: %v", err)
+	}
+	if len(gpx.Track.Segments) != 1 || len(gpx.Track.Segments[0].Points) != len(route.Coords) {
+		t.Fatalf("Got track %+v, expected one segment with %d points.", gpx.Track, len(route.Coords))
+	}
+	if point := gpx.Track.Segments[0].Points[1]; point.Lat != 42.731 || point.Lon != -73.681 {
+		t.Errorf("Got track point %+v, expected the route's second coordinate.", point)
+	}
+	if len(gpx.Waypoints) != 2 || gpx.Waypoints[0].Name != "Sage" || gpx.Waypoints[1].Name != "Union" {
+		t.Errorf("Got waypoints %+v, expected Sage and Union.", gpx.Waypoints)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/east.gpx", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for unknown route, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
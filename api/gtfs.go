@@ -0,0 +1,170 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// gtfsServiceID is the only service in the GTFS export. Schedules don't vary by day, so it runs daily.
+const gtfsServiceID = "daily"
+
+// gtfsBusRouteType is the GTFS route_type for buses.
+const gtfsBusRouteType = "3"
+
+// gtfsFile is one file in a GTFS archive.
+type gtfsFile struct {
+	name    string
+	records [][]string
+}
+
+// GTFSStaticHandler sends enabled routes, all stops, and route schedules as a GTFS static feed, for
+// transit apps. Routes without schedules are included, but have no trips.
+func (api *API) GTFSStaticHandler(w http.ResponseWriter, r *http.Request) {
+	routes, err := api.db.GetRoutes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	schedules := map[string][]model.ScheduledArrival{}
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+		schedule, err := api.db.GetScheduleForRoute(route.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		schedules[route.ID] = schedule
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	files := api.gtfsFiles(routes, stops, schedules, scheme+"://"+r.Host+"/", time.Now().In(api.loc))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"gtfs.zip\"")
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			log.WithError(err).Error("Unable to write GTFS archive.")
+			return
+		}
+		if err := csv.NewWriter(f).WriteAll(file.records); err != nil {
+			log.WithError(err).Error("Unable to write GTFS archive.")
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.WithError(err).Error("Unable to write GTFS archive.")
+	}
+}
+
+// gtfsFiles builds each file of a GTFS feed. The service is valid for a year from now.
+func (api *API) gtfsFiles(routes []model.Route, stops []model.Stop, schedules map[string][]model.ScheduledArrival, agencyURL string, now time.Time) []gtfsFile {
+	agency := gtfsFile{"agency.txt", [][]string{
+		{"agency_name", "agency_url", "agency_timezone"},
+		{"Shuttle Tracker", agencyURL, api.loc.String()},
+	}}
+
+	stopsFile := gtfsFile{"stops.txt", [][]string{{"stop_id", "stop_name", "stop_desc", "stop_lat", "stop_lon"}}}
+	for _, stop := range stops {
+		stopsFile.records = append(stopsFile.records, []string{
+			stop.ID,
+			stop.Name,
+			stop.Description,
+			strconv.FormatFloat(stop.Lat, 'f', -1, 64),
+			strconv.FormatFloat(stop.Lng, 'f', -1, 64),
+		})
+	}
+
+	routesFile := gtfsFile{"routes.txt", [][]string{{"route_id", "route_long_name", "route_desc", "route_type", "route_color"}}}
+	trips := gtfsFile{"trips.txt", [][]string{{"route_id", "service_id", "trip_id"}}}
+	stopTimes := gtfsFile{"stop_times.txt", [][]string{{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"}}}
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+		routesFile.records = append(routesFile.records, []string{
+			route.ID,
+			route.Name,
+			route.Description,
+			gtfsBusRouteType,
+			strings.TrimPrefix(route.Color, "#"),
+		})
+
+		for i, trip := range scheduledTrips(route, schedules[route.ID]) {
+			tripID := route.ID + "-" + strconv.Itoa(i+1)
+			trips.records = append(trips.records, []string{route.ID, gtfsServiceID, tripID})
+			for sequence, arrival := range trip {
+				t := arrival.Time + ":00"
+				stopTimes.records = append(stopTimes.records, []string{tripID, t, t, arrival.StopID, strconv.Itoa(sequence + 1)})
+			}
+		}
+	}
+
+	calendar := gtfsFile{"calendar.txt", [][]string{
+		{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"},
+		{gtfsServiceID, "1", "1", "1", "1", "1", "1", "1", now.Format("20060102"), now.AddDate(1, 0, 0).Format("20060102")},
+	}}
+
+	return []gtfsFile{agency, stopsFile, routesFile, trips, stopTimes, calendar}
+}
+
+// scheduledTrips groups a route's scheduled arrivals into trips. Schedules don't record trips, so in
+// time order, a new trip starts whenever an arrival's stop doesn't come after the previous arrival's
+// stop on the route. Arrivals at stops that aren't on the route, or with invalid times, are left out.
+// Times are normalized to "15:04".
+func scheduledTrips(route model.Route, schedule []model.ScheduledArrival) [][]model.ScheduledArrival {
+	stopIndexes := make(map[string]int, len(route.StopsID))
+	for i, stopID := range route.StopsID {
+		if _, ok := stopIndexes[stopID]; !ok {
+			stopIndexes[stopID] = i
+		}
+	}
+
+	arrivals := make([]model.ScheduledArrival, 0, len(schedule))
+	for _, arrival := range schedule {
+		if _, ok := stopIndexes[arrival.StopID]; !ok {
+			continue
+		}
+		t, err := time.Parse("15:04", arrival.Time)
+		if err != nil {
+			continue
+		}
+		arrival.Time = t.Format("15:04")
+		arrivals = append(arrivals, arrival)
+	}
+	// Times are now zero-padded, so they sort as strings.
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].Time < arrivals[j].Time })
+
+	trips := [][]model.ScheduledArrival{}
+	var trip []model.ScheduledArrival
+	for _, arrival := range arrivals {
+		if len(trip) > 0 && stopIndexes[arrival.StopID] <= stopIndexes[trip[len(trip)-1].StopID] {
+			trips = append(trips, trip)
+			trip = nil
+		}
+		trip = append(trip, arrival)
+	}
+	if len(trip) > 0 {
+		trips = append(trips, trip)
+	}
+	return trips
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestGTFSStaticHandler(t *testing.T) {
+	db := &mockDatabase{
+		routes: []model.Route{
+			{ID: "west", Name: "West Route", Color: "#ff0000", Enabled: true, StopsID: []string{"a", "b"}},
+			{ID: "east", Name: "East Route", Enabled: true, StopsID: []string{"b"}},
+			{ID: "old", Name: "Old Route", StopsID: []string{"a"}},
+		},
+		stops: []model.Stop{
+			{ID: "a", Name: "Union", Lat: 42.73, Lng: -73.677},
+			{ID: "b", Name: "Sage", Lat: 42.731, Lng: -73.682},
+		},
+		// The east route has no schedule.
+		schedules: map[string][]model.ScheduledArrival{
+			"west": {
+				{RouteID: "west", StopID: "b", Time: "9:05"},
+				{RouteID: "west", StopID: "a", Time: "09:00"},
+				{RouteID: "west", StopID: "a", Time: "10:00"},
+			},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/gtfs/static.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Errorf("Got Content-Type %q, expected application/zip.", contentType)
+	}
+
+	body := w.Body.Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Unable to read archive: %v", err)
+	}
+	files := map[string][][]string{}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unable to open %s: %v", f.Name, err)
+		}
+		records, err := csv.NewReader(rc).ReadAll()
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Unable to read %s: %v", f.Name, err)
+		}
+		files[f.Name] = records
+	}
+
+	for _, name := range []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt", "calendar.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Archive is missing %s.", name)
+		}
+	}
+
+	expectedStops := [][]string{
+		{"stop_id", "stop_name", "stop_desc", "stop_lat", "stop_lon"},
+		{"a", "Union", "", "42.73", "-73.677"},
+		{"b", "Sage", "", "42.731", "-73.682"},
+	}
+	if !reflect.DeepEqual(files["stops.txt"], expectedStops) {
+		t.Errorf("Got stops.txt %v, expected %v.", files["stops.txt"], expectedStops)
+	}
+
+	// Disabled routes are left out, but routes without schedules aren't.
+	if routes := files["routes.txt"]; len(routes) != 3 || routes[1][0] != "west" || routes[1][4] != "ff0000" || routes[2][0] != "east" {
+		t.Errorf("Got routes.txt %v, expected west and east.", routes)
+	}
+
+	expectedStopTimes := [][]string{
+		{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"},
+		{"west-1", "09:00:00", "09:00:00", "a", "1"},
+		{"west-1", "09:05:00", "09:05:00", "b", "2"},
+		{"west-2", "10:00:00", "10:00:00", "a", "1"},
+	}
+	if !reflect.DeepEqual(files["stop_times.txt"], expectedStopTimes) {
+		t.Errorf("Got stop_times.txt %v, expected %v.", files["stop_times.txt"], expectedStopTimes)
+	}
+	if trips := files["trips.txt"]; len(trips) != 3 {
+		t.Errorf("Got trips.txt %v, expected two trips.", trips)
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// gtfsRealtimeVersion is the version of the GTFS-Realtime spec that feeds follow.
+const gtfsRealtimeVersion = "2.0"
+
+// FeedMessage is a GTFS-Realtime feed in its JSON representation. Field names follow the
+// GTFS-Realtime protocol buffer definitions.
+type FeedMessage struct {
+	Header FeedHeader   `json:"header"`
+	Entity []FeedEntity `json:"entity"`
+}
+
+// FeedHeader describes a GTFS-Realtime feed.
+type FeedHeader struct {
+	GTFSRealtimeVersion string `json:"gtfs_realtime_version"`
+	Incrementality      string `json:"incrementality"`
+	Timestamp           uint64 `json:"timestamp"`
+}
+
+// FeedEntity is one entity in a GTFS-Realtime feed. Only vehicle positions are provided.
+type FeedEntity struct {
+	ID      string           `json:"id"`
+	Vehicle *VehiclePosition `json:"vehicle,omitempty"`
+}
+
+// VehiclePosition is where a vehicle is and which route it is serving.
+type VehiclePosition struct {
+	// Trip is omitted when the vehicle isn't on a route.
+	Trip      *TripDescriptor   `json:"trip,omitempty"`
+	Vehicle   VehicleDescriptor `json:"vehicle"`
+	Position  Position          `json:"position"`
+	Timestamp uint64            `json:"timestamp"`
+}
+
+// TripDescriptor identifies the route a vehicle is serving. We don't have trips, so only the
+// route is given.
+type TripDescriptor struct {
+	RouteID string `json:"route_id"`
+}
+
+// VehicleDescriptor identifies a vehicle.
+type VehicleDescriptor struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"`
+}
+
+// Position is a vehicle's location. Bearing is in degrees clockwise from north and speed is in
+// meters per second.
+type Position struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Bearing   *float64 `json:"bearing,omitempty"`
+	Speed     *float64 `json:"speed,omitempty"`
+}
+
+// GTFSRealtimeVehiclePositionsHandler provides the latest positions of online vehicles as a
+// GTFS-Realtime feed, in its JSON representation, for transit apps. Route IDs are used as GTFS IDs,
+// and vehicles are identified by their keys, so that IDs repeated across data feeds stay unique.
+func (api *API) GTFSRealtimeVehiclePositionsHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, vehiclePositionsFeed(state, time.Now()))
+}
+
+// vehiclePositionsFeed creates a feed of the positions of the online vehicles in state.
+func vehiclePositionsFeed(state MapState, now time.Time) FeedMessage {
+	feed := FeedMessage{
+		Header: FeedHeader{
+			GTFSRealtimeVersion: gtfsRealtimeVersion,
+			Incrementality:      "FULL_DATASET",
+			Timestamp:           uint64(now.Unix()),
+		},
+		Entity: []FeedEntity{},
+	}
+	for _, vehicle := range state.Vehicles {
+		if !vehicle.Online || vehicle.LastUpdate == nil {
+			continue
+		}
+		position, ok := vehiclePosition(vehicle.Vehicle, vehicle.LastUpdate)
+		if !ok {
+			continue
+		}
+		feed.Entity = append(feed.Entity, FeedEntity{ID: vehicle.Key().String(), Vehicle: &position})
+	}
+	return feed
+}
+
+// vehiclePosition converts a vehicle's update to a GTFS-Realtime position. It fails if the update
+// doesn't have a valid location.
+func vehiclePosition(vehicle model.Vehicle, update *model.VehicleUpdate) (VehiclePosition, bool) {
+	coord, err := update.Coord()
+	if err != nil {
+		return VehiclePosition{}, false
+	}
+	position := VehiclePosition{
+		Vehicle:   VehicleDescriptor{ID: vehicle.Key().String(), Label: vehicle.VehicleName},
+		Position:  Position{Latitude: coord.Lat, Longitude: coord.Lng},
+		Timestamp: uint64(update.Created.Unix()),
+	}
+	if update.Route != "" {
+		position.Trip = &TripDescriptor{RouteID: update.Route}
+	}
+	if bearing, err := strconv.ParseFloat(update.Heading, 64); err == nil {
+		position.Position.Bearing = &bearing
+	}
+	if mph, err := strconv.ParseFloat(update.Speed, 64); err == nil {
+		speed := mph * model.MetersPerMile / 3600
+		position.Position.Speed = &speed
+	}
+	return position, true
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestGTFSRealtimeVehiclePositionsHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", VehicleName: "Bus 1", Enabled: true},
+			{VehicleID: "2", VehicleName: "Offline", Enabled: true},
+			{VehicleID: "3", VehicleName: "Off route", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.73", Lng: "-73.68", Heading: "90", Speed: "22.36936", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Lat: "42.74", Lng: "-73.67", Created: now.Add(-time.Hour)},
+			{VehicleID: "3", Lat: "42.75", Lng: "-73.66", Created: now.Add(-time.Minute)},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/gtfs-rt/vehicle-positions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	var feed FeedMessage
+	if err := json.NewDecoder(w.Body).Decode(&feed); err != nil {
+		t.Fatalf("Unable to decode feed: %v", err)
+	}
+	if feed.Header.GTFSRealtimeVersion != "2.0" || feed.Header.Incrementality != "FULL_DATASET" {
+		t.Errorf("Got header %+v, expected a full dataset for version 2.0.", feed.Header)
+	}
+	if len(feed.Entity) != 2 {
+		t.Fatalf("Got %d entities, expected 2.", len(feed.Entity))
+	}
+
+	entity := feed.Entity[0]
+	if entity.ID != "1" || entity.Vehicle == nil {
+		t.Fatalf("Got %+v, expected vehicle 1's position.", entity)
+	}
+	position := entity.Vehicle
+	if position.Trip == nil || position.Trip.RouteID != "west" {
+		t.Errorf("Got trip %+v, expected route west.", position.Trip)
+	}
+	if position.Vehicle.ID != "1" || position.Vehicle.Label != "Bus 1" {
+		t.Errorf("Got vehicle %+v, expected Bus 1.", position.Vehicle)
+	}
+	if position.Position.Latitude != 42.73 || position.Position.Longitude != -73.68 {
+		t.Errorf("Got position %+v, expected 42.73, -73.68.", position.Position)
+	}
+	if position.Position.Bearing == nil || *position.Position.Bearing != 90 {
+		t.Errorf("Got bearing %v, expected 90.", position.Position.Bearing)
+	}
+	// 22.36936 mph is 10 meters per second.
+	if position.Position.Speed == nil || math.Abs(*position.Position.Speed-10) > 0.001 {
+		t.Errorf("Got speed %v, expected 10.", position.Position.Speed)
+	}
+	if position.Timestamp != uint64(now.Add(-time.Minute).Unix()) {
+		t.Errorf("Got timestamp %d, expected %d.", position.Timestamp, now.Add(-time.Minute).Unix())
+	}
+
+	if offRoute := feed.Entity[1]; offRoute.ID != "3" || offRoute.Vehicle.Trip != nil {
+		t.Errorf("Got %+v, expected vehicle 3 without a trip.", offRoute)
+	}
+}
+
+func TestGTFSRealtimeVehiclePositionsFeeds(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", Feed: "a", Enabled: true},
+			{VehicleID: "1", Feed: "b", Enabled: true},
+			{VehicleID: "2", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Feed: "a", Lat: "42.73", Lng: "-73.68", Created: now.Add(-time.Minute)},
+			{VehicleID: "1", Feed: "b", Lat: "42.74", Lng: "-73.67", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Lat: "42.75", Lng: "-73.66", Created: now.Add(-time.Minute)},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/gtfs-rt/vehicle-positions", nil))
+	var feed FeedMessage
+	if err := json.NewDecoder(w.Body).Decode(&feed); err != nil {
+		t.Fatalf("Unable to decode feed: %v", err)
+	}
+	ids := []string{}
+	for _, entity := range feed.Entity {
+		if entity.Vehicle.Vehicle.ID != entity.ID {
+			t.Errorf("Got vehicle ID %q in entity %q, expected them to match.", entity.Vehicle.Vehicle.ID, entity.ID)
+		}
+		ids = append(ids, entity.ID)
+	}
+	if expected := []string{"a/1", "b/1", "2"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Got entity IDs %v, expected %v.", ids, expected)
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/model"
+	"github.com/wtg/shuttletracker/updater"
+)
+
+// defaultGuessPreviewWindow is how far back a vehicle's updates are used to preview a route guess
+// if no window is given. It matches how far back the updater looks.
+const defaultGuessPreviewWindow = 15 * time.Minute
+
+// RouteGuessPreviewer explains which route would be guessed for a vehicle with some updates.
+type RouteGuessPreviewer interface {
+	PreviewRouteGuess(updates []model.VehicleUpdate) (updater.RouteGuessPreview, error)
+}
+
+// GuessPreviewRequest gives the updates to preview a route guess for. Either Updates is given, or
+// VehicleID is, in which case the updates from the last Window (like "15m") of that vehicle in Feed
+// are used.
+type GuessPreviewRequest struct {
+	Updates   []model.VehicleUpdate `json:"updates"`
+	VehicleID string                `json:"vehicleID"`
+	Feed      string                `json:"feed"`
+	Window    string                `json:"window"`
+}
+
+// GuessPreviewHandler responds with the route that would be guessed for the updates given by a
+// GuessPreviewRequest, along with each route's distance from them, so that the guessing thresholds
+// can be tuned.
+func (api *API) GuessPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	previewer, ok := api.feed.(RouteGuessPreviewer)
+	if !ok {
+		http.Error(w, "route guess previews aren't available", http.StatusNotImplemented)
+		return
+	}
+
+	req := GuessPreviewRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updates := req.Updates
+	if req.VehicleID != "" {
+		if len(req.Updates) > 0 {
+			http.Error(w, "give either updates or vehicleID, not both", http.StatusBadRequest)
+			return
+		}
+		window := defaultGuessPreviewWindow
+		if req.Window != "" {
+			var err error
+			window, err = time.ParseDuration(req.Window)
+			if err != nil || window <= 0 {
+				http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+				return
+			}
+		}
+		if _, err := api.db.GetVehicle(req.VehicleID, req.Feed); err == mgo.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var err error
+		updates, err = api.db.GetUpdatesForVehicleSince(req.VehicleID, req.Feed, time.Now().Add(-window))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	preview, err := previewer.PreviewRouteGuess(updates)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, preview)
+}
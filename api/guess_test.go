@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+	"github.com/wtg/shuttletracker/updater"
+)
+
+func TestGuessPreviewHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		routes: []model.Route{
+			{ID: "west", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}}},
+			{ID: "east", Enabled: true, Coords: []model.Coord{{Lat: 42.800, Lng: -73.68}, {Lat: 42.800, Lng: -73.67}}},
+		},
+		vehicles: []model.Vehicle{{VehicleID: "1"}},
+	}
+	for i := 0; i < 6; i++ {
+		db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.8001", Lng: "-73.68", Created: now.Add(time.Duration(i-6) * 10 * time.Second)})
+	}
+	u, err := updater.NewWithSource(updater.Config{UpdateInterval: "10s", RouteGuessDecay: 0.9}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	api, err := New(Config{}, db, u)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	preview := func(body string) updater.RouteGuessPreview {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/guess/preview", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, body, http.StatusOK)
+		}
+		preview := updater.RouteGuessPreview{}
+		if err := json.NewDecoder(w.Body).Decode(&preview); err != nil {
+			t.Fatalf("Unable to decode preview: %v", err)
+		}
+		return preview
+	}
+
+	// A vehicle's stored updates.
+	if p := preview(`{"vehicleID": "1"}`); p.RouteID != "east" || p.Updates != 6 || len(p.Routes) != 2 {
+		t.Errorf("Got %+v, expected east from six updates.", p)
+	}
+
+	// Updates given directly, halfway between the routes.
+	updates := []model.VehicleUpdate{}
+	for i := 0; i < 5; i++ {
+		updates = append(updates, model.VehicleUpdate{Lat: "42.750", Lng: "-73.68", Created: now.Add(time.Duration(i) * time.Second)})
+	}
+	body, err := json.Marshal(GuessPreviewRequest{Updates: updates})
+	if err != nil {
+		t.Fatalf("Unable to encode request: %v", err)
+	}
+	p := preview(string(body))
+	if p.RouteID != "" || p.Reason != "off-route" {
+		t.Errorf("Got %+v, expected no route.", p)
+	}
+	for _, route := range p.Routes {
+		if route.Distance == nil || *route.Distance <= p.MaxDistance {
+			t.Errorf("Got distance %v for %s, expected more than %v.", route.Distance, route.RouteID, p.MaxDistance)
+		}
+	}
+
+	for body, status := range map[string]int{
+		`{"vehicleID": "2"}`:                   http.StatusNotFound,
+		`{"vehicleID": "1", "window": "soon"}`: http.StatusBadRequest,
+		`{"vehicleID": "1", "updates": [{}]}`:  http.StatusBadRequest,
+		`not json`:                             http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/guess/preview", strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, body, status)
+		}
+	}
+
+	// Without an updater, there's nothing to preview.
+	w := httptest.NewRecorder()
+	newTestAPI(db).handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/guess/preview", strings.NewReader(`{"vehicleID": "1"}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Got status %d without an updater, expected %d.", w.Code, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// Health describes whether Shuttle Tracker is receiving data.
+type Health struct {
+	Status string `json:"status"`
+	// LastUpdate is when any vehicle last reported. It is null if there are no updates at all.
+	LastUpdate *time.Time `json:"lastUpdate"`
+	// ActiveVehicles is how many vehicles have reported recently enough to be online.
+	ActiveVehicles int `json:"activeVehicles"`
+	// OnlineVehicles lists the vehicles that are online, along with their data feeds. It is only
+	// included for logged-in users.
+	OnlineVehicles []model.VehicleKey `json:"onlineVehicles,omitempty"`
+}
+
+// HealthHandler reports the health of Shuttle Tracker, including when data was last received.
+// It responds with 503 Service Unavailable if the data feed has been failing. Logged-in users also
+// see which vehicles are online.
+func (api *API) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: "ok"}
+	if api.feed != nil && !api.feed.FeedHealthy() {
+		health.Status = "unhealthy"
+	}
+
+	lastUpdate, err := api.db.GetLatestUpdateTime()
+	if err == nil {
+		health.LastUpdate = &lastUpdate
+	} else if err != database.ErrUpdateNotFound {
+		log.WithError(err).Error("Unable to get latest update time.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	active, err := api.db.GetActiveVehiclesSince(time.Now().Add(-api.offlineAfter))
+	if err != nil {
+		log.WithError(err).Error("Unable to get active vehicles.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	health.ActiveVehicles = len(active)
+	if isAuthenticated(r) {
+		health.OnlineVehicles = active
+	}
+
+	if health.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	WriteJSON(w, r, health)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestHealthHandler(t *testing.T) {
+	created := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := &mockDatabase{latestUpdateTime: created}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	var health Health
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatalf("Unable to decode health: %v", err)
+	}
+	if health.LastUpdate == nil || !health.LastUpdate.Equal(created) {
+		t.Errorf("Got last update %v, expected %v.", health.LastUpdate, created)
+	}
+}
+
+func TestHealthHandlerWithoutUpdates(t *testing.T) {
+	db := &mockDatabase{latestUpdateTimeErr: database.ErrUpdateNotFound}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	var health Health
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatalf("Unable to decode health: %v", err)
+	}
+	if health.LastUpdate != nil {
+		t.Errorf("Got last update %v, expected none.", health.LastUpdate)
+	}
+}
+
+func TestHealthHandlerActiveVehicles(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		latestUpdateTime: now,
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Created: now.Add(-time.Minute)},
+			{VehicleID: "1", Created: now.Add(-2 * time.Minute)},
+			{VehicleID: "2", Created: now.Add(-time.Minute)},
+			// Silent for too long to count.
+			{VehicleID: "3", Created: now.Add(-time.Hour)},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	var health Health
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatalf("Unable to decode health: %v", err)
+	}
+	if health.ActiveVehicles != 2 {
+		t.Errorf("Got %d active vehicles, expected 2.", health.ActiveVehicles)
+	}
+}
+
+type mockFeedMonitor struct {
+	healthy bool
+}
+
+func (f *mockFeedMonitor) FeedHealthy() bool {
+	return f.healthy
+}
+
+func TestHealthHandlerFeedUnhealthy(t *testing.T) {
+	feed := &mockFeedMonitor{}
+	api, err := New(Config{}, &mockDatabase{latestUpdateTimeErr: database.ErrUpdateNotFound}, feed)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		healthy bool
+		code    int
+		status  string
+	}{
+		{false, http.StatusServiceUnavailable, "unhealthy"},
+		{true, http.StatusOK, "ok"},
+	} {
+		feed.healthy = testCase.healthy
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != testCase.code {
+			t.Errorf("Got status code %d, expected %d.", w.Code, testCase.code)
+		}
+		var health Health
+		if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+			t.Fatalf("Unable to decode health: %v", err)
+		}
+		if health.Status != testCase.status {
+			t.Errorf("Got status %q, expected %q.", health.Status, testCase.status)
+		}
+	}
+}
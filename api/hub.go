@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// hubClientQueueSize is how many updates may wait to be sent to a WebSocket client. More are
+// dropped, so that a slow client can't hold up the others.
+const hubClientQueueSize = 64
+
+// UpdateSubscriber calls subscribers with each vehicle update as it arrives.
+type UpdateSubscriber interface {
+	Subscribe(f func(model.VehicleUpdate))
+}
+
+// Subscription limits which updates a WebSocket client receives. An update matches if it is on
+// one of Routes or from one of Vehicles. Vehicles are given as their keys' String, like "a/1" for
+// vehicle 1 from feed a, since IDs alone may be shared between feeds. An empty Subscription
+// matches every update.
+type Subscription struct {
+	Routes   []string `json:"routes"`
+	Vehicles []string `json:"vehicles"`
+}
+
+// matches reports whether update should be sent to a client with this subscription.
+func (s Subscription) matches(update model.VehicleUpdate) bool {
+	if len(s.Routes) == 0 && len(s.Vehicles) == 0 {
+		return true
+	}
+	for _, routeID := range s.Routes {
+		if update.Route == routeID {
+			return true
+		}
+	}
+	key := update.Key().String()
+	for _, vehicle := range s.Vehicles {
+		if key == vehicle {
+			return true
+		}
+	}
+	return false
+}
+
+// updateHub forwards vehicle updates to connected WebSocket clients.
+type updateHub struct {
+	mu      sync.RWMutex
+	clients map[*hubClient]struct{}
+	// conns are the clients' connections. They aren't closed by the HTTP server once they are
+	// hijacked, so closeAll closes them when the API shuts down.
+	conns map[*websocket.Conn]struct{}
+	// closed means that closeAll has been called, so new connections are refused.
+	closed bool
+}
+
+// hubClient is a WebSocket client connected to an updateHub.
+type hubClient struct {
+	send  chan []byte
+	subMu sync.RWMutex
+	sub   Subscription
+}
+
+func newUpdateHub() *updateHub {
+	return &updateHub{clients: map[*hubClient]struct{}{}, conns: map[*websocket.Conn]struct{}{}}
+}
+
+// track records conn so that closeAll closes it. It reports false if the hub has already been
+// closed, in which case conn should be closed right away.
+func (h *updateHub) track(conn *websocket.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets a connection once it's closed.
+func (h *updateHub) untrack(conn *websocket.Conn) {
+	h.mu.Lock()
+	delete(h.conns, conn)
+	h.mu.Unlock()
+}
+
+// closeAll closes every connection and refuses new ones.
+func (h *updateHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for conn := range h.conns {
+		conn.Close()
+	}
+}
+
+// register adds a client with the given subscription.
+func (h *updateHub) register(sub Subscription) *hubClient {
+	c := &hubClient{send: make(chan []byte, hubClientQueueSize), sub: sub}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+// unregister removes a client and closes its send channel.
+func (h *updateHub) unregister(c *hubClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	close(c.send)
+}
+
+// publish queues update for each client subscribed to it.
+func (h *updateHub) publish(update model.VehicleUpdate) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	payload, err := json.Marshal(update)
+	if err != nil {
+		log.WithError(err).Error("Unable to encode update for WebSocket clients.")
+		return
+	}
+	for c := range h.clients {
+		if !c.subscription().matches(update) {
+			continue
+		}
+		select {
+		case c.send <- payload:
+		default:
+			log.Debugf("WebSocket client queue is full; dropping update for vehicle %s.", update.VehicleID)
+		}
+	}
+}
+
+func (c *hubClient) subscription() Subscription {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.sub
+}
+
+func (c *hubClient) subscribe(sub Subscription) {
+	c.subMu.Lock()
+	c.sub = sub
+	c.subMu.Unlock()
+}
+
+// UpdatesWebSocketHandler streams vehicle updates over a WebSocket as they arrive. The "route" and
+// "vehicle" query parameters, each comma-separated or repeated, limit which updates are sent; see
+// Subscription for how vehicles are given. The client can change its subscription at any time by
+// sending a Subscription as JSON, which replaces the current one. Clients are pinged every
+// wsPingInterval and disconnected if they stop answering.
+func (api *API) UpdatesWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := Subscription{
+		Routes:   splitParams(query["route"]),
+		Vehicles: splitParams(query["vehicle"]),
+	}
+
+	// Register before the handshake so that no updates are missed once it completes.
+	client := api.hub.register(sub)
+	defer api.hub.unregister(client)
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.WithError(err).Debug("Unable to upgrade to WebSocket.")
+		return
+	}
+	if !api.hub.track(conn) {
+		conn.Close()
+		return
+	}
+	defer api.hub.untrack(conn)
+	defer conn.Close()
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case payload, ok := <-client.send:
+				if !ok {
+					return
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				err = conn.WriteMessage(websocket.TextMessage, payload)
+			case <-ticker.C:
+				err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			}
+			if err != nil {
+				// Closing the connection stops the read loop below.
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		sub := Subscription{}
+		if err := json.Unmarshal(msg, &sub); err != nil {
+			log.WithError(err).Debug("Unable to decode WebSocket subscription.")
+			continue
+		}
+		client.subscribe(sub)
+	}
+}
+
+// splitParams splits each comma-separated value and drops empty ones.
+func splitParams(values []string) []string {
+	params := []string{}
+	for _, value := range values {
+		for _, param := range strings.Split(value, ",") {
+			if param = strings.TrimSpace(param); param != "" {
+				params = append(params, param)
+			}
+		}
+	}
+	return params
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// dialUpdates opens a WebSocket to /ws/updates on server with the given query.
+func dialUpdates(t *testing.T, server *httptest.Server, query string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /ws/updates?" + query + " HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Unable to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Got status %d, expected %d.", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Got Sec-WebSocket-Accept %q.", accept)
+	}
+	return conn, r
+}
+
+// readUpdate reads a text frame from the server and decodes it as an update.
+func readUpdate(t *testing.T, r *bufio.Reader) model.VehicleUpdate {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("Unable to read frame: %v", err)
+	}
+	if header[0] != 0x80|websocket.TextMessage {
+		t.Fatalf("Got frame header %x, expected a text frame.", header[0])
+	}
+	length := int(header[1])
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			t.Fatalf("Unable to read frame: %v", err)
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Unable to read frame: %v", err)
+	}
+	update := model.VehicleUpdate{}
+	if err := json.Unmarshal(payload, &update); err != nil {
+		t.Fatalf("Unable to decode update: %v", err)
+	}
+	return update
+}
+
+// writeText sends a masked text frame to the server.
+func writeText(conn net.Conn, payload []byte) {
+	writeFrame(conn, websocket.TextMessage, payload)
+}
+
+// writeFrame sends a masked frame to the server.
+func writeFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+// waitForSubscription waits until the hub's only client has subscribed to sub.
+func waitForSubscription(t *testing.T, hub *updateHub, sub Subscription) {
+	for i := 0; i < 100; i++ {
+		hub.mu.RLock()
+		for c := range hub.clients {
+			if reflect.DeepEqual(c.subscription(), sub) {
+				hub.mu.RUnlock()
+				return
+			}
+		}
+		hub.mu.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Client never subscribed to %+v.", sub)
+}
+
+func TestUpdatesWebSocketHandler(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+	conn, r := dialUpdates(t, server, "route=north")
+	defer conn.Close()
+
+	// The off-route vehicle's update isn't delivered, so the on-route one is read first.
+	api.hub.publish(model.VehicleUpdate{VehicleID: "1", Route: "south"})
+	api.hub.publish(model.VehicleUpdate{VehicleID: "2", Route: "north"})
+	if update := readUpdate(t, r); update.VehicleID != "2" {
+		t.Errorf("Got update for vehicle %s, expected vehicle 2.", update.VehicleID)
+	}
+
+	// Switch to following a single vehicle.
+	writeText(conn, []byte(`{"vehicles": ["1"]}`))
+	waitForSubscription(t, api.hub, Subscription{Vehicles: []string{"1"}})
+	api.hub.publish(model.VehicleUpdate{VehicleID: "2", Route: "north"})
+	api.hub.publish(model.VehicleUpdate{VehicleID: "1", Route: "south"})
+	if update := readUpdate(t, r); update.VehicleID != "1" {
+		t.Errorf("Got update for vehicle %s, expected vehicle 1.", update.VehicleID)
+	}
+}
+
+func TestUpdatesWebSocketHandlerNotHandshake(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/ws/updates", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+	api.hub.mu.RLock()
+	defer api.hub.mu.RUnlock()
+	if len(api.hub.clients) != 0 {
+		t.Errorf("Got %d clients, expected none.", len(api.hub.clients))
+	}
+}
+
+// waitForClients waits until the hub has n clients.
+func waitForClients(t *testing.T, hub *updateHub, n int) {
+	for i := 0; i < 200; i++ {
+		hub.mu.RLock()
+		count := len(hub.clients)
+		hub.mu.RUnlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Hub never had %d clients.", n)
+}
+
+func TestUpdatesWebSocketKeepalive(t *testing.T) {
+	pingInterval, readTimeout := wsPingInterval, wsReadTimeout
+	wsPingInterval, wsReadTimeout = 20*time.Millisecond, 200*time.Millisecond
+	defer func() {
+		wsPingInterval, wsReadTimeout = pingInterval, readTimeout
+	}()
+
+	api := newTestAPI(&mockDatabase{})
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+	conn, r := dialUpdates(t, server, "")
+	defer conn.Close()
+
+	// Answering pings keeps the client connected past the read timeout.
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatalf("Unable to read frame: %v", err)
+		}
+		if header[0] != 0x80|websocket.PingMessage || header[1] != 0 {
+			t.Fatalf("Got frame header %x, expected an empty ping.", header)
+		}
+		writeFrame(conn, websocket.PongMessage, nil)
+	}
+	waitForClients(t, api.hub, 1)
+
+	// A client that stops answering is disconnected.
+	waitForClients(t, api.hub, 0)
+}
+
+func TestUpdatesWebSocketShutdown(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+	conn, r := dialUpdates(t, server, "")
+	defer conn.Close()
+	waitForClients(t, api.hub, 1)
+
+	if err := api.Shutdown(); err != nil {
+		t.Fatalf("Unable to shut down: %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Got error %v, expected the connection to be closed.", err)
+	}
+	waitForClients(t, api.hub, 0)
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	update := model.VehicleUpdate{VehicleID: "1", Route: "north"}
+	for _, c := range []struct {
+		sub     Subscription
+		matches bool
+	}{
+		{Subscription{}, true},
+		{Subscription{Routes: []string{"north"}}, true},
+		{Subscription{Routes: []string{"south"}}, false},
+		{Subscription{Vehicles: []string{"2", "1"}}, true},
+		{Subscription{Routes: []string{"south"}, Vehicles: []string{"1"}}, true},
+		{Subscription{Vehicles: []string{"a/1"}}, false},
+	} {
+		if got := c.sub.matches(update); got != c.matches {
+			t.Errorf("Got %v for %+v, expected %v.", got, c.sub, c.matches)
+		}
+	}
+
+	// Vehicles from different feeds may share an ID.
+	update = model.VehicleUpdate{VehicleID: "1", Feed: "a"}
+	for _, c := range []struct {
+		sub     Subscription
+		matches bool
+	}{
+		{Subscription{Vehicles: []string{"a/1"}}, true},
+		{Subscription{Vehicles: []string{"b/1"}}, false},
+		{Subscription{Vehicles: []string{"1"}}, false},
+	} {
+		if got := c.sub.matches(update); got != c.matches {
+			t.Errorf("Got %v for %+v, expected %v.", got, c.sub, c.matches)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// defaultOfflineAfter is how long a vehicle may go without reporting before it's offline, if
+// OfflineAfter isn't set.
+const defaultOfflineAfter = 5 * time.Minute
+
+// VehicleState sums up whether a vehicle is online, on a route, and moving, so that clients can
+// show each vehicle the same way.
+type VehicleState string
+
+// Vehicle states, in order of precedence. A vehicle that is offline is never off-route, idle, or
+// active, and one that is off-route is never idle or active.
+const (
+	// VehicleOffline vehicles haven't reported recently.
+	VehicleOffline VehicleState = "offline"
+	// VehicleOffRoute vehicles are online but not on any enabled route, whether or not they're moving.
+	VehicleOffRoute VehicleState = "off_route"
+	// VehicleIdle vehicles are online and on a route, but stopped.
+	VehicleIdle VehicleState = "idle"
+	// VehicleActive vehicles are online and moving along a route.
+	VehicleActive VehicleState = "active"
+)
+
+// vehicleState resolves a vehicle's state.
+func vehicleState(online, onRoute, moving bool) VehicleState {
+	switch {
+	case !online:
+		return VehicleOffline
+	case !onRoute:
+		return VehicleOffRoute
+	case !moving:
+		return VehicleIdle
+	default:
+		return VehicleActive
+	}
+}
+
+// MapVehicle is an enabled vehicle and its latest state.
+type MapVehicle struct {
+	model.Vehicle
+	// LastUpdate is null if the vehicle has never reported.
+	LastUpdate *model.VehicleUpdate `json:"lastUpdate"`
+	Online     bool                 `json:"online"`
+	Moving     bool                 `json:"moving"`
+	State      VehicleState         `json:"state"`
+	// Speed is in mph, derived from the vehicle's recent positions rather than the speed it reports.
+	// Heading is the direction it has recently been traveling, in degrees clockwise from north,
+	// smoothed so that GPS jitter doesn't swing it around. Both are null unless the vehicle is online
+	// and has reported at least twice recently, and Heading is also null if it hasn't moved.
+	Speed   *float64 `json:"speed"`
+	Heading *float64 `json:"heading"`
+}
+
+// MapRoute is an enabled route and its stops in order.
+type MapRoute struct {
+	model.Route
+	Stops []model.Stop `json:"stops"`
+}
+
+// MapState is everything needed to draw the map.
+type MapState struct {
+	Vehicles []MapVehicle `json:"vehicles"`
+	Routes   []MapRoute   `json:"routes"`
+}
+
+// MapStateHandler returns all enabled vehicles with their latest updates and all enabled routes
+// with their stops, so that the map can be drawn with a single request.
+func (api *API) MapStateHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSONWithETag(w, r, state)
+}
+
+func (api *API) mapState() (MapState, error) {
+	state := MapState{}
+
+	vehicles, err := api.db.GetEnabledVehicles()
+	if err != nil {
+		return state, err
+	}
+	state.Vehicles = make([]MapVehicle, 0, len(vehicles))
+	keys := make([]model.VehicleKey, len(vehicles))
+	for i, vehicle := range vehicles {
+		keys[i] = vehicle.Key()
+	}
+	lastUpdates, err := api.db.GetLastUpdatesForVehicles(keys)
+	if err != nil {
+		return state, err
+	}
+
+	now := time.Now()
+	activeKeys, err := api.db.GetActiveVehiclesSince(now.Add(-api.offlineAfter))
+	if err != nil {
+		return state, err
+	}
+	active := make(map[model.VehicleKey]bool, len(activeKeys))
+	for _, key := range activeKeys {
+		active[key] = true
+	}
+
+	// Every vehicle's recent updates are read at once, going back as far as moving and
+	// derivedMotion look before the latest update of any vehicle that is still active.
+	window := api.stoppedAfter
+	if window < motionWindow {
+		window = motionWindow
+	}
+	recentUpdates, err := api.db.GetUpdatesSince(now.Add(-api.offlineAfter - window))
+	if err != nil {
+		return state, err
+	}
+	recent := make(map[model.VehicleKey][]model.VehicleUpdate, len(activeKeys))
+	for _, update := range recentUpdates {
+		recent[update.Key()] = append(recent[update.Key()], update)
+	}
+
+	for _, vehicle := range vehicles {
+		mapVehicle := MapVehicle{Vehicle: vehicle}
+		key := vehicle.Key()
+		if update, ok := lastUpdates[key]; ok {
+			mapVehicle.LastUpdate = &update
+			mapVehicle.Online = active[key] || now.Sub(vehicle.LastHeartbeat) < api.offlineAfter
+		}
+
+		// Vehicles that haven't reported recently aren't moving.
+		if active[key] {
+			mapVehicle.Moving = api.moving(recent[key])
+			mapVehicle.Speed, mapVehicle.Heading = derivedMotion(recent[key])
+		}
+		state.Vehicles = append(state.Vehicles, mapVehicle)
+	}
+
+	routes, err := api.db.GetRoutes()
+	if err != nil {
+		return state, err
+	}
+	stops, err := api.db.GetStops()
+	if err != nil {
+		return state, err
+	}
+	stopsByID := make(map[string]model.Stop, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+
+	// Vehicles without their own colors are shown in their routes' colors.
+	routeColors := make(map[string]string, len(routes))
+	enabledRoutes := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		routeColors[route.ID] = route.Color
+		enabledRoutes[route.ID] = route.Enabled
+	}
+	for i := range state.Vehicles {
+		vehicle := &state.Vehicles[i]
+		onRoute := false
+		if vehicle.LastUpdate != nil {
+			if vehicle.Color == "" {
+				vehicle.Color = routeColors[vehicle.LastUpdate.Route]
+			}
+			onRoute = enabledRoutes[vehicle.LastUpdate.Route]
+		}
+		vehicle.State = vehicleState(vehicle.Online, onRoute, vehicle.Moving)
+	}
+
+	state.Routes = []MapRoute{}
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+		mapRoute := MapRoute{Route: route, Stops: []model.Stop{}}
+		for _, stopID := range route.StopsID {
+			if stop, ok := stopsByID[stopID]; ok {
+				mapRoute.Stops = append(mapRoute.Stops, stop)
+			}
+		}
+		state.Routes = append(state.Routes, mapRoute)
+	}
+
+	return state, nil
+}
+
+// moving reports whether a vehicle is moving, given its updates from newest to oldest. It is moving
+// if its reported speed, or the speed implied by its change in position, was above MovingSpeed at any
+// time during the StoppedAfter before its latest update. That way, a vehicle that pauses briefly,
+// like at a traffic light, doesn't flicker between moving and stopped.
+func (api *API) moving(updates []model.VehicleUpdate) bool {
+	if len(updates) == 0 {
+		return false
+	}
+	since := updates[0].Created.Add(-api.stoppedAfter)
+	for i, update := range updates {
+		if update.Created.Before(since) {
+			break
+		}
+		if speed, err := strconv.ParseFloat(update.Speed, 64); err == nil && speed > api.cfg.MovingSpeed {
+			return true
+		}
+		if i+1 < len(updates) && !updates[i+1].Created.Before(since) && impliedSpeed(&updates[i+1], &update) > api.cfg.MovingSpeed {
+			return true
+		}
+	}
+	return false
+}
+
+// motionWindow is how far back before a vehicle's latest update its speed and heading are derived.
+const motionWindow = time.Minute
+
+// derivedMotion derives a vehicle's speed in mph and its heading in degrees from its updates during
+// the motionWindow before its latest one, given newest first. The speed is the distance covered over
+// the time taken. The heading averages the direction between each pair of updates, weighted by the
+// distance between them, so that jitter while the vehicle is nearly stopped barely counts.
+func derivedMotion(updates []model.VehicleUpdate) (speed, heading *float64) {
+	if len(updates) < 2 {
+		return nil, nil
+	}
+	since := updates[0].Created.Add(-motionWindow)
+	to, err := updates[0].Coord()
+	if err != nil {
+		return nil, nil
+	}
+	oldest := updates[0].Created
+	meters, east, north := 0.0, 0.0, 0.0
+	for _, update := range updates[1:] {
+		if update.Created.Before(since) {
+			break
+		}
+		from, err := update.Coord()
+		if err != nil {
+			break
+		}
+		distance := model.DistanceMeters(from, to)
+		bearing := model.BearingDegrees(from, to) * math.Pi / 180
+		meters += distance
+		east += distance * math.Sin(bearing)
+		north += distance * math.Cos(bearing)
+		oldest = update.Created
+		to = from
+	}
+
+	hours := updates[0].Created.Sub(oldest).Hours()
+	if hours <= 0 {
+		return nil, nil
+	}
+	mph := meters / model.MetersPerMile / hours
+	speed = &mph
+	if east != 0 || north != 0 {
+		degrees := math.Mod(math.Atan2(east, north)*180/math.Pi+360, 360)
+		heading = &degrees
+	}
+	return speed, heading
+}
+
+// impliedSpeed returns the speed in mph needed to get from prev to update.
+func impliedSpeed(prev, update *model.VehicleUpdate) float64 {
+	from, err := prev.Coord()
+	if err != nil {
+		return 0
+	}
+	to, err := update.Coord()
+	if err != nil {
+		return 0
+	}
+	hours := update.Created.Sub(prev.Created).Hours()
+	if hours <= 0 {
+		return 0
+	}
+	return model.DistanceMeters(from, to) / model.MetersPerMile / hours
+}
+
+// VehicleCounts is how many online vehicles are on each route.
+type VehicleCounts struct {
+	// Routes has a count for every enabled route, even those without any vehicles, and for any
+	// other route that an online vehicle is on, such as a disabled one.
+	Routes map[string]int `json:"routes"`
+	// OffRoute counts online vehicles that aren't on any route.
+	OffRoute int `json:"offRoute"`
+}
+
+// RoutesVehicleCountsHandler reports how many online vehicles are on each route, to help spot routes
+// that have too many or too few. Vehicles on no route are counted in OffRoute rather than under a
+// null key in Routes, since JSON object keys can't be null.
+func (api *API) RoutesVehicleCountsHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts := VehicleCounts{Routes: make(map[string]int, len(state.Routes))}
+	for _, route := range state.Routes {
+		counts.Routes[route.ID] = 0
+	}
+	for _, vehicle := range state.Vehicles {
+		if !vehicle.Online {
+			continue
+		}
+		if vehicle.LastUpdate.Route == "" {
+			counts.OffRoute++
+		} else {
+			counts.Routes[vehicle.LastUpdate.Route]++
+		}
+	}
+	WriteJSON(w, r, counts)
+}
+
+// VehiclesOffRouteHandler lists the online vehicles that aren't on any enabled route, with their
+// latest positions, so that dispatchers can spot detours, breakdowns, and GPS problems.
+func (api *API) VehiclesOffRouteHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := api.mapState()
+	if err != nil {
+		log.WithError(err).Error("Unable to get map state.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vehicles := []MapVehicle{}
+	for _, vehicle := range state.Vehicles {
+		if vehicle.State == VehicleOffRoute {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	WriteJSON(w, r, vehicles)
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestMapStateHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", VehicleName: "Online", Enabled: true},
+			{VehicleID: "2", VehicleName: "Offline", Enabled: true},
+			{VehicleID: "3", VehicleName: "New", Enabled: true},
+			{VehicleID: "4", VehicleName: "Disabled"},
+			{VehicleID: "5", VehicleName: "Parked", Enabled: true, LastHeartbeat: now.Add(-time.Minute)},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.73", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "1", Lat: "42.72", Lng: "-73.68", Route: "west", Created: now.Add(-2 * time.Minute)},
+			{VehicleID: "2", Lat: "42.74", Lng: "-73.67", Created: now.Add(-time.Hour)},
+			{VehicleID: "5", Lat: "42.75", Lng: "-73.67", Created: now.Add(-time.Hour)},
+		},
+		routes: []model.Route{
+			{ID: "west", Enabled: true, StopsID: []string{"b", "a"}},
+			{ID: "east", Enabled: false, StopsID: []string{"a"}},
+		},
+		stops: []model.Stop{{ID: "a", Name: "Union"}, {ID: "b", Name: "Sage"}},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/map/state", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	var state MapState
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Fatalf("Unable to decode map state: %v", err)
+	}
+
+	if len(state.Vehicles) != 4 {
+		t.Fatalf("Got %d vehicles, expected 4.", len(state.Vehicles))
+	}
+	online := state.Vehicles[0]
+	if !online.Online || online.LastUpdate == nil || online.LastUpdate.Lat != "42.73" || online.LastUpdate.Route != "west" {
+		t.Errorf("Got %+v, expected online vehicle with latest update on west route.", online)
+	}
+	// A hundredth of a degree of latitude north in a minute is about 41.5 mph.
+	if online.Speed == nil || math.Abs(*online.Speed-41.5) > 0.5 || online.Heading == nil || math.Abs(*online.Heading) > 0.1 {
+		t.Errorf("Got speed %v and heading %v, expected about 41.5 mph heading north.", online.Speed, online.Heading)
+	}
+	if offline := state.Vehicles[1]; offline.Online || offline.LastUpdate == nil || offline.Speed != nil || offline.Heading != nil {
+		t.Errorf("Got %+v, expected offline vehicle with an update but no speed or heading.", offline)
+	}
+	if unreported := state.Vehicles[2]; unreported.Online || unreported.LastUpdate != nil {
+		t.Errorf("Got %+v, expected offline vehicle without an update.", unreported)
+	}
+	if parked := state.Vehicles[3]; !parked.Online || parked.LastUpdate == nil {
+		t.Errorf("Got %+v, expected parked vehicle with a recent heartbeat to be online.", parked)
+	}
+
+	if len(state.Routes) != 1 {
+		t.Fatalf("Got %d routes, expected 1.", len(state.Routes))
+	}
+	stops := state.Routes[0].Stops
+	if len(stops) != 2 || stops[0].Name != "Sage" || stops[1].Name != "Union" {
+		t.Errorf("Got stops %+v, expected Sage then Union.", stops)
+	}
+
+	// Updates are read in bulk rather than for each vehicle.
+	if db.vehicleUpdateQueries != 0 {
+		t.Errorf("Got %d queries for single vehicles' updates, expected none.", db.vehicleUpdateQueries)
+	}
+}
+
+func TestDerivedMotion(t *testing.T) {
+	now := time.Now()
+	// The vehicle heads east, wobbling north and south as GPS positions do.
+	updates := []model.VehicleUpdate{
+		{Lat: "42.7300", Lng: "-73.6700", Created: now},
+		{Lat: "42.7301", Lng: "-73.6725", Created: now.Add(-15 * time.Second)},
+		{Lat: "42.7299", Lng: "-73.6750", Created: now.Add(-30 * time.Second)},
+		{Lat: "42.7300", Lng: "-73.6775", Created: now.Add(-45 * time.Second)},
+		// Too long ago to count.
+		{Lat: "42.7000", Lng: "-73.6800", Created: now.Add(-2 * time.Minute)},
+	}
+	speed, heading := derivedMotion(updates)
+	if speed == nil || math.Abs(*speed-30.5) > 1 {
+		t.Errorf("Got speed %v, expected about 30.5 mph.", speed)
+	}
+	if heading == nil || math.Abs(*heading-90) > 1 {
+		t.Errorf("Got heading %v, expected about 90.", heading)
+	}
+
+	// A vehicle that hasn't moved has a speed of zero but no heading.
+	speed, heading = derivedMotion([]model.VehicleUpdate{updates[0], {Lat: "42.7300", Lng: "-73.6700", Created: now.Add(-time.Second)}})
+	if speed == nil || *speed != 0 || heading != nil {
+		t.Errorf("Got speed %v and heading %v, expected zero and no heading.", speed, heading)
+	}
+	if speed, heading = derivedMotion(updates[:1]); speed != nil || heading != nil {
+		t.Errorf("Got speed %v and heading %v from one update, expected neither.", speed, heading)
+	}
+}
+
+func TestRoutesVehicleCountsHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", Enabled: true},
+			{VehicleID: "2", Enabled: true},
+			{VehicleID: "3", Enabled: true},
+			{VehicleID: "4", Enabled: true},
+			{VehicleID: "5", Enabled: true},
+			{VehicleID: "6", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "3", Created: now.Add(-time.Minute)},
+			// Offline, so not counted.
+			{VehicleID: "4", Route: "west", Created: now.Add(-time.Hour)},
+			// Counted under its route even though the route is disabled.
+			{VehicleID: "6", Route: "disabled", Created: now.Add(-time.Minute)},
+		},
+		routes: []model.Route{
+			{ID: "west", Enabled: true},
+			{ID: "east", Enabled: true},
+			{ID: "disabled"},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/vehicle-counts", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var counts VehicleCounts
+	if err := json.NewDecoder(w.Body).Decode(&counts); err != nil {
+		t.Fatalf("Unable to decode counts: %v", err)
+	}
+	expected := VehicleCounts{Routes: map[string]int{"west": 2, "east": 0, "disabled": 1}, OffRoute: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Got %+v, expected %+v.", counts, expected)
+	}
+}
+
+func TestMapStateVehicleColors(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", Enabled: true},
+			{VehicleID: "2", Enabled: true, Color: "#00ff00"},
+			{VehicleID: "3", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.73", Lng: "-73.68", Route: "west", Created: now},
+			{VehicleID: "2", Lat: "42.73", Lng: "-73.68", Route: "west", Created: now},
+		},
+		routes: []model.Route{{ID: "west", Enabled: true, Color: "#ff0000"}},
+	}
+	api := newTestAPI(db)
+
+	state, err := api.mapState()
+	if err != nil {
+		t.Fatalf("Unable to get map state: %v", err)
+	}
+	colors := []string{}
+	for _, vehicle := range state.Vehicles {
+		colors = append(colors, vehicle.Color)
+	}
+	// Vehicle 3 has no color of its own and hasn't reported, so it has no route to take one from.
+	if expected := []string{"#ff0000", "#00ff00", ""}; !reflect.DeepEqual(colors, expected) {
+		t.Errorf("Got colors %v, expected %v.", colors, expected)
+	}
+}
+
+func TestVehicleState(t *testing.T) {
+	for _, c := range []struct {
+		online, onRoute, moving bool
+		expected                VehicleState
+	}{
+		{false, false, false, VehicleOffline},
+		{false, false, true, VehicleOffline},
+		{false, true, false, VehicleOffline},
+		{false, true, true, VehicleOffline},
+		{true, false, false, VehicleOffRoute},
+		{true, false, true, VehicleOffRoute},
+		{true, true, false, VehicleIdle},
+		{true, true, true, VehicleActive},
+	} {
+		if state := vehicleState(c.online, c.onRoute, c.moving); state != c.expected {
+			t.Errorf("Got %s for online %v, on route %v, moving %v; expected %s.", state, c.online, c.onRoute, c.moving, c.expected)
+		}
+	}
+}
+
+func TestMapStateVehicleStates(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", Enabled: true},
+			{VehicleID: "2", Enabled: true},
+			{VehicleID: "3", Enabled: true},
+			{VehicleID: "4", Enabled: true},
+			{VehicleID: "5", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Route: "west", Speed: "20", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Route: "west", Speed: "0", Created: now.Add(-time.Minute)},
+			{VehicleID: "3", Speed: "20", Created: now.Add(-time.Minute)},
+			// On a disabled route, so off-route.
+			{VehicleID: "4", Route: "east", Speed: "20", Created: now.Add(-time.Minute)},
+			{VehicleID: "5", Route: "west", Speed: "20", Created: now.Add(-10 * time.Minute)},
+		},
+		routes: []model.Route{{ID: "west", Enabled: true}, {ID: "east"}},
+	}
+	expected := []VehicleState{VehicleActive, VehicleIdle, VehicleOffRoute, VehicleOffRoute, VehicleOffline}
+
+	api := newTestAPI(db)
+	state, err := api.mapState()
+	if err != nil {
+		t.Fatalf("Unable to get map state: %v", err)
+	}
+	for i, vehicle := range state.Vehicles {
+		if vehicle.State != expected[i] {
+			t.Errorf("Vehicle %s is %s, expected %s.", vehicle.VehicleID, vehicle.State, expected[i])
+		}
+	}
+
+	// A longer OfflineAfter keeps the quiet vehicle online.
+	api, err = New(Config{OfflineAfter: "15m"}, db, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+	state, err = api.mapState()
+	if err != nil {
+		t.Fatalf("Unable to get map state: %v", err)
+	}
+	if vehicle := state.Vehicles[4]; vehicle.State != VehicleActive {
+		t.Errorf("Vehicle %s is %s, expected %s.", vehicle.VehicleID, vehicle.State, VehicleActive)
+	}
+}
+
+func TestMoving(t *testing.T) {
+	api, err := New(Config{MovingSpeed: 2, StoppedAfter: "1m"}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	// track builds updates ten seconds apart, newest first, from positions and speeds oldest first.
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	track := func(lats []string, speeds []string) []model.VehicleUpdate {
+		updates := []model.VehicleUpdate{}
+		for i := range lats {
+			update := model.VehicleUpdate{Lat: lats[i], Lng: "-73.68", Speed: speeds[i], Created: start.Add(time.Duration(i) * 10 * time.Second)}
+			updates = append([]model.VehicleUpdate{update}, updates...)
+		}
+		return updates
+	}
+
+	table := []struct {
+		name     string
+		lats     []string
+		speeds   []string
+		expected bool
+	}{
+		{"driving",
+			[]string{"42.7300", "42.7310", "42.7320"},
+			[]string{"22", "21", "23"}, true},
+		{"paused at a light",
+			[]string{"42.7300", "42.7310", "42.7320", "42.7320", "42.7320", "42.7320"},
+			[]string{"22", "21", "5", "0", "0", "0"}, true},
+		{"reported speed is stuck at zero",
+			[]string{"42.7300", "42.7310", "42.7320"},
+			[]string{"0", "0", "0"}, true},
+		{"parked",
+			[]string{"42.7300", "42.7310", "42.7320", "42.7320", "42.7320", "42.7320", "42.7320", "42.7320", "42.7320", "42.7320"},
+			[]string{"22", "21", "0", "0", "0", "0", "0", "0", "0", "0"}, false},
+	}
+	for _, testCase := range table {
+		if moving := api.moving(track(testCase.lats, testCase.speeds)); moving != testCase.expected {
+			t.Errorf("Got moving %v while %s, expected %v.", moving, testCase.name, testCase.expected)
+		}
+	}
+
+	if api.moving(nil) {
+		t.Error("Expected a vehicle without updates not to be moving.")
+	}
+}
+
+func TestVehiclesOffRouteHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{
+			{VehicleID: "1", Enabled: true},
+			{VehicleID: "2", Enabled: true},
+			{VehicleID: "3", Enabled: true},
+		},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.73", Lng: "-73.68", Route: "west", Created: now.Add(-time.Minute)},
+			{VehicleID: "2", Lat: "42.70", Lng: "-73.60", Created: now.Add(-time.Minute)},
+			// Offline vehicles aren't listed even without a route.
+			{VehicleID: "3", Lat: "42.70", Lng: "-73.60", Created: now.Add(-time.Hour)},
+		},
+		routes: []model.Route{{ID: "west", Enabled: true}},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/off-route", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var vehicles []MapVehicle
+	if err := json.NewDecoder(w.Body).Decode(&vehicles); err != nil {
+		t.Fatalf("Unable to decode vehicles: %v", err)
+	}
+	if len(vehicles) != 1 {
+		t.Fatalf("Got %d vehicles, expected 1.", len(vehicles))
+	}
+	if vehicle := vehicles[0]; vehicle.VehicleID != "2" || vehicle.LastUpdate == nil || vehicle.LastUpdate.Lat != "42.70" {
+		t.Errorf("Got %+v, expected vehicle 2 with its latest position.", vehicle)
+	}
+}
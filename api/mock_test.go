@@ -0,0 +1,616 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/model"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var errMock = errors.New("mock error")
+
+// mockDatabase implements database.Database for handler tests. Calling a method
+// that isn't defined here panics, since the embedded interface is nil.
+type mockDatabase struct {
+	database.Database
+
+	latestUpdateTime    time.Time
+	latestUpdateTimeErr error
+	routes              []model.Route
+	routesErr           error
+	stops               []model.Stop
+	deletedStops        []string
+	// failStopName causes CreateStop to fail for stops with this name.
+	failStopName string
+	vehicles     []model.Vehicle
+	updates      []model.VehicleUpdate
+	stopWindows  []model.StopWindow
+	schedules    map[string][]model.ScheduledArrival
+	trackGaps    []model.TrackGap
+	// trackGapsMin is the minGap last given to GetTrackGapsForVehicle.
+	trackGapsMin time.Duration
+	// headwayWindow is the window last given to GetHeadwayForStop.
+	headwayWindow time.Duration
+	clients       []model.APIClient
+	occupancy     []model.HourlyOccupancy
+	// occupancyRoute and occupancyDay are the arguments last given to GetOccupancyByHour.
+	occupancyRoute string
+	occupancyDay   time.Time
+	// vehicleUpdateQueries counts calls to GetLastUpdateForVehicle and GetUpdatesForVehicleSince.
+	vehicleUpdateQueries int
+}
+
+func (db *mockDatabase) GetStopWindows() ([]model.StopWindow, error) {
+	return db.stopWindows, nil
+}
+
+func (db *mockDatabase) GetScheduleForRoute(routeID string) ([]model.ScheduledArrival, error) {
+	return db.schedules[routeID], nil
+}
+
+func (db *mockDatabase) GetStops() ([]model.Stop, error) {
+	return db.stops, nil
+}
+
+func (db *mockDatabase) GetStopsWithRoutes() ([]model.StopWithRoutes, error) {
+	stops := []model.StopWithRoutes{}
+	for _, stop := range db.stops {
+		routes := []model.StopRoute{}
+		for _, route := range db.routes {
+			for _, stopID := range route.StopsID {
+				if stopID == stop.ID {
+					routes = append(routes, model.StopRoute{ID: route.ID, Name: route.Name})
+				}
+			}
+		}
+		stops = append(stops, model.StopWithRoutes{Stop: stop, Routes: routes})
+	}
+	return stops, nil
+}
+
+func (db *mockDatabase) QueryVehicles(query database.VehicleQuery) ([]model.Vehicle, int, error) {
+	less := map[string]func(a, b model.Vehicle) bool{
+		"":        func(a, b model.Vehicle) bool { return a.VehicleName < b.VehicleName },
+		"name":    func(a, b model.Vehicle) bool { return a.VehicleName < b.VehicleName },
+		"created": func(a, b model.Vehicle) bool { return a.Created.Before(b.Created) },
+		"enabled": func(a, b model.Vehicle) bool { return !a.Enabled && b.Enabled },
+	}[query.Sort]
+	if less == nil {
+		return nil, 0, database.ErrInvalidSort
+	}
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		if strings.Contains(strings.ToLower(vehicle.VehicleName), strings.ToLower(query.NameLike)) {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	sort.SliceStable(vehicles, func(i, j int) bool {
+		if query.Descending {
+			return less(vehicles[j], vehicles[i])
+		}
+		return less(vehicles[i], vehicles[j])
+	})
+	total := len(vehicles)
+	if query.Offset > len(vehicles) {
+		query.Offset = len(vehicles)
+	}
+	vehicles = vehicles[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(vehicles) {
+		vehicles = vehicles[:query.Limit]
+	}
+	return vehicles, total, nil
+}
+
+func (db *mockDatabase) CreateVehicle(vehicle *model.Vehicle) error {
+	for _, existing := range db.vehicles {
+		if existing.VehicleID == vehicle.VehicleID && existing.Feed == vehicle.Feed {
+			return database.ErrVehicleIDTaken
+		}
+	}
+	db.vehicles = append(db.vehicles, *vehicle)
+	return nil
+}
+
+func (db *mockDatabase) ModifyVehicle(vehicle *model.Vehicle) error {
+	for i := range db.vehicles {
+		if db.vehicles[i].Key() == vehicle.Key() {
+			db.vehicles[i] = *vehicle
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetVehicles() ([]model.Vehicle, error) {
+	return db.vehicles, nil
+}
+
+func (db *mockDatabase) GetVehicle(vehicleID string, feed string) (model.Vehicle, error) {
+	for _, vehicle := range db.vehicles {
+		if vehicle.VehicleID == vehicleID && vehicle.Feed == feed {
+			return vehicle, nil
+		}
+	}
+	return model.Vehicle{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetFleetStats(from, to time.Time) (model.FleetStats, error) {
+	updates := make(map[model.VehicleKey][]model.VehicleUpdate)
+	for _, update := range db.updates {
+		if !update.Created.Before(from) && update.Created.Before(to) {
+			updates[update.Key()] = append(updates[update.Key()], update)
+		}
+	}
+	return model.NewFleetStats(from, to, updates, model.TripGap), nil
+}
+
+func (db *mockDatabase) GetVehiclesWithoutUpdates() ([]model.Vehicle, error) {
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		reported := false
+		for _, update := range db.updates {
+			if update.Key() == vehicle.Key() {
+				reported = true
+				break
+			}
+		}
+		if !reported {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	return vehicles, nil
+}
+
+func (db *mockDatabase) DeleteUpdatesForVehicle(vehicleID string, feed string) (int, error) {
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.VehicleID != vehicleID || update.Feed != feed {
+			updates = append(updates, update)
+		}
+	}
+	deleted := len(db.updates) - len(updates)
+	db.updates = updates
+	return deleted, nil
+}
+
+func (db *mockDatabase) MergeVehicles(keep model.VehicleKey, merge model.VehicleKey) error {
+	for _, key := range []model.VehicleKey{keep, merge} {
+		vehicle, err := db.GetVehicle(key.VehicleID, key.Feed)
+		if err != nil {
+			return err
+		}
+		if vehicle.MergingInto != nil && *vehicle.MergingInto != keep {
+			return database.ErrVehicleMerging
+		}
+	}
+	for i := range db.updates {
+		if db.updates[i].Key() == merge {
+			db.updates[i].VehicleID, db.updates[i].Feed = keep.VehicleID, keep.Feed
+		}
+	}
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		if vehicle.Key() != merge {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	db.vehicles = vehicles
+	return nil
+}
+
+func (db *mockDatabase) GetEnabledVehicles() ([]model.Vehicle, error) {
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		if vehicle.Enabled {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	return vehicles, nil
+}
+
+func (db *mockDatabase) GetFirstUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	var first *model.VehicleUpdate
+	for i, update := range db.updates {
+		if update.VehicleID == vehicleID && update.Feed == feed && (first == nil || update.Created.Before(first.Created)) {
+			first = &db.updates[i]
+		}
+	}
+	if first == nil {
+		return model.VehicleUpdate{}, database.ErrUpdateNotFound
+	}
+	return *first, nil
+}
+
+func (db *mockDatabase) GetLastUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	db.vehicleUpdateQueries++
+	var last *model.VehicleUpdate
+	for i, update := range db.updates {
+		if update.VehicleID == vehicleID && update.Feed == feed && (last == nil || update.Created.After(last.Created)) {
+			last = &db.updates[i]
+		}
+	}
+	if last == nil {
+		return model.VehicleUpdate{}, mgo.ErrNotFound
+	}
+	return *last, nil
+}
+
+func (db *mockDatabase) GetLastUpdatesForVehicles(vehicles []model.VehicleKey) (map[model.VehicleKey]model.VehicleUpdate, error) {
+	wanted := make(map[model.VehicleKey]bool, len(vehicles))
+	for _, vehicle := range vehicles {
+		wanted[vehicle] = true
+	}
+	last := map[model.VehicleKey]model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if latest, ok := last[update.Key()]; wanted[update.Key()] && (!ok || update.Created.After(latest.Created)) {
+			last[update.Key()] = update
+		}
+	}
+	return last, nil
+}
+
+// GetUpdatesSince returns updates newest first, like MongoDB.
+func (db *mockDatabase) GetUpdatesSince(since time.Time) ([]model.VehicleUpdate, error) {
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.Created.After(since) {
+			updates = append(updates, update)
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Created.After(updates[j].Created) })
+	return updates, nil
+}
+
+// GetUpdatesPage pages through updates in the order they were added. Cursors are offsets.
+func (db *mockDatabase) GetUpdatesPage(vehicleID string, feed string, cursor string, limit int) ([]model.VehicleUpdate, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil {
+			return nil, "", database.ErrInvalidCursor
+		}
+	}
+	updates := []model.VehicleUpdate{}
+	for i := start; i < len(db.updates); i++ {
+		if vehicleID != "" && (db.updates[i].VehicleID != vehicleID || db.updates[i].Feed != feed) {
+			continue
+		}
+		if len(updates) == limit {
+			return updates, strconv.Itoa(i), nil
+		}
+		updates = append(updates, db.updates[i])
+	}
+	return updates, "", nil
+}
+
+func (db *mockDatabase) GetActiveVehiclesSince(since time.Time) ([]model.VehicleKey, error) {
+	seen := map[model.VehicleKey]bool{}
+	vehicles := []model.VehicleKey{}
+	for _, update := range db.updates {
+		if update.Created.After(since) && !seen[update.Key()] {
+			seen[update.Key()] = true
+			vehicles = append(vehicles, update.Key())
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool {
+		if vehicles[i].VehicleID != vehicles[j].VehicleID {
+			return vehicles[i].VehicleID < vehicles[j].VehicleID
+		}
+		return vehicles[i].Feed < vehicles[j].Feed
+	})
+	return vehicles, nil
+}
+
+// GetUpdatesForVehicleSince returns updates newest first, like MongoDB.
+func (db *mockDatabase) GetUpdatesForVehicleSince(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	db.vehicleUpdateQueries++
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.VehicleID == vehicleID && update.Feed == feed && update.Created.After(since) {
+			updates = append(updates, update)
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Created.After(updates[j].Created) })
+	return updates, nil
+}
+
+// GetUpdatesForVehicleSinceAscending returns updates oldest first.
+func (db *mockDatabase) GetUpdatesForVehicleSinceAscending(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	updates, err := db.GetUpdatesForVehicleSince(vehicleID, feed, since)
+	for i, j := 0, len(updates)-1; i < j; i, j = i+1, j-1 {
+		updates[i], updates[j] = updates[j], updates[i]
+	}
+	return updates, err
+}
+
+func (db *mockDatabase) GetUpdatesForVehicleBetween(vehicleID string, feed string, from, to time.Time) ([]model.VehicleUpdate, error) {
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.VehicleID == vehicleID && update.Feed == feed && !update.Created.Before(from) && update.Created.Before(to) {
+			updates = append(updates, update)
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Created.Before(updates[j].Created) })
+	return updates, nil
+}
+
+func (db *mockDatabase) GetTrackGapsForVehicle(vehicleID string, feed string, since time.Time, minGap time.Duration) ([]model.TrackGap, error) {
+	db.trackGapsMin = minGap
+	return db.trackGaps, nil
+}
+
+func (db *mockDatabase) GetHeadwayForStop(stopID string, routeID string, window time.Duration) (model.Headway, error) {
+	for _, stop := range db.stops {
+		if stop.ID == stopID {
+			db.headwayWindow = window
+			return model.Headway{StopID: stopID, RouteID: routeID, Gaps: []float64{}}, nil
+		}
+	}
+	return model.Headway{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetOccupancyByHour(routeID string, day time.Time) ([]model.HourlyOccupancy, error) {
+	db.occupancyRoute, db.occupancyDay = routeID, day
+	return db.occupancy, nil
+}
+
+func (db *mockDatabase) GetRoutes() ([]model.Route, error) {
+	return db.routes, db.routesErr
+}
+
+func (db *mockDatabase) GetAdherenceForRoute(routeID string, day time.Time) ([]model.StopAdherence, error) {
+	route, err := db.GetRoute(routeID)
+	if err != nil {
+		return nil, err
+	}
+	stops := []model.Stop{}
+	for _, stopID := range route.AtTime(day, 0).StopsID {
+		for _, stop := range db.stops {
+			if stop.ID == stopID {
+				stops = append(stops, stop)
+			}
+		}
+	}
+	return model.Adherence(stops, db.schedules[routeID], nil, day)
+}
+
+func (db *mockDatabase) GetSegmentSpeedsForRoute(routeID string, since time.Time) ([]model.SegmentSpeed, error) {
+	route, err := db.GetRoute(routeID)
+	if err != nil {
+		return nil, err
+	}
+	stops := []model.Stop{}
+	for _, stopID := range route.StopsID {
+		for _, stop := range db.stops {
+			if stop.ID == stopID {
+				stops = append(stops, stop)
+			}
+		}
+	}
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.Route == routeID && update.Created.After(since) {
+			updates = append(updates, update)
+		}
+	}
+	return model.SegmentSpeeds(&route, stops, updates), nil
+}
+
+func (db *mockDatabase) GetUpdatesInBoundingBox(box model.BoundingBox, since time.Time) ([]model.VehicleUpdate, error) {
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if c, err := update.Coord(); err == nil && update.Created.After(since) && box.Contains(c) {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+func (db *mockDatabase) GetUpdateHeatmap(box model.BoundingBox, from, to time.Time, cellSize float64) (model.Heatmap, error) {
+	if cellSize <= 0 {
+		return model.Heatmap{}, database.ErrInvalidCellSize
+	}
+	if rows, cols := model.HeatmapSize(box, cellSize); rows*cols > model.MaxHeatmapCells {
+		return model.Heatmap{}, database.ErrHeatmapTooLarge
+	}
+	heatmap := model.NewHeatmap(box, cellSize)
+	for _, update := range db.updates {
+		if c, err := update.Coord(); err == nil && !update.Created.Before(from) && update.Created.Before(to) {
+			heatmap.Add(c)
+		}
+	}
+	return heatmap, nil
+}
+
+func (db *mockDatabase) GetArrivalsForStop(stopID string, since time.Time, max int) ([]model.StopArrival, error) {
+	for _, stop := range db.stops {
+		if stop.ID != stopID {
+			continue
+		}
+		updates := []model.VehicleUpdate{}
+		for _, update := range db.updates {
+			if update.Created.After(since) {
+				updates = append(updates, update)
+			}
+		}
+		sort.SliceStable(updates, func(i, j int) bool { return updates[i].Created.After(updates[j].Created) })
+		recent := model.NewRecentArrivals(stop)
+		for _, update := range updates {
+			recent.Add(update)
+		}
+		return recent.Arrivals(max), nil
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetRoutesModifiedSince(since time.Time) ([]model.Route, error) {
+	routes := []model.Route{}
+	for _, route := range db.routes {
+		if route.Updated.After(since) {
+			routes = append(routes, route)
+		}
+	}
+	return routes, db.routesErr
+}
+
+func (db *mockDatabase) GetRoute(routeID string) (model.Route, error) {
+	for _, route := range db.routes {
+		if route.ID == routeID {
+			return route, nil
+		}
+	}
+	return model.Route{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) CreateRoute(route *model.Route) error {
+	if route.Enabled && len(route.Coords) < 2 {
+		return database.ErrRouteTooFewCoords
+	}
+	db.routes = append(db.routes, *route)
+	return nil
+}
+
+func (db *mockDatabase) ModifyRoute(route *model.Route) error {
+	if route.Enabled && len(route.Coords) < 2 {
+		return database.ErrRouteTooFewCoords
+	}
+	for _, variant := range route.Variants {
+		if len(variant.Coords) < 2 {
+			return database.ErrRouteInvalidVariant
+		}
+	}
+	for i := range db.routes {
+		if db.routes[i].ID == route.ID {
+			db.routes[i] = *route
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) SetRoutesEnabled(routeIDs []string, enabled bool) (int, error) {
+	matched := []*model.Route{}
+	for _, id := range routeIDs {
+		for i := range db.routes {
+			if db.routes[i].ID == id {
+				if enabled && len(db.routes[i].Coords) < 2 {
+					return 0, database.ErrRouteTooFewCoords
+				}
+				matched = append(matched, &db.routes[i])
+			}
+		}
+	}
+	for _, route := range matched {
+		route.Enabled = enabled
+	}
+	return len(matched), nil
+}
+
+func (db *mockDatabase) SetVehiclesEnabled(vehicles []model.VehicleKey, enabled bool) (int, error) {
+	matched := 0
+	for _, key := range vehicles {
+		for i := range db.vehicles {
+			if db.vehicles[i].Key() == key {
+				db.vehicles[i].Enabled = enabled
+				matched++
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (db *mockDatabase) CreateStop(stop *model.Stop) error {
+	if stop.Name == db.failStopName {
+		return errMock
+	}
+	db.stops = append(db.stops, *stop)
+	return nil
+}
+
+func (db *mockDatabase) DeleteStop(stopID string) error {
+	db.deletedStops = append(db.deletedStops, stopID)
+	for i := range db.stops {
+		if db.stops[i].ID == stopID {
+			db.stops = append(db.stops[:i], db.stops[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) SetStopAttributes(stopID string, attributes map[string]bool) (model.Stop, error) {
+	for i := range db.stops {
+		if db.stops[i].ID == stopID {
+			db.stops[i].Attributes = attributes
+			return db.stops[i], nil
+		}
+	}
+	return model.Stop{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetLatestUpdateTime() (time.Time, error) {
+	return db.latestUpdateTime, db.latestUpdateTimeErr
+}
+
+func (db *mockDatabase) CreateAPIClient(client *model.APIClient) error {
+	db.clients = append(db.clients, *client)
+	return nil
+}
+
+func (db *mockDatabase) GetAPIClients() ([]model.APIClient, error) {
+	return db.clients, nil
+}
+
+func (db *mockDatabase) DeleteAPIClient(clientID string) error {
+	for i := range db.clients {
+		if db.clients[i].ID == clientID {
+			db.clients = append(db.clients[:i], db.clients[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) IssueAPIClientToken(clientID string, tokenHash string, issued time.Time) (model.APIClient, error) {
+	return db.modifyAPIClient(func(client *model.APIClient) bool { return client.ID == clientID }, func(client *model.APIClient) {
+		client.TokenHash = tokenHash
+		client.TokenIssued = &issued
+	})
+}
+
+func (db *mockDatabase) RevokeAPIClientToken(clientID string) (model.APIClient, error) {
+	return db.modifyAPIClient(func(client *model.APIClient) bool { return client.ID == clientID }, func(client *model.APIClient) {
+		client.TokenHash = ""
+		client.TokenIssued = nil
+	})
+}
+
+func (db *mockDatabase) UseAPIClientToken(tokenHash string, used time.Time) (model.APIClient, error) {
+	return db.modifyAPIClient(func(client *model.APIClient) bool { return tokenHash != "" && client.TokenHash == tokenHash }, func(client *model.APIClient) {
+		client.LastUsed = &used
+	})
+}
+
+func (db *mockDatabase) modifyAPIClient(match func(*model.APIClient) bool, modify func(*model.APIClient)) (model.APIClient, error) {
+	for i := range db.clients {
+		if match(&db.clients[i]) {
+			modify(&db.clients[i])
+			return db.clients[i], nil
+		}
+	}
+	return model.APIClient{}, mgo.ErrNotFound
+}
+
+// newTestAPI returns an API backed by db with authentication disabled.
+func newTestAPI(db database.Database) *API {
+	api, err := New(Config{}, db, nil)
+	if err != nil {
+		panic(err)
+	}
+	return api
+}
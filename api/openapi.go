@@ -0,0 +1,996 @@
+package api
+
+import (
+	"net/http"
+)
+
+// openAPISpec describes the routes, stops, vehicles, and updates endpoints as an OpenAPI 3
+// document. It is maintained by hand, so keep it in sync with the handlers and the model types.
+// Other endpoints are listed in TestOpenAPIDescribesEndpoints as deliberately left out.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "Shuttle Tracker",
+    "description": "Routes, stops, and vehicle positions for the shuttles. Endpoints that modify data require CAS authentication.",
+    "version": "1"
+  },
+  "paths": {
+    "/vehicles": {
+      "get": {
+        "summary": "List vehicles",
+        "parameters": [
+          {"name": "search", "in": "query", "description": "Only vehicles whose names contain this, ignoring case.", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["name", "created", "enabled"]}},
+          {"name": "order", "in": "query", "schema": {"type": "string", "enum": ["asc", "desc"]}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1}},
+          {"name": "offset", "in": "query", "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Vehicles. When searching, sorting, or paging, X-Total-Count holds the number of vehicles across all pages.",
+            "headers": {"X-Total-Count": {"schema": {"type": "integer"}}},
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Vehicle"}}}}
+          },
+          "400": {"description": "Invalid sort, order, limit, or offset."}
+        }
+      }
+    },
+    "/vehicles/{id}/current": {
+      "get": {
+        "summary": "Get a vehicle's latest update and the route it's on",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The vehicle's latest update. The route is null if the vehicle is off-route.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "update": {"$ref": "#/components/schemas/VehicleUpdate"},
+                "route": {
+                  "type": "object",
+                  "nullable": true,
+                  "properties": {"id": {"type": "string"}, "name": {"type": "string"}, "color": {"type": "string"}}
+                },
+                "inServiceSince": {"type": "string", "format": "date-time", "nullable": true, "description": "When the vehicle's earliest stored update was created."}
+              }
+            }}}
+          },
+          "204": {"description": "The vehicle has never reported."},
+          "404": {"description": "No such vehicle."}
+        }
+      }
+    },
+    "/vehicles/create": {
+      "post": {
+        "summary": "Create a vehicle",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Vehicle"}}}},
+        "responses": {"200": {"description": "Created."}, "400": {"description": "Invalid color."}}
+      }
+    },
+    "/vehicles/edit": {
+      "post": {
+        "summary": "Modify a vehicle",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Vehicle"}}}},
+        "responses": {"200": {"description": "Modified."}, "400": {"description": "Invalid color."}}
+      }
+    },
+    "/vehicles/merge": {
+      "post": {
+        "summary": "Move one vehicle's updates to another and delete it",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["keep", "merge"],
+          "properties": {
+            "keep": {"type": "string", "description": "The ID of the vehicle that remains."},
+            "keepFeed": {"type": "string"},
+            "merge": {"type": "string", "description": "The ID of the vehicle that is deleted once its updates are moved."},
+            "mergeFeed": {"type": "string"}
+          }
+        }}}},
+        "responses": {
+          "200": {"description": "Merged."},
+          "400": {"description": "keep or merge is missing, or they are the same vehicle."},
+          "404": {"description": "No such vehicle."},
+          "409": {"description": "One of the vehicles is already being merged."}
+        }
+      }
+    },
+    "/vehicles/off-route": {
+      "get": {
+        "summary": "List online vehicles that aren't on any enabled route",
+        "responses": {
+          "200": {
+            "description": "Vehicles with their latest updates.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/MapVehicle"}}}}
+          }
+        }
+      }
+    },
+    "/vehicles/{id}": {
+      "delete": {
+        "summary": "Delete a vehicle",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[0-9]+$"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Deleted."}}
+      }
+    },
+    "/vehicles/{id}/trail": {
+      "get": {
+        "summary": "Get the path a vehicle has recently taken",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}},
+          {"name": "window", "in": "query", "description": "How far back to go, like 30m. Defaults to 15m and may be at most 24h.", "schema": {"type": "string"}},
+          {"name": "tolerance", "in": "query", "description": "Simplify the path so that no position is further than this many meters from it.", "schema": {"type": "number", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The path, oldest point first.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "vehicleID": {"type": "string"},
+                "points": {"type": "array", "items": {"$ref": "#/components/schemas/Coord"}}
+              }
+            }}}
+          },
+          "400": {"description": "Invalid window or tolerance."},
+          "404": {"description": "No such vehicle."}
+        }
+      }
+    },
+    "/vehicles/{id}/trips.geojson": {
+      "get": {
+        "summary": "Get each trip a vehicle made during a day",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}},
+          {"name": "date", "in": "query", "description": "The service day, like 2006-01-02. Defaults to today.", "schema": {"type": "string", "format": "date"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A GeoJSON FeatureCollection with a LineString Feature for each trip. Each Feature's properties are vehicleID, routeID, start, end, and distance in meters.",
+            "content": {"application/geo+json": {"schema": {"type": "object"}}}
+          },
+          "400": {"description": "Invalid date."},
+          "404": {"description": "No such vehicle."}
+        }
+      }
+    },
+    "/vehicles/{id}/gaps": {
+      "get": {
+        "summary": "List the periods during which a vehicle sent no updates",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}},
+          {"name": "window", "in": "query", "description": "How far back to look, like 12h. Defaults to 24h.", "schema": {"type": "string"}},
+          {"name": "min", "in": "query", "description": "Only gaps longer than this, like 10m. Defaults to 5m.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Gaps.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {
+              "type": "object",
+              "properties": {
+                "start": {"type": "string", "format": "date-time"},
+                "end": {"type": "string", "format": "date-time"},
+                "duration": {"type": "number", "description": "Seconds."}
+              }
+            }}}}
+          },
+          "400": {"description": "Invalid window or min."},
+          "404": {"description": "No such vehicle."}
+        }
+      }
+    },
+    "/vehicles/{id}/updates": {
+      "delete": {
+        "summary": "Delete every update for a vehicle",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports the vehicle. Empty means the default feed.", "schema": {"type": "string"}},
+          {"name": "confirm", "in": "query", "required": true, "description": "Must be true, since this can't be undone.", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "How many updates were deleted.",
+            "content": {"application/json": {"schema": {"type": "object", "properties": {"deleted": {"type": "integer"}}}}}
+          },
+          "400": {"description": "confirm isn't true."},
+          "404": {"description": "No such vehicle."}
+        }
+      }
+    },
+    "/updates": {
+      "get": {
+        "summary": "List the latest update for each enabled vehicle that is online",
+        "responses": {
+          "200": {
+            "description": "Updates.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/VehicleUpdate"}}}}
+          }
+        }
+      }
+    },
+    "/updates/message": {
+      "get": {
+        "summary": "Describe each vehicle's latest update for its map popup",
+        "responses": {
+          "200": {
+            "description": "An HTML snippet for each vehicle that has reported.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}
+          }
+        }
+      }
+    },
+    "/updates/export": {
+      "get": {
+        "summary": "Page through all stored updates, oldest first",
+        "parameters": [
+          {"name": "cursor", "in": "query", "description": "The previous page's next_cursor.", "schema": {"type": "string"}},
+          {"name": "vehicleID", "in": "query", "description": "Only this vehicle's updates.", "schema": {"type": "string"}},
+          {"name": "feed", "in": "query", "description": "The data feed that reports vehicleID.", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "description": "The page size. Defaults to 1000.", "schema": {"type": "integer", "minimum": 1, "maximum": 10000}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of updates.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "updates": {"type": "array", "items": {"$ref": "#/components/schemas/VehicleUpdate"}},
+                "next_cursor": {"type": "string", "nullable": true, "description": "Null on the last page."}
+              }
+            }}}
+          },
+          "400": {"description": "Invalid cursor or limit."}
+        }
+      }
+    },
+    "/updates/area": {
+      "get": {
+        "summary": "Find every vehicle's updates within a box, oldest first",
+        "parameters": [
+          {"name": "minLat", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "minLng", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "maxLat", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "maxLng", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "since", "in": "query", "description": "Defaults to an hour ago and may be at most a day ago.", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Updates.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/VehicleUpdate"}}}}
+          },
+          "400": {"description": "Invalid box or since."}
+        }
+      }
+    },
+    "/updates/backfill-routes": {
+      "get": {
+        "summary": "Get the progress of the latest route backfill",
+        "responses": {
+          "200": {"description": "Progress.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RouteBackfill"}}}},
+          "501": {"description": "The data feed can't backfill routes."}
+        }
+      },
+      "post": {
+        "summary": "Start guessing routes for stored updates that have none",
+        "requestBody": {"content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {"cursor": {"type": "string", "description": "Resume after an earlier backfill's cursor."}}
+        }}}},
+        "responses": {
+          "202": {"description": "Started.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RouteBackfill"}}}},
+          "400": {"description": "Invalid request."},
+          "409": {"description": "A backfill is already running."},
+          "501": {"description": "The data feed can't backfill routes."}
+        }
+      }
+    },
+    "/routes": {
+      "get": {
+        "summary": "List routes",
+        "parameters": [
+          {"name": "modifiedSince", "in": "query", "description": "Only routes created or modified after this time. Deleted routes aren't listed.", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Routes.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Route"}}}}
+          },
+          "400": {"description": "Invalid modifiedSince."}
+        }
+      }
+    },
+    "/routes/create": {
+      "post": {
+        "summary": "Create a route",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Route"}}}},
+        "responses": {"200": {"description": "Created."}, "400": {"description": "Invalid route."}}
+      }
+    },
+    "/routes/vehicle-counts": {
+      "get": {
+        "summary": "Count online vehicles on each route",
+        "responses": {
+          "200": {
+            "description": "Counts. Vehicles on no route are counted in offRoute, since a JSON object can't have a null key.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "routes": {"type": "object", "description": "Route IDs to counts. Every enabled route is listed, along with any other route an online vehicle is on.", "additionalProperties": {"type": "integer"}},
+                "offRoute": {"type": "integer"}
+              }
+            }}}
+          }
+        }
+      }
+    },
+    "/routes/edit": {
+      "post": {
+        "summary": "Enable or disable a route, or change its color",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {
+            "id": {"type": "string"},
+            "enabled": {"type": "boolean"},
+            "color": {"type": "string", "description": "A hex color like #1a2b3c. Left as it was if omitted."}
+          }
+        }}}},
+        "responses": {"200": {"description": "Modified."}, "400": {"description": "Invalid color, or the route isn't valid to enable."}}
+      }
+    },
+    "/routes/bounds": {
+      "get": {
+        "summary": "Get the bounding box of all enabled routes",
+        "parameters": [
+          {"name": "stops", "in": "query", "description": "Include the stops on those routes.", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The bounding box.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {"minLat": {"type": "number"}, "minLng": {"type": "number"}, "maxLat": {"type": "number"}, "maxLng": {"type": "number"}}
+            }}}
+          },
+          "404": {"description": "No enabled route has a path."}
+        }
+      }
+    },
+    "/routes/{id}": {
+      "delete": {
+        "summary": "Delete a route",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "Deleted."}}
+      }
+    },
+    "/routes/{id}.gpx": {
+      "get": {
+        "summary": "Download a route's path as a GPX track, with its stops as waypoints",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "A GPX 1.1 document.", "content": {"application/gpx+xml": {"schema": {"type": "string"}}}},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/occupancy": {
+      "get": {
+        "summary": "Get a route's average occupancy for each hour of a day",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "date", "in": "query", "description": "The service day, like 2006-01-02. Defaults to today.", "schema": {"type": "string", "format": "date"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Hours.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {
+              "type": "object",
+              "properties": {
+                "hour": {"type": "integer"},
+                "average": {"type": "number", "nullable": true, "description": "Null if there were no occupancy reports during the hour."}
+              }
+            }}}}
+          },
+          "400": {"description": "Invalid date."}
+        }
+      }
+    },
+    "/routes/{id}/length": {
+      "get": {
+        "summary": "Get the length of a route's path",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "units", "in": "query", "description": "Defaults to mi.", "schema": {"type": "string", "enum": ["mi", "km"]}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The length.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {"routeId": {"type": "string"}, "length": {"type": "number"}, "units": {"type": "string"}}
+            }}}
+          },
+          "400": {"description": "Invalid units."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/stops": {
+      "get": {
+        "summary": "List a route's stops in order with the vehicle approaching each",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "all", "in": "query", "description": "Include stops that aren't served at this time of day.", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Stops. Each has an approaching property, which is null if no vehicle's next stop is that one.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"allOf": [
+              {"$ref": "#/components/schemas/Stop"},
+              {
+                "type": "object",
+                "properties": {"approaching": {
+                  "type": "object",
+                  "nullable": true,
+                  "properties": {
+                    "vehicleID": {"type": "string"},
+                    "vehicleName": {"type": "string"},
+                    "distance": {"type": "number", "description": "Meters along the route."},
+                    "eta": {"type": "number", "description": "Seconds from now."}
+                  }
+                }}
+              }
+            ]}}}}
+          },
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/stops/validate": {
+      "get": {
+        "summary": "Check that a route's stops are near its path and in order along it",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "tolerance", "in": "query", "description": "How far in meters a stop may be from the path. Defaults to 50.", "schema": {"type": "number", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The stops' issues.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "routeId": {"type": "string"},
+                "valid": {"type": "boolean"},
+                "issues": {"type": "array", "items": {
+                  "type": "object",
+                  "properties": {
+                    "stopId": {"type": "string"},
+                    "problem": {"type": "string", "enum": ["off-route", "out-of-order", "missing-coords"]},
+                    "distance": {"type": "number", "description": "Meters from the path."},
+                    "progress": {"type": "number", "description": "Meters along the path."}
+                  }
+                }}
+              }
+            }}}
+          },
+          "400": {"description": "Invalid tolerance, or the route has no path."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/stops/bulk": {
+      "post": {
+        "summary": "Create stops in order at the end of a route's stops",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}}}}},
+        "responses": {
+          "200": {
+            "description": "The created stops. Either all of them are created or none are.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}}}}
+          },
+          "400": {"description": "A stop has no coordinates, or the route isn't valid with them."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/adherence": {
+      "get": {
+        "summary": "Compare arrivals at a route's stops with its schedule for a day",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "date", "in": "query", "description": "The service day, like 2006-01-02. Defaults to today.", "schema": {"type": "string", "format": "date"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Adherence at each stop.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {
+              "type": "object",
+              "properties": {
+                "stopID": {"type": "string"},
+                "scheduled": {"type": "integer"},
+                "early": {"type": "integer"},
+                "onTime": {"type": "integer"},
+                "late": {"type": "integer"},
+                "missed": {"type": "integer"},
+                "averageDelay": {"type": "number", "nullable": true, "description": "Seconds late, or early if negative. Null if no scheduled arrivals were matched."}
+              }
+            }}}}
+          },
+          "400": {"description": "Invalid date."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/segment-speeds": {
+      "get": {
+        "summary": "Get the average speed between each pair of a route's consecutive stops",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "window", "in": "query", "description": "How far back to look, like 72h. Defaults to a week and may be at most two weeks.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Segments, in the route's order.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {
+              "type": "object",
+              "properties": {
+                "fromStopID": {"type": "string"},
+                "toStopID": {"type": "string"},
+                "length": {"type": "number", "description": "Meters along the route."},
+                "samples": {"type": "integer"},
+                "averageSpeed": {"type": "number", "nullable": true, "description": "Miles per hour. Null if there were no samples."}
+              }
+            }}}}
+          },
+          "400": {"description": "Invalid window."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/geometry": {
+      "post": {
+        "summary": "Replace a route's path with a GeoJSON LineString",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "description": "A LineString, or a Feature whose geometry is one."}}}},
+        "responses": {
+          "200": {"description": "The modified route.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Route"}}}},
+          "400": {"description": "Not a LineString, or too few coordinates."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/schedule": {
+      "post": {
+        "summary": "Replace the times a route is scheduled to serve its stops",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ScheduledArrival"}}}}},
+        "responses": {
+          "200": {"description": "The schedule.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ScheduledArrival"}}}}},
+          "400": {"description": "Invalid time."}
+        }
+      }
+    },
+    "/routes/{id}/variants": {
+      "post": {
+        "summary": "Replace a route's variants",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {
+            "variants": {"type": "array", "items": {"$ref": "#/components/schemas/RouteVariant"}},
+            "activeVariant": {"type": "string", "description": "The ID of the variant to run regardless of the day, or empty to run variants by their days."}
+          }
+        }}}},
+        "responses": {
+          "200": {"description": "The modified route.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Route"}}}},
+          "400": {"description": "Invalid variant."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/routes/{id}/service-windows": {
+      "post": {
+        "summary": "Replace the times a route runs each week",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {
+            "serviceWindows": {"type": "array", "items": {"$ref": "#/components/schemas/RouteServiceWindow"}},
+            "manualEnabled": {"type": "boolean", "description": "Keep the route from being enabled or disabled automatically by its windows."}
+          }
+        }}}},
+        "responses": {
+          "200": {"description": "The modified route.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Route"}}}},
+          "400": {"description": "Invalid time."},
+          "404": {"description": "No such route."}
+        }
+      }
+    },
+    "/stops": {
+      "get": {
+        "summary": "List stops",
+        "parameters": [
+          {"name": "all", "in": "query", "description": "Include stops that aren't served at this time of day.", "schema": {"type": "boolean"}},
+          {"name": "include", "in": "query", "description": "List the routes that serve each stop.", "schema": {"type": "string", "enum": ["routes"]}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Stops. Each has a routes property if include is routes.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}}}}
+          },
+          "400": {"description": "Invalid include."}
+        }
+      }
+    },
+    "/stops/create": {
+      "post": {
+        "summary": "Create a stop at the end of its route's stops",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stop"}}}},
+        "responses": {
+          "200": {"description": "The created stop.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stop"}}}},
+          "400": {"description": "The stop has no coordinates, or its route isn't valid with it."}
+        }
+      }
+    },
+    "/stops/nearest": {
+      "get": {
+        "summary": "Find the served stop closest to a position",
+        "parameters": [
+          {"name": "lat", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "lng", "in": "query", "required": true, "schema": {"type": "number"}},
+          {"name": "attribute", "in": "query", "description": "Only stops with this attribute, like accessible. May be repeated.", "schema": {"type": "array", "items": {"type": "string"}}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The stop and its distance from the position in meters.",
+            "content": {"application/json": {"schema": {"allOf": [
+              {"$ref": "#/components/schemas/Stop"},
+              {"type": "object", "properties": {"distance": {"type": "number"}}}
+            ]}}}
+          },
+          "400": {"description": "Invalid lat or lng."},
+          "404": {"description": "No stop matches."}
+        }
+      }
+    },
+    "/stops/{id}": {
+      "delete": {
+        "summary": "Delete a stop",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "Deleted."}}
+      }
+    },
+    "/stops/{id}/headway": {
+      "get": {
+        "summary": "Get the time between successive arrivals at a stop",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "route", "in": "query", "required": true, "description": "Only arrivals by vehicles on this route.", "schema": {"type": "string"}},
+          {"name": "window", "in": "query", "description": "How far back to look, like 1h. Defaults to an hour and may be at most a day.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The headway.",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "stopID": {"type": "string"},
+                "routeID": {"type": "string"},
+                "gaps": {"type": "array", "items": {"type": "number"}, "description": "Seconds between each pair of successive arrivals, oldest first."},
+                "average": {"type": "number", "nullable": true, "description": "Null if there were fewer than two arrivals."}
+              }
+            }}}
+          },
+          "400": {"description": "Missing route, or invalid window."},
+          "404": {"description": "No such stop."}
+        }
+      }
+    },
+    "/stops/{id}/arrivals": {
+      "get": {
+        "summary": "List the vehicles that arrived at a stop, most recent first",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "since", "in": "query", "description": "Defaults to a day ago. Arrivals more than a week ago aren't listed.", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "limit", "in": "query", "description": "Defaults to 50. A page shorter than this is the last.", "schema": {"type": "integer", "minimum": 1, "maximum": 500}},
+          {"name": "offset", "in": "query", "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Arrivals.",
+            "content": {"application/json": {"schema": {"type": "array", "items": {
+              "type": "object",
+              "properties": {
+                "vehicleID": {"type": "string"},
+                "feed": {"type": "string"},
+                "routeID": {"type": "string", "description": "The route the vehicle was on, if any."},
+                "stopID": {"type": "string"},
+                "time": {"type": "string", "format": "date-time"}
+              }
+            }}}}
+          },
+          "400": {"description": "Invalid since, limit, or offset."},
+          "404": {"description": "No such stop."}
+        }
+      }
+    },
+    "/stops/{id}/next": {
+      "get": {
+        "summary": "Find the vehicle that will arrive at a stop soonest",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {
+            "description": "The vehicle, or null if none is on its way.",
+            "content": {"application/json": {"schema": {"allOf": [{"$ref": "#/components/schemas/NextVehicle"}], "nullable": true}}}
+          },
+          "404": {"description": "No such stop."}
+        }
+      }
+    },
+    "/stops/{id}/board": {
+      "get": {
+        "summary": "Get a stop with each enabled route serving it and the next vehicle on each",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {
+            "description": "The stop. Its routes are empty if no route serves it.",
+            "content": {"application/json": {"schema": {"allOf": [
+              {"$ref": "#/components/schemas/Stop"},
+              {
+                "type": "object",
+                "properties": {"routes": {"type": "array", "items": {
+                  "type": "object",
+                  "properties": {
+                    "routeID": {"type": "string"},
+                    "routeName": {"type": "string"},
+                    "color": {"type": "string"},
+                    "next": {"allOf": [{"$ref": "#/components/schemas/NextVehicle"}], "nullable": true, "description": "Null if no vehicle on the route is on its way."}
+                  }
+                }}}
+              }
+            ]}}}
+          },
+          "404": {"description": "No such stop."}
+        }
+      }
+    },
+    "/stops/{id}/windows": {
+      "post": {
+        "summary": "Replace the times of day a stop is served",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/StopWindow"}}}}},
+        "responses": {
+          "200": {"description": "The windows.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/StopWindow"}}}}},
+          "400": {"description": "Invalid time."}
+        }
+      }
+    },
+    "/stops/{id}/attributes": {
+      "post": {
+        "summary": "Replace a stop's attributes, like shelter or accessible",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "boolean"}}}}},
+        "responses": {
+          "200": {"description": "The modified stop.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stop"}}}},
+          "400": {"description": "Invalid attributes."},
+          "404": {"description": "No such stop."}
+        }
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "Vehicle": {
+        "type": "object",
+        "properties": {
+          "vehicleID": {"type": "string"},
+          "vehicleName": {"type": "string"},
+          "Created": {"type": "string", "format": "date-time"},
+          "Updated": {"type": "string", "format": "date-time"},
+          "enabled": {"type": "boolean"},
+          "retentionDays": {"type": "integer", "description": "How long this vehicle's updates are kept. Zero means the default."},
+          "feed": {"type": "string"},
+          "lastHeartbeat": {"type": "string", "format": "date-time"},
+          "color": {"type": "string", "description": "A hex color like #1a2b3c. If empty, the route's color is used."},
+          "mergingInto": {
+            "type": "object",
+            "description": "The vehicle this one is being merged into, if that merge hasn't finished.",
+            "properties": {"vehicleID": {"type": "string"}, "feed": {"type": "string"}}
+          }
+        }
+      },
+      "VehicleUpdate": {
+        "type": "object",
+        "properties": {
+          "vehicleID": {"type": "string"},
+          "lat": {"type": "string"},
+          "lng": {"type": "string"},
+          "heading": {"type": "string"},
+          "speed": {"type": "string", "description": "Miles per hour."},
+          "lock": {"type": "string"},
+          "time": {"type": "string", "description": "HHMMSS in UTC."},
+          "date": {"type": "string", "description": "MMDDYYYY in UTC."},
+          "status": {"type": "string"},
+          "created": {"type": "string", "format": "date-time"},
+          "RouteID": {"type": "string"},
+          "routeCandidates": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {"routeID": {"type": "string"}, "confidence": {"type": "number"}}
+            }
+          },
+          "direction": {"type": "string"},
+          "occupancy": {"type": "integer"},
+          "snapped": {"$ref": "#/components/schemas/Coord"},
+          "synthesizedTime": {"type": "boolean", "description": "The feed's date or time was malformed, so date and time are when the update was fetched."},
+          "feed": {"type": "string", "description": "The data feed that reported the update."}
+        }
+      },
+      "Route": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "description": {"type": "string"},
+          "startTime": {"type": "string"},
+          "endTime": {"type": "string"},
+          "enabled": {"type": "boolean"},
+          "color": {"type": "string"},
+          "width": {"type": "string", "description": "An integer encoded as a string."},
+          "coords": {"type": "array", "items": {"$ref": "#/components/schemas/Coord"}},
+          "duration": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": {"type": "string"},
+                "origin": {"type": "object", "properties": {"latitude": {"type": "number"}, "longitude": {"type": "number"}}},
+                "destination": {"type": "object", "properties": {"latitude": {"type": "number"}, "longitude": {"type": "number"}}},
+                "distance": {"type": "number"},
+                "duration": {"type": "number"}
+              }
+            }
+          },
+          "stopsid": {"type": "array", "items": {"type": "string"}},
+          "availableroute": {"type": "integer"},
+          "created": {"type": "string", "format": "date-time"},
+          "updated": {"type": "string", "format": "date-time"},
+          "variants": {
+            "type": "array",
+            "description": "Other paths the route sometimes runs instead of coords, such as on weekends.",
+            "items": {"$ref": "#/components/schemas/RouteVariant"}
+          },
+          "activeVariant": {"type": "string", "description": "The ID of a variant that runs regardless of the day, if set."},
+          "serviceWindows": {
+            "type": "array",
+            "description": "When the route runs each week. The route is enabled and disabled to match them unless manualEnabled is set.",
+            "items": {"$ref": "#/components/schemas/RouteServiceWindow"}
+          },
+          "manualEnabled": {"type": "boolean", "description": "Leave enabled as it was set, despite serviceWindows."}
+        }
+      },
+      "Stop": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "description": {"type": "string"},
+          "lat": {"type": "string", "description": "A number encoded as a string."},
+          "lng": {"type": "string", "description": "A number encoded as a string."},
+          "address": {"type": "string"},
+          "startTime": {"type": "string"},
+          "endTime": {"type": "string"},
+          "enabled": {"type": "string", "description": "A boolean encoded as a string."},
+          "routeId": {"type": "string"},
+          "segmentindex": {"type": "integer"},
+          "attributes": {"type": "object", "additionalProperties": {"type": "boolean"}, "description": "Amenities at the stop, like shelter."},
+          "routes": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {"id": {"type": "string"}, "name": {"type": "string"}}
+            }
+          }
+        }
+      },
+      "MapVehicle": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Vehicle"},
+          {
+            "type": "object",
+            "properties": {
+              "lastUpdate": {"allOf": [{"$ref": "#/components/schemas/VehicleUpdate"}], "nullable": true, "description": "Null if the vehicle has never reported."},
+              "online": {"type": "boolean"},
+              "moving": {"type": "boolean"},
+              "state": {"type": "string", "enum": ["offline", "off_route", "idle", "active"]},
+              "speed": {"type": "number", "nullable": true, "description": "Miles per hour, from the vehicle's recent positions."},
+              "heading": {"type": "number", "nullable": true, "description": "Degrees clockwise from north."}
+            }
+          }
+        ]
+      },
+      "NextVehicle": {
+        "type": "object",
+        "properties": {
+          "stopID": {"type": "string"},
+          "vehicleID": {"type": "string"},
+          "vehicleName": {"type": "string"},
+          "routeID": {"type": "string"},
+          "routeName": {"type": "string"},
+          "eta": {"type": "number", "description": "Seconds from now."},
+          "arrival": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RouteBackfill": {
+        "type": "object",
+        "properties": {
+          "running": {"type": "boolean"},
+          "done": {"type": "boolean", "description": "Every update has been examined."},
+          "cursor": {"type": "string", "description": "Resumes the backfill after the last batch it examined."},
+          "scanned": {"type": "integer"},
+          "attributed": {"type": "integer"},
+          "error": {"type": "string", "description": "Why the backfill stopped early, if it did."}
+        }
+      },
+      "RouteVariant": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "coords": {"type": "array", "items": {"$ref": "#/components/schemas/Coord"}},
+          "stopsid": {"type": "array", "items": {"type": "string"}},
+          "days": {"$ref": "#/components/schemas/Weekdays"}
+        }
+      },
+      "RouteServiceWindow": {
+        "type": "object",
+        "properties": {
+          "days": {"$ref": "#/components/schemas/Weekdays"},
+          "start": {"type": "string", "description": "A time of day like 15:04. Times before ServiceDayStart are early the next calendar day."},
+          "end": {"type": "string", "description": "A time of day like 15:04. Before start, counting from ServiceDayStart, if the window runs into the next service day."}
+        }
+      },
+      "ScheduledArrival": {
+        "type": "object",
+        "properties": {
+          "routeID": {"type": "string"},
+          "stopID": {"type": "string"},
+          "time": {"type": "string", "description": "A time of day like 15:04."}
+        }
+      },
+      "StopWindow": {
+        "type": "object",
+        "properties": {
+          "stopID": {"type": "string"},
+          "start": {"type": "string", "description": "A time of day like 15:04."},
+          "end": {"type": "string", "description": "A time of day like 15:04. Before start if the window runs past midnight."}
+        }
+      },
+      "Coord": {
+        "type": "object",
+        "properties": {"lat": {"type": "number"}, "lng": {"type": "number"}}
+      },
+      "Weekdays": {
+        "type": "array",
+        "description": "Days of the week, where 0 is Sunday.",
+        "items": {"type": "integer", "minimum": 0, "maximum": 6}
+      }
+    }
+  }
+}
+`
+
+// OpenAPIHandler serves an OpenAPI document describing the API.
+func (api *API) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestOpenAPIHandler(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Got Content-Type %q, expected application/json.", contentType)
+	}
+
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatalf("Unable to decode document: %v", err)
+	}
+	if spec.OpenAPI != "3.0.0" {
+		t.Errorf("Got OpenAPI version %q, expected 3.0.0.", spec.OpenAPI)
+	}
+	for _, path := range []string{"/vehicles", "/updates", "/routes", "/stops"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("Document doesn't describe %s.", path)
+		}
+	}
+}
+
+// undocumentedPaths are the endpoints that openAPISpec deliberately leaves out.
+var undocumentedPaths = map[string]bool{
+	// Pages and files for browsers.
+	"/":               true,
+	"/static/":        true,
+	"/admin":          true,
+	"/admin/":         true,
+	"/admin/success":  true,
+	"/admin/success/": true,
+	"/admin/logout":   true,
+	"/admin/logout/":  true,
+	"/getKey/":        true,
+	// Used only by the admin page.
+	"/admin/vehicles/enabled":   true,
+	"/admin/vehicles/silent":    true,
+	"/admin/routes/enabled":     true,
+	"/admin/guess/preview":      true,
+	"/admin/stats":              true,
+	"/admin/heatmap":            true,
+	"/admin/clients":            true,
+	"/admin/clients/{id}":       true,
+	"/admin/clients/{id}/token": true,
+	// Used only by the map.
+	"/map/state": true,
+	"/time":      true,
+	// Not about routes, stops, vehicles, or updates.
+	"/health":       true,
+	"/openapi.json": true,
+	// WebSockets can't be described by OpenAPI.
+	"/ws/updates": true,
+	// Described by the GTFS specifications.
+	"/gtfs-rt/vehicle-positions": true,
+	"/gtfs/static.zip":           true,
+}
+
+// pathVariablePattern matches the pattern in a route variable like {id:[0-9]+}.
+var pathVariablePattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// TestOpenAPIDescribesEndpoints fails when an endpoint is added without describing it in the
+// document or listing it in undocumentedPaths, or when the document describes one that doesn't exist.
+func TestOpenAPIDescribesEndpoints(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		t.Fatalf("Unable to decode document: %v", err)
+	}
+
+	api := newTestAPI(&mockDatabase{})
+	routed := map[string]map[string]bool{}
+	err := api.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		// OpenAPI path templates don't have patterns.
+		path := pathVariablePattern.ReplaceAllString(template, "{$1}")
+		if undocumentedPaths[path] {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		if routed[path] == nil {
+			routed[path] = map[string]bool{}
+		}
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			routed[path][method] = true
+			if _, ok := spec.Paths[path][method]; !ok {
+				t.Errorf("Document doesn't describe %s %s.", strings.ToUpper(method), path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to walk routes: %v", err)
+	}
+
+	for path, operations := range spec.Paths {
+		if undocumentedPaths[path] {
+			t.Errorf("%s is described but listed as undocumented.", path)
+		}
+		for method := range operations {
+			if !routed[path][method] {
+				t.Errorf("Document describes %s %s, which isn't routed.", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// TestOpenAPISchemasCoverModels fails when a model type gains a field that its schema doesn't
+// describe.
+func TestOpenAPISchemasCoverModels(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		t.Fatalf("Unable to decode document: %v", err)
+	}
+
+	for name, v := range map[string]interface{}{
+		"Vehicle":       model.Vehicle{},
+		"VehicleUpdate": model.VehicleUpdate{},
+		"Route":         model.Route{},
+		"Stop":          model.Stop{},
+		"Coord":         model.Coord{},
+	} {
+		schema, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Errorf("Document has no %s schema.", name)
+			continue
+		}
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			property := strings.Split(field.Tag.Get("json"), ",")[0]
+			if property == "-" {
+				continue
+			}
+			if property == "" {
+				property = field.Name
+			}
+			if _, ok := schema.Properties[property]; !ok {
+				t.Errorf("%s schema is missing property %s.", name, property)
+			}
+		}
+	}
+}
@@ -8,38 +8,715 @@ import (
 	"strconv"
 	"time"
 
-	// MySQL driver
-	"gopkg.in/cas.v1"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 
+	"github.com/wtg/shuttletracker/database"
 	"github.com/wtg/shuttletracker/model"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// RoutesHandler finds all of the routes in the database
+// RoutesHandler finds all of the routes in the database. If the "modifiedSince" query parameter
+// is given as an RFC 3339 time, only routes created or modified after then are returned, so that
+// clients keeping routes around can fetch just the changes.
 func (api *API) RoutesHandler(w http.ResponseWriter, r *http.Request) {
-	// Find all routes in database
-	routes, err := api.db.GetRoutes()
+	var routes []model.Route
+	var err error
+	if param := r.URL.Query().Get("modifiedSince"); param != "" {
+		since, parseErr := time.Parse(time.RFC3339, param)
+		if parseErr != nil {
+			http.Error(w, "modifiedSince must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		routes, err = api.db.GetRoutesModifiedSince(since)
+	} else {
+		// Find all routes in database
+		routes, err = api.db.GetRoutes()
+	}
 	// Handle query errors
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	// Send each route to client as JSON
-	WriteJSON(w, routes)
+	WriteJSON(w, r, routes)
+}
+
+// RoutesOccupancyHandler reports a route's average hourly occupancy for a day, given as
+// a YYYY-MM-DD "date" query parameter. It defaults to today.
+func (api *API) RoutesOccupancyHandler(w http.ResponseWriter, r *http.Request) {
+	day, err := api.requestDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	occupancy, err := api.db.GetOccupancyByHour(mux.Vars(r)["id"], day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, occupancy)
+}
+
+// RoutesAdherenceHandler reports how early or late vehicles arrived at each of a route's stops
+// compared with its schedule, for a day given as a YYYY-MM-DD "date" query parameter. It defaults to today.
+func (api *API) RoutesAdherenceHandler(w http.ResponseWriter, r *http.Request) {
+	day, err := api.requestDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adherence, err := api.db.GetAdherenceForRoute(mux.Vars(r)["id"], day)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, adherence)
+}
+
+const (
+	// defaultSegmentSpeedsWindow is how far back RoutesSegmentSpeedsHandler looks by default. It's
+	// long enough that a single slow trip doesn't stand out.
+	defaultSegmentSpeedsWindow = 7 * 24 * time.Hour
+	// maxSegmentSpeedsWindow is the furthest back RoutesSegmentSpeedsHandler may look, since every
+	// update on the route in the window is read.
+	maxSegmentSpeedsWindow = 14 * 24 * time.Hour
+)
+
+// RoutesSegmentSpeedsHandler reports the average speed of vehicles between each pair of a route's
+// consecutive stops, to find spots where they're consistently slow. The "window" query parameter
+// sets how far back to look, and defaults to a week. It may be at most two weeks.
+func (api *API) RoutesSegmentSpeedsHandler(w http.ResponseWriter, r *http.Request) {
+	window := defaultSegmentSpeedsWindow
+	if param := r.URL.Query().Get("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		if window > maxSegmentSpeedsWindow {
+			http.Error(w, fmt.Sprintf("window must be at most %s", maxSegmentSpeedsWindow), http.StatusBadRequest)
+			return
+		}
+	}
+
+	segments, err := api.db.GetSegmentSpeedsForRoute(mux.Vars(r)["id"], time.Now().Add(-window))
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, segments)
 }
 
-// StopsHandler finds all of the route stops in the database
+// RoutesScheduleHandler replaces the times at which a route is scheduled to serve its stops.
+func (api *API) RoutesScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var schedule []model.ScheduledArrival
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, arrival := range schedule {
+		if _, err := time.Parse("15:04", arrival.Time); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := api.db.SetScheduleForRoute(mux.Vars(r)["id"], schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, schedule)
+}
+
+// RouteVariantsRequest replaces a route's variants. ActiveVariant is the ID of the variant to run
+// regardless of the day, or empty to run variants by their days.
+type RouteVariantsRequest struct {
+	Variants      []model.RouteVariant `json:"variants"`
+	ActiveVariant string               `json:"activeVariant"`
+}
+
+// RoutesVariantsHandler replaces a route's variants given by a RouteVariantsRequest.
+func (api *API) RoutesVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	req := RouteVariantsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	route.Variants = req.Variants
+	route.ActiveVariant = req.ActiveVariant
+	route.Updated = time.Now()
+	err = api.db.ModifyRoute(&route)
+	if err == database.ErrRouteInvalidVariant {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, route)
+}
+
+// requestDay returns the start of the service day given as a YYYY-MM-DD "date" query parameter,
+// or of the current service day if there is none.
+func (api *API) requestDay(r *http.Request) (time.Time, error) {
+	if date := r.URL.Query().Get("date"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", date, api.loc)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return day.Add(api.serviceDayStart), nil
+	}
+	return model.ServiceDay(time.Now().In(api.loc), api.serviceDayStart), nil
+}
+
+// RouteLength is the length of a route's path.
+type RouteLength struct {
+	RouteID string  `json:"routeId"`
+	Length  float64 `json:"length"`
+	Units   string  `json:"units"`
+}
+
+// RoutesLengthHandler reports the length of a route's path in the units given by the "units"
+// query parameter, either "mi" or "km". It defaults to miles.
+func (api *API) RoutesLengthHandler(w http.ResponseWriter, r *http.Request) {
+	units := r.URL.Query().Get("units")
+	if units == "" {
+		units = "mi"
+	}
+	var metersPerUnit float64
+	switch units {
+	case "mi":
+		metersPerUnit = model.MetersPerMile
+	case "km":
+		metersPerUnit = model.MetersPerKilometer
+	default:
+		http.Error(w, "units must be mi or km", http.StatusBadRequest)
+		return
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, r, RouteLength{
+		RouteID: route.ID,
+		Length:  route.LengthMeters() / metersPerUnit,
+		Units:   units,
+	})
+}
+
+// defaultStopTolerance is how far, in meters, a stop may be from its route's path by default.
+const defaultStopTolerance = 50
+
+// StopSequenceIssue is a problem with one of a route's stops.
+type StopSequenceIssue struct {
+	StopID string `json:"stopId"`
+	// Problem is "off-route" if the stop is too far from the path, "out-of-order" if it comes
+	// before the stop listed ahead of it along the path, or "missing-coords" if it is at (0, 0).
+	Problem string `json:"problem"`
+	// Distance is how far the stop is from the path, in meters.
+	Distance float64 `json:"distance"`
+	// Progress is how far along the path the stop is, in meters.
+	Progress float64 `json:"progress"`
+}
+
+// StopSequence reports whether a route's stops form a sensible sequence along its path.
+type StopSequence struct {
+	RouteID string              `json:"routeId"`
+	Valid   bool                `json:"valid"`
+	Issues  []StopSequenceIssue `json:"issues"`
+}
+
+// RoutesStopsValidateHandler checks that each of a route's stops is within the "tolerance" query
+// parameter, in meters, of its path, and that they are listed in the order they're reached along
+// it. It responds with 400 Bad Request if the route has no path.
+func (api *API) RoutesStopsValidateHandler(w http.ResponseWriter, r *http.Request) {
+	tolerance := float64(defaultStopTolerance)
+	if param := r.URL.Query().Get("tolerance"); param != "" {
+		var err error
+		tolerance, err = strconv.ParseFloat(param, 64)
+		if err != nil || tolerance < 0 {
+			http.Error(w, "tolerance must be a non-negative number of meters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(route.Coords) < 2 {
+		http.Error(w, "route has no path", http.StatusBadRequest)
+		return
+	}
+	stops, err := api.db.GetStops()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	issues := stopSequenceIssues(route, stops, tolerance)
+	WriteJSON(w, r, StopSequence{RouteID: route.ID, Valid: len(issues) == 0, Issues: issues})
+}
+
+// stopSequenceIssues finds the route's stops that are missing coordinates, farther than tolerance
+// meters from its path, or out of order along it. Stops the route lists that don't exist are ignored.
+func stopSequenceIssues(route model.Route, stops []model.Stop, tolerance float64) []StopSequenceIssue {
+	stopsByID := make(map[string]model.Stop, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+
+	issues := []StopSequenceIssue{}
+	// Stops near the path, in the order the route lists them.
+	onRoute := []StopSequenceIssue{}
+	for _, stopID := range route.StopsID {
+		stop, ok := stopsByID[stopID]
+		if !ok {
+			continue
+		}
+		if !stop.HasCoords() {
+			issues = append(issues, StopSequenceIssue{StopID: stop.ID, Problem: "missing-coords"})
+			continue
+		}
+		projection, _ := route.Project(model.Coord{Lat: stop.Lat, Lng: stop.Lng})
+		issue := StopSequenceIssue{StopID: stop.ID, Distance: projection.Distance, Progress: projection.Progress}
+		if projection.Distance > tolerance {
+			issue.Problem = "off-route"
+			issues = append(issues, issue)
+			continue
+		}
+		onRoute = append(onRoute, issue)
+	}
+
+	// The longest run of stops whose progress never decreases is taken to be in order, so that
+	// a single misplaced stop is flagged rather than every stop after it.
+	lengths := make([]int, len(onRoute))
+	prev := make([]int, len(onRoute))
+	last := -1
+	for i := range onRoute {
+		lengths[i], prev[i] = 1, -1
+		for j := 0; j < i; j++ {
+			if onRoute[j].Progress <= onRoute[i].Progress && lengths[j]+1 > lengths[i] {
+				lengths[i], prev[i] = lengths[j]+1, j
+			}
+		}
+		if last == -1 || lengths[i] > lengths[last] {
+			last = i
+		}
+	}
+	inOrder := make([]bool, len(onRoute))
+	for i := last; i != -1; i = prev[i] {
+		inOrder[i] = true
+	}
+	for i, issue := range onRoute {
+		if !inOrder[i] {
+			issue.Problem = "out-of-order"
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// Bounds is the smallest box containing a set of coordinates.
+type Bounds struct {
+	MinLat float64 `json:"minLat"`
+	MinLng float64 `json:"minLng"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLng float64 `json:"maxLng"`
+}
+
+// RoutesBoundsHandler reports the bounding box of all enabled routes' paths, so that the map can
+// fit them in its initial view. If the "stops" query parameter is true, the stops on those routes
+// are included too. It responds with 404 Not Found if there is nothing to bound.
+func (api *API) RoutesBoundsHandler(w http.ResponseWriter, r *http.Request) {
+	routes, err := api.db.GetRoutes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	coords := []model.Coord{}
+	for _, route := range routes {
+		if route.Enabled {
+			coords = append(coords, route.Coords...)
+		}
+	}
+
+	if r.URL.Query().Get("stops") == "true" {
+		stops, err := api.db.GetStops()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		onRoute := map[string]bool{}
+		for _, route := range routes {
+			if !route.Enabled {
+				continue
+			}
+			for _, stopID := range route.StopsID {
+				onRoute[stopID] = true
+			}
+		}
+		for _, stop := range stops {
+			if onRoute[stop.ID] {
+				coords = append(coords, model.Coord{Lat: stop.Lat, Lng: stop.Lng})
+			}
+		}
+	}
+
+	bounds, ok := coordBounds(coords)
+	if !ok {
+		http.Error(w, "no enabled routes have paths", http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, r, bounds)
+}
+
+// coordBounds returns the bounding box of coords. It fails if there are none.
+func coordBounds(coords []model.Coord) (Bounds, bool) {
+	if len(coords) == 0 {
+		return Bounds{}, false
+	}
+	bounds := Bounds{MinLat: coords[0].Lat, MinLng: coords[0].Lng, MaxLat: coords[0].Lat, MaxLng: coords[0].Lng}
+	for _, coord := range coords[1:] {
+		bounds.MinLat = math.Min(bounds.MinLat, coord.Lat)
+		bounds.MinLng = math.Min(bounds.MinLng, coord.Lng)
+		bounds.MaxLat = math.Max(bounds.MaxLat, coord.Lat)
+		bounds.MaxLng = math.Max(bounds.MaxLng, coord.Lng)
+	}
+	return bounds, true
+}
+
+// StopsHandler finds all of the route stops in the database. Stops that aren't served
+// at this time of day are left out unless the "all" query parameter is true. If the
+// "include" query parameter is "routes", each stop lists the routes that serve it.
 func (api *API) StopsHandler(w http.ResponseWriter, r *http.Request) {
-	// Find all stops in databases
+	query := r.URL.Query()
+	all, _ := strconv.ParseBool(query.Get("all"))
+
+	switch query.Get("include") {
+	case "":
+		// Find all stops in databases
+		stops, err := api.db.GetStops()
+		// Handle query errors
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !all {
+			stops, err = api.activeStops(stops, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send each stop to client as JSON
+		WriteJSON(w, r, stops)
+	case "routes":
+		stops, err := api.db.GetStopsWithRoutes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !all {
+			stops, err = api.activeStopsWithRoutes(stops, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		WriteJSON(w, r, stops)
+	default:
+		http.Error(w, "include must be routes", http.StatusBadRequest)
+	}
+}
+
+// NearestStop is a stop and how far it is from a rider.
+type NearestStop struct {
+	model.Stop
+	// Distance is in meters.
+	Distance float64 `json:"distance"`
+}
+
+// StopsNearestHandler finds the active stop closest to the position given by the "lat" and "lng"
+// query parameters. Each "attribute" query parameter, like ?attribute=accessible, limits the search
+// to stops with that attribute. It responds 404 if no stop matches.
+func (api *API) StopsNearestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		http.Error(w, "lat must be a number", http.StatusBadRequest)
+		return
+	}
+	lng, err := strconv.ParseFloat(query.Get("lng"), 64)
+	if err != nil {
+		http.Error(w, "lng must be a number", http.StatusBadRequest)
+		return
+	}
+	position := model.Coord{Lat: lat, Lng: lng}
+
 	stops, err := api.db.GetStops()
-	// Handle query errors
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stops, err = api.activeStops(stops, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var nearest *NearestStop
+	for _, stop := range stops {
+		if !stop.HasCoords() || !stop.HasAttributes(query["attribute"]) {
+			continue
+		}
+		distance := model.DistanceMeters(position, model.Coord{Lat: stop.Lat, Lng: stop.Lng})
+		if nearest == nil || distance < nearest.Distance {
+			nearest = &NearestStop{Stop: stop, Distance: distance}
+		}
+	}
+	if nearest == nil {
+		http.Error(w, "no matching stop", http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, r, nearest)
+}
+
+// activeStopsWithRoutes is like activeStops for stops with their routes.
+func (api *API) activeStopsWithRoutes(stops []model.StopWithRoutes, t time.Time) ([]model.StopWithRoutes, error) {
+	plain := make([]model.Stop, len(stops))
+	for i := range stops {
+		plain[i] = stops[i].Stop
+	}
+	active, err := api.activeStops(plain, t)
+	if err != nil {
+		return nil, err
+	}
+	isActive := make(map[string]bool, len(active))
+	for _, stop := range active {
+		isActive[stop.ID] = true
+	}
+
+	result := []model.StopWithRoutes{}
+	for _, stop := range stops {
+		if isActive[stop.ID] {
+			result = append(result, stop)
+		}
+	}
+	return result, nil
+}
+
+// activeStops returns the stops that are served at time t. Stops without any StopWindows are always served.
+func (api *API) activeStops(stops []model.Stop, t time.Time) ([]model.Stop, error) {
+	windows, err := api.db.GetStopWindows()
+	if err != nil {
+		return nil, err
+	}
+	windowsByStop := make(map[string][]model.StopWindow)
+	for _, window := range windows {
+		windowsByStop[window.StopID] = append(windowsByStop[window.StopID], window)
+	}
+
+	t = t.In(api.loc)
+	active := []model.Stop{}
+	for _, stop := range stops {
+		stopWindows, ok := windowsByStop[stop.ID]
+		if !ok {
+			active = append(active, stop)
+			continue
+		}
+		for _, window := range stopWindows {
+			isActive, err := window.Active(t)
+			if err != nil {
+				log.WithError(err).Errorf("Invalid window for stop %s.", stop.ID)
+				continue
+			}
+			if isActive {
+				active = append(active, stop)
+				break
+			}
+		}
+	}
+	return active, nil
+}
+
+// maxHeadwayWindow is the furthest back StopsHeadwayHandler may look, since every update on the
+// route in the window is read.
+const maxHeadwayWindow = 24 * time.Hour
+
+// StopsHeadwayHandler reports the time between successive arrivals at a stop by vehicles on the route
+// given by the "route" query parameter. The "window" query parameter, like "1h", sets how far back to
+// look. It defaults to an hour and may be at most a day.
+func (api *API) StopsHeadwayHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	routeID := query.Get("route")
+	if routeID == "" {
+		http.Error(w, "route is required", http.StatusBadRequest)
+		return
+	}
+	window := time.Hour
+	if win := query.Get("window"); win != "" {
+		var err error
+		window, err = time.ParseDuration(win)
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		if window > maxHeadwayWindow {
+			http.Error(w, fmt.Sprintf("window must be at most %s", maxHeadwayWindow), http.StatusBadRequest)
+			return
+		}
+	}
+
+	headway, err := api.db.GetHeadwayForStop(mux.Vars(r)["id"], routeID, window)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, headway)
+}
+
+// Limits on how many arrivals are returned per page.
+const (
+	defaultArrivalsLimit = 50
+	maxArrivalsLimit     = 500
+	// maxArrivalsWindow is the furthest back that arrivals are looked for.
+	maxArrivalsWindow = 7 * 24 * time.Hour
+)
+
+// StopsArrivalsHandler lists the vehicles that arrived at a stop, most recent first. The "since"
+// query parameter, an RFC 3339 time, sets how far back to look. It defaults to a day ago and is
+// limited to maxArrivalsWindow ago. Arrivals are paged with "limit" and "offset"; a page shorter
+// than the limit is the last.
+func (api *API) StopsArrivalsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	since := now.Add(-24 * time.Hour)
+	if param := query.Get("since"); param != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if earliest := now.Add(-maxArrivalsWindow); since.Before(earliest) {
+		since = earliest
+	}
+	limit := defaultArrivalsLimit
+	if param := query.Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxArrivalsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxArrivalsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	offset := 0
+	if param := query.Get("offset"); param != "" {
+		var err error
+		offset, err = strconv.Atoi(param)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	arrivals, err := api.db.GetArrivalsForStop(mux.Vars(r)["id"], since, offset+limit)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offset > len(arrivals) {
+		offset = len(arrivals)
+	}
+	arrivals = arrivals[offset:]
+	if len(arrivals) > limit {
+		arrivals = arrivals[:limit]
+	}
+	WriteJSON(w, r, arrivals)
+}
+
+// StopsWindowsHandler replaces the times of day during which a stop is served.
+func (api *API) StopsWindowsHandler(w http.ResponseWriter, r *http.Request) {
+	var windows []model.StopWindow
+	if err := json.NewDecoder(r.Body).Decode(&windows); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, window := range windows {
+		if _, err := window.Active(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := api.db.SetStopWindows(mux.Vars(r)["id"], windows); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	// Send each stop to client as JSON
-	WriteJSON(w, stops)
+	WriteJSON(w, r, windows)
+}
+
+// StopsAttributesHandler replaces a stop's attributes, like whether it has a shelter or is
+// accessible.
+func (api *API) StopsAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	var attributes map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stop, err := api.db.SetStopAttributes(mux.Vars(r)["id"], attributes)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, stop)
 }
 
 // compute distance between two coordinates and return a value
@@ -54,9 +731,6 @@ func ComputeDistanceMapPoint(c1 model.MapPoint, c2 model.MapPoint) float64 {
 // RoutesCreateHandler adds a new route to the database
 func (api *API) RoutesCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// Create a new route object using request fields
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
 	var routeData map[string]string
 	var coordsData []map[string]float64
 	// Decode route details
@@ -81,6 +755,10 @@ func (api *API) RoutesCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// Here do the interpolation
 	// now we get the Segment for each segment ( this should be stored in database, just store it inside route for god sake)
 	fmt.Printf("Size of coordinates = %d", len(coords))
+	if routeData["color"] != "" && !model.ValidColor(routeData["color"]) {
+		http.Error(w, "color must be a hex color like #1a2b3c", http.StatusBadRequest)
+		return
+	}
 	// Type conversions
 	enabled, _ := strconv.ParseBool(routeData["enabled"])
 	width, _ := strconv.Atoi(routeData["width"])
@@ -101,7 +779,9 @@ func (api *API) RoutesCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// Store new route under routes collection
 	err = api.db.CreateRoute(&route)
 	// Error handling
-	if err != nil {
+	if err == database.ErrRouteTooFewCoords {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
@@ -109,9 +789,6 @@ func (api *API) RoutesCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 // RoutesDeleteHandler deletes a route from database
 func (api *API) RoutesDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
 	vars := mux.Vars(r)
 	fmt.Printf(vars["id"])
 	log.Debugf("deleting", vars["id"])
@@ -122,30 +799,43 @@ func (api *API) RoutesDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RoutesEditHandler Only handles editing enabled flag for now
+// RouteEditRequest is a route's new settings. Color is left as it was if it's omitted.
+type RouteEditRequest struct {
+	model.Route
+	Color *string `json:"color"`
+}
+
+// RoutesEditHandler Only handles editing enabled flag and color for now
 func (api *API) RoutesEditHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
-	route := model.Route{}
+	req := RouteEditRequest{}
 
-	err := json.NewDecoder(r.Body).Decode(&route)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		log.WithError(err).Error("Unable to decode route")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	en := route.Enabled
+	if req.Color != nil && !model.ValidColor(*req.Color) {
+		http.Error(w, "color must be a hex color like #1a2b3c", http.StatusBadRequest)
+		return
+	}
 
-	route, err = api.db.GetRoute(route.ID)
-	route.Enabled = en
+	route, err := api.db.GetRoute(req.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	route.Enabled = req.Enabled
+	if req.Color != nil {
+		route.Color = *req.Color
+	}
+	route.Updated = time.Now()
 
 	err = api.db.ModifyRoute(&route)
-	if err != nil {
+	if isInvalidRoute(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -154,13 +844,13 @@ func (api *API) RoutesEditHandler(w http.ResponseWriter, r *http.Request) {
 
 // StopsCreateHandler adds a new route stop to the database
 func (api *API) StopsCreateHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
-
 	// Create a new stop object using request fields
 	stop := model.Stop{}
 	err := json.NewDecoder(r.Body).Decode(&stop)
+	if err == nil && !stop.HasCoords() {
+		http.Error(w, "stop has no coordinates", http.StatusBadRequest)
+		return
+	}
 	stop.ID = bson.NewObjectId().Hex()
 	route, err1 := api.db.GetRoute(stop.RouteID)
 	// Error handling
@@ -173,6 +863,7 @@ func (api *API) StopsCreateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// We have to know the order of the stop and store a velocity vector into duration for the prediction
 	route.StopsID = append(route.StopsID, stop.ID) // THIS REQUIRES the front end to have correct order << to be improved
+	route.Updated = time.Now()
 	fmt.Println(route.StopsID)
 
 	// Store new stop under stops collection
@@ -181,21 +872,99 @@ func (api *API) StopsCreateHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	// Don't leave the stop behind if the route can't gain it.
 	err = api.db.ModifyRoute(&route)
 	if err != nil {
-		fmt.Println(err.Error())
+		api.deleteStops([]model.Stop{stop})
 	}
-	WriteJSON(w, stop)
+	if isInvalidRoute(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, stop)
 }
 
-// StopsDeleteHandler deletes a Stop.
-func (api *API) StopsDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
+// isInvalidRoute reports whether err is from a route failing validation when it was stored, which
+// is the request's fault rather than the server's.
+func isInvalidRoute(err error) bool {
+	return err == database.ErrRouteTooFewCoords || err == database.ErrRouteInvalidVariant
+}
+
+// StopsBulkCreateHandler creates an ordered list of stops and adds them to the end of a route's
+// stops. Either all of the stops are created or none are.
+func (api *API) StopsBulkCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var stops []model.Stop
+	if err := json.NewDecoder(r.Body).Decode(&stops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, stop := range stops {
+		if !stop.HasCoords() {
+			http.Error(w, fmt.Sprintf("stop %d has no coordinates", i), http.StatusBadRequest)
+			return
+		}
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	err = api.createStopsForRoute(&route, stops)
+	if isInvalidRoute(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, stops)
+}
+
+// createStopsForRoute creates stops in order and appends them to the route. If any stop can't be
+// created, the stops that were already created are deleted and the route is left unmodified.
+func (api *API) createStopsForRoute(route *model.Route, stops []model.Stop) error {
+	stopsID := route.StopsID
+	for i := range stops {
+		stops[i].ID = bson.NewObjectId().Hex()
+		stops[i].RouteID = route.ID
+		if err := api.db.CreateStop(&stops[i]); err != nil {
+			api.deleteStops(stops[:i])
+			return err
+		}
+		stopsID = append(stopsID, stops[i].ID)
+	}
+
+	route.StopsID = stopsID
+	route.Updated = time.Now()
+	if err := api.db.ModifyRoute(route); err != nil {
+		api.deleteStops(stops)
+		return err
+	}
+	return nil
+}
+
+// deleteStops deletes stops, logging any that can't be deleted.
+func (api *API) deleteStops(stops []model.Stop) {
+	for _, stop := range stops {
+		if err := api.db.DeleteStop(stop.ID); err != nil {
+			log.WithError(err).Errorf("Unable to delete stop %s.", stop.ID)
+		}
+	}
+}
+
+// StopsDeleteHandler deletes a Stop.
+func (api *API) StopsDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	log.Debugf("deleting", vars["id"])
 	fmt.Printf(vars["id"])
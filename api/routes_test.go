@@ -0,0 +1,893 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+const bulkStopsBody = `[
+	{"name": "Union", "lat": "42.730", "lng": "-73.676"},
+	{"name": "Sage", "lat": "42.731", "lng": "-73.680"},
+	{"name": "Blitman", "lat": "42.734", "lng": "-73.686"},
+	{"name": "City Station", "lat": "42.733", "lng": "-73.690"}
+]`
+
+func TestStopsBulkCreateHandler(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west", StopsID: []string{"existing"}}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/stops/bulk", strings.NewReader(bulkStopsBody)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var stops []model.Stop
+	if err := json.NewDecoder(w.Body).Decode(&stops); err != nil {
+		t.Fatalf("Unable to decode stops: %v", err)
+	}
+	names := []string{"Union", "Sage", "Blitman", "City Station"}
+	if len(stops) != len(names) {
+		t.Fatalf("Got %d stops, expected %d.", len(stops), len(names))
+	}
+	expectedIDs := []string{"existing"}
+	for i, stop := range stops {
+		if stop.Name != names[i] || stop.ID == "" || stop.RouteID != "west" {
+			t.Errorf("Got stop %+v at position %d, expected %s on west route with an ID.", stop, i, names[i])
+		}
+		expectedIDs = append(expectedIDs, stop.ID)
+	}
+
+	route := db.routes[0]
+	if strings.Join(route.StopsID, ",") != strings.Join(expectedIDs, ",") {
+		t.Errorf("Got route stops %v, expected %v.", route.StopsID, expectedIDs)
+	}
+}
+
+func TestStopsBulkCreateHandlerAttributes(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}}
+	api := newTestAPI(db)
+
+	body := `[{"name": "Union", "lat": "42.730", "lng": "-73.676", "attributes": {"shelter": true, "accessible": true}}]`
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/stops/bulk", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if len(db.stops) != 1 || !db.stops[0].HasAttributes([]string{"shelter", "accessible"}) {
+		t.Errorf("Got stops %+v, expected a sheltered, accessible stop.", db.stops)
+	}
+}
+
+func TestStopsAttributesHandler(t *testing.T) {
+	db := &mockDatabase{stops: []model.Stop{{ID: "union", Name: "Union", Attributes: map[string]bool{"bench": true}}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/stops/union/attributes", strings.NewReader(`{"shelter": true, "accessible": true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	stop := model.Stop{}
+	if err := json.NewDecoder(w.Body).Decode(&stop); err != nil {
+		t.Fatalf("Unable to decode stop: %v", err)
+	}
+	if stop.Name != "Union" || !stop.HasAttributes([]string{"shelter", "accessible"}) || stop.HasAttributes([]string{"bench"}) {
+		t.Errorf("Got stop %+v, expected a sheltered, accessible Union without a bench.", stop)
+	}
+	if !db.stops[0].HasAttributes([]string{"shelter", "accessible"}) {
+		t.Errorf("Got stored stop %+v, expected it to be sheltered and accessible.", db.stops[0])
+	}
+
+	for _, c := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/stops/nowhere/attributes", `{"shelter": true}`, http.StatusNotFound},
+		{"/stops/union/attributes", `{"shelter": "yes"}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", c.path, strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Errorf("Got status %d for %s %s, expected %d.", w.Code, c.path, c.body, c.code)
+		}
+	}
+}
+
+func TestStopsNearestHandler(t *testing.T) {
+	db := &mockDatabase{stops: []model.Stop{
+		{ID: "close", Lat: 42.730, Lng: -73.676},
+		{ID: "far", Lat: 42.740, Lng: -73.676, Attributes: map[string]bool{"accessible": true, "bench": true}},
+		{ID: "missing", Attributes: map[string]bool{"accessible": true}},
+	}}
+	api := newTestAPI(db)
+
+	for query, expected := range map[string]string{
+		"":                                      "close",
+		"&attribute=accessible":                 "far",
+		"&attribute=accessible&attribute=bench": "far",
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/nearest?lat=42.731&lng=-73.676"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %q, expected %d.", w.Code, query, http.StatusOK)
+		}
+		nearest := NearestStop{}
+		if err := json.NewDecoder(w.Body).Decode(&nearest); err != nil {
+			t.Fatalf("Unable to decode stop: %v", err)
+		}
+		if nearest.ID != expected || nearest.Distance <= 0 {
+			t.Errorf("Got %+v for %q, expected %s.", nearest, query, expected)
+		}
+	}
+
+	for query, status := range map[string]int{
+		"lat=42.731&lng=-73.676&attribute=shelter": http.StatusNotFound,
+		"lat=42.731":            http.StatusBadRequest,
+		"lat=north&lng=-73.676": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/nearest?"+query, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %q, expected %d.", w.Code, query, status)
+		}
+	}
+}
+
+func TestStopsBulkCreateHandlerRollsBack(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}, failStopName: "Blitman"}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/stops/bulk", strings.NewReader(bulkStopsBody)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusInternalServerError)
+	}
+	if len(db.stops) != 0 {
+		t.Errorf("Got %d stops remaining, expected none.", len(db.stops))
+	}
+	if len(db.deletedStops) != 2 {
+		t.Errorf("Got %d stops deleted, expected 2.", len(db.deletedStops))
+	}
+	if len(db.routes[0].StopsID) != 0 {
+		t.Errorf("Got route stops %v, expected none.", db.routes[0].StopsID)
+	}
+}
+
+func TestStopsBulkCreateHandlerMissingCoords(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}}
+	api := newTestAPI(db)
+
+	body := `[{"name": "Union", "lat": "42.730", "lng": "-73.676"}, {"name": "Nowhere", "lat": "0", "lng": "0"}]`
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/stops/bulk", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+	if len(db.stops) != 0 {
+		t.Errorf("Created %d stops, expected none.", len(db.stops))
+	}
+}
+
+func TestStopsBulkCreateHandlerUnknownRoute(t *testing.T) {
+	api := newTestAPI(&mockDatabase{})
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/stops/bulk", strings.NewReader(bulkStopsBody)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestStopsHandlerWindows(t *testing.T) {
+	db := &mockDatabase{
+		stops:       []model.Stop{{ID: "union", Name: "Union"}, {ID: "late", Name: "Late Night"}},
+		stopWindows: []model.StopWindow{{StopID: "late", Start: "18:00", End: "23:59"}},
+	}
+	api := newTestAPI(db)
+
+	day := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	for _, testCase := range []struct {
+		t        time.Time
+		expected int
+	}{
+		{day.Add(12 * time.Hour), 1},
+		{day.Add(21 * time.Hour), 2},
+	} {
+		stops, err := api.activeStops(db.stops, testCase.t)
+		if err != nil {
+			t.Fatalf("Unable to get active stops: %v", err)
+		}
+		if len(stops) != testCase.expected {
+			t.Errorf("Got %d stops at %s, expected %d.", len(stops), testCase.t.Format("15:04"), testCase.expected)
+		}
+		if len(stops) == 0 || stops[0].ID != "union" {
+			t.Errorf("Expected stop without windows to always be active.")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops?all=true", nil))
+	var stops []model.Stop
+	if err := json.NewDecoder(w.Body).Decode(&stops); err != nil {
+		t.Fatalf("Unable to decode stops: %v", err)
+	}
+	if len(stops) != 2 {
+		t.Errorf("Got %d stops with all=true, expected 2.", len(stops))
+	}
+}
+
+func TestStopsHandlerIncludeRoutes(t *testing.T) {
+	db := &mockDatabase{
+		stops: []model.Stop{{ID: "union"}, {ID: "orphan"}},
+		routes: []model.Route{
+			{ID: "west", Name: "West", StopsID: []string{"union"}},
+			{ID: "east", Name: "East", StopsID: []string{"union"}},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops?include=routes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var stops []struct {
+		ID     string             `json:"id"`
+		Routes *[]model.StopRoute `json:"routes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stops); err != nil {
+		t.Fatalf("Unable to decode stops: %v", err)
+	}
+	if len(stops) != 2 {
+		t.Fatalf("Got %d stops, expected 2.", len(stops))
+	}
+	if stops[0].Routes == nil || len(*stops[0].Routes) != 2 {
+		t.Errorf("Got routes %v for union, expected west and east.", stops[0].Routes)
+	}
+	if stops[1].Routes == nil || len(*stops[1].Routes) != 0 {
+		t.Errorf("Got routes %v for orphan, expected an empty array.", stops[1].Routes)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops?include=vehicles", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRequestDayServiceDayStart(t *testing.T) {
+	api, err := New(Config{Timezone: "UTC", ServiceDayStart: "03:00"}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	day, err := api.requestDay(httptest.NewRequest("GET", "/routes/west/adherence?date=2017-09-01", nil))
+	if err != nil {
+		t.Fatalf("Unable to get day: %v", err)
+	}
+	if expected := time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC); !day.Equal(expected) {
+		t.Errorf("Got day %v, expected %v.", day, expected)
+	}
+
+	day, err = api.requestDay(httptest.NewRequest("GET", "/routes/west/adherence", nil))
+	if err != nil {
+		t.Fatalf("Unable to get day: %v", err)
+	}
+	if now := time.Now(); day.After(now) || now.Sub(day) >= 24*time.Hour || day.Hour() != 3 {
+		t.Errorf("Got day %v, expected the service day containing %v.", day, now)
+	}
+
+	if _, err := New(Config{ServiceDayStart: "3am"}, &mockDatabase{}, nil); err == nil {
+		t.Error("Expected error for invalid service day start.")
+	}
+}
+
+func TestRoutesLengthHandler(t *testing.T) {
+	// Ten hundredths of a degree of latitude, in two legs, is about 11.12 km.
+	route := model.Route{ID: "west", Coords: []model.Coord{
+		{Lat: 42.70, Lng: -73.68},
+		{Lat: 42.75, Lng: -73.68},
+		{Lat: 42.80, Lng: -73.68},
+	}}
+	api := newTestAPI(&mockDatabase{routes: []model.Route{route, {ID: "empty"}}})
+
+	table := []struct {
+		path     string
+		expected float64
+	}{
+		{"/routes/west/length?units=km", 11.12},
+		{"/routes/west/length?units=mi", 6.91},
+		{"/routes/west/length", 6.91},
+		{"/routes/empty/length", 0},
+	}
+	for _, testCase := range table {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", testCase.path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, testCase.path, http.StatusOK)
+		}
+		length := RouteLength{}
+		if err := json.NewDecoder(w.Body).Decode(&length); err != nil {
+			t.Fatalf("Unable to decode length: %v", err)
+		}
+		if math.Abs(length.Length-testCase.expected) > 0.01 {
+			t.Errorf("Got %v for %s, expected about %v.", length.Length, testCase.path, testCase.expected)
+		}
+	}
+
+	for path, status := range map[string]int{
+		"/routes/east/length":          http.StatusNotFound,
+		"/routes/west/length?units=ft": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestRoutesStopsValidateHandler(t *testing.T) {
+	route := model.Route{ID: "west", Coords: []model.Coord{
+		{Lat: 42.70, Lng: -73.68},
+		{Lat: 42.80, Lng: -73.68},
+	}, StopsID: []string{"a", "misplaced", "b", "far", "c", "missing", "unplaced"}}
+	db := &mockDatabase{
+		routes: []model.Route{route, {ID: "empty"}, {ID: "ordered", Coords: route.Coords, StopsID: []string{"a", "b", "c"}}},
+		stops: []model.Stop{
+			{ID: "a", Lat: 42.71, Lng: -73.68},
+			{ID: "b", Lat: 42.73, Lng: -73.6801},
+			{ID: "c", Lat: 42.75, Lng: -73.68},
+			// Listed second, but near the end of the path.
+			{ID: "misplaced", Lat: 42.78, Lng: -73.68},
+			// About 6.5 km east of the path.
+			{ID: "far", Lat: 42.74, Lng: -73.60},
+			// Imported without coordinates.
+			{ID: "unplaced"},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/west/stops/validate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	sequence := StopSequence{}
+	if err := json.NewDecoder(w.Body).Decode(&sequence); err != nil {
+		t.Fatalf("Unable to decode stop sequence: %v", err)
+	}
+	if sequence.Valid {
+		t.Error("Expected route to be invalid.")
+	}
+	problems := map[string]string{}
+	for _, issue := range sequence.Issues {
+		problems[issue.StopID] = issue.Problem
+	}
+	if expected := map[string]string{"misplaced": "out-of-order", "far": "off-route", "unplaced": "missing-coords"}; !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Got problems %v, expected %v.", problems, expected)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/ordered/stops/validate", nil))
+	sequence = StopSequence{}
+	if err := json.NewDecoder(w.Body).Decode(&sequence); err != nil {
+		t.Fatalf("Unable to decode stop sequence: %v", err)
+	}
+	if !sequence.Valid || len(sequence.Issues) != 0 {
+		t.Errorf("Got %+v, expected ordered route to be valid.", sequence)
+	}
+
+	for path, status := range map[string]int{
+		"/routes/east/stops/validate":                 http.StatusNotFound,
+		"/routes/empty/stops/validate":                http.StatusBadRequest,
+		"/routes/west/stops/validate?tolerance=-1":    http.StatusBadRequest,
+		"/routes/ordered/stops/validate?tolerance=10": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestRoutesBoundsHandler(t *testing.T) {
+	db := &mockDatabase{
+		routes: []model.Route{
+			{ID: "west", Enabled: true, StopsID: []string{"a"}, Coords: []model.Coord{{Lat: 42.70, Lng: -73.69}, {Lat: 42.72, Lng: -73.68}}},
+			{ID: "east", Enabled: true, Coords: []model.Coord{{Lat: 42.71, Lng: -73.67}, {Lat: 42.73, Lng: -73.66}}},
+			// Disabled routes don't count.
+			{ID: "old", Coords: []model.Coord{{Lat: 43.00, Lng: -74.00}}},
+		},
+		stops: []model.Stop{
+			{ID: "a", Lat: 42.74, Lng: -73.68},
+			{ID: "b", Lat: 40.00, Lng: -70.00},
+		},
+	}
+	api := newTestAPI(db)
+
+	for path, expected := range map[string]Bounds{
+		"/routes/bounds":            {MinLat: 42.70, MinLng: -73.69, MaxLat: 42.73, MaxLng: -73.66},
+		"/routes/bounds?stops=true": {MinLat: 42.70, MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.66},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, path, http.StatusOK)
+		}
+		bounds := Bounds{}
+		if err := json.NewDecoder(w.Body).Decode(&bounds); err != nil {
+			t.Fatalf("Unable to decode bounds: %v", err)
+		}
+		if bounds != expected {
+			t.Errorf("Got %+v for %s, expected %+v.", bounds, path, expected)
+		}
+	}
+}
+
+func TestRoutesBoundsHandlerWithoutPaths(t *testing.T) {
+	api := newTestAPI(&mockDatabase{routes: []model.Route{{ID: "west", Enabled: true}}})
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/bounds", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRoutesHandlerModifiedSince(t *testing.T) {
+	created := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := &mockDatabase{routes: []model.Route{
+		{ID: "west", Updated: created},
+		{ID: "east", Updated: created.Add(time.Hour)},
+		{ID: "north", Updated: created},
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes?modifiedSince=2017-09-01T12:30:00Z", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var routes []model.Route
+	if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+		t.Fatalf("Unable to decode routes: %v", err)
+	}
+	if len(routes) != 1 || routes[0].ID != "east" {
+		t.Errorf("Got %+v, expected only east.", routes)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes?modifiedSince=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestStopsCreateHandlerModifiesRoute(t *testing.T) {
+	created := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := &mockDatabase{routes: []model.Route{{ID: "west", Updated: created}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	body := `{"name": "Union", "lat": "42.73", "lng": "-73.68", "routeId": "west"}`
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/stops/create", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	// Clients polling for changes see that the route gained a stop.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes?modifiedSince=2017-09-01T12:30:00Z", nil))
+	var routes []model.Route
+	if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+		t.Fatalf("Unable to decode routes: %v", err)
+	}
+	if len(routes) != 1 || len(routes[0].StopsID) != 1 {
+		t.Errorf("Got %+v, expected west with its new stop.", routes)
+	}
+}
+
+func TestInvalidRouteIsBadRequest(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{
+		// Enabled before routes needed coordinates to be.
+		{ID: "west", Enabled: true},
+		{ID: "east", Variants: []model.RouteVariant{{ID: "weekend"}}},
+	}}
+	api := newTestAPI(db)
+
+	for _, routeID := range []string{"west", "east"} {
+		w := httptest.NewRecorder()
+		body := `{"name": "Union", "lat": "42.73", "lng": "-73.68", "routeId": "` + routeID + `"}`
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/stops/create", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, routeID, http.StatusBadRequest)
+		}
+
+		w = httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/"+routeID+"/stops/bulk", strings.NewReader(bulkStopsBody)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d creating stops in bulk for %s, expected %d.", w.Code, routeID, http.StatusBadRequest)
+		}
+	}
+	// The rejected stops aren't left behind.
+	if len(db.stops) != 0 {
+		t.Errorf("Got stops %+v, expected none.", db.stops)
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/edit", strings.NewReader(`{"id": "east", "enabled": false}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d editing a route with an invalid variant, expected %d.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRoutesHandlerCoordFormat(t *testing.T) {
+	db := &mockDatabase{
+		routes: []model.Route{
+			{ID: "west", Coords: []model.Coord{{Lat: 42.73, Lng: -73.676}, {Lat: 42.731, Lng: -73.68}}},
+		},
+		vehicles: []model.Vehicle{{VehicleID: "1", Enabled: true}},
+		updates:  []model.VehicleUpdate{{VehicleID: "1", Lat: "42.7300", Lng: "-73.6760", Created: time.Now()}},
+		stops:    []model.Stop{{ID: "union", Lat: 42.73, Lng: -73.676}},
+	}
+	api := newTestAPI(db)
+
+	for _, test := range []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/routes", http.StatusOK, `"coords":[{"lat":42.73,"lng":-73.676},{"lat":42.731,"lng":-73.68}]`},
+		{"/routes?coordFormat=object", http.StatusOK, `"coords":[{"lat":42.73,"lng":-73.676},{"lat":42.731,"lng":-73.68}]`},
+		{"/routes?coordFormat=array", http.StatusOK, `"coords":[[-73.676,42.73],[-73.68,42.731]]`},
+		{"/routes?coordFormat=geojson", http.StatusBadRequest, ""},
+		{"/updates", http.StatusOK, `"lat":"42.7300","lng":"-73.6760"`},
+		{"/updates?coordFormat=array", http.StatusOK, `"position":[-73.676,42.73]`},
+		{"/stops?all=true", http.StatusOK, `"lat":"42.73","lng":"-73.676"`},
+		{"/stops?all=true&coordFormat=array", http.StatusOK, `"position":[-73.676,42.73]`},
+		{"/map/state?coordFormat=array", http.StatusOK, `"position":[-73.676,42.73]`},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, expected %d.", test.path, w.Code, test.status)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), test.contains) {
+			t.Errorf("%s: got %s, expected it to contain %s.", test.path, w.Body.String(), test.contains)
+		}
+		// Stops and updates written with arrays don't have their positions twice.
+		if strings.Contains(test.path, "coordFormat=array") && strings.Contains(w.Body.String(), `"lat"`) {
+			t.Errorf("%s: got %s, expected no lat.", test.path, w.Body.String())
+		}
+	}
+}
+
+func TestRoutesVariantsHandler(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}}
+	api := newTestAPI(db)
+
+	body := `{"variants": [{"id": "weekend", "name": "Weekend", "days": [0, 6], "coords": [
+		{"lat": 42.730, "lng": -73.690}, {"lat": 42.740, "lng": -73.690}
+	]}], "activeVariant": "weekend"}`
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/variants", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	route := db.routes[0]
+	if len(route.Variants) != 1 || len(route.Variants[0].Coords) != 2 || route.ActiveVariant != "weekend" {
+		t.Errorf("Got route %+v, expected the weekend variant to be active.", route)
+	}
+	if days := route.Variants[0].Days; !reflect.DeepEqual(days, []time.Weekday{time.Sunday, time.Saturday}) {
+		t.Errorf("Got days %v, expected Sunday and Saturday.", days)
+	}
+
+	for path, status := range map[string]int{
+		"/routes/east/variants": http.StatusNotFound,
+		"/routes/west/variants": http.StatusBadRequest,
+	} {
+		reqBody := body
+		if status == http.StatusBadRequest {
+			reqBody = "not json"
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(reqBody)))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestRoutesAdherenceHandler(t *testing.T) {
+	db := &mockDatabase{
+		routes:    []model.Route{{ID: "north", StopsID: []string{"union"}}},
+		stops:     []model.Stop{{ID: "union", RouteID: "south"}},
+		schedules: map[string][]model.ScheduledArrival{"north": {{StopID: "union", Time: "08:00"}}},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/north/adherence?date=2017-09-01", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var adherence []model.StopAdherence
+	if err := json.NewDecoder(w.Body).Decode(&adherence); err != nil {
+		t.Fatalf("Unable to decode adherence: %v", err)
+	}
+	if len(adherence) != 1 || adherence[0].StopID != "union" || adherence[0].Missed != 1 {
+		t.Errorf("Got %+v, expected a missed arrival at union.", adherence)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/south/adherence", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for an unknown route, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRoutesSegmentSpeedsHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{
+		routes: []model.Route{{
+			ID:      "north",
+			Coords:  []model.Coord{{Lat: 42.730, Lng: -73.680}, {Lat: 42.750, Lng: -73.680}},
+			StopsID: []string{"a", "b"},
+		}},
+		stops: []model.Stop{{ID: "a", Lat: 42.730, Lng: -73.680}, {ID: "b", Lat: 42.740, Lng: -73.680}},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Route: "north", Lat: "42.731", Lng: "-73.680", Created: now.Add(-time.Minute)},
+			{VehicleID: "1", Route: "north", Lat: "42.732", Lng: "-73.680", Created: now.Add(-30 * time.Second)},
+			// Too old for the window.
+			{VehicleID: "1", Route: "north", Lat: "42.745", Lng: "-73.680", Created: now.Add(-2 * time.Hour)},
+			{VehicleID: "1", Route: "north", Lat: "42.746", Lng: "-73.680", Created: now.Add(-2*time.Hour + 30*time.Second)},
+		},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/north/segment-speeds?window=1h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var segments []model.SegmentSpeed
+	if err := json.NewDecoder(w.Body).Decode(&segments); err != nil {
+		t.Fatalf("Unable to decode segments: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("Got %d segments, expected 2.", len(segments))
+	}
+	if segments[0].Samples != 1 || segments[0].AverageSpeed == nil {
+		t.Errorf("Got %+v, expected one sample from a to b.", segments[0])
+	}
+	if segments[1].Samples != 0 || segments[1].AverageSpeed != nil {
+		t.Errorf("Got %+v, expected no data from b to a.", segments[1])
+	}
+
+	for path, status := range map[string]int{
+		"/routes/south/segment-speeds":              http.StatusNotFound,
+		"/routes/north/segment-speeds?window=0":     http.StatusBadRequest,
+		"/routes/north/segment-speeds?window=8760h": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestStopsHeadwayHandler(t *testing.T) {
+	db := &mockDatabase{stops: []model.Stop{{ID: "union"}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/union/headway?route=west&window=2h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if db.headwayWindow != 2*time.Hour {
+		t.Errorf("Got window %v, expected 2h.", db.headwayWindow)
+	}
+
+	for path, status := range map[string]int{
+		"/stops/sage/headway?route=west":               http.StatusNotFound,
+		"/stops/union/headway":                         http.StatusBadRequest,
+		"/stops/union/headway?route=west&window=0":     http.StatusBadRequest,
+		"/stops/union/headway?route=west&window=8760h": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestRoutesOccupancyHandler(t *testing.T) {
+	average := 12.5
+	db := &mockDatabase{occupancy: []model.HourlyOccupancy{{Hour: 8, Average: &average}, {Hour: 9}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/north/occupancy?date=2018-03-05", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var occupancy []model.HourlyOccupancy
+	if err := json.NewDecoder(w.Body).Decode(&occupancy); err != nil {
+		t.Fatalf("Unable to decode occupancy: %v", err)
+	}
+	if len(occupancy) != 2 || occupancy[0].Average == nil || *occupancy[0].Average != average || occupancy[1].Average != nil {
+		t.Errorf("Got %+v, expected an average of %v at 8 and none at 9.", occupancy, average)
+	}
+	day := time.Date(2018, 3, 5, 0, 0, 0, 0, api.loc)
+	if db.occupancyRoute != "north" || !db.occupancyDay.Equal(day) {
+		t.Errorf("Got route %s on %v, expected north on %v.", db.occupancyRoute, db.occupancyDay, day)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/routes/north/occupancy?date=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestStopsArrivalsHandler(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	since := func(d time.Duration) string { return "since=" + start.Add(d).Format(time.RFC3339) }
+	at := func(vehicleID, routeID string, minutes int, lat string) model.VehicleUpdate {
+		return model.VehicleUpdate{VehicleID: vehicleID, Route: routeID, Lat: lat, Lng: "-73.6800", Created: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	db := &mockDatabase{
+		stops: []model.Stop{{ID: "union", Lat: 42.7300, Lng: -73.6800}, {ID: "sage", Lat: 42.7320, Lng: -73.6800}, {ID: "blitman", Lat: 42.7340, Lng: -73.6860}},
+		updates: []model.VehicleUpdate{
+			at("1", "west", 0, "42.7300"), // arrives
+			at("1", "west", 1, "42.7301"), // still there
+			at("1", "west", 2, "42.7320"),
+			at("2", "east", 10, "42.7300"), // arrives
+			at("1", "west", 20, "42.7300"), // arrives again
+		},
+	}
+	api := newTestAPI(db)
+
+	arrivals := func(stopID, query string) []model.StopArrival {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/"+stopID+"/arrivals?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+		}
+		var arrivals []model.StopArrival
+		if err := json.NewDecoder(w.Body).Decode(&arrivals); err != nil {
+			t.Fatalf("Unable to decode arrivals: %v", err)
+		}
+		return arrivals
+	}
+
+	got := arrivals("union", since(-time.Hour))
+	expected := []model.StopArrival{
+		{VehicleID: "1", RouteID: "west", StopID: "union", Time: start.Add(20 * time.Minute)},
+		{VehicleID: "2", RouteID: "east", StopID: "union", Time: start.Add(10 * time.Minute)},
+		{VehicleID: "1", RouteID: "west", StopID: "union", Time: start},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %+v, expected %+v.", got, expected)
+	}
+
+	if got := arrivals("union", since(5*time.Minute)); len(got) != 2 || got[1].VehicleID != "2" {
+		t.Errorf("Got %+v, expected the two arrivals after the first five minutes.", got)
+	}
+	if got := arrivals("union", since(-time.Hour)+"&limit=1&offset=1"); len(got) != 1 || got[0].VehicleID != "2" {
+		t.Errorf("Got %+v, expected only the second most recent arrival.", got)
+	}
+	if got := arrivals("union", since(time.Hour)); got == nil || len(got) != 0 {
+		t.Errorf("Got %+v, expected an empty list after the last arrival.", got)
+	}
+	if got := arrivals("blitman", since(-time.Hour)); got == nil || len(got) != 0 {
+		t.Errorf("Got %+v, expected an empty list for a stop that was never visited.", got)
+	}
+
+	// Arrivals more than a week ago aren't looked for.
+	db.updates = append(db.updates, at("3", "west", -8*24*60, "42.7300"))
+	if got := arrivals("union", "since=2017-09-01T00:00:00Z"); len(got) != 3 {
+		t.Errorf("Got %+v, expected only the three arrivals within the last week.", got)
+	}
+
+	for _, path := range []string{"/stops/union/arrivals?since=yesterday", "/stops/union/arrivals?limit=0"} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, http.StatusBadRequest)
+		}
+	}
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/stops/unknown/arrivals", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRoutesColor(t *testing.T) {
+	db := &mockDatabase{}
+	api := newTestAPI(db)
+
+	for _, testCase := range []struct {
+		path     string
+		body     string
+		expected int
+	}{
+		// West is enabled below, so it needs enough coordinates to be drawn.
+		{"/routes/create", `{"name": "West", "color": "#1a2b3c", "coords": "[{\"lat\": 42.73, \"lng\": -73.68}, {\"lat\": 42.74, \"lng\": -73.67}]"}`, http.StatusOK},
+		{"/routes/create", `{"name": "East", "color": "purple", "coords": "[]"}`, http.StatusBadRequest},
+		// An enabled route needs enough coordinates to be drawn.
+		{"/routes/create", `{"name": "North", "enabled": "true", "coords": "[]"}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", testCase.path, strings.NewReader(testCase.body)))
+		if w.Code != testCase.expected {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, testCase.body, testCase.expected)
+		}
+	}
+	if len(db.routes) != 1 {
+		t.Fatalf("Got %d routes, expected 1.", len(db.routes))
+	}
+
+	id := db.routes[0].ID
+	for _, testCase := range []struct {
+		body     string
+		expected int
+		color    string
+	}{
+		{`{"id": "` + id + `", "enabled": true, "color": "#abc"}`, http.StatusOK, "#abc"},
+		{`{"id": "` + id + `", "enabled": true, "color": ""}`, http.StatusBadRequest, "#abc"},
+		{`{"id": "` + id + `", "enabled": true, "color": "#abcd"}`, http.StatusBadRequest, "#abc"},
+		// Leaving out the color keeps it.
+		{`{"id": "` + id + `", "enabled": false}`, http.StatusOK, "#abc"},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/edit", strings.NewReader(testCase.body)))
+		if w.Code != testCase.expected {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, testCase.body, testCase.expected)
+		}
+		if db.routes[0].Color != testCase.color {
+			t.Errorf("Got color %q after %s, expected %q.", db.routes[0].Color, testCase.body, testCase.color)
+		}
+	}
+}
+
+func TestVehiclesEditHandlerRetentionDays(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", VehicleName: "Bus", RetentionDays: 30}}}
+	api := newTestAPI(db)
+
+	for _, testCase := range []struct {
+		body     string
+		expected int
+	}{
+		// Leaving out retentionDays keeps the override.
+		{`{"vehicleID": "1", "vehicleName": "Bus 1", "enabled": true}`, 30},
+		{`{"vehicleID": "1", "vehicleName": "Bus 1", "retentionDays": 7}`, 7},
+		{`{"vehicleID": "1", "vehicleName": "Bus 1", "retentionDays": 0}`, 0},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/edit", strings.NewReader(testCase.body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, testCase.body, http.StatusOK)
+		}
+		if db.vehicles[0].RetentionDays != testCase.expected {
+			t.Errorf("Got %d retention days for %s, expected %d.", db.vehicles[0].RetentionDays, testCase.body, testCase.expected)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// RouteServiceWindowsRequest replaces a route's service windows. ManualEnabled keeps the route
+// from being enabled or disabled automatically by them.
+type RouteServiceWindowsRequest struct {
+	ServiceWindows []model.RouteServiceWindow `json:"serviceWindows"`
+	ManualEnabled  bool                       `json:"manualEnabled"`
+}
+
+// RoutesServiceWindowsHandler replaces a route's service windows given by a
+// RouteServiceWindowsRequest.
+func (api *API) RoutesServiceWindowsHandler(w http.ResponseWriter, r *http.Request) {
+	req := RouteServiceWindowsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, window := range req.ServiceWindows {
+		if err := window.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	route, err := api.db.GetRoute(mux.Vars(r)["id"])
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	route.ServiceWindows = req.ServiceWindows
+	route.ManualEnabled = req.ManualEnabled
+	route.Updated = time.Now()
+	if err := api.db.ModifyRoute(&route); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, route)
+}
+
+// runRouteSchedules applies route service windows every routeScheduleInterval until the API
+// shuts down.
+func (api *API) runRouteSchedules() {
+	api.applyRouteSchedules(time.Now())
+	ticker := time.NewTicker(api.routeScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-api.ctx.Done():
+			return
+		case now := <-ticker.C:
+			api.applyRouteSchedules(now)
+		}
+	}
+}
+
+// applyRouteSchedules enables or disables each route that has service windows, unless it's
+// manually enabled, to match whether one of its windows is open at now.
+func (api *API) applyRouteSchedules(now time.Time) {
+	routes, err := api.db.GetRoutes()
+	if err != nil {
+		log.WithError(err).Error("Unable to get routes to schedule.")
+		return
+	}
+
+	changed := false
+	for _, route := range routes {
+		if route.ManualEnabled || len(route.ServiceWindows) == 0 {
+			continue
+		}
+		running, err := route.ScheduledToRun(now.In(api.loc), api.serviceDayStart)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to check schedule for route %s.", route.ID)
+			continue
+		}
+		if running == route.Enabled {
+			continue
+		}
+		if _, err := api.db.SetRoutesEnabled([]string{route.ID}, running); err != nil {
+			log.WithError(err).Errorf("Unable to set route %s enabled to %v.", route.ID, running)
+			continue
+		}
+		log.Infof("Set route %s enabled to %v by its schedule.", route.ID, running)
+		changed = true
+	}
+	if changed {
+		api.cache.clear()
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestApplyRouteSchedules(t *testing.T) {
+	coords := []model.Coord{{Lat: 42.730, Lng: -73.690}, {Lat: 42.740, Lng: -73.690}}
+	mornings := []model.RouteServiceWindow{{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: "07:00",
+		End:   "11:00",
+	}}
+	db := &mockDatabase{routes: []model.Route{
+		{ID: "mornings", Coords: coords, ServiceWindows: mornings},
+		{ID: "override", Coords: coords, ServiceWindows: mornings, ManualEnabled: true},
+		{ID: "unscheduled", Coords: coords},
+	}}
+	api := newTestAPI(db)
+
+	enabled := func() map[string]bool {
+		result := map[string]bool{}
+		for _, route := range db.routes {
+			result[route.ID] = route.Enabled
+		}
+		return result
+	}
+
+	// September 4, 2017 was a Monday.
+	api.applyRouteSchedules(time.Date(2017, 9, 4, 8, 0, 0, 0, time.UTC))
+	if got := enabled(); !got["mornings"] || got["override"] || got["unscheduled"] {
+		t.Errorf("Got %v on Monday morning, expected only mornings enabled.", got)
+	}
+
+	api.applyRouteSchedules(time.Date(2017, 9, 4, 12, 0, 0, 0, time.UTC))
+	if got := enabled(); got["mornings"] {
+		t.Errorf("Got %v on Monday afternoon, expected mornings disabled.", got)
+	}
+
+	// Routes that are manually enabled or have no windows keep whatever was set by hand.
+	db.routes[1].Enabled = true
+	db.routes[2].Enabled = true
+	api.applyRouteSchedules(time.Date(2017, 9, 9, 8, 0, 0, 0, time.UTC))
+	if got := enabled(); got["mornings"] || !got["override"] || !got["unscheduled"] {
+		t.Errorf("Got %v on Saturday, expected override and unscheduled to stay enabled.", got)
+	}
+}
+
+func TestRoutesServiceWindowsHandler(t *testing.T) {
+	db := &mockDatabase{routes: []model.Route{{ID: "west"}}}
+	api := newTestAPI(db)
+
+	body := `{"serviceWindows": [{"days": [1, 2, 3, 4, 5], "start": "07:00", "end": "11:00"}], "manualEnabled": true}`
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/routes/west/service-windows", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	route := db.routes[0]
+	if len(route.ServiceWindows) != 1 || len(route.ServiceWindows[0].Days) != 5 || !route.ManualEnabled {
+		t.Errorf("Got route %+v, expected a weekday window with manual override.", route)
+	}
+
+	for _, testCase := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/routes/east/service-windows", body, http.StatusNotFound},
+		{"/routes/west/service-windows", "not json", http.StatusBadRequest},
+		{"/routes/west/service-windows", `{"serviceWindows": [{"days": [1], "start": "7am", "end": "11:00"}]}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", testCase.path, strings.NewReader(testCase.body)))
+		if w.Code != testCase.status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, testCase.body, testCase.status)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wtg/shuttletracker/database"
+)
+
+// StatsHandler totals what the fleet did between the RFC 3339 times given by the "from" and "to"
+// query parameters: how far vehicles traveled, how long they spent on trips, how many trips they
+// made, and the most vehicles that were out at once.
+func (api *API) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := timeRangeParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := api.db.GetFleetStats(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, stats)
+}
+
+// HeatmapHandler counts the updates between the "from" and "to" times in each cell of a grid over
+// the box given by the "minLat", "minLng", "maxLat", and "maxLng" query parameters, to show where
+// vehicles spend their time. The "cellSize" query parameter is the length of each cell's sides in
+// degrees. Grids with more than model.MaxHeatmapCells cells are refused.
+func (api *API) HeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	box, err := boundingBoxParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := timeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cellSize, err := strconv.ParseFloat(query.Get("cellSize"), 64)
+	if err != nil || math.IsNaN(cellSize) || math.IsInf(cellSize, 0) {
+		http.Error(w, "cellSize must be a number", http.StatusBadRequest)
+		return
+	}
+
+	heatmap, err := api.db.GetUpdateHeatmap(box, from, to, cellSize)
+	if err == database.ErrInvalidCellSize || err == database.ErrHeatmapTooLarge {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, heatmap)
+}
+
+// timeRangeParams parses the RFC 3339 times given by the "from" and "to" query parameters. to must
+// not be before from.
+func timeRangeParams(query url.Values) (from, to time.Time, err error) {
+	from, err = time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return from, to, errors.New("from must be an RFC 3339 time")
+	}
+	to, err = time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		return from, to, errors.New("to must be an RFC 3339 time")
+	}
+	if to.Before(from) {
+		return from, to, errors.New("to must not be before from")
+	}
+	return from, to, nil
+}
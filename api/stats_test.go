@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestStatsHandler(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	at := func(vehicleID string, minutes int, lat string) model.VehicleUpdate {
+		return model.VehicleUpdate{VehicleID: vehicleID, Lat: lat, Lng: "-73.680", Created: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	db := &mockDatabase{updates: []model.VehicleUpdate{
+		at("1", 0, "42.730"), at("1", 1, "42.731"),
+		at("2", 0, "42.730"), at("2", 2, "42.732"),
+		// Outside of the period.
+		at("3", 120, "42.730"), at("3", 121, "42.731"),
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats?from=2017-09-01T12:00:00Z&to=2017-09-01T13:00:00Z", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	stats := model.FleetStats{}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Unable to decode stats: %v", err)
+	}
+	if stats.Trips != 2 || stats.PeakVehicles != 2 {
+		t.Errorf("Got %+v, expected two trips at once.", stats)
+	}
+
+	for query, status := range map[string]int{
+		"from=2017-09-01T12:00:00Z&to=2017-09-01T12:00:00Z": http.StatusOK,
+		"from=2017-09-01T13:00:00Z&to=2017-09-01T12:00:00Z": http.StatusBadRequest,
+		"from=2017-09-01T12:00:00Z":                         http.StatusBadRequest,
+		"from=noon&to=2017-09-01T12:00:00Z":                 http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/stats?"+query, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, query, status)
+		}
+	}
+}
+
+func TestHeatmapHandler(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int, lat, lng string) model.VehicleUpdate {
+		return model.VehicleUpdate{VehicleID: "1", Lat: lat, Lng: lng, Created: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	db := &mockDatabase{updates: []model.VehicleUpdate{
+		at(0, "42.725", "-73.685"), at(1, "42.726", "-73.684"),
+		at(2, "42.735", "-73.675"),
+		// Outside of the box.
+		at(3, "42.750", "-73.685"),
+		// Outside of the period.
+		at(120, "42.735", "-73.675"),
+	}}
+	api := newTestAPI(db)
+
+	box := "minLat=42.72&minLng=-73.69&maxLat=42.74&maxLng=-73.67"
+	period := "from=2017-09-01T12:00:00Z&to=2017-09-01T13:00:00Z"
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/heatmap?"+box+"&"+period+"&cellSize=0.01", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	heatmap := model.Heatmap{}
+	if err := json.NewDecoder(w.Body).Decode(&heatmap); err != nil {
+		t.Fatalf("Unable to decode heatmap: %v", err)
+	}
+	expected := [][]int{{2, 0}, {0, 1}}
+	if !reflect.DeepEqual(heatmap.Counts, expected) || heatmap.Total != 3 {
+		t.Errorf("Got counts %v and total %d, expected %v and 3.", heatmap.Counts, heatmap.Total, expected)
+	}
+
+	for query, status := range map[string]int{
+		box + "&" + period + "&cellSize=0":                                                 http.StatusBadRequest,
+		box + "&" + period + "&cellSize=0.00001":                                           http.StatusBadRequest,
+		box + "&" + period + "&cellSize=NaN":                                               http.StatusBadRequest,
+		box + "&" + period + "&cellSize=Inf":                                               http.StatusBadRequest,
+		"minLat=NaN&minLng=-73.69&maxLat=42.74&maxLng=-73.67&" + period + "&cellSize=0.01": http.StatusBadRequest,
+		"minLat=42.72&minLng=-73.69&maxLat=Inf&maxLng=-73.67&" + period + "&cellSize=0.01": http.StatusBadRequest,
+		box + "&" + period:        http.StatusBadRequest,
+		box + "&cellSize=0.01":    http.StatusBadRequest,
+		period + "&cellSize=0.01": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/heatmap?"+query, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, query, status)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// ServerTime is the server's current time, for clients to correct for their own clock skew.
+type ServerTime struct {
+	Time        string `json:"time"`
+	EpochMillis int64  `json:"epochMillis"`
+	Timezone    string `json:"timezone"`
+}
+
+// TimeHandler returns the server's current time and the time zone it uses.
+func (api *API) TimeHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().In(api.loc)
+	WriteJSON(w, r, ServerTime{
+		Time:        now.Format(time.RFC3339Nano),
+		EpochMillis: now.UnixNano() / int64(time.Millisecond),
+		Timezone:    api.loc.String(),
+	})
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeHandler(t *testing.T) {
+	api, err := New(Config{Timezone: "America/New_York"}, &mockDatabase{}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create API: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/time", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+
+	var serverTime ServerTime
+	if err := json.NewDecoder(w.Body).Decode(&serverTime); err != nil {
+		t.Fatalf("Unable to decode time: %v", err)
+	}
+	parsed, err := time.Parse(time.RFC3339, serverTime.Time)
+	if err != nil {
+		t.Fatalf("Unable to parse time: %v", err)
+	}
+	if skew := time.Since(parsed); skew < 0 || skew > 5*time.Second {
+		t.Errorf("Got time %v, expected close to now.", parsed)
+	}
+	millis := time.Unix(0, serverTime.EpochMillis*int64(time.Millisecond))
+	if diff := parsed.Sub(millis); diff < -time.Millisecond || diff > time.Millisecond {
+		t.Errorf("Got epoch millis %v, expected it to match %v.", millis, parsed)
+	}
+	if serverTime.Timezone != "America/New_York" {
+		t.Errorf("Got time zone %s, expected America/New_York.", serverTime.Timezone)
+	}
+}
@@ -2,44 +2,101 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
-	"gopkg.in/cas.v1"
-
+	"github.com/wtg/shuttletracker/database"
 	"github.com/wtg/shuttletracker/log"
 	"github.com/wtg/shuttletracker/model"
 
 	"github.com/gorilla/mux"
+	mgo "gopkg.in/mgo.v2"
 )
 
 var (
 	lastUpdate time.Time
 )
 
-// VehiclesHandler finds all the vehicles in the database.
+// VehiclesHandler finds all the vehicles in the database. If the "search" query parameter is
+// given, only vehicles whose names contain it, ignoring case, are found, ordered by name.
+// Vehicles may also be sorted with "sort" (name, created, or enabled) and "order" (asc or desc)
+// and paged with "limit" and "offset"; the X-Total-Count header then holds the number of
+// vehicles across all pages.
 func (api *API) VehiclesHandler(w http.ResponseWriter, r *http.Request) {
-	// Find all vehicles in database
-	vehicles, err := api.db.GetVehicles()
+	params := r.URL.Query()
+	paged := false
+	for _, param := range []string{"search", "sort", "order", "limit", "offset"} {
+		if params.Get(param) != "" {
+			paged = true
+		}
+	}
+	if !paged {
+		// Find all vehicles in database
+		vehicles, err := api.db.GetVehicles()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		WriteJSONWithETag(w, r, vehicles)
+		return
+	}
 
-	// Handle query errors
+	query, err := vehicleQuery(params)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vehicles, total, err := api.db.QueryVehicles(query)
+	if err == database.ErrInvalidSort {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Send each vehicle to client as JSON
-	WriteJSON(w, vehicles)
+	// Pagination UIs need to know how many vehicles there are beyond this page.
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	WriteJSONWithETag(w, r, vehicles)
 }
 
-// VehiclesCreateHandler adds a new vehicle to the database.
-func (api *API) VehiclesCreateHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
+// vehicleQuery creates a VehicleQuery from the search, sort, order, limit, and offset parameters.
+func vehicleQuery(params url.Values) (database.VehicleQuery, error) {
+	query := database.VehicleQuery{
+		NameLike: params.Get("search"),
+		Sort:     params.Get("sort"),
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New("order must be asc or desc")
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return query, errors.New("limit must be a positive integer")
+		}
+		query.Limit = n
 	}
+	if offset := params.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return query, errors.New("offset must be a non-negative integer")
+		}
+		query.Offset = n
+	}
+	return query, nil
+}
 
+// VehiclesCreateHandler adds a new vehicle to the database.
+func (api *API) VehiclesCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// Create new vehicle object using request fields
 	vehicle := model.Vehicle{}
 	vehicle.Created = time.Now()
@@ -51,35 +108,55 @@ func (api *API) VehiclesCreateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if vehicle.Color != "" && !model.ValidColor(vehicle.Color) {
+		http.Error(w, "color must be a hex color like #1a2b3c", http.StatusBadRequest)
+		return
+	}
 	// Store new vehicle under vehicles collection
 	err = api.db.CreateVehicle(&vehicle)
 	// Error handling
-	if err != nil {
+	if err == database.ErrVehicleIDTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func (api *API) VehiclesEditHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
+// VehicleEditRequest is a vehicle's new settings. RetentionDays and Color are left as they were if
+// they're omitted.
+type VehicleEditRequest struct {
+	model.Vehicle
+	RetentionDays *int    `json:"retentionDays"`
+	Color         *string `json:"color"`
+}
 
-	vehicle := model.Vehicle{}
-	err := json.NewDecoder(r.Body).Decode(&vehicle)
+// VehiclesEditHandler changes a vehicle's settings given by a VehicleEditRequest.
+func (api *API) VehiclesEditHandler(w http.ResponseWriter, r *http.Request) {
+	req := VehicleEditRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	name := vehicle.VehicleName
-	enabled := vehicle.Enabled
+	if req.Color != nil && *req.Color != "" && !model.ValidColor(*req.Color) {
+		http.Error(w, "color must be a hex color like #1a2b3c", http.StatusBadRequest)
+		return
+	}
 
-	vehicle, err = api.db.GetVehicle(vehicle.VehicleID)
+	vehicle, err := api.db.GetVehicle(req.VehicleID, req.Feed)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	vehicle.VehicleName = name
-	vehicle.Enabled = enabled
+	vehicle.VehicleName = req.VehicleName
+	vehicle.Enabled = req.Enabled
+	if req.RetentionDays != nil {
+		vehicle.RetentionDays = *req.RetentionDays
+	}
+	if req.Color != nil {
+		vehicle.Color = *req.Color
+	}
 	vehicle.Updated = time.Now()
 
 	err = api.db.ModifyVehicle(&vehicle)
@@ -90,19 +167,103 @@ func (api *API) VehiclesEditHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) VehiclesDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if api.cfg.Authenticate && !cas.IsAuthenticated(r) {
-		return
-	}
 	// Delete vehicle from Vehicles collection
 	vars := mux.Vars(r)
 	log.Debugf("deleting", vars["id"])
-	err := api.db.DeleteVehicle(vars["id"])
+	err := api.db.DeleteVehicle(vars["id"], r.URL.Query().Get("feed"))
 	// Error handling
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// VehiclesSilentHandler finds the vehicles that have never reported, which usually means that their
+// iTrak IDs are wrong or their trackers aren't installed.
+func (api *API) VehiclesSilentHandler(w http.ResponseWriter, r *http.Request) {
+	vehicles, err := api.db.GetVehiclesWithoutUpdates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, vehicles)
+}
+
+// DeleteSummary reports how many records a request deleted.
+type DeleteSummary struct {
+	Deleted int `json:"deleted"`
+}
+
+// VehiclesUpdatesDeleteHandler deletes every update for a vehicle, leaving the vehicle itself and
+// other vehicles' updates alone. Since this can't be undone, the request must have ?confirm=true.
+// It responds with the number of updates deleted.
+func (api *API) VehiclesUpdatesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if confirm, _ := strconv.ParseBool(r.URL.Query().Get("confirm")); !confirm {
+		http.Error(w, "confirm=true is required to delete a vehicle's updates", http.StatusBadRequest)
+		return
+	}
+	vehicle, err := api.requestVehicle(r)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	deleted, err := api.db.DeleteUpdatesForVehicle(vehicle.VehicleID, vehicle.Feed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Deleted %d updates for vehicle %s.", deleted, vehicle.VehicleID)
+	WriteJSON(w, r, DeleteSummary{Deleted: deleted})
+}
+
+// MergeRequest asks for one vehicle's updates to be moved to another, such as when two vehicle
+// records were created for one shuttle.
+type MergeRequest struct {
+	// Keep is the ID of the vehicle that remains.
+	Keep string `json:"keep"`
+	// KeepFeed is the data feed of the vehicle that remains.
+	KeepFeed string `json:"keepFeed"`
+	// Merge is the ID of the vehicle that is deleted once its updates are moved.
+	Merge string `json:"merge"`
+	// MergeFeed is the data feed of the vehicle that is deleted.
+	MergeFeed string `json:"mergeFeed"`
+}
+
+// VehiclesMergeHandler merges two vehicles given by a MergeRequest.
+func (api *API) VehiclesMergeHandler(w http.ResponseWriter, r *http.Request) {
+	req := MergeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Keep == "" || req.Merge == "" {
+		http.Error(w, "keep and merge are required", http.StatusBadRequest)
+		return
+	}
+	keep := model.VehicleKey{VehicleID: req.Keep, Feed: req.KeepFeed}
+	merge := model.VehicleKey{VehicleID: req.Merge, Feed: req.MergeFeed}
+	if keep == merge {
+		http.Error(w, "can't merge a vehicle with itself", http.StatusBadRequest)
+		return
+	}
+
+	err := api.db.MergeVehicles(keep, merge)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == database.ErrVehicleMerging {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Merged vehicle %s into %s.", req.Merge, req.Keep)
+}
+
 // Here's my view, keep every name the same meaning, otherwise, choose another.
 // UpdatesHandler get the most recent update for each vehicle in the vehicles collection.
 func (api *API) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
@@ -116,8 +277,8 @@ func (api *API) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
 	// slice of capacity len(vehicles) and size zero
 	updates := make([]model.VehicleUpdate, 0, len(vehicles))
 	for _, vehicle := range vehicles {
-		since := time.Now().Add(time.Minute * -5)
-		vehicleUpdates, err := api.db.GetUpdatesForVehicleSince(vehicle.VehicleID, since)
+		since := time.Now().Add(-api.offlineAfter)
+		vehicleUpdates, err := api.db.GetUpdatesForVehicleSince(vehicle.VehicleID, vehicle.Feed, since)
 		if err != nil {
 			log.WithError(err).Error("Unable to get last vehicle update.")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -127,11 +288,342 @@ func (api *API) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
 		// if there is an update since the time, append it to all updates
 		if len(vehicleUpdates) > 0 {
 			updates = append(updates, vehicleUpdates[0])
+		} else if vehicle.LastHeartbeat.After(since) {
+			// The vehicle is parked, so its last update is still its position.
+			update, err := api.db.GetLastUpdateForVehicle(vehicle.VehicleID, vehicle.Feed)
+			if err == nil {
+				updates = append(updates, update)
+			} else if err != mgo.ErrNotFound {
+				log.WithError(err).Error("Unable to get last vehicle update.")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if api.cfg.SnapToRoute {
+		if err := api.snapUpdates(updates); err != nil {
+			log.WithError(err).Error("Unable to snap updates to routes.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
 	// Convert updates to JSON
-	WriteJSON(w, updates) // it's good to take some REST in our server :)
+	WriteJSONWithETag(w, r, updates) // it's good to take some REST in our server :)
+}
+
+// requestVehicle finds the vehicle given by the "id" route variable in the data feed given by the
+// "feed" query parameter. Vehicle IDs are only unique within a feed, and vehicles without a feed are
+// found when "feed" is omitted.
+func (api *API) requestVehicle(r *http.Request) (model.Vehicle, error) {
+	return api.db.GetVehicle(mux.Vars(r)["id"], r.URL.Query().Get("feed"))
+}
+
+// CurrentRoute is the route a vehicle is currently on.
+type CurrentRoute struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// CurrentVehicle is a vehicle's latest update and the route it's on.
+type CurrentVehicle struct {
+	Update model.VehicleUpdate `json:"update"`
+	// Route is null if the vehicle is off-route.
+	Route *CurrentRoute `json:"route"`
+	// InServiceSince is when the vehicle's earliest stored update was created.
+	InServiceSince *time.Time `json:"inServiceSince"`
+}
+
+const (
+	// defaultTrailWindow is how far back a vehicle's trail goes by default.
+	defaultTrailWindow = 15 * time.Minute
+	// maxTrailWindow is the furthest back a vehicle's trail may go.
+	maxTrailWindow = 24 * time.Hour
+)
+
+// Trail is the path a vehicle has recently taken, oldest point first.
+type Trail struct {
+	VehicleID string        `json:"vehicleID"`
+	Points    []model.Coord `json:"points"`
+}
+
+// VehiclesTrailHandler returns the path a vehicle has taken over the duration given by the
+// "window" query parameter, which defaults to 15 minutes and may be at most a day. If the "tolerance" query parameter is
+// given, the path is simplified so that no recorded position is further than that many meters
+// from it, which greatly reduces the number of points.
+func (api *API) VehiclesTrailHandler(w http.ResponseWriter, r *http.Request) {
+	window := defaultTrailWindow
+	if param := r.URL.Query().Get("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		if window > maxTrailWindow {
+			http.Error(w, fmt.Sprintf("window must be at most %s", maxTrailWindow), http.StatusBadRequest)
+			return
+		}
+	}
+	tolerance := 0.0
+	if param := r.URL.Query().Get("tolerance"); param != "" {
+		var err error
+		tolerance, err = strconv.ParseFloat(param, 64)
+		if err != nil || tolerance < 0 {
+			http.Error(w, "tolerance must be a non-negative number of meters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	vehicle, err := api.requestVehicle(r)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updates, err := api.db.GetUpdatesForVehicleSinceAscending(vehicle.VehicleID, vehicle.Feed, time.Now().Add(-window))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	points := make([]model.Coord, 0, len(updates))
+	for _, update := range updates {
+		if coord, err := update.Coord(); err == nil {
+			points = append(points, coord)
+		}
+	}
+	if tolerance > 0 {
+		points = model.Simplify(points, tolerance)
+	}
+	WriteJSON(w, r, Trail{VehicleID: vehicle.VehicleID, Points: points})
+}
+
+// defaultGapsWindow and defaultMinGap are how far back and how long a gap VehiclesGapsHandler looks
+// for by default.
+const (
+	defaultGapsWindow = 24 * time.Hour
+	defaultMinGap     = 5 * time.Minute
+)
+
+// VehiclesGapsHandler lists the periods during which a vehicle sent no updates, for diagnosing GPS
+// dropouts. The "window" query parameter sets how far back to look and defaults to a day, and gaps
+// must be longer than the "min" query parameter, which defaults to five minutes.
+func (api *API) VehiclesGapsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window := defaultGapsWindow
+	if param := query.Get("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	minGap := defaultMinGap
+	if param := query.Get("min"); param != "" {
+		var err error
+		minGap, err = time.ParseDuration(param)
+		if err != nil || minGap <= 0 {
+			http.Error(w, "min must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	vehicle, err := api.requestVehicle(r)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gaps, err := api.db.GetTrackGapsForVehicle(vehicle.VehicleID, vehicle.Feed, time.Now().Add(-window), minGap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, gaps)
+}
+
+// VehiclesCurrentHandler returns a vehicle's latest update along with the route it's currently on
+// and when it was first tracked. It responds with no content if the vehicle has never reported.
+func (api *API) VehiclesCurrentHandler(w http.ResponseWriter, r *http.Request) {
+	vehicle, err := api.requestVehicle(r)
+	if err == mgo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	update, err := api.db.GetLastUpdateForVehicle(vehicle.VehicleID, vehicle.Feed)
+	if err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	current := CurrentVehicle{Update: update}
+	first, err := api.db.GetFirstUpdateForVehicle(vehicle.VehicleID, vehicle.Feed)
+	if err == nil {
+		current.InServiceSince = &first.Created
+	} else if err != database.ErrUpdateNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if update.Route != "" {
+		route, err := api.db.GetRoute(update.Route)
+		if err == nil {
+			current.Route = &CurrentRoute{ID: route.ID, Name: route.Name, Color: route.Color}
+		} else if err != mgo.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	WriteJSON(w, r, current)
+}
+
+// Limits on how many updates are exported per page.
+const (
+	defaultExportLimit = 1000
+	maxExportLimit     = 10000
+)
+
+// UpdatesPage is one page of exported updates.
+type UpdatesPage struct {
+	Updates []model.VehicleUpdate `json:"updates"`
+	// NextCursor leads to the next page. It is null on the last page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// UpdatesExportHandler pages through all stored updates, oldest first. Pass the previous page's
+// next_cursor as the "cursor" query parameter to get the next page. The optional "vehicleID" query
+// parameter limits the export to one vehicle, in the data feed given by "feed", and "limit" sets
+// the page size.
+func (api *API) UpdatesExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultExportLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxExportLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxExportLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	updates, next, err := api.db.GetUpdatesPage(query.Get("vehicleID"), query.Get("feed"), query.Get("cursor"), limit)
+	if err == database.ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := UpdatesPage{Updates: updates}
+	if next != "" {
+		page.NextCursor = &next
+	}
+	WriteJSON(w, r, page)
+}
+
+// maxAreaWindow is the furthest back UpdatesAreaHandler may look, since every update in the window
+// is read to find those in the box.
+const maxAreaWindow = 24 * time.Hour
+
+// UpdatesAreaHandler finds every vehicle's updates within the box given by the "minLat", "minLng",
+// "maxLat", and "maxLng" query parameters, oldest first, to see how vehicles move through a
+// particular spot. The "since" query parameter, an RFC 3339 time, sets how far back to look. It
+// defaults to an hour ago and may be at most a day ago. A box whose minimums exceed its maximums
+// contains nothing.
+func (api *API) UpdatesAreaHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	box, err := boundingBoxParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	since := now.Add(-time.Hour)
+	if param := query.Get("since"); param != "" {
+		since, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if since.Before(now.Add(-maxAreaWindow)) {
+		http.Error(w, fmt.Sprintf("since must be within the last %s", maxAreaWindow), http.StatusBadRequest)
+		return
+	}
+
+	updates, err := api.db.GetUpdatesInBoundingBox(box, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, r, updates)
+}
+
+// boundingBoxParams parses a box from the "minLat", "minLng", "maxLat", and "maxLng" query
+// parameters.
+func boundingBoxParams(query url.Values) (model.BoundingBox, error) {
+	box := model.BoundingBox{}
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{
+		{"minLat", &box.MinLat},
+		{"minLng", &box.MinLng},
+		{"maxLat", &box.MaxLat},
+		{"maxLng", &box.MaxLng},
+	} {
+		var err error
+		*param.value, err = strconv.ParseFloat(query.Get(param.name), 64)
+		if err != nil || math.IsNaN(*param.value) || math.IsInf(*param.value, 0) {
+			return box, errors.New(param.name + " must be a number")
+		}
+	}
+	return box, nil
+}
+
+// snapUpdates sets the snapped position of each update that is on a route to the nearest point on
+// that route. The update's own position is left untouched.
+func (api *API) snapUpdates(updates []model.VehicleUpdate) error {
+	routes, err := api.db.GetRoutes()
+	if err != nil {
+		return err
+	}
+	routesByID := make(map[string]model.Route, len(routes))
+	for _, route := range routes {
+		routesByID[route.ID] = route
+	}
+
+	for i := range updates {
+		route, ok := routesByID[updates[i].Route]
+		if !ok {
+			continue
+		}
+		coord, err := updates[i].Coord()
+		if err != nil {
+			log.WithError(err).Warnf("Unable to parse position of vehicle %s.", updates[i].VehicleID)
+			continue
+		}
+		if projection, ok := route.Project(coord); ok {
+			updates[i].Snapped = &projection.Coord
+		}
+	}
+	return nil
 }
 
 // UpdateMessageHandler generates a message about an update for a vehicle
@@ -149,7 +641,7 @@ func (api *API) UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
 	// Find recent updates and generate message
 	for _, vehicle := range vehicles {
 		// find 10 most recent records
-		update, err := api.db.GetLastUpdateForVehicle(vehicle.VehicleID)
+		update, err := api.db.GetLastUpdateForVehicle(vehicle.VehicleID, vehicle.Feed)
 		if err == nil {
 			// Use first 4 char substring of update.Speed
 			speed := update.Speed
@@ -158,19 +650,14 @@ func (api *API) UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Convert last updated time to local timezone
-			loc, err := time.LoadLocation("America/New_York")
-			if err != nil {
-				log.WithError(err).Error("Could not load time zone information.")
-				continue
-			}
-			lastUpdate := update.Created.In(loc).Format("3:04:05pm")
+			lastUpdate := update.Created.In(api.loc).Format("3:04:05pm")
 
 			message = fmt.Sprintf("<b>%s</b><br/>Traveling %s at<br/> %s mph as of %s", vehicle.VehicleName, CardinalDirection(&update.Heading), speed, lastUpdate)
 			messages = append(messages, message)
 		}
 	}
 	// Convert to JSON
-	WriteJSON(w, messages)
+	WriteJSON(w, r, messages)
 }
 
 // CardinalDirection returns the cardinal direction of a vehicle's heading.
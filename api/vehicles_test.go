@@ -1,6 +1,17 @@
 package api
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
 
 func TestCardinalDirection(t *testing.T) {
 	table := [][]string{
@@ -23,3 +34,580 @@ func TestCardinalDirection(t *testing.T) {
 		}
 	}
 }
+
+func TestSnapUpdates(t *testing.T) {
+	route := model.Route{ID: "route", Coords: []model.Coord{{Lat: 42.730, Lng: -73.680}, {Lat: 42.732, Lng: -73.680}}}
+	api := newTestAPI(&mockDatabase{routes: []model.Route{route}})
+
+	updates := []model.VehicleUpdate{
+		{VehicleID: "1", Lat: "42.731", Lng: "-73.6801", Route: "route"},
+		{VehicleID: "2", Lat: "42.731", Lng: "-73.6801"},
+	}
+	if err := api.snapUpdates(updates); err != nil {
+		t.Fatalf("Unable to snap updates: %v", err)
+	}
+
+	if updates[0].Snapped == nil {
+		t.Fatal("Expected on-route update to be snapped.")
+	}
+	if model.DistanceMeters(*updates[0].Snapped, model.Coord{Lat: 42.731, Lng: -73.680}) > 0.5 {
+		t.Errorf("Got snapped position %+v, expected it on the route.", *updates[0].Snapped)
+	}
+	if updates[0].Lat != "42.731" || updates[0].Lng != "-73.6801" {
+		t.Errorf("Raw position was modified to %s, %s.", updates[0].Lat, updates[0].Lng)
+	}
+	if updates[1].Snapped != nil {
+		t.Errorf("Got snapped position %+v for off-route update, expected none.", *updates[1].Snapped)
+	}
+}
+
+func TestVehiclesHandlerETag(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", VehicleName: "Shuttle"}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Got status %d and ETag %q, expected %d with an ETag.", w.Code, etag, http.StatusOK)
+	}
+
+	req := httptest.NewRequest("GET", "/vehicles", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Got status %d for repeat request, expected %d.", w.Code, http.StatusNotModified)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Got body %q, expected none.", w.Body.String())
+	}
+
+	db.vehicles[0].VehicleName = "Renamed"
+	req = httptest.NewRequest("GET", "/vehicles", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d after change, expected %d.", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change.")
+	}
+}
+
+func TestVehiclesCurrentHandler(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}, {VehicleID: "3"}},
+		routes:   []model.Route{{ID: "west", Name: "West", Color: "#0000ff"}},
+		updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.73", Lng: "-73.68", Route: "west", Created: start.Add(2 * time.Hour)},
+			{VehicleID: "1", Lat: "42.72", Lng: "-73.68", Created: start},
+			{VehicleID: "1", Lat: "42.72", Lng: "-73.68", Created: start.Add(time.Hour)},
+			{VehicleID: "2", Lat: "42.74", Lng: "-73.69", Created: start.Add(time.Hour)},
+		},
+	}
+	api := newTestAPI(db)
+
+	for _, testCase := range []struct {
+		vehicleID      string
+		route          *CurrentRoute
+		inServiceSince time.Time
+	}{
+		{"1", &CurrentRoute{ID: "west", Name: "West", Color: "#0000ff"}, start},
+		{"2", nil, start.Add(time.Hour)},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/"+testCase.vehicleID+"/current", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for vehicle %s, expected %d.", w.Code, testCase.vehicleID, http.StatusOK)
+		}
+		current := CurrentVehicle{}
+		if err := json.NewDecoder(w.Body).Decode(&current); err != nil {
+			t.Fatalf("Unable to decode response: %v", err)
+		}
+		if current.Update.VehicleID != testCase.vehicleID {
+			t.Errorf("Got update for vehicle %s, expected %s.", current.Update.VehicleID, testCase.vehicleID)
+		}
+		if !reflect.DeepEqual(current.Route, testCase.route) {
+			t.Errorf("Got route %+v for vehicle %s, expected %+v.", current.Route, testCase.vehicleID, testCase.route)
+		}
+		if current.InServiceSince == nil || !current.InServiceSince.Equal(testCase.inServiceSince) {
+			t.Errorf("Got in service since %v for vehicle %s, expected %v.", current.InServiceSince, testCase.vehicleID, testCase.inServiceSince)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/3/current", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Got status %d for vehicle without updates, expected %d.", w.Code, http.StatusNoContent)
+	}
+
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/4/current", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for unknown vehicle, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestUpdatesExportHandler(t *testing.T) {
+	db := &mockDatabase{}
+	for i := 0; i < 5; i++ {
+		db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Time: strconv.Itoa(i)})
+	}
+	api := newTestAPI(db)
+
+	times := []string{}
+	path := "/updates/export?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("Too many pages.")
+		}
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+		}
+		page := UpdatesPage{}
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatalf("Unable to decode page: %v", err)
+		}
+		for _, update := range page.Updates {
+			times = append(times, update.Time)
+		}
+		path = ""
+		if page.NextCursor != nil {
+			path = "/updates/export?limit=2&cursor=" + *page.NextCursor
+		}
+	}
+	if expected := []string{"0", "1", "2", "3", "4"}; !reflect.DeepEqual(times, expected) {
+		t.Errorf("Got updates %v, expected %v.", times, expected)
+	}
+
+	for _, path := range []string{"/updates/export?limit=0", "/updates/export?cursor=bogus"} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestVehiclesHandlerSearch(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{
+		{VehicleID: "1", VehicleName: "West Shuttle 2"},
+		{VehicleID: "2", VehicleName: "East Bus"},
+		{VehicleID: "3", VehicleName: "west shuttle 1"},
+		{VehicleID: "4", VehicleName: "Night Van"},
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles?search=SHUTTLE", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	vehicles := []model.Vehicle{}
+	if err := json.NewDecoder(w.Body).Decode(&vehicles); err != nil {
+		t.Fatalf("Unable to decode vehicles: %v", err)
+	}
+	ids := []string{}
+	for _, vehicle := range vehicles {
+		ids = append(ids, vehicle.VehicleID)
+	}
+	if expected := []string{"1", "3"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Got vehicles %v, expected %v.", ids, expected)
+	}
+}
+
+func TestVehiclesHandlerSortAndPage(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{
+		{VehicleID: "1", VehicleName: "Charlie"},
+		{VehicleID: "2", VehicleName: "Alpha"},
+		{VehicleID: "3", VehicleName: "Delta"},
+		{VehicleID: "4", VehicleName: "Bravo"},
+	}}
+	api := newTestAPI(db)
+
+	for query, expected := range map[string][]string{
+		"sort=name":                   {"2", "4", "1", "3"},
+		"sort=name&order=desc":        {"3", "1", "4", "2"},
+		"sort=name&limit=2":           {"2", "4"},
+		"sort=name&limit=2&offset=2":  {"1", "3"},
+		"order=desc&limit=1&offset=1": {"1"},
+		"sort=name&offset=10":         {},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %q, expected %d.", w.Code, query, http.StatusOK)
+		}
+		if total := w.Header().Get("X-Total-Count"); total != "4" {
+			t.Errorf("Got X-Total-Count %q for %q, expected 4.", total, query)
+		}
+		vehicles := []model.Vehicle{}
+		if err := json.NewDecoder(w.Body).Decode(&vehicles); err != nil {
+			t.Fatalf("Unable to decode vehicles: %v", err)
+		}
+		ids := []string{}
+		for _, vehicle := range vehicles {
+			ids = append(ids, vehicle.VehicleID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Got vehicles %v for %q, expected %v.", ids, query, expected)
+		}
+	}
+
+	for _, query := range []string{"sort=vehicleID", "order=up", "limit=0", "limit=x", "offset=-1"} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %q, expected %d.", w.Code, query, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestVehiclesTrailHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}}}
+	// Heading east in a nearly straight line, then north.
+	for i, coord := range [][2]string{
+		{"42.73000", "-73.680"},
+		{"42.73001", "-73.679"},
+		{"42.73000", "-73.678"},
+		{"42.73100", "-73.678"},
+	} {
+		db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: coord[0], Lng: coord[1], Created: now.Add(time.Duration(i-4) * time.Minute)})
+	}
+	// Too old to be part of the trail.
+	db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.70", Lng: "-73.70", Created: now.Add(-time.Hour)})
+	api := newTestAPI(db)
+
+	for path, expected := range map[string]int{
+		"/vehicles/1/trail":              4,
+		"/vehicles/1/trail?tolerance=10": 3,
+		"/vehicles/1/trail?window=2m30s": 2,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, path, http.StatusOK)
+		}
+		trail := Trail{}
+		if err := json.NewDecoder(w.Body).Decode(&trail); err != nil {
+			t.Fatalf("Unable to decode trail: %v", err)
+		}
+		if len(trail.Points) != expected {
+			t.Errorf("Got %d points for %s, expected %d.", len(trail.Points), path, expected)
+		}
+		if len(trail.Points) > 0 && trail.Points[len(trail.Points)-1] != (model.Coord{Lat: 42.731, Lng: -73.678}) {
+			t.Errorf("Got %v for %s, expected the trail to end at the latest position.", trail.Points, path)
+		}
+	}
+
+	for path, expected := range map[string]int{
+		"/vehicles/2/trail":              http.StatusNotFound,
+		"/vehicles/1/trail?tolerance=-1": http.StatusBadRequest,
+		"/vehicles/1/trail?window=soon":  http.StatusBadRequest,
+		"/vehicles/1/trail?window=8760h": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, expected)
+		}
+	}
+}
+
+func TestVehiclesColor(t *testing.T) {
+	db := &mockDatabase{}
+	api := newTestAPI(db)
+
+	for _, testCase := range []struct {
+		path     string
+		body     string
+		expected int
+	}{
+		{"/vehicles/create", `{"vehicleID": "1", "vehicleName": "Bus", "color": "#1a2b3c"}`, http.StatusOK},
+		{"/vehicles/create", `{"vehicleID": "2", "vehicleName": "Van", "color": "purple"}`, http.StatusBadRequest},
+		{"/vehicles/edit", `{"vehicleID": "1", "vehicleName": "Bus", "color": "#abc"}`, http.StatusOK},
+		{"/vehicles/edit", `{"vehicleID": "1", "vehicleName": "Bus", "color": "#abcd"}`, http.StatusBadRequest},
+		// Leaving out the color keeps it.
+		{"/vehicles/edit", `{"vehicleID": "1", "vehicleName": "Bus 1"}`, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", testCase.path, strings.NewReader(testCase.body)))
+		if w.Code != testCase.expected {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, testCase.body, testCase.expected)
+		}
+	}
+
+	if len(db.vehicles) != 1 || db.vehicles[0].Color != "#abc" {
+		t.Errorf("Got vehicles %+v, expected one with color #abc.", db.vehicles)
+	}
+
+	// An empty color goes back to the route's color.
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/edit", strings.NewReader(`{"vehicleID": "1", "color": ""}`)))
+	if w.Code != http.StatusOK || db.vehicles[0].Color != "" {
+		t.Errorf("Got status %d and color %q, expected the color to be cleared.", w.Code, db.vehicles[0].Color)
+	}
+}
+
+func TestVehiclesCreateHandlerDuplicateID(t *testing.T) {
+	db := &mockDatabase{}
+	api := newTestAPI(db)
+
+	for _, testCase := range []struct {
+		body     string
+		expected int
+	}{
+		{`{"vehicleID": "1", "vehicleName": "Bus"}`, http.StatusOK},
+		{`{"vehicleID": "1", "vehicleName": "Bus again"}`, http.StatusConflict},
+		// The same ID is fine in another feed.
+		{`{"vehicleID": "1", "vehicleName": "Other bus", "feed": "other"}`, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/create", strings.NewReader(testCase.body)))
+		if w.Code != testCase.expected {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, testCase.body, testCase.expected)
+		}
+	}
+	if len(db.vehicles) != 2 {
+		t.Errorf("Got %d vehicles, expected 2.", len(db.vehicles))
+	}
+}
+
+func TestVehiclesSilentHandler(t *testing.T) {
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}},
+		updates:  []model.VehicleUpdate{{VehicleID: "1"}},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/vehicles/silent", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var vehicles []model.Vehicle
+	if err := json.NewDecoder(w.Body).Decode(&vehicles); err != nil {
+		t.Fatalf("Unable to decode vehicles: %v", err)
+	}
+	if len(vehicles) != 1 || vehicles[0].VehicleID != "2" {
+		t.Errorf("Got %+v, expected only vehicle 2.", vehicles)
+	}
+}
+
+func TestVehiclesUpdatesDeleteHandler(t *testing.T) {
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}},
+		updates:  []model.VehicleUpdate{{VehicleID: "1"}, {VehicleID: "2"}, {VehicleID: "1"}},
+	}
+	api := newTestAPI(db)
+
+	for path, status := range map[string]int{
+		"/vehicles/1/updates":               http.StatusBadRequest,
+		"/vehicles/1/updates?confirm=false": http.StatusBadRequest,
+		"/vehicles/3/updates?confirm=true":  http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("DELETE", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+	if len(db.updates) != 3 {
+		t.Fatalf("Got %d updates, expected none to be deleted yet.", len(db.updates))
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/vehicles/1/updates?confirm=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	summary := DeleteSummary{}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatalf("Unable to decode summary: %v", err)
+	}
+	if summary.Deleted != 2 {
+		t.Errorf("Got %d deleted, expected 2.", summary.Deleted)
+	}
+	if len(db.updates) != 1 || db.updates[0].VehicleID != "2" {
+		t.Errorf("Got updates %v, expected only vehicle 2's.", db.updates)
+	}
+}
+
+func TestVehiclesMergeHandler(t *testing.T) {
+	db := &mockDatabase{
+		vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}},
+		updates:  []model.VehicleUpdate{{VehicleID: "1"}, {VehicleID: "2"}, {VehicleID: "2"}},
+	}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/merge", strings.NewReader(`{"keep": "1", "merge": "2"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	if len(db.vehicles) != 1 || db.vehicles[0].VehicleID != "1" {
+		t.Errorf("Got vehicles %v, expected only vehicle 1.", db.vehicles)
+	}
+	for _, update := range db.updates {
+		if update.VehicleID != "1" {
+			t.Errorf("Got update for vehicle %s, expected all updates for vehicle 1.", update.VehicleID)
+		}
+	}
+
+	for body, status := range map[string]int{
+		`{"keep": "1", "merge": "2"}`: http.StatusNotFound,
+		`{"keep": "1", "merge": "1"}`: http.StatusBadRequest,
+		`{"keep": "1"}`:               http.StatusBadRequest,
+		`not json`:                    http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/merge", strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, body, status)
+		}
+	}
+}
+
+func TestVehiclesTrailHandlerFeeds(t *testing.T) {
+	now := time.Now()
+	// Vehicle 1 from feed b shares its ID with the vehicle without a feed.
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "1", Feed: "b"}}}
+	for i, feed := range []string{"", "b", "b"} {
+		db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Feed: feed, Lat: "42.73", Lng: "-73.68", Created: now.Add(time.Duration(i-4) * time.Minute)})
+	}
+	api := newTestAPI(db)
+
+	for path, expected := range map[string]int{
+		"/vehicles/1/trail":        1,
+		"/vehicles/1/trail?feed=b": 2,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for %s, expected %d.", w.Code, path, http.StatusOK)
+		}
+		trail := Trail{}
+		if err := json.NewDecoder(w.Body).Decode(&trail); err != nil {
+			t.Fatalf("Unable to decode trail: %v", err)
+		}
+		if len(trail.Points) != expected {
+			t.Errorf("Got %d points for %s, expected %d.", len(trail.Points), path, expected)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/1/trail?feed=c", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for an unknown feed, expected %d.", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestVehiclesMergeHandlerUnfinishedMerge(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2", MergingInto: &model.VehicleKey{VehicleID: "3"}}, {VehicleID: "3"}}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("POST", "/vehicles/merge", strings.NewReader(`{"keep": "1", "merge": "2"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Got status %d, expected %d.", w.Code, http.StatusConflict)
+	}
+}
+
+func TestVehiclesGapsHandler(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	gaps := []model.TrackGap{{Start: start, End: start.Add(10 * time.Minute), Duration: 600}}
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}}, trackGaps: gaps}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/1/gaps?min=2m", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var got []model.TrackGap
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("Unable to decode gaps: %v", err)
+	}
+	if len(got) != 1 || got[0].Duration != 600 {
+		t.Errorf("Got %+v, expected %+v.", got, gaps)
+	}
+	if db.trackGapsMin != 2*time.Minute {
+		t.Errorf("Got minimum gap %v, expected 2m.", db.trackGapsMin)
+	}
+
+	// A vehicle without updates has no gaps.
+	db.trackGaps = []model.TrackGap{}
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/vehicles/2/gaps", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("Got %s, expected [].", body)
+	}
+	if db.trackGapsMin != defaultMinGap {
+		t.Errorf("Got minimum gap %v, expected %v.", db.trackGapsMin, defaultMinGap)
+	}
+
+	for path, status := range map[string]int{
+		"/vehicles/3/gaps":          http.StatusNotFound,
+		"/vehicles/1/gaps?min=-1s":  http.StatusBadRequest,
+		"/vehicles/1/gaps?window=x": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, path, status)
+		}
+	}
+}
+
+func TestUpdatesAreaHandler(t *testing.T) {
+	now := time.Now()
+	db := &mockDatabase{updates: []model.VehicleUpdate{
+		{VehicleID: "1", Lat: "42.7300", Lng: "-73.6800", Created: now.Add(-30 * time.Minute)},
+		{VehicleID: "2", Lat: "42.7305", Lng: "-73.6795", Created: now.Add(-10 * time.Minute)},
+		// Outside the box.
+		{VehicleID: "1", Lat: "42.7400", Lng: "-73.6800", Created: now.Add(-5 * time.Minute)},
+		// Too long ago.
+		{VehicleID: "3", Lat: "42.7300", Lng: "-73.6800", Created: now.Add(-2 * time.Hour)},
+	}}
+	api := newTestAPI(db)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/updates/area?minLat=42.729&minLng=-73.681&maxLat=42.731&maxLng=-73.679", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d.", w.Code, http.StatusOK)
+	}
+	var updates []model.VehicleUpdate
+	if err := json.NewDecoder(w.Body).Decode(&updates); err != nil {
+		t.Fatalf("Unable to decode updates: %v", err)
+	}
+	if len(updates) != 2 || updates[0].VehicleID != "1" || updates[1].VehicleID != "2" {
+		t.Errorf("Got %+v, expected the updates from vehicles 1 and 2 inside the box.", updates)
+	}
+
+	// An inverted box contains nothing.
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/updates/area?minLat=42.731&minLng=-73.681&maxLat=42.729&maxLng=-73.679", nil))
+	if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != "[]" {
+		t.Errorf("Got status %d and %s for an empty box, expected %d and [].", w.Code, body, http.StatusOK)
+	}
+
+	for _, query := range []string{
+		"minLat=42.729&minLng=-73.681&maxLat=42.731",
+		"minLat=north&minLng=-73.681&maxLat=42.731&maxLng=-73.679",
+		"minLat=42.729&minLng=-73.681&maxLat=42.731&maxLng=-73.679&since=today",
+		// Too far back.
+		"minLat=42.729&minLng=-73.681&maxLat=42.731&maxLng=-73.679&since=1970-01-01T00:00:00Z",
+	} {
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, httptest.NewRequest("GET", "/updates/area?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %s, expected %d.", w.Code, query, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsMaxMessageSize is the largest message a client may send. Clients only send subscriptions,
+	// which are small.
+	wsMaxMessageSize = 4096
+	// wsWriteTimeout limits how long writing a message to a client may take.
+	wsWriteTimeout = 10 * time.Second
+)
+
+var (
+	// wsPingInterval is how often clients are pinged to check that they're still there.
+	wsPingInterval = 30 * time.Second
+	// wsReadTimeout is how long a client may send nothing, not even a pong, before it's considered
+	// gone. It's longer than wsPingInterval so that clients answering pings stay connected.
+	wsReadTimeout = 60 * time.Second
+)
+
+// wsUpgrader accepts connections from any origin, since the updates it streams are public.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// upgradeWebSocket completes the WebSocket handshake for r. If it fails, an error response has
+// already been written. The connection times out if the client sends nothing for wsReadTimeout;
+// messages and pongs extend that deadline.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+	return conn, nil
+}
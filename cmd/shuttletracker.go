@@ -3,16 +3,28 @@
 package cmd
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/kochman/runner"
 
 	"github.com/wtg/shuttletracker/api"
 	"github.com/wtg/shuttletracker/config"
 	"github.com/wtg/shuttletracker/database"
 	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/mqtt"
 	"github.com/wtg/shuttletracker/updater"
 )
 
-// Run starts the shuttle tracker and blocks forever.
+// stoppable is a runnable that can be told to stop, and that closes Done once Run returns.
+type stoppable interface {
+	Stop()
+	Done() <-chan struct{}
+}
+
+// Run starts the shuttle tracker and blocks until it is interrupted or terminated.
 func Run() {
 	log.Info("Shuttle Tracker starting...")
 
@@ -29,28 +41,61 @@ func Run() {
 	log.SetLevel(cfg.Log.Level)
 
 	// Database
-	db, err := database.NewMongoDB(*cfg.Database)
+	db, err := database.New(*cfg.Database)
 	if err != nil {
-		log.WithError(err).Errorf("MongoDB connection to \"%v\" failed.", cfg.Database.MongoURL)
+		log.WithError(err).Errorf("Could not create %s database at \"%v\".", cfg.Database.Type, cfg.Database.MongoURL)
 		return
 	}
 
 	// Make shuttle position updater
+	cfg.Updater.Timezone = cfg.API.Timezone
+	cfg.Updater.ServiceDayStart = cfg.API.ServiceDayStart
 	updater, err := updater.New(*cfg.Updater, db)
 	if err != nil {
 		log.WithError(err).Error("Could not create updater.")
 		return
 	}
 	runner.Add(updater)
+	stoppables := []stoppable{updater}
+
+	// Publish updates to MQTT if a broker is configured
+	if cfg.MQTT.BrokerURL != "" {
+		publisher, err := mqtt.New(*cfg.MQTT)
+		if err != nil {
+			log.WithError(err).Error("Could not create MQTT publisher.")
+			return
+		}
+		updater.Subscribe(publisher.Publish)
+		runner.Add(publisher)
+		stoppables = append(stoppables, publisher)
+	}
 
 	// Make API server
-	api, err := api.New(*cfg.API, db)
+	api, err := api.New(*cfg.API, db, updater)
 	if err != nil {
 		log.WithError(err).Error("Could not create API server.")
 		return
 	}
 	runner.Add(api)
 
-	// Run all runnables
-	runner.Run()
+	// Run all runnables until we're told to stop
+	go runner.Run()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+
+	// Stop fetching and publishing new data, then let in-flight requests finish. A runnable that
+	// hasn't started yet never finishes, so none is waited on longer than requests are.
+	log.Infof("Received %s; shutting down.", sig)
+	for _, s := range stoppables {
+		s.Stop()
+		select {
+		case <-s.Done():
+		case <-time.After(api.ShutdownTimeout()):
+			log.Warnf("Timed out waiting for %T to stop.", s)
+		}
+	}
+	if err := api.Shutdown(); err != nil {
+		log.WithError(err).Error("Could not shut down API server gracefully.")
+	}
 }
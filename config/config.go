@@ -8,6 +8,7 @@ import (
 	"github.com/wtg/shuttletracker/api"
 	"github.com/wtg/shuttletracker/database"
 	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/mqtt"
 	"github.com/wtg/shuttletracker/updater"
 )
 
@@ -17,6 +18,7 @@ type Config struct {
 	Updater  *updater.Config
 	API      *api.Config
 	Log      *log.Config
+	MQTT     *mqtt.Config
 }
 
 // New creates a new, global Config. Reads in configuration from config files.
@@ -33,6 +35,7 @@ func New() (*Config, error) {
 	cfg.Database = database.NewMongoDBConfig(v)
 	cfg.Updater = updater.NewConfig(v)
 	cfg.Log = log.NewConfig()
+	cfg.MQTT = mqtt.NewConfig(v)
 
 	log.Debugf("All settings: %+v", v.AllSettings())
 
@@ -1,42 +1,180 @@
 package database
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/wtg/shuttletracker/model"
 )
 
-// Database is an interface that can be implemented by a database backend.
+var (
+	// ErrUpdateNotFound indicates that no matching Update exists.
+	ErrUpdateNotFound = errors.New("update not found")
+	// ErrRouteTooFewCoords indicates that a Route can't be enabled because it has fewer than two coordinates.
+	ErrRouteTooFewCoords = errors.New("route must have at least two coordinates to be enabled")
+	// ErrRouteInvalidVariant indicates that a Route's variants are missing IDs or coordinates, or that
+	// its ActiveVariant isn't one of them.
+	ErrRouteInvalidVariant = errors.New("route variants must have unique IDs and at least two coordinates, and the active variant must be one of them")
+	// ErrInvalidInterval indicates that updates can't be sampled at an interval that isn't positive.
+	ErrInvalidInterval = errors.New("interval must be positive")
+	// ErrInvalidCellSize indicates that a heatmap can't have cells whose size isn't positive.
+	ErrInvalidCellSize = errors.New("cell size must be positive")
+	// ErrHeatmapTooLarge indicates that a heatmap would have more than model.MaxHeatmapCells cells.
+	ErrHeatmapTooLarge = errors.New("heatmap has too many cells; use a smaller area or larger cells")
+	// ErrInvalidCursor indicates that a pagination cursor wasn't one returned by the Database.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidSort indicates that results can't be sorted by the requested field.
+	ErrInvalidSort = errors.New("invalid sort field")
+	// ErrVehicleIDTaken indicates that a Vehicle with the same ID already exists in its data feed.
+	ErrVehicleIDTaken = errors.New("a vehicle with this ID already exists in this feed")
+	// ErrVehicleMerging indicates that a Vehicle is part of a merge that hasn't finished, so it
+	// can't be merged differently until that merge is retried.
+	ErrVehicleMerging = errors.New("the vehicle is part of an unfinished merge")
+)
+
+// VehicleQuery selects, sorts, and pages Vehicles.
+type VehicleQuery struct {
+	// NameLike limits the results to Vehicles whose names contain it, ignoring case.
+	NameLike string
+	// Sort is "name", "created", or "enabled". Vehicles are sorted by name if it's empty.
+	Sort       string
+	Descending bool
+	// Limit is the most Vehicles to return. Zero means no limit.
+	Limit int
+	// Offset is how many Vehicles to skip.
+	Offset int
+}
+
+// Database is an interface that can be implemented by a database backend. Vehicles and their
+// Updates are identified by vehicle ID within a data feed, since IDs from different feeds may
+// collide. Vehicles without a feed are found with an empty feed.
 type Database interface {
 	// Routes
 	CreateRoute(route *model.Route) error
 	DeleteRoute(routeID string) error
 	GetRoute(routeID string) (model.Route, error)
 	GetRoutes() ([]model.Route, error)
+	GetRoutesModifiedSince(since time.Time) ([]model.Route, error)
 	ModifyRoute(route *model.Route) error
+	SetRoutesEnabled(routeIDs []string, enabled bool) (int, error)
+	GetScheduleForRoute(routeID string) ([]model.ScheduledArrival, error)
+	SetScheduleForRoute(routeID string, schedule []model.ScheduledArrival) error
+	GetAdherenceForRoute(routeID string, day time.Time) ([]model.StopAdherence, error)
+	GetSegmentSpeedsForRoute(routeID string, since time.Time) ([]model.SegmentSpeed, error)
 
 	// Stops
 	CreateStop(stop *model.Stop) error
 	DeleteStop(stopID string) error
 	GetStops() ([]model.Stop, error)
+	GetStopsWithRoutes() ([]model.StopWithRoutes, error)
+	GetHeadwayForStop(stopID string, routeID string, window time.Duration) (model.Headway, error)
+	GetArrivalsForStop(stopID string, since time.Time, max int) ([]model.StopArrival, error)
+	GetStopWindows() ([]model.StopWindow, error)
+	SetStopWindows(stopID string, windows []model.StopWindow) error
+	SetStopAttributes(stopID string, attributes map[string]bool) (model.Stop, error)
 	// GetStopsForRoute(routeID string) ([]model.Stop, error)
 	// ModifyStop(stop *model.Stop) error
 
 	// Vehicles
 	CreateVehicle(vehicle *model.Vehicle) error
-	DeleteVehicle(vehicleID string) error
-	GetVehicle(vehicleID string) (model.Vehicle, error)
+	DeleteVehicle(vehicleID string, feed string) error
+	GetVehicle(vehicleID string, feed string) (model.Vehicle, error)
 	GetVehicles() ([]model.Vehicle, error)
+	QueryVehicles(query VehicleQuery) ([]model.Vehicle, int, error)
 	GetEnabledVehicles() ([]model.Vehicle, error)
+	GetVehiclesWithoutUpdates() ([]model.Vehicle, error)
 	ModifyVehicle(vehicle *model.Vehicle) error
+	SetVehiclesEnabled(vehicles []model.VehicleKey, enabled bool) (int, error)
+	SetVehicleHeartbeat(vehicleID string, feed string, heartbeat time.Time) error
+	MergeVehicles(keep model.VehicleKey, merge model.VehicleKey) error
 
 	// Updates
 	CreateUpdate(update *model.VehicleUpdate) error
+	SetRouteForUpdate(vehicleID string, feed string, created time.Time, routeID string) error
 	DeleteUpdatesBefore(before time.Time) (int, error)
-	// GetUpdatesSince(since time.Time) ([]model.VehicleUpdate, error)
-	GetUpdatesForVehicleSince(vehicleID string, since time.Time) ([]model.VehicleUpdate, error)
-	GetLastUpdateForVehicle(vehicleID string) (model.VehicleUpdate, error)
+	DeleteUpdatesForVehicle(vehicleID string, feed string) (int, error)
+	DeleteUpdatesBeforePerVehicle(before time.Time) (int, error)
+	ArchiveUpdatesBeforePerVehicle(before time.Time) (int, error)
+	DeleteUpdatesExceedingCountPerVehicle(max int, since time.Time) (int, error)
+	GetUpdatesSince(since time.Time) ([]model.VehicleUpdate, error)
+	GetUpdatesForVehicleSince(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error)
+	GetUpdatesForVehicleSinceAscending(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error)
+	GetUpdatesForVehicleBetween(vehicleID string, feed string, from, to time.Time) ([]model.VehicleUpdate, error)
+	GetSampledUpdatesForVehicle(vehicleID string, feed string, since time.Time, interval time.Duration) ([]model.VehicleUpdate, error)
+	GetUpdatesPage(vehicleID string, feed string, cursor string, limit int) ([]model.VehicleUpdate, string, error)
+	GetLastUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error)
+	GetLastUpdatesForVehicles(vehicles []model.VehicleKey) (map[model.VehicleKey]model.VehicleUpdate, error)
+	GetFirstUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error)
+	GetUpdateForVehicleBefore(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error)
+	GetUpdateForVehicleAfter(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error)
+	GetUpdatesInBoundingBox(box model.BoundingBox, since time.Time) ([]model.VehicleUpdate, error)
+	GetUpdateHeatmap(box model.BoundingBox, from, to time.Time, cellSize float64) (model.Heatmap, error)
+	GetLatestUpdateTime() (time.Time, error)
+	GetActiveVehiclesSince(since time.Time) ([]model.VehicleKey, error)
+	GetOccupancyByHour(routeID string, day time.Time) ([]model.HourlyOccupancy, error)
+	GetTrackGapsForVehicle(vehicleID string, feed string, since time.Time, minGap time.Duration) ([]model.TrackGap, error)
+	GetFleetStats(from, to time.Time) (model.FleetStats, error)
 
 	// Users
 	GetUsers() ([]model.User, error)
+
+	// API clients
+	CreateAPIClient(client *model.APIClient) error
+	GetAPIClients() ([]model.APIClient, error)
+	DeleteAPIClient(clientID string) error
+	IssueAPIClientToken(clientID string, tokenHash string, issued time.Time) (model.APIClient, error)
+	RevokeAPIClientToken(clientID string) (model.APIClient, error)
+	UseAPIClientToken(tokenHash string, used time.Time) (model.APIClient, error)
+}
+
+// New creates the Database backend given by cfg.Type. MongoDB is currently the only backend, and it
+// is used if Type is empty. If cfg has a SlowQueryThreshold, slow calls to the Database are logged.
+func New(cfg MongoDBConfig) (Database, error) {
+	var threshold time.Duration
+	if cfg.SlowQueryThreshold != "" {
+		var err error
+		threshold, err = time.ParseDuration(cfg.SlowQueryThreshold)
+		if err != nil {
+			return nil, err
+		}
+		if threshold <= 0 {
+			return nil, errors.New("slow query threshold must be positive")
+		}
+	}
+
+	var db Database
+	switch cfg.Type {
+	case "", "mongodb":
+		mongo, err := NewMongoDB(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db = mongo
+	default:
+		return nil, fmt.Errorf("unknown database type %q", cfg.Type)
+	}
+
+	if threshold > 0 {
+		db = LogSlowQueries(db, threshold)
+	}
+	return db, nil
+}
+
+// validateRoute checks that a Route can be stored.
+func validateRoute(route *model.Route) error {
+	if route.Enabled && len(route.Coords) < 2 {
+		return ErrRouteTooFewCoords
+	}
+	variantIDs := make(map[string]bool, len(route.Variants))
+	for _, variant := range route.Variants {
+		if variant.ID == "" || variantIDs[variant.ID] || len(variant.Coords) < 2 {
+			return ErrRouteInvalidVariant
+		}
+		variantIDs[variant.ID] = true
+	}
+	if route.ActiveVariant != "" && !variantIDs[route.ActiveVariant] {
+		return ErrRouteInvalidVariant
+	}
+	return nil
 }
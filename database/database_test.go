@@ -0,0 +1,108 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestValidateRoute(t *testing.T) {
+	coords := []model.Coord{{Lat: 42.73, Lng: -73.67}, {Lat: 42.74, Lng: -73.68}}
+	table := []struct {
+		enabled  bool
+		coords   int
+		expected error
+	}{
+		{true, 0, ErrRouteTooFewCoords},
+		{true, 1, ErrRouteTooFewCoords},
+		{true, 2, nil},
+		{false, 0, nil},
+		{false, 1, nil},
+	}
+
+	for _, testCase := range table {
+		route := model.Route{Enabled: testCase.enabled, Coords: coords[:testCase.coords]}
+		if err := validateRoute(&route); err != testCase.expected {
+			t.Errorf("Enabled %v with %d coords: got %v, expected %v.", testCase.enabled, testCase.coords, err, testCase.expected)
+		}
+	}
+}
+
+func TestValidateRouteVariants(t *testing.T) {
+	coords := []model.Coord{{Lat: 42.73, Lng: -73.67}, {Lat: 42.74, Lng: -73.68}}
+	table := []struct {
+		variants []model.RouteVariant
+		active   string
+		expected error
+	}{
+		{[]model.RouteVariant{{ID: "weekend", Coords: coords}}, "", nil},
+		{[]model.RouteVariant{{ID: "weekend", Coords: coords}}, "weekend", nil},
+		{[]model.RouteVariant{{ID: "weekend", Coords: coords}}, "detour", ErrRouteInvalidVariant},
+		{[]model.RouteVariant{{ID: "weekend", Coords: coords[:1]}}, "", ErrRouteInvalidVariant},
+		{[]model.RouteVariant{{Coords: coords}}, "", ErrRouteInvalidVariant},
+		{[]model.RouteVariant{{ID: "weekend", Coords: coords}, {ID: "weekend", Coords: coords}}, "", ErrRouteInvalidVariant},
+		{nil, "weekend", ErrRouteInvalidVariant},
+	}
+
+	for i, testCase := range table {
+		route := model.Route{Coords: coords, Variants: testCase.variants, ActiveVariant: testCase.active}
+		if err := validateRoute(&route); err != testCase.expected {
+			t.Errorf("Case %d: got %v, expected %v.", i, err, testCase.expected)
+		}
+	}
+}
+
+func TestUpdatesCursorRoundTrip(t *testing.T) {
+	c := updatesCursor{created: time.Date(2017, 9, 1, 12, 0, 0, 5000000, time.UTC), id: bson.NewObjectId()}
+	parsed, err := parseUpdatesCursor(c.String())
+	if err != nil {
+		t.Fatalf("Unable to parse cursor: %v", err)
+	}
+	if !parsed.created.Equal(c.created) || parsed.id != c.id {
+		t.Errorf("Got %+v, expected %+v.", parsed, c)
+	}
+
+	for _, s := range []string{"", "not base64!", "MTIzNDU"} {
+		if _, err := parseUpdatesCursor(s); err != ErrInvalidCursor {
+			t.Errorf("Got error %v for %q, expected %v.", err, s, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestStopsWithRoutes(t *testing.T) {
+	stops := []model.Stop{
+		{ID: "union", RouteID: "west"},
+		{ID: "sage", RouteID: "east"},
+		{ID: "orphan"},
+	}
+	routes := []model.Route{
+		{ID: "west", Name: "West", StopsID: []string{"union"}},
+		{ID: "east", Name: "East", StopsID: []string{"sage", "union"}},
+	}
+
+	result := stopsWithRoutes(stops, routes)
+	expected := map[string][]model.StopRoute{
+		"union":  {{ID: "west", Name: "West"}, {ID: "east", Name: "East"}},
+		"sage":   {{ID: "east", Name: "East"}},
+		"orphan": {},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Got %d stops, expected %d.", len(result), len(expected))
+	}
+	for _, stop := range result {
+		if !reflect.DeepEqual(stop.Routes, expected[stop.ID]) {
+			t.Errorf("Got routes %+v for %s, expected %+v.", stop.Routes, stop.ID, expected[stop.ID])
+		}
+	}
+}
+
+func TestNewUnknownType(t *testing.T) {
+	for _, backend := range []string{"postgres", "sqlite", "memory"} {
+		if db, err := New(MongoDBConfig{Type: backend}); err == nil || db != nil {
+			t.Errorf("Got %v and error %v for %s, expected only an error.", db, err, backend)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package database
 
 import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -11,22 +17,45 @@ import (
 
 // MongoDB implements Database with—you guessed it—MongoDB.
 type MongoDB struct {
-	session  *mgo.Session
-	updates  *mgo.Collection
-	vehicles *mgo.Collection
-	routes   *mgo.Collection
-	stops    *mgo.Collection
-	users    *mgo.Collection
+	session        *mgo.Session
+	updates        *mgo.Collection
+	updatesArchive *mgo.Collection
+	vehicles       *mgo.Collection
+	routes         *mgo.Collection
+	stops          *mgo.Collection
+	stopWindows    *mgo.Collection
+	schedules      *mgo.Collection
+	users          *mgo.Collection
+	apiClients     *mgo.Collection
+	// palette is the colors given to new routes without one.
+	palette []string
 }
 
 // MongoDBConfig contains information on how to connect to a MongoDB server.
 type MongoDBConfig struct {
+	// Type is which backend New creates. Only "mongodb" is supported.
+	Type     string
 	MongoURL string
+	// RoutePalette is the colors that routes created without one are given. Each route gets the
+	// color used by the fewest enabled routes, so colors only repeat once all have been used. It
+	// defaults to model.DefaultRoutePalette if empty.
+	RoutePalette []string
+	// SlowQueryThreshold is how long a database call, like "500ms", may take before it is logged as
+	// slow. Calls aren't timed if it's empty.
+	SlowQueryThreshold string
 }
 
 // NewMongoDB creates a MongoDB.
 func NewMongoDB(cfg MongoDBConfig) (*MongoDB, error) {
-	db := &MongoDB{}
+	db := &MongoDB{palette: cfg.RoutePalette}
+	if len(db.palette) == 0 {
+		db.palette = model.DefaultRoutePalette
+	}
+	for _, color := range db.palette {
+		if !model.ValidColor(color) {
+			return nil, fmt.Errorf("route palette color %q isn't a hex color", color)
+		}
+	}
 
 	session, err := mgo.Dial(cfg.MongoURL)
 	if err != nil {
@@ -35,28 +64,58 @@ func NewMongoDB(cfg MongoDBConfig) (*MongoDB, error) {
 	db.session = session
 
 	db.updates = db.session.DB("").C("updates")
+	db.updatesArchive = db.session.DB("").C("updates_archive")
 	db.vehicles = db.session.DB("").C("vehicles")
 	db.routes = db.session.DB("").C("routes")
 	db.stops = db.session.DB("").C("stops")
+	db.stopWindows = db.session.DB("").C("stopWindows")
+	db.schedules = db.session.DB("").C("schedules")
 	db.users = db.session.DB("").C("users")
+	db.apiClients = db.session.DB("").C("apiClients")
 
-	// Ensure unique vehicle identification
+	// Ensure unique vehicle identification within each data feed. Vehicle IDs used to be unique
+	// across all feeds, so drop that index if it's still around.
+	db.vehicles.DropIndex("vehicleID")
 	vehicleIndex := mgo.Index{
-		Key:      []string{"vehicleID"},
+		Key:      []string{"vehicleID", "feed"},
 		Unique:   true,
 		DropDups: true}
 	if err = db.vehicles.EnsureIndex(vehicleIndex); err != nil {
 		return nil, err
 	}
 
-	// Create index on update vehicle ID and creation time to quickly find the most recent updates for specific vehicles.
+	// Vehicles created before they had colors get the default, empty color.
+	if _, err = db.vehicles.UpdateAll(bson.M{"color": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"color": ""}}); err != nil {
+		return nil, err
+	}
+
+	// Create index on update vehicle ID, feed, and creation time to quickly find the most recent updates for specific vehicles.
 	if err = db.updates.EnsureIndexKey("created"); err != nil {
 		return nil, err
 	}
 	if err = db.updates.EnsureIndexKey("vehicleID"); err != nil {
 		return nil, err
 	}
-	if err = db.updates.EnsureIndexKey("vehicleID", "created"); err != nil {
+	// It replaces the index on just vehicle ID and creation time from before updates had feeds.
+	// Newer databases never had that index, so failing to drop it is fine.
+	db.updates.DropIndex("vehicleID", "created")
+	if err = db.updates.EnsureIndexKey("vehicleID", "feed", "created"); err != nil {
+		return nil, err
+	}
+	// Index for paging through all updates in order.
+	if err = db.updates.EnsureIndexKey("created", "_id"); err != nil {
+		return nil, err
+	}
+
+	// Index stop windows by their stops
+	if err = db.stopWindows.EnsureIndexKey("stopID"); err != nil {
+		return nil, err
+	}
+	if err = db.schedules.EnsureIndexKey("routeID"); err != nil {
+		return nil, err
+	}
+	// Clients are found by their token's hash on each request they make.
+	if err = db.apiClients.EnsureIndexKey("tokenHash"); err != nil {
 		return nil, err
 	}
 
@@ -69,14 +128,35 @@ func NewMongoDB(cfg MongoDBConfig) (*MongoDB, error) {
 // NewMongoDBConfig creates a MongoDBConfig from a Viper instance.
 func NewMongoDBConfig(v *viper.Viper) *MongoDBConfig {
 	cfg := &MongoDBConfig{
-		MongoURL: "localhost:27017",
+		Type:         "mongodb",
+		MongoURL:     "localhost:27017",
+		RoutePalette: model.DefaultRoutePalette,
 	}
+	v.SetDefault("database.type", cfg.Type)
 	v.SetDefault("database.mongourl", cfg.MongoURL)
+	v.SetDefault("database.routepalette", cfg.RoutePalette)
+	v.SetDefault("database.slowquerythreshold", cfg.SlowQueryThreshold)
 	return cfg
 }
 
-// CreateRoute creates a Route.
+// CreateRoute creates a Route. A Route without a color is given the palette color that the fewest
+// enabled Routes have. It returns ErrRouteTooFewCoords if the Route is enabled without enough
+// coordinates to draw it.
 func (m *MongoDB) CreateRoute(route *model.Route) error {
+	if err := validateRoute(route); err != nil {
+		return err
+	}
+	if route.Color == "" {
+		var routes []model.Route
+		if err := m.routes.Find(bson.M{"enabled": true}).Select(bson.M{"color": 1}).All(&routes); err != nil {
+			return err
+		}
+		used := make([]string, len(routes))
+		for i := range routes {
+			used[i] = routes[i].Color
+		}
+		route.Color = model.NextColor(m.palette, used)
+	}
 	return m.routes.Insert(&route)
 }
 
@@ -99,11 +179,142 @@ func (m *MongoDB) GetRoutes() ([]model.Route, error) {
 	return routes, err
 }
 
-// ModifyRoute updates an existing Route by its ID.
+// GetRoutesModifiedSince returns the Routes that were created or modified after since. Deleted
+// Routes aren't included.
+func (m *MongoDB) GetRoutesModifiedSince(since time.Time) ([]model.Route, error) {
+	var routes []model.Route
+	err := m.routes.Find(bson.M{"updated": bson.M{"$gt": since}}).All(&routes)
+	return routes, err
+}
+
+// ModifyRoute updates an existing Route by its ID. It returns ErrRouteTooFewCoords
+// if the Route is enabled without enough coordinates to draw it.
 func (m *MongoDB) ModifyRoute(route *model.Route) error {
+	if err := validateRoute(route); err != nil {
+		return err
+	}
 	return m.routes.Update(bson.M{"id": route.ID}, route)
 }
 
+// SetRoutesEnabled enables or disables many Routes at once and returns how many matched.
+// If any of them has too few coordinates to be enabled, none are changed. The check and the update
+// aren't atomic, so a Route that loses its coordinates in between is left as it was and isn't
+// counted, rather than being enabled without them.
+func (m *MongoDB) SetRoutesEnabled(routeIDs []string, enabled bool) (int, error) {
+	selector := bson.M{"id": bson.M{"$in": routeIDs}}
+	if enabled {
+		// Routes with no second coordinate have fewer than two.
+		n, err := m.routes.Find(bson.M{"id": bson.M{"$in": routeIDs}, "coords.1": bson.M{"$exists": false}}).Count()
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return 0, ErrRouteTooFewCoords
+		}
+		selector["coords.1"] = bson.M{"$exists": true}
+	}
+	info, err := m.routes.UpdateAll(selector, bson.M{"$set": bson.M{"enabled": enabled, "updated": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Matched, nil
+}
+
+// GetScheduleForRoute returns a Route's ScheduledArrivals.
+func (m *MongoDB) GetScheduleForRoute(routeID string) ([]model.ScheduledArrival, error) {
+	var schedule []model.ScheduledArrival
+	err := m.schedules.Find(bson.M{"routeID": routeID}).All(&schedule)
+	return schedule, err
+}
+
+// SetScheduleForRoute replaces a Route's ScheduledArrivals.
+func (m *MongoDB) SetScheduleForRoute(routeID string, schedule []model.ScheduledArrival) error {
+	if _, err := m.schedules.RemoveAll(bson.M{"routeID": routeID}); err != nil {
+		return err
+	}
+	for i := range schedule {
+		schedule[i].RouteID = routeID
+		if err := m.schedules.Insert(&schedule[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAdherenceForRoute compares when vehicles on a Route arrived at its Stops during the service
+// day starting at day with the Route's schedule. Its Stops are those of the variant running that
+// day, if any. Arrivals up to MaxScheduleDeviation past either end of the day still count toward
+// scheduled arrivals near it. It returns mgo.ErrNotFound if there is no such Route.
+func (m *MongoDB) GetAdherenceForRoute(routeID string, day time.Time) ([]model.StopAdherence, error) {
+	route, err := m.GetRoute(routeID)
+	if err != nil {
+		return nil, err
+	}
+	// day is the start of a service day, so it falls on that service day's calendar date.
+	stops, err := m.getStopsInOrder(route.AtTime(day, 0).StopsID)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := m.GetScheduleForRoute(routeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []model.VehicleUpdate
+	query := bson.M{
+		"routeID": routeID,
+		"created": bson.M{
+			"$gte": day.Add(-model.MaxScheduleDeviation),
+			"$lt":  day.AddDate(0, 0, 1).Add(model.MaxScheduleDeviation),
+		},
+	}
+	if err := m.updates.Find(query).Sort("created").All(&updates); err != nil {
+		return nil, err
+	}
+
+	return model.Adherence(stops, schedule, model.DetectArrivals(stops, updates), day)
+}
+
+// GetSegmentSpeedsForRoute returns the average speed of vehicles between each of a Route's
+// consecutive stops since since. It returns mgo.ErrNotFound if there is no such Route.
+func (m *MongoDB) GetSegmentSpeedsForRoute(routeID string, since time.Time) ([]model.SegmentSpeed, error) {
+	route, err := m.GetRoute(routeID)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := m.getStopsInOrder(route.StopsID)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []model.VehicleUpdate
+	query := bson.M{"routeID": routeID, "created": bson.M{"$gt": since}}
+	if err := m.updates.Find(query).Sort("created").All(&updates); err != nil {
+		return nil, err
+	}
+	return model.SegmentSpeeds(&route, ordered, updates), nil
+}
+
+// getStopsInOrder returns the Stops with the given IDs, in the same order. IDs of Stops that don't
+// exist are skipped.
+func (m *MongoDB) getStopsInOrder(stopIDs []string) ([]model.Stop, error) {
+	var stops []model.Stop
+	if err := m.stops.Find(bson.M{"id": bson.M{"$in": stopIDs}}).All(&stops); err != nil {
+		return nil, err
+	}
+	stopsByID := make(map[string]model.Stop, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+	ordered := make([]model.Stop, 0, len(stopIDs))
+	for _, stopID := range stopIDs {
+		if stop, ok := stopsByID[stopID]; ok {
+			ordered = append(ordered, stop)
+		}
+	}
+	return ordered, nil
+}
+
 // CreateStop creates a Stop.
 func (m *MongoDB) CreateStop(stop *model.Stop) error {
 	return m.stops.Insert(&stop)
@@ -128,6 +339,140 @@ func (m *MongoDB) GetStops() ([]model.Stop, error) {
 	return stops, err
 }
 
+// GetStopsWithRoutes returns all Stops along with the Routes that serve them.
+func (m *MongoDB) GetStopsWithRoutes() ([]model.StopWithRoutes, error) {
+	stops, err := m.GetStops()
+	if err != nil {
+		return nil, err
+	}
+	var routes []model.Route
+	if err := m.routes.Find(bson.M{}).Select(bson.M{"id": 1, "name": 1, "stopsid": 1}).All(&routes); err != nil {
+		return nil, err
+	}
+	return stopsWithRoutes(stops, routes), nil
+}
+
+// stopsWithRoutes finds the Routes that serve each Stop, either by listing it among their
+// stops or by being the Stop's own Route.
+func stopsWithRoutes(stops []model.Stop, routes []model.Route) []model.StopWithRoutes {
+	servedBy := make(map[string][]model.StopRoute)
+	for _, route := range routes {
+		stopRoute := model.StopRoute{ID: route.ID, Name: route.Name}
+		for _, stopID := range route.StopsID {
+			servedBy[stopID] = append(servedBy[stopID], stopRoute)
+		}
+	}
+	names := make(map[string]string, len(routes))
+	for _, route := range routes {
+		names[route.ID] = route.Name
+	}
+
+	result := make([]model.StopWithRoutes, 0, len(stops))
+	for _, stop := range stops {
+		stopRoutes := []model.StopRoute{}
+		seen := make(map[string]bool)
+		for _, stopRoute := range servedBy[stop.ID] {
+			if !seen[stopRoute.ID] {
+				seen[stopRoute.ID] = true
+				stopRoutes = append(stopRoutes, stopRoute)
+			}
+		}
+		if name, ok := names[stop.RouteID]; ok && !seen[stop.RouteID] {
+			stopRoutes = append(stopRoutes, model.StopRoute{ID: stop.RouteID, Name: name})
+		}
+		result = append(result, model.StopWithRoutes{Stop: stop, Routes: stopRoutes})
+	}
+	return result
+}
+
+// GetHeadwayForStop returns the time between successive arrivals of vehicles on a Route at a Stop
+// during the last window.
+func (m *MongoDB) GetHeadwayForStop(stopID string, routeID string, window time.Duration) (model.Headway, error) {
+	headway := model.Headway{StopID: stopID, RouteID: routeID}
+
+	var stop model.Stop
+	if err := m.stops.Find(bson.M{"id": stopID}).One(&stop); err != nil {
+		return headway, err
+	}
+	var updates []model.VehicleUpdate
+	query := bson.M{
+		"routeID": routeID,
+		"created": bson.M{"$gte": time.Now().Add(-window)},
+	}
+	if err := m.updates.Find(query).Sort("created").All(&updates); err != nil {
+		return headway, err
+	}
+
+	headway.Gaps = model.Headways(model.DetectArrivals([]model.Stop{stop}, updates))
+	if len(headway.Gaps) > 0 {
+		total := 0.0
+		for _, gap := range headway.Gaps {
+			total += gap
+		}
+		average := total / float64(len(headway.Gaps))
+		headway.Average = &average
+	}
+	return headway, nil
+}
+
+// GetArrivalsForStop returns up to max of the most recent times that a vehicle arrived at a Stop
+// after since, most recent first, or all of them if max isn't positive. Updates are read newest
+// first, and only until the most recent arrivals are known.
+func (m *MongoDB) GetArrivalsForStop(stopID string, since time.Time, max int) ([]model.StopArrival, error) {
+	var stop model.Stop
+	if err := m.stops.Find(bson.M{"id": stopID}).One(&stop); err != nil {
+		return nil, err
+	}
+
+	recent := model.NewRecentArrivals(stop)
+	fields := bson.M{"vehicleID": 1, "feed": 1, "routeID": 1, "lat": 1, "lng": 1, "created": 1}
+	iter := m.updates.Find(bson.M{"created": bson.M{"$gt": since}}).Select(fields).Sort("-created").Iter()
+	for {
+		var update model.VehicleUpdate
+		if !iter.Next(&update) {
+			break
+		}
+		recent.Add(update)
+		if max > 0 && recent.Have(max) {
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return recent.Arrivals(max), nil
+}
+
+// GetStopWindows returns all StopWindows.
+func (m *MongoDB) GetStopWindows() ([]model.StopWindow, error) {
+	var windows []model.StopWindow
+	err := m.stopWindows.Find(bson.M{}).All(&windows)
+	return windows, err
+}
+
+// SetStopAttributes replaces a Stop's Attributes and returns the modified Stop. It returns
+// mgo.ErrNotFound if there is no such Stop.
+func (m *MongoDB) SetStopAttributes(stopID string, attributes map[string]bool) (model.Stop, error) {
+	var stop model.Stop
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"attributes": attributes}}, ReturnNew: true}
+	_, err := m.stops.Find(bson.M{"id": stopID}).Apply(change, &stop)
+	return stop, err
+}
+
+// SetStopWindows replaces a Stop's StopWindows.
+func (m *MongoDB) SetStopWindows(stopID string, windows []model.StopWindow) error {
+	if _, err := m.stopWindows.RemoveAll(bson.M{"stopID": stopID}); err != nil {
+		return err
+	}
+	for i := range windows {
+		windows[i].StopID = stopID
+		if err := m.stopWindows.Insert(&windows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CreateUpdate creates an Update.
 func (m *MongoDB) CreateUpdate(update *model.VehicleUpdate) error {
 	return m.updates.Insert(&update)
@@ -142,20 +487,572 @@ func (m *MongoDB) DeleteUpdatesBefore(before time.Time) (int, error) {
 	return info.Removed, nil
 }
 
+// DeleteUpdatesForVehicle deletes every Update for a vehicle, such as when its GPS was broken and its
+// track is garbage. Other vehicles' Updates are untouched.
+func (m *MongoDB) DeleteUpdatesForVehicle(vehicleID string, feed string) (int, error) {
+	info, err := m.updates.RemoveAll(vehicleForFeedQuery(vehicleID, feed))
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// DeleteUpdatesBeforePerVehicle deletes all Updates that were created before a time, except for those
+// belonging to vehicles with their own retention period. Their Updates are deleted once they are older
+// than that period instead.
+func (m *MongoDB) DeleteUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	selector, err := m.expiredUpdates(before)
+	if err != nil {
+		return 0, err
+	}
+	info, err := m.updates.RemoveAll(selector)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// archiveBatchSize is how many Updates ArchiveUpdatesBeforePerVehicle copies and deletes at a time.
+var archiveBatchSize = 1000
+
+// ArchiveUpdatesBeforePerVehicle moves the Updates that DeleteUpdatesBeforePerVehicle would delete into
+// the updates archive, archiveBatchSize at a time. Updates are copied before they are deleted, so if
+// archiving is interrupted it is safe to try again.
+func (m *MongoDB) ArchiveUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	selector, err := m.expiredUpdates(before)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	batch := make([]bson.M, 0, archiveBatchSize)
+	archive := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids := make([]interface{}, 0, len(batch))
+		for _, update := range batch {
+			if _, err := m.updatesArchive.Upsert(bson.M{"_id": update["_id"]}, update); err != nil {
+				return err
+			}
+			ids = append(ids, update["_id"])
+		}
+		info, err := m.updates.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		removed += info.Removed
+		batch = batch[:0]
+		return nil
+	}
+
+	iter := m.updates.Find(selector).Iter()
+	for {
+		var update bson.M
+		if !iter.Next(&update) {
+			break
+		}
+		batch = append(batch, update)
+		if len(batch) < archiveBatchSize {
+			continue
+		}
+		if err := archive(); err != nil {
+			iter.Close()
+			return removed, err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return removed, err
+	}
+	if err := archive(); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// DeleteUpdatesExceedingCountPerVehicle deletes all but the most recent max Updates for each vehicle
+// with Updates since a time. Other vehicles can't have gained Updates since then.
+func (m *MongoDB) DeleteUpdatesExceedingCountPerVehicle(max int, since time.Time) (int, error) {
+	vehicles, err := m.GetActiveVehiclesSince(since)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, vehicle := range vehicles {
+		var excess []bson.M
+		err := m.updates.Find(vehicleForFeedQuery(vehicle.VehicleID, vehicle.Feed)).Sort("-created").Skip(max).Select(bson.M{"_id": 1}).All(&excess)
+		if err != nil {
+			return removed, err
+		}
+		if len(excess) == 0 {
+			continue
+		}
+
+		ids := make([]interface{}, 0, len(excess))
+		for _, update := range excess {
+			ids = append(ids, update["_id"])
+		}
+		info, err := m.updates.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return removed, err
+		}
+		removed += info.Removed
+	}
+	return removed, nil
+}
+
+// expiredUpdates returns a selector for Updates that were created before a time, or before
+// their vehicle's own retention period if it has one.
+func (m *MongoDB) expiredUpdates(before time.Time) (bson.M, error) {
+	var vehicles []model.Vehicle
+	err := m.vehicles.Find(bson.M{"retentionDays": bson.M{"$gt": 0}}).All(&vehicles)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	overridden := make([]bson.M, 0, len(vehicles))
+	selectors := make([]bson.M, 0, len(vehicles)+1)
+	for _, vehicle := range vehicles {
+		query := vehicleForFeedQuery(vehicle.VehicleID, vehicle.Feed)
+		overridden = append(overridden, query)
+		cutoff := now.AddDate(0, 0, -vehicle.RetentionDays)
+		selectors = append(selectors, bson.M{"$and": []bson.M{query, {"created": bson.M{"$lt": cutoff}}}})
+	}
+	rest := bson.M{"created": bson.M{"$lt": before}}
+	if len(overridden) > 0 {
+		rest["$nor"] = overridden
+	}
+	selectors = append(selectors, rest)
+	return bson.M{"$or": selectors}, nil
+}
+
+// SetRouteForUpdate sets the Route of the vehicle's Update created at created.
+func (m *MongoDB) SetRouteForUpdate(vehicleID string, feed string, created time.Time, routeID string) error {
+	return m.updates.Update(vehicleUpdatesQuery(vehicleID, feed, created),
+		bson.M{"$set": bson.M{"routeID": routeID}})
+}
+
 // GetLastUpdateForVehicle returns the latest Update for a vehicle by its ID.
-func (m *MongoDB) GetLastUpdateForVehicle(vehicleID string) (model.VehicleUpdate, error) {
+func (m *MongoDB) GetLastUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
 	var update model.VehicleUpdate
-	err := m.updates.Find(bson.M{"vehicleID": vehicleID}).Sort("-created").One(&update)
+	err := m.updates.Find(vehicleForFeedQuery(vehicleID, feed)).Sort("-created").One(&update)
 	return update, err
 }
 
-// GetUpdatesForVehicleSince returns all updates since a time for a vehicle by its ID.
-func (m *MongoDB) GetUpdatesForVehicleSince(vehicleID string, since time.Time) ([]model.VehicleUpdate, error) {
+// GetLastUpdatesForVehicles returns the latest Update for each of the vehicles in a single query.
+// Vehicles without Updates are left out.
+func (m *MongoDB) GetLastUpdatesForVehicles(vehicles []model.VehicleKey) (map[model.VehicleKey]model.VehicleUpdate, error) {
+	updates := make(map[model.VehicleKey]model.VehicleUpdate, len(vehicles))
+	if len(vehicles) == 0 {
+		return updates, nil
+	}
+	selectors := make([]bson.M, len(vehicles))
+	for i, vehicle := range vehicles {
+		selectors[i] = vehicleForFeedQuery(vehicle.VehicleID, vehicle.Feed)
+	}
+	// Sorting the same way as the index on vehicleID, feed, and created lets MongoDB go straight to
+	// each vehicle's latest Update instead of reading all of them.
+	pipeline := []bson.M{
+		{"$match": bson.M{"$or": selectors}},
+		{"$sort": bson.D{{Name: "vehicleID", Value: -1}, {Name: "feed", Value: -1}, {Name: "created", Value: -1}}},
+		{"$group": bson.M{
+			"_id":    bson.M{"vehicleID": "$vehicleID", "feed": "$feed"},
+			"update": bson.M{"$first": "$$ROOT"},
+		}},
+	}
+	var latest []struct {
+		Update model.VehicleUpdate `bson:"update"`
+	}
+	if err := m.updates.Pipe(pipeline).All(&latest); err != nil {
+		return nil, err
+	}
+	for _, l := range latest {
+		// Updates without a feed may have an empty or missing one, which are grouped separately.
+		key := l.Update.Key()
+		if update, ok := updates[key]; ok && update.Created.After(l.Update.Created) {
+			continue
+		}
+		updates[key] = l.Update
+	}
+	return updates, nil
+}
+
+// GetFirstUpdateForVehicle returns the earliest stored Update for a vehicle by its ID. Archived
+// Updates aren't considered. It returns ErrUpdateNotFound if the vehicle has no Updates.
+func (m *MongoDB) GetFirstUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	return m.nearestUpdateForVehicle(vehicleForFeedQuery(vehicleID, feed), "created")
+}
+
+// GetUpdateForVehicleBefore returns a vehicle's latest Update created at or before t. It returns
+// ErrUpdateNotFound if there is none.
+func (m *MongoDB) GetUpdateForVehicleBefore(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error) {
+	return m.nearestUpdateForVehicle(vehicleUpdatesQuery(vehicleID, feed, bson.M{"$lte": t}), "-created")
+}
+
+// GetUpdateForVehicleAfter returns a vehicle's earliest Update created after t. It returns
+// ErrUpdateNotFound if there is none.
+func (m *MongoDB) GetUpdateForVehicleAfter(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error) {
+	return m.nearestUpdateForVehicle(vehicleUpdatesQuery(vehicleID, feed, bson.M{"$gt": t}), "created")
+}
+
+// GetUpdatesInBoundingBox returns every vehicle's Updates created after since whose positions are
+// within box, oldest first. Positions are stored as strings, which can't be compared as numbers in
+// a query, so Updates are found by the created index and then filtered by position.
+func (m *MongoDB) GetUpdatesInBoundingBox(box model.BoundingBox, since time.Time) ([]model.VehicleUpdate, error) {
+	inBox := []model.VehicleUpdate{}
+	if box.Empty() {
+		return inBox, nil
+	}
+	iter := m.updates.Find(bson.M{"created": bson.M{"$gt": since}}).Sort("created").Iter()
+	for {
+		var update model.VehicleUpdate
+		if !iter.Next(&update) {
+			break
+		}
+		if c, err := update.Coord(); err == nil && box.Contains(c) {
+			inBox = append(inBox, update)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return inBox, nil
+}
+
+// GetUpdateHeatmap counts every vehicle's Updates created from from until to in each cell of a
+// grid over box, with cells cellSize degrees on a side. Like GetUpdatesInBoundingBox, Updates are
+// found by the created index and then counted by position, but only their positions are fetched
+// and the Updates themselves are never returned.
+func (m *MongoDB) GetUpdateHeatmap(box model.BoundingBox, from, to time.Time, cellSize float64) (model.Heatmap, error) {
+	if cellSize <= 0 {
+		return model.Heatmap{}, ErrInvalidCellSize
+	}
+	if rows, cols := model.HeatmapSize(box, cellSize); rows*cols > model.MaxHeatmapCells {
+		return model.Heatmap{}, ErrHeatmapTooLarge
+	}
+	heatmap := model.NewHeatmap(box, cellSize)
+	if box.Empty() || !to.After(from) {
+		return heatmap, nil
+	}
+	query := bson.M{"created": bson.M{"$gte": from, "$lt": to}}
+	iter := m.updates.Find(query).Select(bson.M{"lat": 1, "lng": 1}).Iter()
+	for {
+		var update model.VehicleUpdate
+		if !iter.Next(&update) {
+			break
+		}
+		if c, err := update.Coord(); err == nil {
+			heatmap.Add(c)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return model.Heatmap{}, err
+	}
+	return heatmap, nil
+}
+
+// nearestUpdateForVehicle returns the first Update matching query in sort order. The vehicleID, feed,
+// and created index makes this a single index lookup.
+func (m *MongoDB) nearestUpdateForVehicle(query bson.M, sort string) (model.VehicleUpdate, error) {
+	var update model.VehicleUpdate
+	err := m.updates.Find(query).Sort(sort).One(&update)
+	if err == mgo.ErrNotFound {
+		return update, ErrUpdateNotFound
+	}
+	return update, err
+}
+
+// GetLatestUpdateTime returns the creation time of the most recent Update for any vehicle.
+// It returns ErrUpdateNotFound if there are no Updates.
+func (m *MongoDB) GetLatestUpdateTime() (time.Time, error) {
+	var update model.VehicleUpdate
+	err := m.updates.Find(bson.M{}).Sort("-created").One(&update)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, ErrUpdateNotFound
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return update.Created, nil
+}
+
+// GetActiveVehiclesSince returns the vehicles with Updates since a time, sorted by ID and then feed.
+func (m *MongoDB) GetActiveVehiclesSince(since time.Time) ([]model.VehicleKey, error) {
+	return m.reportingVehicles(bson.M{"created": bson.M{"$gt": since}})
+}
+
+// reportingVehicles returns the vehicles with Updates matching query, sorted by ID and then feed.
+func (m *MongoDB) reportingVehicles(query bson.M) ([]model.VehicleKey, error) {
+	pipeline := []bson.M{
+		{"$group": bson.M{"_id": bson.M{"vehicleID": "$vehicleID", "feed": "$feed"}}},
+	}
+	if query != nil {
+		pipeline = append([]bson.M{{"$match": query}}, pipeline...)
+	}
+	var groups []struct {
+		Vehicle struct {
+			VehicleID string `bson:"vehicleID"`
+			Feed      string `bson:"feed"`
+		} `bson:"_id"`
+	}
+	if err := m.updates.Pipe(pipeline).All(&groups); err != nil {
+		return nil, err
+	}
+
+	// Updates without a feed may have an empty or missing one, which are grouped separately.
+	seen := make(map[model.VehicleKey]bool, len(groups))
+	vehicles := []model.VehicleKey{}
+	for _, group := range groups {
+		vehicle := model.VehicleKey{VehicleID: group.Vehicle.VehicleID, Feed: group.Vehicle.Feed}
+		if !seen[vehicle] {
+			seen[vehicle] = true
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool {
+		if vehicles[i].VehicleID != vehicles[j].VehicleID {
+			return vehicles[i].VehicleID < vehicles[j].VehicleID
+		}
+		return vehicles[i].Feed < vehicles[j].Feed
+	})
+	return vehicles, nil
+}
+
+// GetUpdatesSince returns every vehicle's updates since a time, newest first.
+func (m *MongoDB) GetUpdatesSince(since time.Time) ([]model.VehicleUpdate, error) {
 	var updates []model.VehicleUpdate
-	err := m.updates.Find(bson.M{"vehicleID": vehicleID, "created": bson.M{"$gt": since}}).Sort("-created").All(&updates)
+	err := m.updates.Find(bson.M{"created": bson.M{"$gt": since}}).Sort("-created").All(&updates)
 	return updates, err
 }
 
+// GetUpdatesForVehicleSince returns all updates since a time for a vehicle by its ID, newest first.
+func (m *MongoDB) GetUpdatesForVehicleSince(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	return m.updatesForVehicleSince(vehicleID, feed, since, "-created")
+}
+
+// GetSampledUpdatesForVehicle returns a vehicle's updates since a time, oldest first, but no more
+// than one for each interval after since, so that long trails stay small. Each interval's earliest
+// update is the one returned. The sampling is done by MongoDB so that the rest are never sent.
+func (m *MongoDB) GetSampledUpdatesForVehicle(vehicleID string, feed string, since time.Time, interval time.Duration) ([]model.VehicleUpdate, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	// Subtracting dates gives milliseconds.
+	elapsed := bson.M{"$subtract": []interface{}{"$created", since}}
+	ms := int64(interval / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	pipeline := []bson.M{
+		{"$match": vehicleUpdatesQuery(vehicleID, feed, bson.M{"$gt": since})},
+		{"$sort": bson.M{"created": 1}},
+		{"$group": bson.M{
+			"_id":    bson.M{"$subtract": []interface{}{elapsed, bson.M{"$mod": []interface{}{elapsed, ms}}}},
+			"update": bson.M{"$first": "$$ROOT"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	var buckets []struct {
+		Update model.VehicleUpdate `bson:"update"`
+	}
+	if err := m.updates.Pipe(pipeline).All(&buckets); err != nil {
+		return nil, err
+	}
+	updates := make([]model.VehicleUpdate, len(buckets))
+	for i := range buckets {
+		updates[i] = buckets[i].Update
+	}
+	return updates, nil
+}
+
+// GetUpdatesForVehicleSinceAscending returns all updates since a time for a vehicle by its ID, oldest first.
+func (m *MongoDB) GetUpdatesForVehicleSinceAscending(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	return m.updatesForVehicleSince(vehicleID, feed, since, "created")
+}
+
+// GetUpdatesForVehicleBetween returns a vehicle's updates created at or after from and before to,
+// oldest first.
+func (m *MongoDB) GetUpdatesForVehicleBetween(vehicleID string, feed string, from, to time.Time) ([]model.VehicleUpdate, error) {
+	var updates []model.VehicleUpdate
+	err := m.updates.Find(vehicleUpdatesQuery(vehicleID, feed, bson.M{"$gte": from, "$lt": to})).Sort("created").All(&updates)
+	return updates, err
+}
+
+func (m *MongoDB) updatesForVehicleSince(vehicleID string, feed string, since time.Time, sort string) ([]model.VehicleUpdate, error) {
+	var updates []model.VehicleUpdate
+	err := m.updates.Find(vehicleUpdatesQuery(vehicleID, feed, bson.M{"$gt": since})).Sort(sort).All(&updates)
+	return updates, err
+}
+
+// vehicleUpdatesQuery selects a vehicle's Updates whose creation times match created.
+func vehicleUpdatesQuery(vehicleID string, feed string, created interface{}) bson.M {
+	query := vehicleForFeedQuery(vehicleID, feed)
+	query["created"] = created
+	return query
+}
+
+// GetUpdatesPage returns up to limit Updates, oldest first, following the position given by cursor.
+// Only the Updates for vehicleID in feed are returned unless vehicleID is empty. An empty cursor
+// starts from the beginning. The returned cursor leads to the next page, and is empty if this is the
+// last page.
+func (m *MongoDB) GetUpdatesPage(vehicleID string, feed string, cursor string, limit int) ([]model.VehicleUpdate, string, error) {
+	query := bson.M{}
+	if vehicleID != "" {
+		query = vehicleForFeedQuery(vehicleID, feed)
+	}
+	if cursor != "" {
+		c, err := parseUpdatesCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query["$or"] = []bson.M{
+			{"created": bson.M{"$gt": c.created}},
+			{"created": c.created, "_id": bson.M{"$gt": c.id}},
+		}
+	}
+
+	var docs []struct {
+		ID                  bson.ObjectId `bson:"_id"`
+		model.VehicleUpdate `bson:",inline"`
+	}
+	// Ask for one extra to find out whether there's another page.
+	if err := m.updates.Find(query).Sort("created", "_id").Limit(limit + 1).All(&docs); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		last := docs[len(docs)-1]
+		next = updatesCursor{created: last.Created, id: last.ID}.String()
+	}
+	updates := make([]model.VehicleUpdate, len(docs))
+	for i := range docs {
+		updates[i] = docs[i].VehicleUpdate
+	}
+	return updates, next, nil
+}
+
+// updatesCursor is a position among Updates ordered by creation time, with ties broken by ID.
+type updatesCursor struct {
+	created time.Time
+	id      bson.ObjectId
+}
+
+// String encodes the cursor so that it can be passed around opaquely.
+func (c updatesCursor) String() string {
+	s := strconv.FormatInt(c.created.UnixNano(), 10) + ":" + c.id.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseUpdatesCursor(s string) (updatesCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return updatesCursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return updatesCursor{}, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return updatesCursor{}, ErrInvalidCursor
+	}
+	return updatesCursor{created: time.Unix(0, nanos), id: bson.ObjectIdHex(parts[1])}, nil
+}
+
+// GetOccupancyByHour returns the average occupancy reported by vehicles on a route during each hour of
+// the day starting at day. Hours are in day's location.
+func (m *MongoDB) GetOccupancyByHour(routeID string, day time.Time) ([]model.HourlyOccupancy, error) {
+	var updates []model.VehicleUpdate
+	query := bson.M{
+		"routeID":   routeID,
+		"created":   bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)},
+		"occupancy": bson.M{"$exists": true},
+	}
+	if err := m.updates.Find(query).All(&updates); err != nil {
+		return nil, err
+	}
+	return hourlyOccupancy(updates, day.Location()), nil
+}
+
+// GetTrackGapsForVehicle returns the periods since since, oldest first, that are longer than minGap
+// and during which the vehicle sent no updates. Only the gaps between updates are found, so a
+// vehicle that has gone silent has no gap after its last update.
+func (m *MongoDB) GetTrackGapsForVehicle(vehicleID string, feed string, since time.Time, minGap time.Duration) ([]model.TrackGap, error) {
+	var updates []model.VehicleUpdate
+	query := vehicleUpdatesQuery(vehicleID, feed, bson.M{"$gt": since})
+	if err := m.updates.Find(query).Select(bson.M{"created": 1}).Sort("created").All(&updates); err != nil {
+		return nil, err
+	}
+	return trackGaps(updates, minGap), nil
+}
+
+// GetFleetStats totals the trips made by every vehicle from from until to. A period that doesn't
+// end after it starts has no trips. Updates are read one vehicle at a time, so only one vehicle's
+// updates are held at once.
+func (m *MongoDB) GetFleetStats(from, to time.Time) (model.FleetStats, error) {
+	tally := model.NewFleetTally(from, to)
+	if !to.After(from) {
+		return tally.Stats(), nil
+	}
+	iter := m.updates.Find(bson.M{"created": bson.M{"$gte": from, "$lt": to}}).Sort("vehicleID", "feed", "created").Iter()
+	var vehicleUpdates []model.VehicleUpdate
+	for {
+		var update model.VehicleUpdate
+		if !iter.Next(&update) {
+			break
+		}
+		if len(vehicleUpdates) > 0 && vehicleUpdates[0].Key() != update.Key() {
+			tally.Add(vehicleUpdates, model.TripGap)
+			vehicleUpdates = vehicleUpdates[:0]
+		}
+		vehicleUpdates = append(vehicleUpdates, update)
+	}
+	if err := iter.Close(); err != nil {
+		return model.FleetStats{}, err
+	}
+	tally.Add(vehicleUpdates, model.TripGap)
+	return tally.Stats(), nil
+}
+
+// trackGaps finds the gaps longer than minGap between consecutive updates, which must be sorted
+// oldest first.
+func trackGaps(updates []model.VehicleUpdate, minGap time.Duration) []model.TrackGap {
+	gaps := []model.TrackGap{}
+	for i := 1; i < len(updates); i++ {
+		start, end := updates[i-1].Created, updates[i].Created
+		if gap := end.Sub(start); gap > minGap {
+			gaps = append(gaps, model.TrackGap{Start: start, End: end, Duration: gap.Seconds()})
+		}
+	}
+	return gaps
+}
+
+// hourlyOccupancy averages the occupancy of updates into 24 hourly buckets.
+func hourlyOccupancy(updates []model.VehicleUpdate, loc *time.Location) []model.HourlyOccupancy {
+	var totals, counts [24]int
+	for _, update := range updates {
+		if update.Occupancy == nil {
+			continue
+		}
+		hour := update.Created.In(loc).Hour()
+		totals[hour] += *update.Occupancy
+		counts[hour]++
+	}
+
+	occupancy := make([]model.HourlyOccupancy, 24)
+	for hour := range occupancy {
+		occupancy[hour].Hour = hour
+		if counts[hour] > 0 {
+			average := float64(totals[hour]) / float64(counts[hour])
+			occupancy[hour].Average = &average
+		}
+	}
+	return occupancy
+}
+
 // GetUsers returns all Users.
 func (m *MongoDB) GetUsers() ([]model.User, error) {
 	var users []model.User
@@ -163,23 +1060,132 @@ func (m *MongoDB) GetUsers() ([]model.User, error) {
 	return users, err
 }
 
-// CreateVehicle creates a Vehicle.
+// CreateAPIClient creates an APIClient.
+func (m *MongoDB) CreateAPIClient(client *model.APIClient) error {
+	return m.apiClients.Insert(client)
+}
+
+// GetAPIClients returns all APIClients, ordered by name.
+func (m *MongoDB) GetAPIClients() ([]model.APIClient, error) {
+	clients := []model.APIClient{}
+	err := m.apiClients.Find(bson.M{}).Sort("name").All(&clients)
+	return clients, err
+}
+
+// DeleteAPIClient deletes an APIClient by its ID. It returns mgo.ErrNotFound if there is none.
+func (m *MongoDB) DeleteAPIClient(clientID string) error {
+	return m.apiClients.Remove(bson.M{"id": clientID})
+}
+
+// IssueAPIClientToken replaces an APIClient's token with the one whose hash is tokenHash, and
+// returns the modified APIClient. It returns mgo.ErrNotFound if there is none.
+func (m *MongoDB) IssueAPIClientToken(clientID string, tokenHash string, issued time.Time) (model.APIClient, error) {
+	update := bson.M{"$set": bson.M{"tokenHash": tokenHash, "tokenIssued": issued}}
+	return m.modifyAPIClient(bson.M{"id": clientID}, update)
+}
+
+// RevokeAPIClientToken removes an APIClient's token, so that it can no longer be used, and returns
+// the modified APIClient. It returns mgo.ErrNotFound if there is none.
+func (m *MongoDB) RevokeAPIClientToken(clientID string) (model.APIClient, error) {
+	return m.modifyAPIClient(bson.M{"id": clientID}, bson.M{"$unset": bson.M{"tokenHash": "", "tokenIssued": ""}})
+}
+
+// UseAPIClientToken finds the APIClient with the token whose hash is tokenHash and records that it
+// was used. It returns mgo.ErrNotFound if no APIClient has that token.
+func (m *MongoDB) UseAPIClientToken(tokenHash string, used time.Time) (model.APIClient, error) {
+	if tokenHash == "" {
+		return model.APIClient{}, mgo.ErrNotFound
+	}
+	return m.modifyAPIClient(bson.M{"tokenHash": tokenHash}, bson.M{"$set": bson.M{"lastUsed": used}})
+}
+
+// modifyAPIClient applies update to the APIClient matching query and returns it as modified.
+func (m *MongoDB) modifyAPIClient(query, update bson.M) (model.APIClient, error) {
+	var client model.APIClient
+	_, err := m.apiClients.Find(query).Apply(mgo.Change{Update: update, ReturnNew: true}, &client)
+	return client, err
+}
+
+// CreateVehicle creates a Vehicle. It returns ErrVehicleIDTaken if a Vehicle with the same ID
+// already exists in its data feed.
 func (m *MongoDB) CreateVehicle(vehicle *model.Vehicle) error {
-	return m.vehicles.Insert(&vehicle)
+	err := m.vehicles.Insert(&vehicle)
+	if mgo.IsDup(err) {
+		return ErrVehicleIDTaken
+	}
+	return err
 }
 
-// DeleteVehicle deletes a Vehicle by its ID.
-func (m *MongoDB) DeleteVehicle(vehicleID string) error {
-	return m.vehicles.Remove(bson.M{"vehicleID": vehicleID})
+// DeleteVehicle deletes a Vehicle by its ID within a data feed.
+func (m *MongoDB) DeleteVehicle(vehicleID string, feed string) error {
+	return m.vehicles.Remove(vehicleForFeedQuery(vehicleID, feed))
 }
 
-// GetVehicle returns a Vehicle by its ID.
-func (m *MongoDB) GetVehicle(vehicleID string) (model.Vehicle, error) {
+// MergeVehicles moves all of the merged Vehicle's updates, including archived ones, to the kept
+// Vehicle, then deletes the merged Vehicle. It returns mgo.ErrNotFound if either doesn't exist.
+//
+// The MongoDB versions supported here have no multi-document transactions, so the merge is
+// recorded on the merged Vehicle's MergingInto before anything is moved. If the merge fails
+// partway through, retrying it finishes it, since each step can safely be repeated. Until then,
+// neither Vehicle can be merged with any other, which returns ErrVehicleMerging, so the updates
+// can't end up split between more vehicles.
+func (m *MongoDB) MergeVehicles(keep model.VehicleKey, merge model.VehicleKey) error {
+	kept, err := m.GetVehicle(keep.VehicleID, keep.Feed)
+	if err != nil {
+		return err
+	}
+	if kept.MergingInto != nil {
+		return ErrVehicleMerging
+	}
+	query := vehicleForFeedQuery(merge.VehicleID, merge.Feed)
+	query["mergingInto"] = bson.M{"$in": []interface{}{nil, keep}}
+	err = m.vehicles.Update(query, bson.M{"$set": bson.M{"mergingInto": keep}})
+	if err == mgo.ErrNotFound {
+		// Either there's no such Vehicle, or it's being merged into another.
+		if _, err := m.GetVehicle(merge.VehicleID, merge.Feed); err != nil {
+			return err
+		}
+		return ErrVehicleMerging
+	} else if err != nil {
+		return err
+	}
+
+	move := bson.M{"$set": bson.M{"vehicleID": keep.VehicleID, "feed": keep.Feed}}
+	if keep.Feed == "" {
+		move = bson.M{"$set": bson.M{"vehicleID": keep.VehicleID}, "$unset": bson.M{"feed": ""}}
+	}
+	for _, updates := range []*mgo.Collection{m.updates, m.updatesArchive} {
+		_, err := updates.UpdateAll(vehicleForFeedQuery(merge.VehicleID, merge.Feed), move)
+		if err != nil {
+			return err
+		}
+	}
+	return m.DeleteVehicle(merge.VehicleID, merge.Feed)
+}
+
+// GetVehicle returns a Vehicle by its ID within a data feed. Vehicles without a feed are found
+// with an empty feed.
+func (m *MongoDB) GetVehicle(vehicleID string, feed string) (model.Vehicle, error) {
 	var vehicle model.Vehicle
-	err := m.vehicles.Find(bson.M{"vehicleID": vehicleID}).One(&vehicle)
+	err := m.vehicles.Find(vehicleForFeedQuery(vehicleID, feed)).One(&vehicle)
 	return vehicle, err
 }
 
+// SetVehicleHeartbeat records when a Vehicle within a data feed last reported.
+func (m *MongoDB) SetVehicleHeartbeat(vehicleID string, feed string, heartbeat time.Time) error {
+	return m.vehicles.Update(vehicleForFeedQuery(vehicleID, feed), bson.M{"$set": bson.M{"lastHeartbeat": heartbeat}})
+}
+
+// vehicleForFeedQuery selects a vehicle's Vehicle or Updates by its ID within a data feed. Those
+// stored without a feed are selected with an empty feed.
+func vehicleForFeedQuery(vehicleID string, feed string) bson.M {
+	query := bson.M{"vehicleID": vehicleID, "feed": feed}
+	if feed == "" {
+		query["feed"] = bson.M{"$in": []interface{}{nil, ""}}
+	}
+	return query
+}
+
 // GetVehicles returns all Vehicles.
 func (m *MongoDB) GetVehicles() ([]model.Vehicle, error) {
 	var vehicles []model.Vehicle
@@ -187,6 +1193,45 @@ func (m *MongoDB) GetVehicles() ([]model.Vehicle, error) {
 	return vehicles, err
 }
 
+// vehicleSortFields maps the fields Vehicles may be sorted by to their keys. Only these keys may
+// be used, so that requests can't sort by arbitrary keys.
+var vehicleSortFields = map[string]string{
+	"":        "vehicleName",
+	"name":    "vehicleName",
+	"created": "created",
+	"enabled": "enabled",
+}
+
+// QueryVehicles returns the Vehicles selected by query, along with how many there are in total
+// before limiting and offsetting. It returns ErrInvalidSort if the sort field isn't allowed.
+func (m *MongoDB) QueryVehicles(query VehicleQuery) ([]model.Vehicle, int, error) {
+	key, ok := vehicleSortFields[query.Sort]
+	if !ok {
+		return nil, 0, ErrInvalidSort
+	}
+	if query.Descending {
+		key = "-" + key
+	}
+
+	filter := bson.M{}
+	if query.NameLike != "" {
+		filter["vehicleName"] = bson.M{"$regex": regexp.QuoteMeta(query.NameLike), "$options": "i"}
+	}
+	total, err := m.vehicles.Find(filter).Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Break ties by ID so that pages are stable.
+	q := m.vehicles.Find(filter).Sort(key, "vehicleID").Skip(query.Offset)
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	vehicles := []model.Vehicle{}
+	err = q.All(&vehicles)
+	return vehicles, total, err
+}
+
 // GetEnabledVehicles returns all Vehicles that are enabled.
 func (m *MongoDB) GetEnabledVehicles() ([]model.Vehicle, error) {
 	var vehicles []model.Vehicle
@@ -194,7 +1239,49 @@ func (m *MongoDB) GetEnabledVehicles() ([]model.Vehicle, error) {
 	return vehicles, err
 }
 
-// ModifyVehicle updates a Vehicle by its ID.
+// GetVehiclesWithoutUpdates returns the Vehicles that have never reported, such as those with the
+// wrong iTrak ID, sorted by ID.
+func (m *MongoDB) GetVehiclesWithoutUpdates() ([]model.Vehicle, error) {
+	reporting, err := m.reportingVehicles(nil)
+	if err != nil {
+		return nil, err
+	}
+	reported := make(map[model.VehicleKey]bool, len(reporting))
+	for _, vehicle := range reporting {
+		reported[vehicle] = true
+	}
+
+	var all []model.Vehicle
+	if err := m.vehicles.Find(nil).Sort("vehicleID").All(&all); err != nil {
+		return nil, err
+	}
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range all {
+		if !reported[vehicle.Key()] {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	return vehicles, nil
+}
+
+// ModifyVehicle updates a Vehicle by its ID within its data feed.
 func (m *MongoDB) ModifyVehicle(vehicle *model.Vehicle) error {
-	return m.vehicles.Update(bson.M{"vehicleID": vehicle.VehicleID}, vehicle)
+	return m.vehicles.Update(vehicleForFeedQuery(vehicle.VehicleID, vehicle.Feed), vehicle)
+}
+
+// SetVehiclesEnabled enables or disables many Vehicles at once and returns how many matched.
+func (m *MongoDB) SetVehiclesEnabled(vehicles []model.VehicleKey, enabled bool) (int, error) {
+	if len(vehicles) == 0 {
+		return 0, nil
+	}
+	selectors := make([]bson.M, len(vehicles))
+	for i, vehicle := range vehicles {
+		selectors[i] = vehicleForFeedQuery(vehicle.VehicleID, vehicle.Feed)
+	}
+	info, err := m.vehicles.UpdateAll(bson.M{"$or": selectors},
+		bson.M{"$set": bson.M{"enabled": enabled, "updated": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Matched, nil
 }
@@ -0,0 +1,1348 @@
+package database
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// newTestMongoDB connects to the MongoDB server at SHUTTLETRACKER_TEST_MONGOURL. The test is
+// skipped if that variable is unset. Call the returned function to drop the test database.
+func newTestMongoDB(t *testing.T) (*MongoDB, func()) {
+	url := os.Getenv("SHUTTLETRACKER_TEST_MONGOURL")
+	if url == "" {
+		t.Skip("SHUTTLETRACKER_TEST_MONGOURL is not set.")
+	}
+	db, err := NewMongoDB(MongoDBConfig{MongoURL: url})
+	if err != nil {
+		t.Fatalf("Unable to connect to MongoDB: %v", err)
+	}
+	return db, func() {
+		if err := db.session.DB("").DropDatabase(); err != nil {
+			t.Errorf("Unable to drop test database: %v", err)
+		}
+		db.session.Close()
+	}
+}
+
+func TestNewMongoDBType(t *testing.T) {
+	url := os.Getenv("SHUTTLETRACKER_TEST_MONGOURL")
+	if url == "" {
+		t.Skip("SHUTTLETRACKER_TEST_MONGOURL is not set.")
+	}
+	for _, backend := range []string{"", "mongodb"} {
+		db, err := New(MongoDBConfig{Type: backend, MongoURL: url})
+		if err != nil {
+			t.Fatalf("Unable to create database of type %q: %v", backend, err)
+		}
+		mongo, ok := db.(*MongoDB)
+		if !ok {
+			t.Fatalf("Got %T for type %q, expected *MongoDB.", db, backend)
+		}
+		mongo.session.Close()
+	}
+}
+
+func TestGetLatestUpdateTime(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	if _, err := db.GetLatestUpdateTime(); err != ErrUpdateNotFound {
+		t.Errorf("Got error %v, expected %v.", err, ErrUpdateNotFound)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	for i, vehicleID := range []string{"1", "2", "1"} {
+		update := model.VehicleUpdate{VehicleID: vehicleID, Created: now.Add(time.Duration(-i) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	latest, err := db.GetLatestUpdateTime()
+	if err != nil {
+		t.Fatalf("Unable to get latest update time: %v", err)
+	}
+	if !latest.Equal(now) {
+		t.Errorf("Got %v, expected %v.", latest, now)
+	}
+}
+
+func TestDeleteUpdatesBeforePerVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	vehicles := []model.Vehicle{
+		{VehicleID: "1", VehicleName: "Default"},
+		{VehicleID: "2", VehicleName: "Research", RetentionDays: 365},
+	}
+	for i := range vehicles {
+		if err := db.CreateVehicle(&vehicles[i]); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+
+	// Each vehicle has an update from yesterday and one from two months ago.
+	now := time.Now()
+	for _, vehicle := range vehicles {
+		for _, created := range []time.Time{now.AddDate(0, 0, -1), now.AddDate(0, -2, 0)} {
+			update := model.VehicleUpdate{VehicleID: vehicle.VehicleID, Created: created}
+			if err := db.CreateUpdate(&update); err != nil {
+				t.Fatalf("Unable to create update: %v", err)
+			}
+		}
+	}
+
+	removed, err := db.DeleteUpdatesBeforePerVehicle(now.AddDate(0, -1, 0))
+	if err != nil {
+		t.Fatalf("Unable to delete updates: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Got %d removed, expected 1.", removed)
+	}
+
+	since := now.AddDate(-1, 0, 0)
+	for vehicleID, expected := range map[string]int{"1": 1, "2": 2} {
+		updates, err := db.GetUpdatesForVehicleSince(vehicleID, "", since)
+		if err != nil {
+			t.Fatalf("Unable to get updates: %v", err)
+		}
+		if len(updates) != expected {
+			t.Errorf("Vehicle %s has %d updates, expected %d.", vehicleID, len(updates), expected)
+		}
+	}
+}
+
+func TestGetVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	vehicles := []model.Vehicle{
+		{VehicleID: "1", VehicleName: "Unassigned"},
+		{VehicleID: "1", VehicleName: "Vendor A", Feed: "a"},
+		{VehicleID: "1", VehicleName: "Vendor B", Feed: "b"},
+	}
+	for i := range vehicles {
+		if err := db.CreateVehicle(&vehicles[i]); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+
+	for feed, expected := range map[string]string{"": "Unassigned", "a": "Vendor A", "b": "Vendor B"} {
+		vehicle, err := db.GetVehicle("1", feed)
+		if err != nil {
+			t.Fatalf("Unable to get vehicle for feed %q: %v", feed, err)
+		}
+		if vehicle.VehicleName != expected {
+			t.Errorf("Got %s for feed %q, expected %s.", vehicle.VehicleName, feed, expected)
+		}
+	}
+}
+
+func TestVehicleFeedsKeepSeparateHistories(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	// Two vendors' feeds both report a vehicle 1, and a vehicle without a feed shares the ID.
+	for _, feed := range []string{"", "a", "b"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: "1", Feed: feed}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+	now := time.Now()
+	counts := map[string]int{"": 1, "a": 2, "b": 3}
+	for feed, count := range counts {
+		for i := 0; i < count; i++ {
+			update := model.VehicleUpdate{VehicleID: "1", Feed: feed, Created: now.Add(time.Duration(-i-len(feed)*10) * time.Minute)}
+			if err := db.CreateUpdate(&update); err != nil {
+				t.Fatalf("Unable to create update: %v", err)
+			}
+		}
+	}
+
+	for feed, count := range counts {
+		updates, err := db.GetUpdatesForVehicleSince("1", feed, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("Unable to get updates: %v", err)
+		}
+		if len(updates) != count {
+			t.Errorf("Got %d updates for feed %q, expected %d.", len(updates), feed, count)
+		}
+		for _, update := range updates {
+			if update.Feed != feed {
+				t.Errorf("Got update from feed %q for feed %q.", update.Feed, feed)
+			}
+		}
+		last, err := db.GetLastUpdateForVehicle("1", feed)
+		if err != nil {
+			t.Fatalf("Unable to get last update: %v", err)
+		}
+		if expected := now.Add(time.Duration(-len(feed)*10) * time.Minute); !last.Created.Equal(expected.Truncate(time.Millisecond)) {
+			t.Errorf("Got last update at %v for feed %q, expected %v.", last.Created, feed, expected)
+		}
+	}
+
+	deleted, err := db.DeleteUpdatesForVehicle("1", "a")
+	if err != nil {
+		t.Fatalf("Unable to delete updates: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Deleted %d updates, expected 2.", deleted)
+	}
+	for feed, expected := range map[string]int{"": 1, "b": 3} {
+		updates, err := db.GetUpdatesForVehicleSince("1", feed, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("Unable to get updates: %v", err)
+		}
+		if len(updates) != expected {
+			t.Errorf("Got %d updates for feed %q after deleting feed a's, expected %d.", len(updates), feed, expected)
+		}
+	}
+}
+
+func TestArchiveUpdatesBeforePerVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	// Archive a partial batch after a full one.
+	batchSize := archiveBatchSize
+	archiveBatchSize = 2
+	defer func() {
+		archiveBatchSize = batchSize
+	}()
+
+	now := time.Now()
+	for _, created := range []time.Time{now, now.AddDate(0, -2, 0), now.AddDate(0, -3, 0), now.AddDate(0, -4, 0)} {
+		update := model.VehicleUpdate{VehicleID: "1", Created: created}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	archived, err := db.ArchiveUpdatesBeforePerVehicle(now.AddDate(0, -1, 0))
+	if err != nil {
+		t.Fatalf("Unable to archive updates: %v", err)
+	}
+	if archived != 3 {
+		t.Errorf("Got %d archived, expected 3.", archived)
+	}
+
+	live, err := db.updates.Count()
+	if err != nil {
+		t.Fatalf("Unable to count updates: %v", err)
+	}
+	if live != 1 {
+		t.Errorf("Got %d live updates, expected 1.", live)
+	}
+	var archive []model.VehicleUpdate
+	if err := db.updatesArchive.Find(nil).All(&archive); err != nil {
+		t.Fatalf("Unable to get archived updates: %v", err)
+	}
+	if len(archive) != 3 {
+		t.Fatalf("Got %d archived updates, expected 3.", len(archive))
+	}
+	for _, update := range archive {
+		if update.Created.After(now.AddDate(0, -1, 0)) {
+			t.Errorf("Archived update from %v, expected only old updates.", update.Created)
+		}
+	}
+}
+
+func TestDeleteUpdatesExceedingCountPerVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	now := time.Now().Truncate(time.Millisecond)
+	counts := map[string]int{"over": 5, "under": 2}
+	for vehicleID, count := range counts {
+		for i := 0; i < count; i++ {
+			update := model.VehicleUpdate{VehicleID: vehicleID, Created: now.Add(time.Duration(-i) * time.Minute)}
+			if err := db.CreateUpdate(&update); err != nil {
+				t.Fatalf("Unable to create update: %v", err)
+			}
+		}
+	}
+	// Quiet hasn't reported since the last prune, so it's left alone.
+	for i := 0; i < 5; i++ {
+		update := model.VehicleUpdate{VehicleID: "quiet", Created: now.Add(time.Duration(-i-10) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	removed, err := db.DeleteUpdatesExceedingCountPerVehicle(3, now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("Unable to delete updates: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Got %d removed, expected 2.", removed)
+	}
+
+	since := now.Add(-time.Hour)
+	over, err := db.GetUpdatesForVehicleSince("over", "", since)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(over) != 3 {
+		t.Fatalf("Got %d updates, expected 3.", len(over))
+	}
+	if oldest := over[len(over)-1].Created; !oldest.Equal(now.Add(-2 * time.Minute)) {
+		t.Errorf("Got oldest update from %v, expected the three most recent to be kept.", oldest)
+	}
+	under, err := db.GetUpdatesForVehicleSince("under", "", since)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(under) != 2 {
+		t.Errorf("Got %d updates, expected 2.", len(under))
+	}
+	quiet, err := db.GetUpdatesForVehicleSince("quiet", "", since)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(quiet) != 5 {
+		t.Errorf("Got %d updates for a quiet vehicle, expected 5.", len(quiet))
+	}
+}
+
+func TestSetVehiclesEnabled(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: id, Enabled: true}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+
+	matched, err := db.SetVehiclesEnabled([]model.VehicleKey{{VehicleID: "1"}, {VehicleID: "3"}, {VehicleID: "4"}}, false)
+	if err != nil {
+		t.Fatalf("Unable to disable vehicles: %v", err)
+	}
+	if matched != 2 {
+		t.Errorf("Matched %d vehicles, expected 2.", matched)
+	}
+
+	enabled, err := db.GetEnabledVehicles()
+	if err != nil {
+		t.Fatalf("Unable to get enabled vehicles: %v", err)
+	}
+	if len(enabled) != 1 || enabled[0].VehicleID != "2" {
+		t.Errorf("Got enabled vehicles %+v, expected only vehicle 2.", enabled)
+	}
+}
+
+func TestCreateRouteColors(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+	db.palette = []string{"#ff0000", "#00ff00", "#0000ff"}
+
+	// A disabled route's color is free to use.
+	if err := db.CreateRoute(&model.Route{ID: "disabled", Color: "#ff0000"}); err != nil {
+		t.Fatalf("Unable to create route: %v", err)
+	}
+	for i, expected := range []string{"#ff0000", "#00ff00", "#0000ff", "#ff0000"} {
+		route := model.Route{ID: strconv.Itoa(i), Enabled: true, Coords: []model.Coord{{Lat: 42.73, Lng: -73.68}, {Lat: 42.74, Lng: -73.68}}}
+		if err := db.CreateRoute(&route); err != nil {
+			t.Fatalf("Unable to create route: %v", err)
+		}
+		stored, err := db.GetRoute(route.ID)
+		if err != nil {
+			t.Fatalf("Unable to get route: %v", err)
+		}
+		if stored.Color != expected {
+			t.Errorf("Got color %s for route %d, expected %s.", stored.Color, i, expected)
+		}
+	}
+
+	route := model.Route{ID: "chosen", Color: "#123456"}
+	if err := db.CreateRoute(&route); err != nil {
+		t.Fatalf("Unable to create route: %v", err)
+	}
+	if route.Color != "#123456" {
+		t.Errorf("Got color %s, expected the route's own color to be kept.", route.Color)
+	}
+}
+
+func TestCreateRouteTooFewCoords(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	if err := db.CreateRoute(&model.Route{ID: "empty", Enabled: true}); err != ErrRouteTooFewCoords {
+		t.Errorf("Got error %v, expected %v.", err, ErrRouteTooFewCoords)
+	}
+	if _, err := db.GetRoute("empty"); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for the rejected route, expected %v.", err, mgo.ErrNotFound)
+	}
+}
+
+func TestSetRoutesEnabled(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	coords := []model.Coord{{Lat: 42.73, Lng: -73.68}, {Lat: 42.74, Lng: -73.68}}
+	for _, route := range []model.Route{{ID: "west", Coords: coords}, {ID: "empty"}} {
+		if err := db.CreateRoute(&route); err != nil {
+			t.Fatalf("Unable to create route: %v", err)
+		}
+	}
+
+	if _, err := db.SetRoutesEnabled([]string{"west", "empty"}, true); err != ErrRouteTooFewCoords {
+		t.Errorf("Got error %v, expected %v.", err, ErrRouteTooFewCoords)
+	}
+	if matched, err := db.SetRoutesEnabled([]string{"west"}, true); err != nil || matched != 1 {
+		t.Errorf("Got %d and error %v, expected 1 and no error.", matched, err)
+	}
+	route, err := db.GetRoute("west")
+	if err != nil {
+		t.Fatalf("Unable to get route: %v", err)
+	}
+	if !route.Enabled {
+		t.Error("Expected west to be enabled.")
+	}
+}
+
+func TestGetRoutesModifiedSince(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	created := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for _, id := range []string{"west", "east", "north"} {
+		route := model.Route{ID: id, Created: created, Updated: created}
+		if err := db.CreateRoute(&route); err != nil {
+			t.Fatalf("Unable to create route: %v", err)
+		}
+	}
+	since := created.Add(time.Minute)
+	route, err := db.GetRoute("east")
+	if err != nil {
+		t.Fatalf("Unable to get route: %v", err)
+	}
+	route.Name = "East"
+	route.Updated = since.Add(time.Minute)
+	if err := db.ModifyRoute(&route); err != nil {
+		t.Fatalf("Unable to modify route: %v", err)
+	}
+
+	routes, err := db.GetRoutesModifiedSince(since)
+	if err != nil {
+		t.Fatalf("Unable to get routes: %v", err)
+	}
+	if len(routes) != 1 || routes[0].ID != "east" || routes[0].Name != "East" {
+		t.Errorf("Got %+v, expected only east.", routes)
+	}
+}
+
+func TestGetUpdatesPage(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	// Several updates share creation times, so paging must break ties consistently.
+	now := time.Now().Truncate(time.Millisecond)
+	expected := map[string]bool{}
+	for i := 0; i < 25; i++ {
+		vehicleID := strconv.Itoa(i % 2)
+		update := model.VehicleUpdate{VehicleID: vehicleID, Time: strconv.Itoa(i), Created: now.Add(time.Duration(i/3) * time.Second)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+		expected[update.Time] = true
+	}
+
+	for _, vehicleID := range []string{"", "1"} {
+		seen := map[string]bool{}
+		cursor := ""
+		var last time.Time
+		for pages := 0; ; pages++ {
+			if pages > 25 {
+				t.Fatal("Too many pages.")
+			}
+			updates, next, err := db.GetUpdatesPage(vehicleID, "", cursor, 4)
+			if err != nil {
+				t.Fatalf("Unable to get page: %v", err)
+			}
+			for _, update := range updates {
+				if seen[update.Time] {
+					t.Errorf("Update %s was returned twice.", update.Time)
+				}
+				if vehicleID != "" && update.VehicleID != vehicleID {
+					t.Errorf("Got update for vehicle %s, expected %s.", update.VehicleID, vehicleID)
+				}
+				if update.Created.Before(last) {
+					t.Errorf("Update %s is out of order.", update.Time)
+				}
+				seen[update.Time] = true
+				last = update.Created
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		for updateTime := range expected {
+			index, _ := strconv.Atoi(updateTime)
+			if (vehicleID == "" || strconv.Itoa(index%2) == vehicleID) && !seen[updateTime] {
+				t.Errorf("Update %s was skipped for vehicle %q.", updateTime, vehicleID)
+			}
+		}
+	}
+
+	if _, _, err := db.GetUpdatesPage("", "", "bogus", 4); err != ErrInvalidCursor {
+		t.Errorf("Got error %v, expected %v.", err, ErrInvalidCursor)
+	}
+}
+
+func TestGetUpdatesForVehicleSinceOrder(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	// Insert out of order so that the results can't simply follow insertion order.
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, minutes := range []int{2, 0, 3, 1} {
+		update := model.VehicleUpdate{VehicleID: "1", Created: start.Add(time.Duration(minutes) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	descending, err := db.GetUpdatesForVehicleSince("1", "", start)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	ascending, err := db.GetUpdatesForVehicleSinceAscending("1", "", start)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+
+	// The update at start itself is excluded.
+	if len(descending) != 3 || len(ascending) != 3 {
+		t.Fatalf("Got %d and %d updates, expected 3.", len(descending), len(ascending))
+	}
+	for i := 0; i < 3; i++ {
+		if expected := start.Add(time.Duration(3-i) * time.Minute); !descending[i].Created.Equal(expected) {
+			t.Errorf("Descending update %d was created at %v, expected %v.", i, descending[i].Created, expected)
+		}
+		if expected := start.Add(time.Duration(i+1) * time.Minute); !ascending[i].Created.Equal(expected) {
+			t.Errorf("Ascending update %d was created at %v, expected %v.", i, ascending[i].Created, expected)
+		}
+	}
+}
+
+func TestGetUpdatesForVehicleBetween(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, update := range []model.VehicleUpdate{
+		{VehicleID: "1", Created: start.Add(2 * time.Minute)},
+		{VehicleID: "1", Created: start},
+		{VehicleID: "1", Created: start.Add(3 * time.Minute)},
+		{VehicleID: "1", Created: start.Add(-time.Minute)},
+		{VehicleID: "2", Created: start.Add(time.Minute)},
+	} {
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	// The update at from is included, but the one at to isn't.
+	updates, err := db.GetUpdatesForVehicleBetween("1", "", start, start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(updates) != 2 || !updates[0].Created.Equal(start) || !updates[1].Created.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("Got updates %+v, expected the ones at %v and two minutes later.", updates, start)
+	}
+}
+
+func TestGetLastUpdatesForVehicles(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, update := range []model.VehicleUpdate{
+		{VehicleID: "1", Created: start},
+		{VehicleID: "1", Created: start.Add(2 * time.Minute)},
+		{VehicleID: "1", Created: start.Add(time.Minute)},
+		{VehicleID: "2", Created: start},
+		{VehicleID: "3", Created: start.Add(time.Hour)},
+	} {
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	// Vehicle 3 wasn't asked for, and vehicle 4 has never reported.
+	updates, err := db.GetLastUpdatesForVehicles([]model.VehicleKey{{VehicleID: "1"}, {VehicleID: "2"}, {VehicleID: "4"}})
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	one, two := model.VehicleKey{VehicleID: "1"}, model.VehicleKey{VehicleID: "2"}
+	if len(updates) != 2 || !updates[one].Created.Equal(start.Add(2*time.Minute)) || !updates[two].Created.Equal(start) {
+		t.Errorf("Got %+v, expected the latest updates for vehicles 1 and 2.", updates)
+	}
+
+	since, err := db.GetUpdatesSince(start)
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(since) != 3 || since[0].VehicleID != "3" || !since[2].Created.Equal(start.Add(time.Minute)) {
+		t.Errorf("Got %+v, expected the three updates after %v, newest first.", since, start)
+	}
+}
+
+func TestGetFirstUpdateForVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	if _, err := db.GetFirstUpdateForVehicle("1", ""); err != ErrUpdateNotFound {
+		t.Errorf("Got error %v, expected %v.", err, ErrUpdateNotFound)
+	}
+
+	// Insert out of order, with another vehicle's update earlier still.
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, u := range []struct {
+		vehicleID string
+		minutes   int
+	}{{"1", 20}, {"1", 5}, {"2", 0}, {"1", 10}} {
+		update := model.VehicleUpdate{VehicleID: u.vehicleID, Created: start.Add(time.Duration(u.minutes) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	first, err := db.GetFirstUpdateForVehicle("1", "")
+	if err != nil {
+		t.Fatalf("Unable to get first update: %v", err)
+	}
+	if expected := start.Add(5 * time.Minute); !first.Created.Equal(expected) {
+		t.Errorf("Got first update created at %v, expected %v.", first.Created, expected)
+	}
+}
+
+func TestGetSampledUpdatesForVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	// One update every five seconds for ten minutes, and a few from another vehicle.
+	since := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 120; i++ {
+		update := model.VehicleUpdate{VehicleID: "1", Created: since.Add(time.Duration(i) * 5 * time.Second)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+		if i%10 == 0 {
+			other := model.VehicleUpdate{VehicleID: "2", Created: update.Created}
+			if err := db.CreateUpdate(&other); err != nil {
+				t.Fatalf("Unable to create update: %v", err)
+			}
+		}
+	}
+
+	updates, err := db.GetSampledUpdatesForVehicle("1", "", since, time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to get sampled updates: %v", err)
+	}
+	// The final update, exactly ten minutes in, starts an eleventh minute.
+	if len(updates) != 11 {
+		t.Fatalf("Got %d updates, expected one for each of 11 minutes.", len(updates))
+	}
+	for i, update := range updates {
+		// Each minute's first update is on the minute, except the first since only later updates count.
+		expected := since.Add(time.Duration(i) * time.Minute)
+		if i == 0 {
+			expected = since.Add(5 * time.Second)
+		}
+		if update.VehicleID != "1" || !update.Created.Equal(expected) {
+			t.Errorf("Got update %d from %s at %v, expected vehicle 1 at %v.", i, update.VehicleID, update.Created, expected)
+		}
+	}
+
+	if _, err := db.GetSampledUpdatesForVehicle("1", "", since, 0); err != ErrInvalidInterval {
+		t.Errorf("Got error %v for no interval, expected %v.", err, ErrInvalidInterval)
+	}
+}
+
+func TestGetUpdateForVehicleBeforeAndAfter(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, u := range []struct {
+		vehicleID string
+		minutes   int
+	}{{"1", 0}, {"1", 10}, {"1", 20}, {"1", 30}, {"2", 15}} {
+		update := model.VehicleUpdate{VehicleID: u.vehicleID, Created: start.Add(time.Duration(u.minutes) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	// Updates on both sides of 12:15, ignoring vehicle 2's update right at it.
+	target := start.Add(15 * time.Minute)
+	before, err := db.GetUpdateForVehicleBefore("1", "", target)
+	if err != nil {
+		t.Fatalf("Unable to get update before: %v", err)
+	}
+	if expected := start.Add(10 * time.Minute); !before.Created.Equal(expected) {
+		t.Errorf("Got update before created at %v, expected %v.", before.Created, expected)
+	}
+	after, err := db.GetUpdateForVehicleAfter("1", "", target)
+	if err != nil {
+		t.Fatalf("Unable to get update after: %v", err)
+	}
+	if expected := start.Add(20 * time.Minute); !after.Created.Equal(expected) {
+		t.Errorf("Got update after created at %v, expected %v.", after.Created, expected)
+	}
+
+	// Updates on only one side.
+	if _, err := db.GetUpdateForVehicleBefore("1", "", start.Add(-time.Minute)); err != ErrUpdateNotFound {
+		t.Errorf("Got error %v before the first update, expected %v.", err, ErrUpdateNotFound)
+	}
+	if after, err := db.GetUpdateForVehicleAfter("1", "", start.Add(-time.Minute)); err != nil || !after.Created.Equal(start) {
+		t.Errorf("Got %v and error %v after a minute before the first update, expected the first update.", after.Created, err)
+	}
+	if _, err := db.GetUpdateForVehicleAfter("1", "", start.Add(30*time.Minute)); err != ErrUpdateNotFound {
+		t.Errorf("Got error %v after the last update, expected %v.", err, ErrUpdateNotFound)
+	}
+	if before, err := db.GetUpdateForVehicleBefore("1", "", start.Add(30*time.Minute)); err != nil || !before.Created.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("Got %v and error %v at the last update, expected the last update.", before.Created, err)
+	}
+}
+
+func TestGetUpdatesInBoundingBox(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i, position := range []struct{ lat, lng string }{
+		{"42.7300", "-73.6800"},
+		{"42.7400", "-73.6800"}, // north of the box
+		{"42.7300", "-73.6700"}, // east of the box
+		{"42.7301", "-73.6801"},
+	} {
+		update := model.VehicleUpdate{VehicleID: "1", Lat: position.lat, Lng: position.lng, Created: start.Add(time.Duration(i) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	box := model.BoundingBox{MinLat: 42.729, MinLng: -73.681, MaxLat: 42.731, MaxLng: -73.679}
+	updates, err := db.GetUpdatesInBoundingBox(box, start.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(updates) != 2 || updates[0].Lat != "42.7300" || updates[1].Lat != "42.7301" {
+		t.Errorf("Got %+v, expected the two updates inside the box.", updates)
+	}
+
+	if updates, err := db.GetUpdatesInBoundingBox(box, start); err != nil || len(updates) != 1 {
+		t.Errorf("Got %+v and error %v since the first update, expected one update.", updates, err)
+	}
+	empty := model.BoundingBox{MinLat: 42.731, MinLng: -73.681, MaxLat: 42.729, MaxLng: -73.679}
+	if updates, err := db.GetUpdatesInBoundingBox(empty, time.Time{}); err != nil || len(updates) != 0 {
+		t.Errorf("Got %+v and error %v for an empty box, expected no updates.", updates, err)
+	}
+}
+
+func TestGetUpdateHeatmap(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i, position := range []struct{ lat, lng string }{
+		{"42.7250", "-73.6850"},
+		{"42.7260", "-73.6840"},
+		{"42.7350", "-73.6750"},
+		{"42.7500", "-73.6850"}, // north of the box
+	} {
+		update := model.VehicleUpdate{VehicleID: strconv.Itoa(i % 2), Lat: position.lat, Lng: position.lng, Created: start.Add(time.Duration(i) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	box := model.BoundingBox{MinLat: 42.72, MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.67}
+	heatmap, err := db.GetUpdateHeatmap(box, start, start.Add(time.Hour), 0.01)
+	if err != nil {
+		t.Fatalf("Unable to get heatmap: %v", err)
+	}
+	expected := [][]int{{2, 0}, {0, 1}}
+	if !reflect.DeepEqual(heatmap.Counts, expected) || heatmap.Total != 3 {
+		t.Errorf("Got counts %v and total %d, expected %v and 3.", heatmap.Counts, heatmap.Total, expected)
+	}
+
+	// The period ends before the last update in the box.
+	if heatmap, err := db.GetUpdateHeatmap(box, start, start.Add(2*time.Minute), 0.01); err != nil || heatmap.Total != 2 {
+		t.Errorf("Got %+v and error %v, expected two updates.", heatmap, err)
+	}
+	if _, err := db.GetUpdateHeatmap(box, start, start.Add(time.Hour), 0); err != ErrInvalidCellSize {
+		t.Errorf("Got error %v, expected %v.", err, ErrInvalidCellSize)
+	}
+	if _, err := db.GetUpdateHeatmap(box, start, start.Add(time.Hour), 0.00001); err != ErrHeatmapTooLarge {
+		t.Errorf("Got error %v, expected %v.", err, ErrHeatmapTooLarge)
+	}
+}
+
+func TestGetActiveVehiclesSince(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	updates := []model.VehicleUpdate{
+		{VehicleID: "2", Created: now.Add(-time.Minute)},
+		{VehicleID: "1", Feed: "b", Created: now.Add(-time.Minute)},
+		{VehicleID: "1", Created: now.Add(-time.Minute)},
+		{VehicleID: "1", Created: now.Add(-2 * time.Minute)},
+		// Silent since long before the window.
+		{VehicleID: "3", Created: now.Add(-time.Hour)},
+	}
+	for i := range updates {
+		if err := db.CreateUpdate(&updates[i]); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	vehicles, err := db.GetActiveVehiclesSince(now.Add(-5 * time.Minute))
+	if err != nil {
+		t.Fatalf("Unable to get active vehicles: %v", err)
+	}
+	expected := []model.VehicleKey{{VehicleID: "1"}, {VehicleID: "1", Feed: "b"}, {VehicleID: "2"}}
+	if !reflect.DeepEqual(vehicles, expected) {
+		t.Errorf("Got %v, expected %v.", vehicles, expected)
+	}
+}
+
+func TestQueryVehiclesNameLike(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for _, name := range []string{"West Shuttle 2", "East Bus", "west shuttle 1", "Shuttle (spare)"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: name, VehicleName: name}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+
+	for search, expected := range map[string][]string{
+		"SHUTTLE ": {"West Shuttle 2", "west shuttle 1"},
+		// Regular expression characters are matched literally.
+		"(spare)": {"Shuttle (spare)"},
+		"van":     {},
+	} {
+		vehicles, _, err := db.QueryVehicles(VehicleQuery{NameLike: search})
+		if err != nil {
+			t.Fatalf("Unable to search vehicles: %v", err)
+		}
+		names := []string{}
+		for _, vehicle := range vehicles {
+			names = append(names, vehicle.VehicleName)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Got %v for %q, expected %v.", names, search, expected)
+		}
+	}
+}
+
+func TestQueryVehicles(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for i, name := range []string{"Charlie", "alpha", "Bravo", "Delta"} {
+		vehicle := model.Vehicle{VehicleID: strconv.Itoa(i), VehicleName: name}
+		if err := db.CreateVehicle(&vehicle); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		query    VehicleQuery
+		expected []string
+	}{
+		{VehicleQuery{}, []string{"Bravo", "Charlie", "Delta", "alpha"}},
+		{VehicleQuery{Sort: "name", Descending: true}, []string{"alpha", "Delta", "Charlie", "Bravo"}},
+		{VehicleQuery{Limit: 2, Offset: 1}, []string{"Charlie", "Delta"}},
+		{VehicleQuery{Offset: 10}, []string{}},
+	} {
+		vehicles, total, err := db.QueryVehicles(test.query)
+		if err != nil {
+			t.Fatalf("Unable to query vehicles: %v", err)
+		}
+		if total != 4 {
+			t.Errorf("Got total %d for %+v, expected 4.", total, test.query)
+		}
+		names := []string{}
+		for _, vehicle := range vehicles {
+			names = append(names, vehicle.VehicleName)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Got %v for %+v, expected %v.", names, test.query, test.expected)
+		}
+	}
+
+	if _, _, err := db.QueryVehicles(VehicleQuery{Sort: "vehicleID"}); err != ErrInvalidSort {
+		t.Errorf("Got error %v for unknown sort field, expected %v.", err, ErrInvalidSort)
+	}
+}
+
+func TestVehicleColor(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	vehicle := model.Vehicle{VehicleID: "1", Color: "#1a2b3c"}
+	if err := db.CreateVehicle(&vehicle); err != nil {
+		t.Fatalf("Unable to create vehicle: %v", err)
+	}
+	stored, err := db.GetVehicle("1", "")
+	if err != nil {
+		t.Fatalf("Unable to get vehicle: %v", err)
+	}
+	if stored.Color != "#1a2b3c" {
+		t.Errorf("Got color %q, expected #1a2b3c.", stored.Color)
+	}
+
+	stored.Color = "#abc"
+	if err := db.ModifyVehicle(&stored); err != nil {
+		t.Fatalf("Unable to modify vehicle: %v", err)
+	}
+	if stored, err = db.GetVehicle("1", ""); err != nil {
+		t.Fatalf("Unable to get vehicle: %v", err)
+	}
+	if stored.Color != "#abc" {
+		t.Errorf("Got color %q, expected #abc.", stored.Color)
+	}
+}
+
+func TestGetFleetStats(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i, vehicleID := range []string{"1", "2", "1", "2", "3"} {
+		// Vehicle 3 reports after the period.
+		minutes := i
+		if vehicleID == "3" {
+			minutes = 120
+		}
+		update := model.VehicleUpdate{VehicleID: vehicleID, Lat: "42.73" + strconv.Itoa(i), Lng: "-73.68", Created: start.Add(time.Duration(minutes) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	stats, err := db.GetFleetStats(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to get stats: %v", err)
+	}
+	if stats.Trips != 2 || stats.PeakVehicles != 2 || stats.Distance == 0 {
+		t.Errorf("Got %+v, expected two vehicles on trips at once.", stats)
+	}
+
+	stats, err = db.GetFleetStats(start, start)
+	if err != nil {
+		t.Fatalf("Unable to get stats: %v", err)
+	}
+	if stats.Trips != 0 {
+		t.Errorf("Got %d trips for an empty period, expected none.", stats.Trips)
+	}
+}
+
+func TestGetVehiclesWithoutUpdates(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for _, vehicleID := range []string{"reporting", "silent"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: vehicleID}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+	if err := db.CreateUpdate(&model.VehicleUpdate{VehicleID: "reporting", Created: time.Now()}); err != nil {
+		t.Fatalf("Unable to create update: %v", err)
+	}
+
+	vehicles, err := db.GetVehiclesWithoutUpdates()
+	if err != nil {
+		t.Fatalf("Unable to get vehicles: %v", err)
+	}
+	if len(vehicles) != 1 || vehicles[0].VehicleID != "silent" {
+		t.Errorf("Got %+v, expected only the silent vehicle.", vehicles)
+	}
+}
+
+func TestDeleteUpdatesForVehicle(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	for i, vehicleID := range []string{"broken", "fine", "broken", "fine", "broken"} {
+		update := model.VehicleUpdate{VehicleID: vehicleID, Created: now.Add(time.Duration(i-5) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	deleted, err := db.DeleteUpdatesForVehicle("broken", "")
+	if err != nil {
+		t.Fatalf("Unable to delete updates: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Got %d deleted, expected 3.", deleted)
+	}
+	for vehicleID, expected := range map[string]int{"broken": 0, "fine": 2} {
+		updates, err := db.GetUpdatesForVehicleSince(vehicleID, "", now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("Unable to get updates: %v", err)
+		}
+		if len(updates) != expected {
+			t.Errorf("Got %d updates for %s, expected %d.", len(updates), vehicleID, expected)
+		}
+	}
+}
+
+func TestMergeVehicles(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for _, vehicleID := range []string{"keep", "merge"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: vehicleID}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+	now := time.Now()
+	for i, vehicleID := range []string{"keep", "merge", "keep", "merge"} {
+		update := model.VehicleUpdate{VehicleID: vehicleID, Created: now.Add(time.Duration(i-4) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	keep, merge := model.VehicleKey{VehicleID: "keep"}, model.VehicleKey{VehicleID: "merge"}
+	if err := db.MergeVehicles(keep, merge); err != nil {
+		t.Fatalf("Unable to merge vehicles: %v", err)
+	}
+	updates, err := db.GetUpdatesForVehicleSince("keep", "", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(updates) != 4 {
+		t.Errorf("Got %d updates for kept vehicle, expected 4.", len(updates))
+	}
+	if _, err := db.GetVehicle("merge", ""); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for merged vehicle, expected %v.", err, mgo.ErrNotFound)
+	}
+
+	if err := db.MergeVehicles(keep, merge); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v merging deleted vehicle, expected %v.", err, mgo.ErrNotFound)
+	}
+}
+
+func TestMergeVehiclesRetry(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	for _, vehicleID := range []string{"keep", "merge", "other"} {
+		if err := db.CreateVehicle(&model.Vehicle{VehicleID: vehicleID}); err != nil {
+			t.Fatalf("Unable to create vehicle: %v", err)
+		}
+	}
+	// A merge into keep was recorded and moved one update before it failed.
+	if err := db.vehicles.Update(bson.M{"vehicleID": "merge"}, bson.M{"$set": bson.M{"mergingInto": model.VehicleKey{VehicleID: "keep"}}}); err != nil {
+		t.Fatalf("Unable to record merge: %v", err)
+	}
+	now := time.Now()
+	for i, vehicleID := range []string{"keep", "merge"} {
+		update := model.VehicleUpdate{VehicleID: vehicleID, Created: now.Add(time.Duration(i-2) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	keep, merge, other := model.VehicleKey{VehicleID: "keep"}, model.VehicleKey{VehicleID: "merge"}, model.VehicleKey{VehicleID: "other"}
+	for _, keys := range [][2]model.VehicleKey{{other, merge}, {merge, other}} {
+		if err := db.MergeVehicles(keys[0], keys[1]); err != ErrVehicleMerging {
+			t.Errorf("Got error %v merging %s into %s, expected %v.", err, keys[1].VehicleID, keys[0].VehicleID, ErrVehicleMerging)
+		}
+	}
+
+	if err := db.MergeVehicles(keep, merge); err != nil {
+		t.Fatalf("Unable to finish merge: %v", err)
+	}
+	updates, err := db.GetUpdatesForVehicleSince("keep", "", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to get updates: %v", err)
+	}
+	if len(updates) != 2 {
+		t.Errorf("Got %d updates for kept vehicle, expected 2.", len(updates))
+	}
+	if _, err := db.GetVehicle("merge", ""); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for merged vehicle, expected %v.", err, mgo.ErrNotFound)
+	}
+}
+
+func TestCreateVehicleDuplicateID(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	if err := db.CreateVehicle(&model.Vehicle{VehicleID: "1"}); err != nil {
+		t.Fatalf("Unable to create vehicle: %v", err)
+	}
+	if err := db.CreateVehicle(&model.Vehicle{VehicleID: "1"}); err != ErrVehicleIDTaken {
+		t.Errorf("Got error %v, expected %v.", err, ErrVehicleIDTaken)
+	}
+	if err := db.CreateVehicle(&model.Vehicle{VehicleID: "1", Feed: "other"}); err != nil {
+		t.Errorf("Unable to create vehicle in another feed: %v", err)
+	}
+}
+
+// High-precision coordinates, well beyond what any GPS receiver reports.
+var (
+	preciseLat = 42.73029482619374
+	preciseLng = -73.67655638921047
+)
+
+func TestStopAttributes(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	attributes := map[string]bool{"shelter": true, "accessible": true, "bench": false}
+	for _, stop := range []model.Stop{{ID: "a", Attributes: attributes}, {ID: "b"}} {
+		if err := db.CreateStop(&stop); err != nil {
+			t.Fatalf("Unable to create stop: %v", err)
+		}
+	}
+
+	stops, err := db.GetStops()
+	if err != nil {
+		t.Fatalf("Unable to get stops: %v", err)
+	}
+	if len(stops) != 2 {
+		t.Fatalf("Got %d stops, expected 2.", len(stops))
+	}
+	for _, stop := range stops {
+		accessible := stop.HasAttributes([]string{"accessible"})
+		if accessible != (stop.ID == "a") {
+			t.Errorf("Got accessible %v for stop %s.", accessible, stop.ID)
+		}
+	}
+	if !reflect.DeepEqual(stops[0].Attributes, attributes) && !reflect.DeepEqual(stops[1].Attributes, attributes) {
+		t.Errorf("Got stops %+v, expected one with attributes %v.", stops, attributes)
+	}
+}
+
+func TestSetStopAttributes(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	stop := model.Stop{ID: "a", Name: "Union", Attributes: map[string]bool{"bench": true}}
+	if err := db.CreateStop(&stop); err != nil {
+		t.Fatalf("Unable to create stop: %v", err)
+	}
+
+	attributes := map[string]bool{"shelter": true}
+	modified, err := db.SetStopAttributes("a", attributes)
+	if err != nil {
+		t.Fatalf("Unable to set attributes: %v", err)
+	}
+	if modified.Name != "Union" || !reflect.DeepEqual(modified.Attributes, attributes) {
+		t.Errorf("Got stop %+v, expected Union with attributes %v.", modified, attributes)
+	}
+	if _, err := db.SetStopAttributes("b", attributes); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v, expected %v.", err, mgo.ErrNotFound)
+	}
+}
+
+func TestCoordinatePrecision(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	coord := model.Coord{Lat: preciseLat, Lng: preciseLng}
+	route := model.Route{ID: "west", Coords: []model.Coord{coord, {Lat: 42.74, Lng: -73.68}}}
+	if err := db.CreateRoute(&route); err != nil {
+		t.Fatalf("Unable to create route: %v", err)
+	}
+	stop := model.Stop{ID: "a", Lat: preciseLat, Lng: preciseLng}
+	if err := db.CreateStop(&stop); err != nil {
+		t.Fatalf("Unable to create stop: %v", err)
+	}
+	update := model.VehicleUpdate{VehicleID: "1", Lat: "42.73029482619374", Lng: "-73.67655638921047"}
+	if err := db.CreateUpdate(&update); err != nil {
+		t.Fatalf("Unable to create update: %v", err)
+	}
+
+	storedRoute, err := db.GetRoute("west")
+	if err != nil {
+		t.Fatalf("Unable to get route: %v", err)
+	}
+	if storedRoute.Coords[0] != coord {
+		t.Errorf("Got route coordinate %+v, expected %+v.", storedRoute.Coords[0], coord)
+	}
+	stops, err := db.GetStops()
+	if err != nil {
+		t.Fatalf("Unable to get stops: %v", err)
+	}
+	if len(stops) != 1 || stops[0].Lat != preciseLat || stops[0].Lng != preciseLng {
+		t.Errorf("Got stops %+v, expected one at %v, %v.", stops, preciseLat, preciseLng)
+	}
+	storedUpdate, err := db.GetLastUpdateForVehicle("1", "")
+	if err != nil {
+		t.Fatalf("Unable to get update: %v", err)
+	}
+	if storedUpdate.Lat != update.Lat || storedUpdate.Lng != update.Lng {
+		t.Errorf("Got update at %s, %s, expected %s, %s.", storedUpdate.Lat, storedUpdate.Lng, update.Lat, update.Lng)
+	}
+}
+
+func TestGetArrivalsForStop(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	if _, err := db.GetArrivalsForStop("union", time.Time{}, 0); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for an unknown stop, expected %v.", err, mgo.ErrNotFound)
+	}
+	stop := model.Stop{ID: "union", Lat: 42.7300, Lng: -73.6800}
+	if err := db.CreateStop(&stop); err != nil {
+		t.Fatalf("Unable to create stop: %v", err)
+	}
+
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, minutes := range []int{20, 0, 10} {
+		update := model.VehicleUpdate{VehicleID: "1", Route: "west", Lat: "42.7300", Lng: "-73.6800", Created: start.Add(time.Duration(minutes) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+		// Leave the stop in between.
+		away := model.VehicleUpdate{VehicleID: "1", Route: "west", Lat: "42.7400", Lng: "-73.6800", Created: update.Created.Add(time.Minute)}
+		if err := db.CreateUpdate(&away); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	arrivals, err := db.GetArrivalsForStop("union", start, 0)
+	if err != nil {
+		t.Fatalf("Unable to get arrivals: %v", err)
+	}
+	// The arrival at start itself is excluded.
+	if len(arrivals) != 2 || !arrivals[0].Time.Equal(start.Add(20*time.Minute)) || !arrivals[1].Time.Equal(start.Add(10*time.Minute)) {
+		t.Fatalf("Got %+v, expected arrivals at 12:20 and 12:10.", arrivals)
+	}
+	if arrivals[0].RouteID != "west" {
+		t.Errorf("Got route %q, expected west.", arrivals[0].RouteID)
+	}
+	if arrivals, err := db.GetArrivalsForStop("union", start, 1); err != nil || len(arrivals) != 1 || !arrivals[0].Time.Equal(start.Add(20*time.Minute)) {
+		t.Errorf("Got %+v and error %v, expected only the arrival at 12:20.", arrivals, err)
+	}
+}
+
+func TestGetArrivalsForStopFeeds(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	stop := model.Stop{ID: "union", Lat: 42.7300, Lng: -73.6800}
+	if err := db.CreateStop(&stop); err != nil {
+		t.Fatalf("Unable to create stop: %v", err)
+	}
+	// Vehicle 1 from feeds a and b reach the stop a minute apart without either leaving it, so
+	// they'd look like a single visit if they were one vehicle.
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i, feed := range []string{"a", "b"} {
+		update := model.VehicleUpdate{VehicleID: "1", Feed: feed, Route: "west", Lat: "42.7300", Lng: "-73.6800", Created: start.Add(time.Duration(i+1) * time.Minute)}
+		if err := db.CreateUpdate(&update); err != nil {
+			t.Fatalf("Unable to create update: %v", err)
+		}
+	}
+
+	arrivals, err := db.GetArrivalsForStop("union", start, 0)
+	if err != nil {
+		t.Fatalf("Unable to get arrivals: %v", err)
+	}
+	if len(arrivals) != 2 || arrivals[0].Feed != "b" || arrivals[1].Feed != "a" {
+		t.Errorf("Got %+v, expected an arrival from feed b and then one from feed a.", arrivals)
+	}
+}
+
+func TestGetAdherenceForRoute(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	day := time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC)
+	if _, err := db.GetAdherenceForRoute("west", day); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for an unknown route, expected %v.", err, mgo.ErrNotFound)
+	}
+
+	// The stop is on the route through StopsID, even though its RouteID is another route's.
+	stop := model.Stop{ID: "union", RouteID: "east", Lat: 42.7300, Lng: -73.6800}
+	if err := db.CreateStop(&stop); err != nil {
+		t.Fatalf("Unable to create stop: %v", err)
+	}
+	if err := db.CreateRoute(&model.Route{ID: "west", StopsID: []string{"union"}}); err != nil {
+		t.Fatalf("Unable to create route: %v", err)
+	}
+	// Scheduled near the end of the service day, which ends at 03:00 the next morning.
+	if err := db.SetScheduleForRoute("west", []model.ScheduledArrival{{StopID: "union", Time: "02:55"}}); err != nil {
+		t.Fatalf("Unable to set schedule: %v", err)
+	}
+	// Ten minutes late, after the service day has ended.
+	update := model.VehicleUpdate{VehicleID: "1", Route: "west", Lat: "42.7300", Lng: "-73.6800", Created: time.Date(2017, 9, 2, 3, 5, 0, 0, time.UTC)}
+	if err := db.CreateUpdate(&update); err != nil {
+		t.Fatalf("Unable to create update: %v", err)
+	}
+
+	adherence, err := db.GetAdherenceForRoute("west", day)
+	if err != nil {
+		t.Fatalf("Unable to get adherence: %v", err)
+	}
+	if len(adherence) != 1 || adherence[0].StopID != "union" || adherence[0].Late != 1 || adherence[0].Missed != 0 {
+		t.Errorf("Got %+v, expected one late arrival at union.", adherence)
+	}
+}
+
+func TestAPIClientTokens(t *testing.T) {
+	db, cleanup := newTestMongoDB(t)
+	defer cleanup()
+
+	client := model.APIClient{ID: "signage", Name: "Signage", Created: time.Now()}
+	if err := db.CreateAPIClient(&client); err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	issued := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	if client, err := db.IssueAPIClientToken("signage", "hash", issued); err != nil || client.TokenHash != "hash" || !client.TokenIssued.Equal(issued) {
+		t.Fatalf("Got %+v and error %v, expected the token to be issued.", client, err)
+	}
+
+	used := issued.Add(time.Hour)
+	if client, err := db.UseAPIClientToken("hash", used); err != nil || client.ID != "signage" || !client.LastUsed.Equal(used) {
+		t.Errorf("Got %+v and error %v, expected signage to have used its token.", client, err)
+	}
+	for _, hash := range []string{"other", ""} {
+		if _, err := db.UseAPIClientToken(hash, used); err != mgo.ErrNotFound {
+			t.Errorf("Got error %v for hash %q, expected %v.", err, hash, mgo.ErrNotFound)
+		}
+	}
+
+	if client, err := db.RevokeAPIClientToken("signage"); err != nil || client.TokenHash != "" || client.TokenIssued != nil {
+		t.Errorf("Got %+v and error %v, expected the token to be revoked.", client, err)
+	}
+	if _, err := db.UseAPIClientToken("hash", used); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for a revoked token, expected %v.", err, mgo.ErrNotFound)
+	}
+	if _, err := db.RevokeAPIClientToken("unknown"); err != mgo.ErrNotFound {
+		t.Errorf("Got error %v for an unknown client, expected %v.", err, mgo.ErrNotFound)
+	}
+
+	if clients, err := db.GetAPIClients(); err != nil || len(clients) != 1 || clients[0].LastUsed == nil {
+		t.Errorf("Got %+v and error %v, expected signage with its last use.", clients, err)
+	}
+	if err := db.DeleteAPIClient("signage"); err != nil {
+		t.Errorf("Unable to delete client: %v", err)
+	}
+	if clients, err := db.GetAPIClients(); err != nil || len(clients) != 0 {
+		t.Errorf("Got %+v and error %v after deleting, expected no clients.", clients, err)
+	}
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestHourlyOccupancy(t *testing.T) {
+	day := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	occupancy := func(n int) *int { return &n }
+	updates := []model.VehicleUpdate{
+		{Created: day.Add(8*time.Hour + 5*time.Minute), Occupancy: occupancy(10)},
+		{Created: day.Add(8*time.Hour + 45*time.Minute), Occupancy: occupancy(20)},
+		{Created: day.Add(9 * time.Hour), Occupancy: occupancy(3)},
+		{Created: day.Add(17*time.Hour + 30*time.Minute), Occupancy: occupancy(0)},
+		{Created: day.Add(18 * time.Hour)},
+	}
+
+	hours := hourlyOccupancy(updates, time.UTC)
+	if len(hours) != 24 {
+		t.Fatalf("Got %d hours, expected 24.", len(hours))
+	}
+	expected := map[int]float64{8: 15, 9: 3, 17: 0}
+	for _, hour := range hours {
+		average, ok := expected[hour.Hour]
+		if !ok {
+			if hour.Average != nil {
+				t.Errorf("Hour %d has average %v, expected none.", hour.Hour, *hour.Average)
+			}
+			continue
+		}
+		if hour.Average == nil {
+			t.Errorf("Hour %d has no average, expected %v.", hour.Hour, average)
+		} else if *hour.Average != average {
+			t.Errorf("Hour %d has average %v, expected %v.", hour.Hour, *hour.Average, average)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package database
+
+import (
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// slowQueryLogger is a Database that logs a warning whenever a call to the Database it wraps takes
+// longer than threshold.
+type slowQueryLogger struct {
+	db        Database
+	threshold time.Duration
+}
+
+// LogSlowQueries wraps db so that calls taking longer than threshold are logged with the method's
+// name and how long it took.
+func LogSlowQueries(db Database, threshold time.Duration) Database {
+	return &slowQueryLogger{db: db, threshold: threshold}
+}
+
+// logIfSlow logs method if it has been running since start for longer than the threshold.
+func (s *slowQueryLogger) logIfSlow(method string, start time.Time) {
+	if elapsed := time.Since(start); elapsed > s.threshold {
+		log.Warnf("Slow database query: %s took %s.", method, elapsed)
+	}
+}
+
+func (s *slowQueryLogger) CreateRoute(route *model.Route) error {
+	defer s.logIfSlow("CreateRoute", time.Now())
+	return s.db.CreateRoute(route)
+}
+
+func (s *slowQueryLogger) DeleteRoute(routeID string) error {
+	defer s.logIfSlow("DeleteRoute", time.Now())
+	return s.db.DeleteRoute(routeID)
+}
+
+func (s *slowQueryLogger) GetRoute(routeID string) (model.Route, error) {
+	defer s.logIfSlow("GetRoute", time.Now())
+	return s.db.GetRoute(routeID)
+}
+
+func (s *slowQueryLogger) GetRoutes() ([]model.Route, error) {
+	defer s.logIfSlow("GetRoutes", time.Now())
+	return s.db.GetRoutes()
+}
+
+func (s *slowQueryLogger) GetRoutesModifiedSince(since time.Time) ([]model.Route, error) {
+	defer s.logIfSlow("GetRoutesModifiedSince", time.Now())
+	return s.db.GetRoutesModifiedSince(since)
+}
+
+func (s *slowQueryLogger) ModifyRoute(route *model.Route) error {
+	defer s.logIfSlow("ModifyRoute", time.Now())
+	return s.db.ModifyRoute(route)
+}
+
+func (s *slowQueryLogger) SetRoutesEnabled(routeIDs []string, enabled bool) (int, error) {
+	defer s.logIfSlow("SetRoutesEnabled", time.Now())
+	return s.db.SetRoutesEnabled(routeIDs, enabled)
+}
+
+func (s *slowQueryLogger) GetScheduleForRoute(routeID string) ([]model.ScheduledArrival, error) {
+	defer s.logIfSlow("GetScheduleForRoute", time.Now())
+	return s.db.GetScheduleForRoute(routeID)
+}
+
+func (s *slowQueryLogger) SetScheduleForRoute(routeID string, schedule []model.ScheduledArrival) error {
+	defer s.logIfSlow("SetScheduleForRoute", time.Now())
+	return s.db.SetScheduleForRoute(routeID, schedule)
+}
+
+func (s *slowQueryLogger) GetAdherenceForRoute(routeID string, day time.Time) ([]model.StopAdherence, error) {
+	defer s.logIfSlow("GetAdherenceForRoute", time.Now())
+	return s.db.GetAdherenceForRoute(routeID, day)
+}
+
+func (s *slowQueryLogger) GetSegmentSpeedsForRoute(routeID string, since time.Time) ([]model.SegmentSpeed, error) {
+	defer s.logIfSlow("GetSegmentSpeedsForRoute", time.Now())
+	return s.db.GetSegmentSpeedsForRoute(routeID, since)
+}
+
+func (s *slowQueryLogger) CreateStop(stop *model.Stop) error {
+	defer s.logIfSlow("CreateStop", time.Now())
+	return s.db.CreateStop(stop)
+}
+
+func (s *slowQueryLogger) DeleteStop(stopID string) error {
+	defer s.logIfSlow("DeleteStop", time.Now())
+	return s.db.DeleteStop(stopID)
+}
+
+func (s *slowQueryLogger) GetStops() ([]model.Stop, error) {
+	defer s.logIfSlow("GetStops", time.Now())
+	return s.db.GetStops()
+}
+
+func (s *slowQueryLogger) GetStopsWithRoutes() ([]model.StopWithRoutes, error) {
+	defer s.logIfSlow("GetStopsWithRoutes", time.Now())
+	return s.db.GetStopsWithRoutes()
+}
+
+func (s *slowQueryLogger) GetHeadwayForStop(stopID string, routeID string, window time.Duration) (model.Headway, error) {
+	defer s.logIfSlow("GetHeadwayForStop", time.Now())
+	return s.db.GetHeadwayForStop(stopID, routeID, window)
+}
+
+func (s *slowQueryLogger) GetArrivalsForStop(stopID string, since time.Time, max int) ([]model.StopArrival, error) {
+	defer s.logIfSlow("GetArrivalsForStop", time.Now())
+	return s.db.GetArrivalsForStop(stopID, since, max)
+}
+
+func (s *slowQueryLogger) GetStopWindows() ([]model.StopWindow, error) {
+	defer s.logIfSlow("GetStopWindows", time.Now())
+	return s.db.GetStopWindows()
+}
+
+func (s *slowQueryLogger) SetStopWindows(stopID string, windows []model.StopWindow) error {
+	defer s.logIfSlow("SetStopWindows", time.Now())
+	return s.db.SetStopWindows(stopID, windows)
+}
+
+func (s *slowQueryLogger) SetStopAttributes(stopID string, attributes map[string]bool) (model.Stop, error) {
+	defer s.logIfSlow("SetStopAttributes", time.Now())
+	return s.db.SetStopAttributes(stopID, attributes)
+}
+
+func (s *slowQueryLogger) CreateVehicle(vehicle *model.Vehicle) error {
+	defer s.logIfSlow("CreateVehicle", time.Now())
+	return s.db.CreateVehicle(vehicle)
+}
+
+func (s *slowQueryLogger) DeleteVehicle(vehicleID string, feed string) error {
+	defer s.logIfSlow("DeleteVehicle", time.Now())
+	return s.db.DeleteVehicle(vehicleID, feed)
+}
+
+func (s *slowQueryLogger) GetVehicle(vehicleID string, feed string) (model.Vehicle, error) {
+	defer s.logIfSlow("GetVehicle", time.Now())
+	return s.db.GetVehicle(vehicleID, feed)
+}
+
+func (s *slowQueryLogger) GetVehicles() ([]model.Vehicle, error) {
+	defer s.logIfSlow("GetVehicles", time.Now())
+	return s.db.GetVehicles()
+}
+
+func (s *slowQueryLogger) QueryVehicles(query VehicleQuery) ([]model.Vehicle, int, error) {
+	defer s.logIfSlow("QueryVehicles", time.Now())
+	return s.db.QueryVehicles(query)
+}
+
+func (s *slowQueryLogger) GetEnabledVehicles() ([]model.Vehicle, error) {
+	defer s.logIfSlow("GetEnabledVehicles", time.Now())
+	return s.db.GetEnabledVehicles()
+}
+
+func (s *slowQueryLogger) GetVehiclesWithoutUpdates() ([]model.Vehicle, error) {
+	defer s.logIfSlow("GetVehiclesWithoutUpdates", time.Now())
+	return s.db.GetVehiclesWithoutUpdates()
+}
+
+func (s *slowQueryLogger) ModifyVehicle(vehicle *model.Vehicle) error {
+	defer s.logIfSlow("ModifyVehicle", time.Now())
+	return s.db.ModifyVehicle(vehicle)
+}
+
+func (s *slowQueryLogger) SetVehiclesEnabled(vehicles []model.VehicleKey, enabled bool) (int, error) {
+	defer s.logIfSlow("SetVehiclesEnabled", time.Now())
+	return s.db.SetVehiclesEnabled(vehicles, enabled)
+}
+
+func (s *slowQueryLogger) SetVehicleHeartbeat(vehicleID string, feed string, heartbeat time.Time) error {
+	defer s.logIfSlow("SetVehicleHeartbeat", time.Now())
+	return s.db.SetVehicleHeartbeat(vehicleID, feed, heartbeat)
+}
+
+func (s *slowQueryLogger) MergeVehicles(keep model.VehicleKey, merge model.VehicleKey) error {
+	defer s.logIfSlow("MergeVehicles", time.Now())
+	return s.db.MergeVehicles(keep, merge)
+}
+
+func (s *slowQueryLogger) CreateUpdate(update *model.VehicleUpdate) error {
+	defer s.logIfSlow("CreateUpdate", time.Now())
+	return s.db.CreateUpdate(update)
+}
+
+func (s *slowQueryLogger) SetRouteForUpdate(vehicleID string, feed string, created time.Time, routeID string) error {
+	defer s.logIfSlow("SetRouteForUpdate", time.Now())
+	return s.db.SetRouteForUpdate(vehicleID, feed, created, routeID)
+}
+
+func (s *slowQueryLogger) DeleteUpdatesBefore(before time.Time) (int, error) {
+	defer s.logIfSlow("DeleteUpdatesBefore", time.Now())
+	return s.db.DeleteUpdatesBefore(before)
+}
+
+func (s *slowQueryLogger) DeleteUpdatesForVehicle(vehicleID string, feed string) (int, error) {
+	defer s.logIfSlow("DeleteUpdatesForVehicle", time.Now())
+	return s.db.DeleteUpdatesForVehicle(vehicleID, feed)
+}
+
+func (s *slowQueryLogger) DeleteUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	defer s.logIfSlow("DeleteUpdatesBeforePerVehicle", time.Now())
+	return s.db.DeleteUpdatesBeforePerVehicle(before)
+}
+
+func (s *slowQueryLogger) ArchiveUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	defer s.logIfSlow("ArchiveUpdatesBeforePerVehicle", time.Now())
+	return s.db.ArchiveUpdatesBeforePerVehicle(before)
+}
+
+func (s *slowQueryLogger) DeleteUpdatesExceedingCountPerVehicle(max int, since time.Time) (int, error) {
+	defer s.logIfSlow("DeleteUpdatesExceedingCountPerVehicle", time.Now())
+	return s.db.DeleteUpdatesExceedingCountPerVehicle(max, since)
+}
+
+func (s *slowQueryLogger) GetUpdatesSince(since time.Time) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdatesSince", time.Now())
+	return s.db.GetUpdatesSince(since)
+}
+
+func (s *slowQueryLogger) GetUpdatesForVehicleSince(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdatesForVehicleSince", time.Now())
+	return s.db.GetUpdatesForVehicleSince(vehicleID, feed, since)
+}
+
+func (s *slowQueryLogger) GetUpdatesForVehicleSinceAscending(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdatesForVehicleSinceAscending", time.Now())
+	return s.db.GetUpdatesForVehicleSinceAscending(vehicleID, feed, since)
+}
+
+func (s *slowQueryLogger) GetUpdatesForVehicleBetween(vehicleID string, feed string, from, to time.Time) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdatesForVehicleBetween", time.Now())
+	return s.db.GetUpdatesForVehicleBetween(vehicleID, feed, from, to)
+}
+
+func (s *slowQueryLogger) GetSampledUpdatesForVehicle(vehicleID string, feed string, since time.Time, interval time.Duration) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetSampledUpdatesForVehicle", time.Now())
+	return s.db.GetSampledUpdatesForVehicle(vehicleID, feed, since, interval)
+}
+
+func (s *slowQueryLogger) GetUpdatesPage(vehicleID string, feed string, cursor string, limit int) ([]model.VehicleUpdate, string, error) {
+	defer s.logIfSlow("GetUpdatesPage", time.Now())
+	return s.db.GetUpdatesPage(vehicleID, feed, cursor, limit)
+}
+
+func (s *slowQueryLogger) GetLastUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetLastUpdateForVehicle", time.Now())
+	return s.db.GetLastUpdateForVehicle(vehicleID, feed)
+}
+
+func (s *slowQueryLogger) GetLastUpdatesForVehicles(vehicles []model.VehicleKey) (map[model.VehicleKey]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetLastUpdatesForVehicles", time.Now())
+	return s.db.GetLastUpdatesForVehicles(vehicles)
+}
+
+func (s *slowQueryLogger) GetFirstUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetFirstUpdateForVehicle", time.Now())
+	return s.db.GetFirstUpdateForVehicle(vehicleID, feed)
+}
+
+func (s *slowQueryLogger) GetUpdateForVehicleBefore(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdateForVehicleBefore", time.Now())
+	return s.db.GetUpdateForVehicleBefore(vehicleID, feed, t)
+}
+
+func (s *slowQueryLogger) GetUpdateForVehicleAfter(vehicleID string, feed string, t time.Time) (model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdateForVehicleAfter", time.Now())
+	return s.db.GetUpdateForVehicleAfter(vehicleID, feed, t)
+}
+
+func (s *slowQueryLogger) GetUpdatesInBoundingBox(box model.BoundingBox, since time.Time) ([]model.VehicleUpdate, error) {
+	defer s.logIfSlow("GetUpdatesInBoundingBox", time.Now())
+	return s.db.GetUpdatesInBoundingBox(box, since)
+}
+
+func (s *slowQueryLogger) GetUpdateHeatmap(box model.BoundingBox, from, to time.Time, cellSize float64) (model.Heatmap, error) {
+	defer s.logIfSlow("GetUpdateHeatmap", time.Now())
+	return s.db.GetUpdateHeatmap(box, from, to, cellSize)
+}
+
+func (s *slowQueryLogger) GetLatestUpdateTime() (time.Time, error) {
+	defer s.logIfSlow("GetLatestUpdateTime", time.Now())
+	return s.db.GetLatestUpdateTime()
+}
+
+func (s *slowQueryLogger) GetActiveVehiclesSince(since time.Time) ([]model.VehicleKey, error) {
+	defer s.logIfSlow("GetActiveVehiclesSince", time.Now())
+	return s.db.GetActiveVehiclesSince(since)
+}
+
+func (s *slowQueryLogger) GetOccupancyByHour(routeID string, day time.Time) ([]model.HourlyOccupancy, error) {
+	defer s.logIfSlow("GetOccupancyByHour", time.Now())
+	return s.db.GetOccupancyByHour(routeID, day)
+}
+
+func (s *slowQueryLogger) GetTrackGapsForVehicle(vehicleID string, feed string, since time.Time, minGap time.Duration) ([]model.TrackGap, error) {
+	defer s.logIfSlow("GetTrackGapsForVehicle", time.Now())
+	return s.db.GetTrackGapsForVehicle(vehicleID, feed, since, minGap)
+}
+
+func (s *slowQueryLogger) GetFleetStats(from, to time.Time) (model.FleetStats, error) {
+	defer s.logIfSlow("GetFleetStats", time.Now())
+	return s.db.GetFleetStats(from, to)
+}
+
+func (s *slowQueryLogger) GetUsers() ([]model.User, error) {
+	defer s.logIfSlow("GetUsers", time.Now())
+	return s.db.GetUsers()
+}
+
+func (s *slowQueryLogger) CreateAPIClient(client *model.APIClient) error {
+	defer s.logIfSlow("CreateAPIClient", time.Now())
+	return s.db.CreateAPIClient(client)
+}
+
+func (s *slowQueryLogger) GetAPIClients() ([]model.APIClient, error) {
+	defer s.logIfSlow("GetAPIClients", time.Now())
+	return s.db.GetAPIClients()
+}
+
+func (s *slowQueryLogger) DeleteAPIClient(clientID string) error {
+	defer s.logIfSlow("DeleteAPIClient", time.Now())
+	return s.db.DeleteAPIClient(clientID)
+}
+
+func (s *slowQueryLogger) IssueAPIClientToken(clientID string, tokenHash string, issued time.Time) (model.APIClient, error) {
+	defer s.logIfSlow("IssueAPIClientToken", time.Now())
+	return s.db.IssueAPIClientToken(clientID, tokenHash, issued)
+}
+
+func (s *slowQueryLogger) RevokeAPIClientToken(clientID string) (model.APIClient, error) {
+	defer s.logIfSlow("RevokeAPIClientToken", time.Now())
+	return s.db.RevokeAPIClientToken(clientID)
+}
+
+func (s *slowQueryLogger) UseAPIClientToken(tokenHash string, used time.Time) (model.APIClient, error) {
+	defer s.logIfSlow("UseAPIClientToken", time.Now())
+	return s.db.UseAPIClientToken(tokenHash, used)
+}
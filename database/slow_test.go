@@ -0,0 +1,60 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// slowDatabase is a Database with a slow GetRoutes and a fast GetStops.
+type slowDatabase struct {
+	Database
+}
+
+func (db slowDatabase) GetRoutes() ([]model.Route, error) {
+	time.Sleep(20 * time.Millisecond)
+	return []model.Route{{ID: "west"}}, nil
+}
+
+func (db slowDatabase) GetStops() ([]model.Stop, error) {
+	return []model.Stop{}, nil
+}
+
+func TestLogSlowQueries(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	db := LogSlowQueries(slowDatabase{}, 10*time.Millisecond)
+	routes, err := db.GetRoutes()
+	if err != nil {
+		t.Fatalf("Unable to get routes: %v", err)
+	}
+	if len(routes) != 1 {
+		t.Errorf("Got %d routes, expected the wrapped database's one.", len(routes))
+	}
+	if _, err := db.GetStops(); err != nil {
+		t.Fatalf("Unable to get stops: %v", err)
+	}
+
+	logged := out.String()
+	if !strings.Contains(logged, "Slow database query: GetRoutes took") {
+		t.Errorf("Got log %q, expected GetRoutes to be logged as slow.", logged)
+	}
+	if strings.Contains(logged, "GetStops") {
+		t.Errorf("Got log %q, expected GetStops not to be logged.", logged)
+	}
+}
+
+func TestNewInvalidSlowQueryThreshold(t *testing.T) {
+	for _, threshold := range []string{"soon", "0s", "-1s"} {
+		if db, err := New(MongoDBConfig{SlowQueryThreshold: threshold}); err == nil || db != nil {
+			t.Errorf("Got %v and error %v for %q, expected only an error.", db, err, threshold)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestTrackGaps(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	var updates []model.VehicleUpdate
+	// An update every five seconds for ten minutes, then nothing for ten minutes, then five more.
+	for i := 0; i < 120; i++ {
+		updates = append(updates, model.VehicleUpdate{Created: start.Add(time.Duration(i) * 5 * time.Second)})
+	}
+	resumed := updates[len(updates)-1].Created.Add(10 * time.Minute)
+	for i := 0; i < 60; i++ {
+		updates = append(updates, model.VehicleUpdate{Created: resumed.Add(time.Duration(i) * 5 * time.Second)})
+	}
+
+	gaps := trackGaps(updates, time.Minute)
+	if len(gaps) != 1 {
+		t.Fatalf("Got %d gaps, expected 1.", len(gaps))
+	}
+	gap := gaps[0]
+	if !gap.Start.Equal(start.Add(595*time.Second)) || !gap.End.Equal(resumed) {
+		t.Errorf("Got gap from %v to %v, expected %v to %v.", gap.Start, gap.End, start.Add(595*time.Second), resumed)
+	}
+	if gap.Duration != 600 {
+		t.Errorf("Got duration %v, expected 600.", gap.Duration)
+	}
+
+	// The steady stream has no gaps at a finer threshold either.
+	if gaps := trackGaps(updates[:120], 6*time.Second); len(gaps) != 0 {
+		t.Errorf("Got %d gaps in a steady stream, expected none.", len(gaps))
+	}
+}
+
+func TestTrackGapsWithoutUpdates(t *testing.T) {
+	for _, updates := range [][]model.VehicleUpdate{nil, {{Created: time.Now()}}} {
+		gaps := trackGaps(updates, time.Minute)
+		if gaps == nil || len(gaps) != 0 {
+			t.Errorf("Got %v for %d updates, expected an empty list.", gaps, len(updates))
+		}
+	}
+}
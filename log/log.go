@@ -2,6 +2,7 @@ package log
 
 import (
 	"github.com/Sirupsen/logrus"
+	"io"
 	"path"
 	"runtime"
 	"strings"
@@ -36,6 +37,10 @@ func SetLevel(level string) {
 	logger.Level = parsed
 }
 
+func SetOutput(out io.Writer) {
+	logger.Out = out
+}
+
 func contextFields(lvl ...int) Fields {
 	level := 2
 	if len(lvl) == 1 {
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// APIClient is an automated client that authenticates with a bearer token instead of a CAS login.
+type APIClient struct {
+	ID      string    `json:"id"      bson:"id"`
+	Name    string    `json:"name"    bson:"name"`
+	Created time.Time `json:"created" bson:"created"`
+	// TokenHash is the hex-encoded SHA-256 hash of the client's token. The token itself is never
+	// stored. It is empty if the client has no token.
+	TokenHash string `json:"-" bson:"tokenHash,omitempty"`
+	// TokenIssued is when the client's token was issued. It is nil if the client has no token,
+	// such as after it was revoked.
+	TokenIssued *time.Time `json:"tokenIssued" bson:"tokenIssued,omitempty"`
+	// LastUsed is when the client last made a request with a token, if it ever has.
+	LastUsed *time.Time `json:"lastUsed" bson:"lastUsed,omitempty"`
+}
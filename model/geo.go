@@ -0,0 +1,263 @@
+package model
+
+import (
+	"math"
+)
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371000.0
+
+// Units of distance, in meters.
+const (
+	MetersPerMile      = 1609.344
+	MetersPerKilometer = 1000.0
+)
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// DistanceMeters returns the great-circle distance between two coordinates in meters.
+func DistanceMeters(a, b Coord) float64 {
+	lat1 := toRadians(a.Lat)
+	lat2 := toRadians(b.Lat)
+	dLat := lat2 - lat1
+	dLng := toRadians(b.Lng - a.Lng)
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// BearingDegrees returns the initial bearing from a to b in degrees clockwise from north, between 0
+// and 360.
+func BearingDegrees(a, b Coord) float64 {
+	lat1 := toRadians(a.Lat)
+	lat2 := toRadians(b.Lat)
+	dLng := toRadians(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// BoundingBox is the area between two latitudes and two longitudes.
+type BoundingBox struct {
+	MinLat float64 `json:"minLat"`
+	MinLng float64 `json:"minLng"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLng float64 `json:"maxLng"`
+}
+
+// Empty reports whether the box contains no points because its minimums exceed its maximums.
+func (b BoundingBox) Empty() bool {
+	return b.MinLat > b.MaxLat || b.MinLng > b.MaxLng
+}
+
+// Contains reports whether c is inside the box or on its edge.
+func (b BoundingBox) Contains(c Coord) bool {
+	return c.Lat >= b.MinLat && c.Lat <= b.MaxLat && c.Lng >= b.MinLng && c.Lng <= b.MaxLng
+}
+
+// MaxHeatmapCells is the most cells that a Heatmap may have.
+const MaxHeatmapCells = 10000
+
+// Heatmap counts how many points fall within each cell of a grid laid over a BoundingBox. Cells
+// are CellSize degrees of latitude and longitude on a side. Row 0 begins at MinLat and column 0 at
+// MinLng, and the last row and column may extend past the box.
+type Heatmap struct {
+	Box      BoundingBox `json:"box"`
+	CellSize float64     `json:"cellSize"`
+	// Counts are indexed by row and then by column.
+	Counts [][]int `json:"counts"`
+	// Total is how many points are in the box.
+	Total int `json:"total"`
+}
+
+// HeatmapSize returns how many rows and columns a Heatmap over box has with cells of cellSize
+// degrees, which must be positive. Each is capped just above MaxHeatmapCells, before converting
+// it to an int, so that tiny cells or spans that aren't finite don't overflow. An Empty box has no
+// cells.
+func HeatmapSize(box BoundingBox, cellSize float64) (rows, cols int) {
+	if box.Empty() {
+		return 0, 0
+	}
+	size := func(span float64) int {
+		// Leave room for rounding so that spans that are a multiple of cellSize don't get an
+		// extra row or column.
+		n := math.Ceil(span/cellSize - 1e-9)
+		// NaN fails every comparison, so it's capped too.
+		if !(n <= MaxHeatmapCells) {
+			return MaxHeatmapCells + 1
+		}
+		return int(math.Max(1, n))
+	}
+	return size(box.MaxLat - box.MinLat), size(box.MaxLng - box.MinLng)
+}
+
+// NewHeatmap returns a Heatmap over box with no points counted. cellSize must be positive and
+// small enough that there are no more than MaxHeatmapCells cells.
+func NewHeatmap(box BoundingBox, cellSize float64) Heatmap {
+	rows, cols := HeatmapSize(box, cellSize)
+	counts := make([][]int, rows)
+	for i := range counts {
+		counts[i] = make([]int, cols)
+	}
+	return Heatmap{Box: box, CellSize: cellSize, Counts: counts}
+}
+
+// Add counts c in the cell containing it. It reports whether c is within the box.
+func (h *Heatmap) Add(c Coord) bool {
+	if !h.Box.Contains(c) {
+		return false
+	}
+	// Points on the box's maximum edges belong to the last row or column.
+	row := int(math.Min(math.Floor((c.Lat-h.Box.MinLat)/h.CellSize), float64(len(h.Counts)-1)))
+	col := int(math.Min(math.Floor((c.Lng-h.Box.MinLng)/h.CellSize), float64(len(h.Counts[row])-1)))
+	h.Counts[row][col]++
+	h.Total++
+	return true
+}
+
+// Bounds returns the smallest BoundingBox containing the Route's path. It is Empty if the Route
+// has no coordinates.
+func (r *Route) Bounds() BoundingBox {
+	box := BoundingBox{MinLat: math.Inf(1), MinLng: math.Inf(1), MaxLat: math.Inf(-1), MaxLng: math.Inf(-1)}
+	for _, c := range r.Coords {
+		box.MinLat = math.Min(box.MinLat, c.Lat)
+		box.MinLng = math.Min(box.MinLng, c.Lng)
+		box.MaxLat = math.Max(box.MaxLat, c.Lat)
+		box.MaxLng = math.Max(box.MaxLng, c.Lng)
+	}
+	return box
+}
+
+// LengthMeters returns the length of the Route's path in meters. Routes with fewer than
+// two coordinates have no length.
+func (r *Route) LengthMeters() float64 {
+	length := 0.0
+	for i := 0; i+1 < len(r.Coords); i++ {
+		length += DistanceMeters(r.Coords[i], r.Coords[i+1])
+	}
+	return length
+}
+
+// Projection is the point on a Route's path nearest to some other point.
+type Projection struct {
+	// Coord is the nearest point on the path.
+	Coord Coord
+	// Progress is how far along the path Coord is from its first coordinate, in meters.
+	Progress float64
+	// Distance is how far the original point is from Coord, in meters.
+	Distance float64
+}
+
+// Project finds the point on the Route's path nearest to c. It returns false if
+// the Route has fewer than two coordinates and therefore no path.
+func (r *Route) Project(c Coord) (Projection, bool) {
+	if len(r.Coords) < 2 {
+		return Projection{}, false
+	}
+
+	best := Projection{Distance: math.Inf(1)}
+	progress := 0.0
+	for i := 0; i+1 < len(r.Coords); i++ {
+		start, end := r.Coords[i], r.Coords[i+1]
+		nearest, fraction := projectOntoSegment(c, start, end)
+		if distance := DistanceMeters(c, nearest); distance < best.Distance {
+			length := DistanceMeters(start, end)
+			best = Projection{Coord: nearest, Progress: progress + fraction*length, Distance: distance}
+		}
+		progress += DistanceMeters(start, end)
+	}
+	return best, true
+}
+
+// projectOntoSegment returns the point on the segment from start to end nearest to c, along with
+// how far along the segment it is as a fraction from 0 to 1. Over the short distances between a
+// route's coordinates, treating latitude and longitude as planar (scaled by latitude) is accurate enough.
+func projectOntoSegment(c, start, end Coord) (Coord, float64) {
+	scale := math.Cos(toRadians(start.Lat))
+	dx := (end.Lng - start.Lng) * scale
+	dy := end.Lat - start.Lat
+	lengthSquared := dx*dx + dy*dy
+	if lengthSquared == 0 {
+		return start, 0
+	}
+
+	fraction := ((c.Lng-start.Lng)*scale*dx + (c.Lat-start.Lat)*dy) / lengthSquared
+	fraction = math.Max(0, math.Min(1, fraction))
+	return Coord{
+		Lat: start.Lat + fraction*(end.Lat-start.Lat),
+		Lng: start.Lng + fraction*(end.Lng-start.Lng),
+	}, fraction
+}
+
+// Directions a vehicle can travel along a Route's path.
+const (
+	// DirectionOutbound is toward the end of the path.
+	DirectionOutbound = "outbound"
+	// DirectionInbound is toward the start of the path.
+	DirectionInbound = "inbound"
+)
+
+// minDirectionStep is how far in meters a vehicle must move along a path for the movement to count
+// toward its direction. Smaller movements are likely to be GPS noise.
+const minDirectionStep = 5.0
+
+// InferDirection determines which way a vehicle is traveling from its chronological progress along a
+// Route's path. It returns an empty string if the direction can't be determined.
+func InferDirection(progress []float64) string {
+	forward, backward := 0, 0
+	for i := 1; i < len(progress); i++ {
+		step := progress[i] - progress[i-1]
+		if step > minDirectionStep {
+			forward++
+		} else if step < -minDirectionStep {
+			backward++
+		}
+	}
+
+	switch {
+	case forward > backward:
+		return DirectionOutbound
+	case backward > forward:
+		return DirectionInbound
+	default:
+		return ""
+	}
+}
+
+// Simplify reduces a path to fewer coordinates with the Douglas-Peucker algorithm. No coordinate
+// that is dropped is further than tolerance meters from the simplified path. The first and last
+// coordinates are always kept.
+func Simplify(coords []Coord, tolerance float64) []Coord {
+	if len(coords) < 3 {
+		return append([]Coord{}, coords...)
+	}
+	keep := make([]bool, len(coords))
+	keep[0], keep[len(coords)-1] = true, true
+	simplifyRange(coords, 0, len(coords)-1, tolerance, keep)
+
+	simplified := []Coord{}
+	for i, coord := range coords {
+		if keep[i] {
+			simplified = append(simplified, coord)
+		}
+	}
+	return simplified
+}
+
+// simplifyRange marks which coordinates strictly between first and last must be kept.
+func simplifyRange(coords []Coord, first, last int, tolerance float64, keep []bool) {
+	farthest, farthestDistance := -1, tolerance
+	for i := first + 1; i < last; i++ {
+		nearest, _ := projectOntoSegment(coords[i], coords[first], coords[last])
+		if distance := DistanceMeters(coords[i], nearest); distance > farthestDistance {
+			farthest, farthestDistance = i, distance
+		}
+	}
+	if farthest < 0 {
+		return
+	}
+	keep[farthest] = true
+	simplifyRange(coords, first, farthest, tolerance, keep)
+	simplifyRange(coords, farthest, last, tolerance, keep)
+}
@@ -0,0 +1,247 @@
+package model
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDistanceMeters(t *testing.T) {
+	// One thousandth of a degree of latitude is about 111 meters.
+	distance := DistanceMeters(Coord{Lat: 42.730, Lng: -73.680}, Coord{Lat: 42.731, Lng: -73.680})
+	if math.Abs(distance-111.2) > 0.5 {
+		t.Errorf("Got %v, expected about 111.2.", distance)
+	}
+	if distance := DistanceMeters(Coord{Lat: 42.73, Lng: -73.68}, Coord{Lat: 42.73, Lng: -73.68}); distance != 0 {
+		t.Errorf("Got %v, expected 0.", distance)
+	}
+}
+
+func TestBearingDegrees(t *testing.T) {
+	origin := Coord{Lat: 42.730, Lng: -73.680}
+	for _, testCase := range []struct {
+		to       Coord
+		expected float64
+	}{
+		{Coord{Lat: 42.731, Lng: -73.680}, 0},
+		{Coord{Lat: 42.730, Lng: -73.679}, 90},
+		{Coord{Lat: 42.729, Lng: -73.680}, 180},
+		{Coord{Lat: 42.730, Lng: -73.681}, 270},
+	} {
+		if bearing := BearingDegrees(origin, testCase.to); math.Abs(bearing-testCase.expected) > 0.1 {
+			t.Errorf("Got %v toward %v, expected about %v.", bearing, testCase.to, testCase.expected)
+		}
+	}
+}
+
+func TestRouteLengthMeters(t *testing.T) {
+	// Two legs of one thousandth of a degree of latitude each, out and back.
+	route := Route{Coords: []Coord{
+		{Lat: 42.730, Lng: -73.680},
+		{Lat: 42.731, Lng: -73.680},
+		{Lat: 42.730, Lng: -73.680},
+	}}
+	if length := route.LengthMeters(); math.Abs(length-222.4) > 1 {
+		t.Errorf("Got %v, expected about 222.4.", length)
+	}
+
+	for _, coords := range [][]Coord{nil, {{Lat: 42.73, Lng: -73.68}}} {
+		route := Route{Coords: coords}
+		if length := route.LengthMeters(); length != 0 {
+			t.Errorf("Got %v for %d coordinates, expected 0.", length, len(coords))
+		}
+	}
+}
+
+func TestRouteProject(t *testing.T) {
+	// An L-shaped route: north along a line of longitude, then east along a line of latitude.
+	route := Route{Coords: []Coord{
+		{Lat: 42.730, Lng: -73.680},
+		{Lat: 42.732, Lng: -73.680},
+		{Lat: 42.732, Lng: -73.677},
+	}}
+	firstLeg := DistanceMeters(route.Coords[0], route.Coords[1])
+
+	table := []struct {
+		point    Coord
+		expected Coord
+		progress float64
+	}{
+		// Slightly east of the first leg's midpoint
+		{Coord{Lat: 42.731, Lng: -73.6799}, Coord{Lat: 42.731, Lng: -73.680}, firstLeg / 2},
+		// Slightly south of the second leg
+		{Coord{Lat: 42.7319, Lng: -73.6785}, Coord{Lat: 42.732, Lng: -73.6785}, firstLeg + DistanceMeters(route.Coords[1], Coord{Lat: 42.732, Lng: -73.6785})},
+		// Before the start of the route
+		{Coord{Lat: 42.729, Lng: -73.680}, Coord{Lat: 42.730, Lng: -73.680}, 0},
+	}
+
+	for _, testCase := range table {
+		projection, ok := route.Project(testCase.point)
+		if !ok {
+			t.Fatal("Expected a projection.")
+		}
+		if DistanceMeters(projection.Coord, testCase.expected) > 0.5 {
+			t.Errorf("Projected %+v to %+v, expected %+v.", testCase.point, projection.Coord, testCase.expected)
+		}
+		if math.Abs(projection.Progress-testCase.progress) > 0.5 {
+			t.Errorf("Got progress %v, expected %v.", projection.Progress, testCase.progress)
+		}
+		if math.Abs(projection.Distance-DistanceMeters(testCase.point, testCase.expected)) > 0.5 {
+			t.Errorf("Got distance %v, expected %v.", projection.Distance, DistanceMeters(testCase.point, testCase.expected))
+		}
+	}
+}
+
+func TestRouteProjectWithoutPath(t *testing.T) {
+	route := Route{Coords: []Coord{{Lat: 42.73, Lng: -73.68}}}
+	if _, ok := route.Project(Coord{Lat: 42.73, Lng: -73.68}); ok {
+		t.Error("Expected no projection for a route with one coordinate.")
+	}
+}
+
+func TestInferDirection(t *testing.T) {
+	table := []struct {
+		progress []float64
+		expected string
+	}{
+		{[]float64{0, 50, 120, 200}, DirectionOutbound},
+		{[]float64{800, 700, 650, 500}, DirectionInbound},
+		// Mostly forward, with one GPS hiccup backward
+		{[]float64{100, 150, 140, 210, 260}, DirectionOutbound},
+		// Parked, with small jitter
+		{[]float64{300, 302, 299, 301}, ""},
+		{[]float64{300}, ""},
+		{nil, ""},
+	}
+
+	for _, testCase := range table {
+		if direction := InferDirection(testCase.progress); direction != testCase.expected {
+			t.Errorf("Got %q for %v, expected %q.", direction, testCase.progress, testCase.expected)
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	// A zig-zag heading east, with peaks about 111 meters north of a straight line.
+	zigZag := []Coord{
+		{Lat: 42.730, Lng: -73.680},
+		{Lat: 42.731, Lng: -73.679},
+		{Lat: 42.730, Lng: -73.678},
+		{Lat: 42.731, Lng: -73.677},
+		{Lat: 42.730, Lng: -73.676},
+	}
+	// A straight line east, with tiny GPS jitter.
+	jittery := []Coord{
+		{Lat: 42.73000, Lng: -73.680},
+		{Lat: 42.73001, Lng: -73.679},
+		{Lat: 42.72999, Lng: -73.678},
+		{Lat: 42.73000, Lng: -73.677},
+	}
+
+	table := []struct {
+		coords    []Coord
+		tolerance float64
+		expected  []Coord
+	}{
+		// The peaks are too far off to drop.
+		{zigZag, 50, zigZag},
+		// A loose enough tolerance flattens the zig-zag entirely.
+		{zigZag, 150, []Coord{zigZag[0], zigZag[4]}},
+		{jittery, 5, []Coord{jittery[0], jittery[3]}},
+		{jittery[:2], 5, jittery[:2]},
+		{nil, 5, []Coord{}},
+	}
+
+	for _, testCase := range table {
+		simplified := Simplify(testCase.coords, testCase.tolerance)
+		if !reflect.DeepEqual(simplified, testCase.expected) {
+			t.Errorf("Got %v with tolerance %v, expected %v.", simplified, testCase.tolerance, testCase.expected)
+		}
+	}
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	box := BoundingBox{MinLat: 42.72, MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.67}
+	for _, testCase := range []struct {
+		c        Coord
+		contains bool
+	}{
+		{Coord{Lat: 42.73, Lng: -73.68}, true},
+		{Coord{Lat: 42.72, Lng: -73.67}, true},
+		{Coord{Lat: 42.75, Lng: -73.68}, false},
+		{Coord{Lat: 42.73, Lng: -73.66}, false},
+	} {
+		if contains := box.Contains(testCase.c); contains != testCase.contains {
+			t.Errorf("Got %v for %+v, expected %v.", contains, testCase.c, testCase.contains)
+		}
+	}
+	if box.Empty() {
+		t.Error("Expected box not to be empty.")
+	}
+
+	inverted := BoundingBox{MinLat: 42.74, MinLng: -73.69, MaxLat: 42.72, MaxLng: -73.67}
+	if !inverted.Empty() || inverted.Contains(Coord{Lat: 42.73, Lng: -73.68}) {
+		t.Error("Expected inverted box to be empty.")
+	}
+}
+
+func TestRouteBounds(t *testing.T) {
+	route := Route{Coords: []Coord{{Lat: 42.73, Lng: -73.68}, {Lat: 42.71, Lng: -73.66}, {Lat: 42.72, Lng: -73.69}}}
+	expected := BoundingBox{MinLat: 42.71, MinLng: -73.69, MaxLat: 42.73, MaxLng: -73.66}
+	if box := route.Bounds(); box != expected {
+		t.Errorf("Got %+v, expected %+v.", box, expected)
+	}
+	if box := (&Route{}).Bounds(); !box.Empty() {
+		t.Errorf("Got %+v for a route without coordinates, expected an empty box.", box)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	box := BoundingBox{MinLat: 42.72, MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.66}
+	heatmap := NewHeatmap(box, 0.01)
+	if rows, cols := len(heatmap.Counts), len(heatmap.Counts[0]); rows != 2 || cols != 3 {
+		t.Fatalf("Got %d rows and %d columns, expected 2 and 3.", rows, cols)
+	}
+
+	for _, c := range []Coord{
+		{Lat: 42.725, Lng: -73.685},
+		{Lat: 42.726, Lng: -73.684},
+		{Lat: 42.735, Lng: -73.665},
+		// On the maximum edges.
+		{Lat: 42.74, Lng: -73.66},
+	} {
+		if !heatmap.Add(c) {
+			t.Errorf("Expected %+v to be in the box.", c)
+		}
+	}
+	if heatmap.Add(Coord{Lat: 42.75, Lng: -73.68}) {
+		t.Error("Expected a point outside the box not to be counted.")
+	}
+	expected := [][]int{{2, 0, 0}, {0, 0, 2}}
+	if !reflect.DeepEqual(heatmap.Counts, expected) || heatmap.Total != 4 {
+		t.Errorf("Got counts %v and total %d, expected %v and 4.", heatmap.Counts, heatmap.Total, expected)
+	}
+}
+
+func TestHeatmapSize(t *testing.T) {
+	box := BoundingBox{MinLat: 42.72, MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.67}
+	for _, testCase := range []struct {
+		box        BoundingBox
+		cellSize   float64
+		rows, cols int
+	}{
+		{box, 0.01, 2, 2},
+		{box, 0.015, 2, 2},
+		{box, 1, 1, 1},
+		{BoundingBox{MinLat: 42.72, MinLng: -73.69, MaxLat: 42.72, MaxLng: -73.69}, 0.01, 1, 1},
+		{BoundingBox{MinLat: 42.74, MinLng: -73.69, MaxLat: 42.72, MaxLng: -73.67}, 0.01, 0, 0},
+		{box, 1e-12, MaxHeatmapCells + 1, MaxHeatmapCells + 1},
+		{box, math.NaN(), MaxHeatmapCells + 1, MaxHeatmapCells + 1},
+		{BoundingBox{MinLat: math.NaN(), MinLng: -73.69, MaxLat: 42.74, MaxLng: -73.67}, 0.01, MaxHeatmapCells + 1, 2},
+		{BoundingBox{MinLat: 42.72, MinLng: math.Inf(-1), MaxLat: 42.74, MaxLng: -73.67}, 0.01, 2, MaxHeatmapCells + 1},
+	} {
+		if rows, cols := HeatmapSize(testCase.box, testCase.cellSize); rows != testCase.rows || cols != testCase.cols {
+			t.Errorf("Got %d by %d for cell size %v, expected %d by %d.", rows, cols, testCase.cellSize, testCase.rows, testCase.cols)
+		}
+	}
+}
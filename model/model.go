@@ -2,10 +2,14 @@
 package model
 
 import (
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// VehicleUpdate represents a single position observed for a Vehicle.
+// VehicleUpdate represents a single position observed for a Vehicle. Lat, Lng, Heading, and Speed
+// are kept exactly as the feed reported them, so no precision is lost in storing them.
 type VehicleUpdate struct {
 	VehicleID string    `json:"vehicleID"   bson:"vehicleID,omitempty"`
 	Lat       string    `json:"lat"         bson:"lat"`
@@ -18,6 +22,74 @@ type VehicleUpdate struct {
 	Status    string    `json:"status"      bson:"status"`
 	Created   time.Time `json:"created"     bson:"created"`
 	Route     string    `json:"RouteID"     bson:"routeID"`
+	// RouteCandidates are the routes the vehicle might be on, most likely first.
+	RouteCandidates []RouteCandidate `json:"routeCandidates,omitempty" bson:"routeCandidates,omitempty"`
+	// Direction is which way the vehicle is traveling along Route, if it can be determined.
+	Direction string `json:"direction,omitempty" bson:"direction,omitempty"`
+	// Occupancy is the number of riders aboard, for feeds that report it. It's read from the
+	// feed field given the "occupancy" alias in the updater's FieldAliases.
+	Occupancy *int `json:"occupancy,omitempty" bson:"occupancy,omitempty"`
+	// Snapped is the nearest position on Route, if the API has been asked to compute it.
+	Snapped *Coord `json:"snapped,omitempty" bson:"-"`
+	// SynthesizedTime means that the feed's date or time was malformed, so Date and Time are
+	// when the update was fetched instead.
+	SynthesizedTime bool `json:"synthesizedTime,omitempty" bson:"synthesizedTime,omitempty"`
+	// Feed is the data feed that reported the update, which is also its vehicle's Feed.
+	Feed string `json:"feed,omitempty" bson:"feed,omitempty"`
+}
+
+// Key identifies the vehicle that the update is for.
+func (u VehicleUpdate) Key() VehicleKey {
+	return VehicleKey{VehicleID: u.VehicleID, Feed: u.Feed}
+}
+
+// Coord parses the update's position.
+func (u *VehicleUpdate) Coord() (Coord, error) {
+	lat, err := strconv.ParseFloat(u.Lat, 64)
+	if err != nil {
+		return Coord{}, err
+	}
+	lng, err := strconv.ParseFloat(u.Lng, 64)
+	if err != nil {
+		return Coord{}, err
+	}
+	return Coord{Lat: lat, Lng: lng}, nil
+}
+
+// RouteCandidate is a Route that a vehicle might be on.
+type RouteCandidate struct {
+	RouteID string `json:"routeID" bson:"routeID"`
+	// Confidence is between 0 and 1. The confidences of an update's RouteCandidates add up to 1.
+	Confidence float64 `json:"confidence" bson:"confidence"`
+}
+
+// HourlyOccupancy is the average occupancy of vehicles on a route during one hour of a day.
+type HourlyOccupancy struct {
+	Hour int `json:"hour"`
+	// Average is null if there were no occupancy reports during the hour.
+	Average *float64 `json:"average"`
+}
+
+// TrackGap is a period during which a vehicle sent no updates.
+type TrackGap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Duration is the length of the gap in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// RouteBackfill reports the progress of guessing routes for stored updates that have none.
+type RouteBackfill struct {
+	Running bool `json:"running"`
+	// Done is true once every update has been examined.
+	Done bool `json:"done"`
+	// Cursor resumes the backfill after the last batch of updates it examined.
+	Cursor string `json:"cursor"`
+	// Scanned is how many updates have been examined, and Attributed how many were given routes.
+	Scanned    int `json:"scanned"`
+	Attributed int `json:"attributed"`
+	// Error is why the backfill stopped early, if it did.
+	Error string `json:"error,omitempty"`
 }
 
 // Vehicle represents an object being tracked.
@@ -27,6 +99,65 @@ type Vehicle struct {
 	Created     time.Time `bson:"created"`
 	Updated     time.Time `bson:"updated"`
 	Enabled     bool      `json:"enabled"     bson:"enabled"`
+	// RetentionDays overrides how long this vehicle's updates are kept. Zero means the default is used.
+	RetentionDays int `json:"retentionDays" bson:"retentionDays,omitempty"`
+	// Feed identifies the data feed that reports this vehicle, in case vehicle IDs collide between feeds.
+	Feed string `json:"feed" bson:"feed,omitempty"`
+	// LastHeartbeat is when the vehicle last reported, even if it hadn't moved.
+	LastHeartbeat time.Time `json:"lastHeartbeat" bson:"lastHeartbeat,omitempty"`
+	// Color is a hex color like "#1a2b3c". If empty, the vehicle is shown in its route's color.
+	Color string `json:"color" bson:"color"`
+	// MergingInto is the vehicle this one is being merged into, if that merge hasn't finished.
+	MergingInto *VehicleKey `json:"mergingInto,omitempty" bson:"mergingInto,omitempty"`
+}
+
+// Key identifies the vehicle.
+func (v Vehicle) Key() VehicleKey {
+	return VehicleKey{VehicleID: v.VehicleID, Feed: v.Feed}
+}
+
+// VehicleKey identifies a vehicle by its ID within the data feed that reports it, since vehicle IDs
+// from different feeds may collide. Vehicles without a feed have an empty Feed.
+type VehicleKey struct {
+	VehicleID string `json:"vehicleID" bson:"vehicleID"`
+	Feed      string `json:"feed" bson:"feed,omitempty"`
+}
+
+// String returns the vehicle ID, preceded by the feed and "/" if there is one, like "a/1". It is
+// unique across feeds.
+func (k VehicleKey) String() string {
+	if k.Feed == "" {
+		return k.VehicleID
+	}
+	return k.Feed + "/" + k.VehicleID
+}
+
+// colorRegexp matches hex colors like "#1a2b3c" or "#abc".
+var colorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// ValidColor reports whether color is a hex color like "#1a2b3c" or "#abc".
+func ValidColor(color string) bool {
+	return colorRegexp.MatchString(color)
+}
+
+// DefaultRoutePalette is the colors given to routes created without one, chosen to be easy to tell
+// apart on the map.
+var DefaultRoutePalette = []string{"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4", "#f032e6", "#9a6324"}
+
+// NextColor returns the color in palette that the fewest of used share, preferring earlier colors,
+// so that no color repeats until every color has been used. It returns "" if palette is empty.
+func NextColor(palette []string, used []string) string {
+	counts := make(map[string]int, len(used))
+	for _, color := range used {
+		counts[strings.ToLower(color)]++
+	}
+	next := ""
+	for _, color := range palette {
+		if next == "" || counts[strings.ToLower(color)] < counts[strings.ToLower(next)] {
+			next = color
+		}
+	}
+	return next
 }
 
 // Status contains a detailed message on the tracked object's status.
@@ -47,7 +178,9 @@ type LatestPosition struct {
 	StatusMessage *string   `json:"public_status_message"` // this is a pointer so it defaults to null
 }
 
-// Coord represents a single lat/lng point used to draw routes
+// Coord represents a single lat/lng point used to draw routes. Coordinates are stored as BSON
+// doubles and encoded in JSON with the fewest digits that parse back to the same float64, so they
+// round-trip exactly.
 type Coord struct {
 	Lat float64 `json:"lat" bson:"lat"`
 	Lng float64 `json:"lng" bson:"lng"`
@@ -69,6 +202,58 @@ type Route struct {
 	AvailableRoute int       `json:"availableroute" bson:"availableroute"`
 	Created        time.Time `json:"created"        bson:"created"`
 	Updated        time.Time `json:"updated"        bson:"updated"`
+	// Variants are other paths the Route sometimes runs instead of Coords, such as on weekends.
+	Variants []RouteVariant `json:"variants" bson:"variants"`
+	// ActiveVariant is the ID of a variant that runs regardless of the day, if it is set.
+	ActiveVariant string `json:"activeVariant" bson:"activeVariant"`
+	// ServiceWindows are when the Route runs each week. If there are any, the Route is enabled
+	// and disabled automatically to match them unless ManualEnabled is set.
+	ServiceWindows []RouteServiceWindow `json:"serviceWindows" bson:"serviceWindows"`
+	// ManualEnabled leaves the Route enabled or disabled as it was set, despite its ServiceWindows.
+	ManualEnabled bool `json:"manualEnabled" bson:"manualEnabled"`
+}
+
+// RouteVariant is another path and set of stops for a Route. At most one variant runs at a time.
+type RouteVariant struct {
+	ID      string   `json:"id"      bson:"id"`
+	Name    string   `json:"name"    bson:"name"`
+	Coords  []Coord  `json:"coords"  bson:"coords"`
+	StopsID []string `json:"stopsid" bson:"stopsid"`
+	// Days are the service days of the week the variant runs, unless the Route has an ActiveVariant.
+	Days []time.Weekday `json:"days" bson:"days"`
+}
+
+// Variant returns the RouteVariant that runs at t: the ActiveVariant if there is one, otherwise
+// the first variant that runs on t's service day of the week, which begins serviceDayStart after
+// midnight in t's location. It returns false if the Route runs its own path at t.
+func (r Route) Variant(t time.Time, serviceDayStart time.Duration) (RouteVariant, bool) {
+	if r.ActiveVariant != "" {
+		for _, variant := range r.Variants {
+			if variant.ID == r.ActiveVariant {
+				return variant, true
+			}
+		}
+		return RouteVariant{}, false
+	}
+	weekday := ServiceDay(t, serviceDayStart).Weekday()
+	for _, variant := range r.Variants {
+		for _, day := range variant.Days {
+			if day == weekday {
+				return variant, true
+			}
+		}
+	}
+	return RouteVariant{}, false
+}
+
+// AtTime returns the Route as it runs at t, with the Coords and StopsID of its variant if one runs
+// then. Each service day begins serviceDayStart after midnight in t's location.
+func (r Route) AtTime(t time.Time, serviceDayStart time.Duration) Route {
+	if variant, ok := r.Variant(t, serviceDayStart); ok {
+		r.Coords = variant.Coords
+		r.StopsID = variant.StopsID
+	}
+	return r
 }
 
 // Stop indicates where a tracked object is scheduled to arrive
@@ -84,6 +269,78 @@ type Stop struct {
 	Enabled      bool    `json:"enabled,string" bson:"enabled"`
 	RouteID      string  `json:"routeId"        bson:"routeId"`
 	SegmentIndex int     `json:"segmentindex"   bson:"segmentindex"`
+	// Attributes flag amenities at the Stop that riders care about, like "shelter", "bench",
+	// "accessible", and "lit". Attributes that are missing aren't known to be there.
+	Attributes map[string]bool `json:"attributes" bson:"attributes"`
+}
+
+// HasCoords reports whether the Stop has a real position. Stops imported without coordinates end
+// up at (0, 0), which is in the Gulf of Guinea rather than anywhere a shuttle goes.
+func (s Stop) HasCoords() bool {
+	return s.Lat != 0 || s.Lng != 0
+}
+
+// HasAttributes reports whether the Stop has every one of the named attributes.
+func (s Stop) HasAttributes(names []string) bool {
+	for _, name := range names {
+		if !s.Attributes[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// StopRoute identifies a Route that serves a Stop.
+type StopRoute struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// StopWithRoutes is a Stop along with every Route that serves it.
+type StopWithRoutes struct {
+	Stop
+	Routes []StopRoute `json:"routes"`
+}
+
+// StopWindow is a time of day during which a Stop is served. Start and End are formatted
+// like "15:04". A window that ends before it starts continues past midnight.
+type StopWindow struct {
+	StopID string `json:"stopID" bson:"stopID"`
+	Start  string `json:"start"  bson:"start"`
+	End    string `json:"end"    bson:"end"`
+}
+
+// Active reports whether the time of day of t is within the window.
+func (w StopWindow) Active(t time.Time) (bool, error) {
+	return withinTimesOfDay(w.Start, w.End, t)
+}
+
+// withinTimesOfDay reports whether the time of day of t is at or after start and before end, both
+// formatted like "15:04". If end is earlier than start, the period runs past midnight.
+func withinTimesOfDay(startTime, endTime string, t time.Time) (bool, error) {
+	startMinute, err := minuteOfDay(startTime)
+	if err != nil {
+		return false, err
+	}
+	endMinute, err := minuteOfDay(endTime)
+	if err != nil {
+		return false, err
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute, nil
+	}
+	return minute >= startMinute || minute < endMinute, nil
+}
+
+// minuteOfDay parses a time of day formatted like "15:04" into minutes after midnight.
+func minuteOfDay(timeOfDay string) (int, error) {
+	parsed, err := time.Parse("15:04", timeOfDay)
+	if err != nil {
+		return 0, err
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
 }
 
 type MapPoint struct {
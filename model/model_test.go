@@ -0,0 +1,155 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStopWindowActive(t *testing.T) {
+	day := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	evening := StopWindow{Start: "18:00", End: "23:00"}
+	lateNight := StopWindow{Start: "22:00", End: "02:00"}
+
+	table := []struct {
+		window   StopWindow
+		t        time.Time
+		expected bool
+	}{
+		{evening, day.Add(12 * time.Hour), false},
+		{evening, day.Add(18 * time.Hour), true},
+		{evening, day.Add(21*time.Hour + 30*time.Minute), true},
+		{evening, day.Add(23 * time.Hour), false},
+		{lateNight, day.Add(23 * time.Hour), true},
+		{lateNight, day.Add(time.Hour), true},
+		{lateNight, day.Add(12 * time.Hour), false},
+	}
+
+	for _, testCase := range table {
+		active, err := testCase.window.Active(testCase.t)
+		if err != nil {
+			t.Fatalf("Unable to check window: %v", err)
+		}
+		if active != testCase.expected {
+			t.Errorf("Window %s-%s at %s: got %v, expected %v.", testCase.window.Start, testCase.window.End, testCase.t.Format("15:04"), active, testCase.expected)
+		}
+	}
+
+	if _, err := (StopWindow{Start: "6pm", End: "23:00"}).Active(day); err == nil {
+		t.Error("Expected error for malformed window.")
+	}
+}
+
+func TestValidColor(t *testing.T) {
+	for color, expected := range map[string]bool{
+		"#1a2b3c": true,
+		"#ABC":    true,
+		"":        false,
+		"1a2b3c":  false,
+		"#1a2b3":  false,
+		"#ggg":    false,
+		"blue":    false,
+	} {
+		if valid := ValidColor(color); valid != expected {
+			t.Errorf("Got %v for %q, expected %v.", valid, color, expected)
+		}
+	}
+}
+
+func TestVehicleKeyString(t *testing.T) {
+	for key, expected := range map[VehicleKey]string{
+		{VehicleID: "1"}:            "1",
+		{VehicleID: "1", Feed: "a"}: "a/1",
+	} {
+		if s := key.String(); s != expected {
+			t.Errorf("Got %q for %+v, expected %q.", s, key, expected)
+		}
+	}
+}
+
+func TestCoordinateJSONPrecision(t *testing.T) {
+	stop := Stop{Lat: 42.73029482619374, Lng: -73.67655638921047}
+	route := Route{Coords: []Coord{{Lat: stop.Lat, Lng: stop.Lng}}}
+
+	b, err := json.Marshal(stop)
+	if err != nil {
+		t.Fatalf("Unable to encode stop: %v", err)
+	}
+	decodedStop := Stop{}
+	if err := json.Unmarshal(b, &decodedStop); err != nil {
+		t.Fatalf("Unable to decode stop: %v", err)
+	}
+	if decodedStop.Lat != stop.Lat || decodedStop.Lng != stop.Lng {
+		t.Errorf("Got stop at %v, %v, expected %v, %v.", decodedStop.Lat, decodedStop.Lng, stop.Lat, stop.Lng)
+	}
+
+	b, err = json.Marshal(route)
+	if err != nil {
+		t.Fatalf("Unable to encode route: %v", err)
+	}
+	decodedRoute := Route{}
+	if err := json.Unmarshal(b, &decodedRoute); err != nil {
+		t.Fatalf("Unable to decode route: %v", err)
+	}
+	if len(decodedRoute.Coords) != 1 || decodedRoute.Coords[0] != route.Coords[0] {
+		t.Errorf("Got route coordinates %+v, expected %+v.", decodedRoute.Coords, route.Coords)
+	}
+}
+
+func TestRouteAtTime(t *testing.T) {
+	weekday := []Coord{{Lat: 42.73, Lng: -73.68}, {Lat: 42.74, Lng: -73.68}}
+	weekend := []Coord{{Lat: 42.73, Lng: -73.69}, {Lat: 42.74, Lng: -73.69}}
+	detour := []Coord{{Lat: 42.73, Lng: -73.70}, {Lat: 42.74, Lng: -73.70}}
+	route := Route{
+		ID:     "west",
+		Coords: weekday,
+		Variants: []RouteVariant{
+			{ID: "weekend", Coords: weekend, Days: []time.Weekday{time.Saturday, time.Sunday}},
+			{ID: "detour", Coords: detour},
+		},
+	}
+	friday := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	saturday := friday.AddDate(0, 0, 1)
+
+	if coords := route.AtTime(friday, 0).Coords; coords[0] != weekday[0] {
+		t.Errorf("Got %v on Friday, expected the route's own path.", coords)
+	}
+	if coords := route.AtTime(saturday, 0).Coords; coords[0] != weekend[0] {
+		t.Errorf("Got %v on Saturday, expected the weekend variant.", coords)
+	}
+
+	// Early Saturday morning is still Friday's service day.
+	if coords := route.AtTime(saturday.Add(-10*time.Hour), 3*time.Hour).Coords; coords[0] != weekday[0] {
+		t.Errorf("Got %v early on Saturday, expected the route's own path.", coords)
+	}
+
+	route.ActiveVariant = "detour"
+	for _, day := range []time.Time{friday, saturday} {
+		if coords := route.AtTime(day, 0).Coords; coords[0] != detour[0] {
+			t.Errorf("Got %v on %s, expected the active variant.", coords, day.Weekday())
+		}
+	}
+	if route.Coords[0] != weekday[0] {
+		t.Error("Expected AtTime to leave the route unchanged.")
+	}
+}
+
+func TestNextColor(t *testing.T) {
+	palette := []string{"#ff0000", "#00ff00", "#0000ff"}
+	used := []string{}
+	for i, expected := range []string{"#ff0000", "#00ff00", "#0000ff", "#ff0000", "#00ff00"} {
+		color := NextColor(palette, used)
+		if color != expected {
+			t.Errorf("Got %s for route %d, expected %s.", color, i, expected)
+		}
+		used = append(used, color)
+	}
+
+	// Colors are compared without regard to case, and colors outside the palette don't count.
+	if color := NextColor(palette, []string{"#FF0000", "#123456"}); color != "#00ff00" {
+		t.Errorf("Got %s, expected #00ff00.", color)
+	}
+	if color := NextColor(nil, used); color != "" {
+		t.Errorf("Got %s for an empty palette, expected none.", color)
+	}
+}
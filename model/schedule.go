@@ -0,0 +1,328 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// StopArrivalRadius is how close in meters a vehicle must come to a Stop to have arrived at it.
+	StopArrivalRadius = 30.0
+	// EarlyTolerance is how early a vehicle may arrive at a Stop and still be on time.
+	EarlyTolerance = time.Minute
+	// LateTolerance is how late a vehicle may arrive at a Stop and still be on time.
+	LateTolerance = 5 * time.Minute
+	// MaxScheduleDeviation is the furthest an arrival may be from a scheduled time to count toward it.
+	// Scheduled arrivals with no arrival this close were missed.
+	MaxScheduleDeviation = 30 * time.Minute
+)
+
+// ScheduledArrival is a time of day at which a Route is scheduled to serve a Stop. Time is
+// formatted like "15:04".
+type ScheduledArrival struct {
+	RouteID string `json:"routeID" bson:"routeID"`
+	StopID  string `json:"stopID"  bson:"stopID"`
+	Time    string `json:"time"    bson:"time"`
+}
+
+// RouteServiceWindow is a time of day during which a Route runs on some days of the week. Start
+// and End are formatted like "15:04". Times earlier in the day than the service day's start are in
+// the early hours of the next calendar day.
+type RouteServiceWindow struct {
+	// Days are the service days that the window starts on. A window that ends before it starts,
+	// counting from the start of the service day, runs into the next service day.
+	Days  []time.Weekday `json:"days"  bson:"days"`
+	Start string         `json:"start" bson:"start"`
+	End   string         `json:"end"   bson:"end"`
+}
+
+// Validate checks that the window's times are formatted correctly.
+func (w RouteServiceWindow) Validate() error {
+	_, err := withinTimesOfDay(w.Start, w.End, time.Time{})
+	return err
+}
+
+// startsOn reports whether the window starts on day.
+func (w RouteServiceWindow) startsOn(day time.Weekday) bool {
+	for _, windowDay := range w.Days {
+		if windowDay == day {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledToRun reports whether one of the Route's service windows is open at t. Days and times
+// of day are in t's location, and each service day begins serviceDayStart after midnight.
+func (r Route) ScheduledToRun(t time.Time, serviceDayStart time.Duration) (bool, error) {
+	// Minutes are counted from the start of the service day, so that a window in the early hours
+	// belongs to the service day before.
+	dayStart := int(serviceDayStart / time.Minute)
+	sinceDayStart := func(minute int) int {
+		return (minute - dayStart + 24*60) % (24 * 60)
+	}
+	minute := sinceDayStart(t.Hour()*60 + t.Minute())
+	serviceDay := ServiceDay(t, serviceDayStart).Weekday()
+
+	for _, window := range r.ServiceWindows {
+		start, err := minuteOfDay(window.Start)
+		if err != nil {
+			return false, err
+		}
+		end, err := minuteOfDay(window.End)
+		if err != nil {
+			return false, err
+		}
+		start, end = sinceDayStart(start), sinceDayStart(end)
+
+		day := serviceDay
+		switch {
+		case start <= end && minute >= start && minute < end:
+		case start > end && minute >= start:
+		case start > end && minute < end:
+			// Past the start of this service day, the window started the service day before.
+			day = (day + 6) % 7
+		default:
+			continue
+		}
+		if window.startsOn(day) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// StopArrival is a Vehicle arriving at a Stop.
+type StopArrival struct {
+	VehicleID string `json:"vehicleID"`
+	Feed      string `json:"feed,omitempty"`
+	// RouteID is the route the vehicle was on when it arrived, if any.
+	RouteID string    `json:"routeID"`
+	StopID  string    `json:"stopID"`
+	Time    time.Time `json:"time"`
+}
+
+// StopAdherence summarizes how closely vehicles kept to a Stop's schedule during one day.
+type StopAdherence struct {
+	StopID    string `json:"stopID"`
+	Scheduled int    `json:"scheduled"`
+	Early     int    `json:"early"`
+	OnTime    int    `json:"onTime"`
+	Late      int    `json:"late"`
+	Missed    int    `json:"missed"`
+	// AverageDelay is how late in seconds, or early if negative, vehicles arrived on average.
+	// It is null if no scheduled arrivals were matched.
+	AverageDelay *float64 `json:"averageDelay"`
+}
+
+// DetectArrivals finds each time a vehicle arrived at one of the stops. Updates must be in
+// chronological order. A vehicle that stays near a stop for several updates arrives only once.
+func DetectArrivals(stops []Stop, updates []VehicleUpdate) []StopArrival {
+	arrivals := []StopArrival{}
+	// atStop is the stop each vehicle was last near, if any.
+	atStop := make(map[VehicleKey]string)
+	for _, update := range updates {
+		c, err := update.Coord()
+		if err != nil {
+			continue
+		}
+
+		nearest := ""
+		nearestDistance := StopArrivalRadius
+		for _, stop := range stops {
+			if distance := DistanceMeters(c, Coord{Lat: stop.Lat, Lng: stop.Lng}); distance <= nearestDistance {
+				nearest = stop.ID
+				nearestDistance = distance
+			}
+		}
+
+		if nearest != "" && nearest != atStop[update.Key()] {
+			arrivals = append(arrivals, StopArrival{VehicleID: update.VehicleID, Feed: update.Feed, RouteID: update.Route, StopID: nearest, Time: update.Created})
+		}
+		atStop[update.Key()] = nearest
+	}
+	return arrivals
+}
+
+// RecentArrivals finds the arrivals at one Stop from updates given newest first, so that the most
+// recent arrivals can be found without reading every update. It finds the same arrivals as
+// DetectArrivals does for that Stop.
+type RecentArrivals struct {
+	stop Stop
+	// found are arrivals known to be complete, in no particular order.
+	found []StopArrival
+	// pending holds, for each vehicle that was last seen near the stop, the earliest update in that
+	// visit. It's an arrival unless an earlier update turns out to be near the stop too.
+	pending map[VehicleKey]StopArrival
+	// oldest is when the last update added was created.
+	oldest time.Time
+}
+
+// NewRecentArrivals returns a RecentArrivals for stop.
+func NewRecentArrivals(stop Stop) *RecentArrivals {
+	return &RecentArrivals{stop: stop, pending: make(map[VehicleKey]StopArrival)}
+}
+
+// Add considers update, which must be no newer than any update added before.
+func (a *RecentArrivals) Add(update VehicleUpdate) {
+	a.oldest = update.Created
+	c, err := update.Coord()
+	if err != nil {
+		return
+	}
+	if DistanceMeters(c, Coord{Lat: a.stop.Lat, Lng: a.stop.Lng}) <= StopArrivalRadius {
+		a.pending[update.Key()] = StopArrival{VehicleID: update.VehicleID, Feed: update.Feed, RouteID: update.Route, StopID: a.stop.ID, Time: update.Created}
+		return
+	}
+	if arrival, ok := a.pending[update.Key()]; ok {
+		a.found = append(a.found, arrival)
+		delete(a.pending, update.Key())
+	}
+}
+
+// Have reports whether the n most recent arrivals are known, because no update older than those
+// added so far could change them.
+func (a *RecentArrivals) Have(n int) bool {
+	// Visits still in progress could end up arriving as late as they were last seen.
+	bound := a.oldest
+	for _, arrival := range a.pending {
+		if arrival.Time.After(bound) {
+			bound = arrival.Time
+		}
+	}
+	known := 0
+	for _, arrival := range a.found {
+		if arrival.Time.After(bound) {
+			known++
+		}
+	}
+	return known >= n
+}
+
+// Arrivals returns up to n of the most recent arrivals, most recent first, or all of them if n
+// isn't positive. Visits still in progress are counted as arrivals, so it must be called only
+// once every update has been added or Have(n) is true.
+func (a *RecentArrivals) Arrivals(n int) []StopArrival {
+	arrivals := append([]StopArrival{}, a.found...)
+	for _, arrival := range a.pending {
+		arrivals = append(arrivals, arrival)
+	}
+	sort.Slice(arrivals, func(i, j int) bool {
+		if !arrivals[i].Time.Equal(arrivals[j].Time) {
+			return arrivals[i].Time.After(arrivals[j].Time)
+		}
+		return arrivals[i].VehicleID < arrivals[j].VehicleID
+	})
+	if n > 0 && len(arrivals) > n {
+		arrivals = arrivals[:n]
+	}
+	return arrivals
+}
+
+// ServiceDay returns the start of the service day containing t, in t's location. Service days
+// begin start after midnight, so that service running past midnight counts toward the day it began.
+func ServiceDay(t time.Time, start time.Duration) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(start)
+	if t.Before(day) {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
+
+// Adherence compares arrivals with the schedule for the service day starting at day, in day's
+// location. Scheduled times earlier in the day than day are during the early hours of the next
+// calendar day. It returns the adherence of each stop in order. Each arrival counts toward at most
+// one scheduled arrival.
+func Adherence(stops []Stop, schedule []ScheduledArrival, arrivals []StopArrival, day time.Time) ([]StopAdherence, error) {
+	scheduled := make(map[string][]time.Time)
+	for _, s := range schedule {
+		t, err := time.Parse("15:04", s.Time)
+		if err != nil {
+			return nil, err
+		}
+		at := time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location())
+		if at.Before(day) {
+			at = at.AddDate(0, 0, 1)
+		}
+		scheduled[s.StopID] = append(scheduled[s.StopID], at)
+	}
+	arrived := make(map[string][]time.Time)
+	for _, arrival := range arrivals {
+		arrived[arrival.StopID] = append(arrived[arrival.StopID], arrival.Time)
+	}
+
+	adherence := make([]StopAdherence, 0, len(stops))
+	for _, stop := range stops {
+		times := scheduled[stop.ID]
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		used := make([]bool, len(arrived[stop.ID]))
+
+		a := StopAdherence{StopID: stop.ID, Scheduled: len(times)}
+		totalDelay := 0.0
+		for _, at := range times {
+			best := -1
+			for i, t := range arrived[stop.ID] {
+				if used[i] || absDuration(t.Sub(at)) > MaxScheduleDeviation {
+					continue
+				}
+				if best == -1 || absDuration(t.Sub(at)) < absDuration(arrived[stop.ID][best].Sub(at)) {
+					best = i
+				}
+			}
+			if best == -1 {
+				a.Missed++
+				continue
+			}
+			used[best] = true
+
+			delay := arrived[stop.ID][best].Sub(at)
+			totalDelay += delay.Seconds()
+			switch {
+			case delay < -EarlyTolerance:
+				a.Early++
+			case delay > LateTolerance:
+				a.Late++
+			default:
+				a.OnTime++
+			}
+		}
+		if matched := a.Early + a.OnTime + a.Late; matched > 0 {
+			average := totalDelay / float64(matched)
+			a.AverageDelay = &average
+		}
+		adherence = append(adherence, a)
+	}
+	return adherence, nil
+}
+
+// Headway is the time between successive arrivals of vehicles at a Stop.
+type Headway struct {
+	StopID  string `json:"stopID"`
+	RouteID string `json:"routeID"`
+	// Gaps are the seconds between each pair of successive arrivals, oldest first.
+	Gaps []float64 `json:"gaps"`
+	// Average is null if there were fewer than two arrivals.
+	Average *float64 `json:"average"`
+}
+
+// Headways returns the seconds between successive arrivals, in chronological order.
+func Headways(arrivals []StopArrival) []float64 {
+	times := make([]time.Time, 0, len(arrivals))
+	for _, arrival := range arrivals {
+		times = append(times, arrival.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	gaps := []float64{}
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]).Seconds())
+	}
+	return gaps
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
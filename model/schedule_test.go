@@ -0,0 +1,326 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDetectArrivals(t *testing.T) {
+	stops := []Stop{
+		{ID: "union", Lat: 42.7300, Lng: -73.6800},
+		{ID: "sage", Lat: 42.7320, Lng: -73.6800},
+	}
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	positions := []struct {
+		vehicleID string
+		routeID   string
+		lat       string
+	}{
+		{"1", "west", "42.7300"}, // arrives at union
+		{"1", "west", "42.7301"}, // still at union
+		{"1", "west", "42.7310"}, // between stops
+		{"2", "east", "42.7320"}, // arrives at sage
+		{"1", "west", "42.7320"}, // arrives at sage
+		{"1", "", "42.7300"},     // arrives back at union
+	}
+	updates := []VehicleUpdate{}
+	for i, p := range positions {
+		updates = append(updates, VehicleUpdate{VehicleID: p.vehicleID, Route: p.routeID, Lat: p.lat, Lng: "-73.6800", Created: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	arrivals := DetectArrivals(stops, updates)
+	expected := []StopArrival{
+		{"1", "", "west", "union", start},
+		{"2", "", "east", "sage", start.Add(3 * time.Minute)},
+		{"1", "", "west", "sage", start.Add(4 * time.Minute)},
+		{"1", "", "", "union", start.Add(5 * time.Minute)},
+	}
+	if len(arrivals) != len(expected) {
+		t.Fatalf("Got %d arrivals, expected %d: %+v", len(arrivals), len(expected), arrivals)
+	}
+	for i := range expected {
+		if arrivals[i] != expected[i] {
+			t.Errorf("Got arrival %+v, expected %+v.", arrivals[i], expected[i])
+		}
+	}
+}
+
+func TestRecentArrivals(t *testing.T) {
+	union := Stop{ID: "union", Lat: 42.7300, Lng: -73.6800}
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	positions := []struct {
+		vehicleID string
+		lat       string
+	}{
+		{"1", "42.7300"}, // arrives
+		{"2", "42.7301"}, // arrives
+		{"1", "42.7301"}, // still there
+		{"1", "42.7400"},
+		{"2", "42.7400"},
+		{"1", "42.7300"}, // arrives again
+		{"2", "bad"},
+		{"2", "42.7300"}, // arrives again
+		{"1", "42.7300"}, // still there
+	}
+	updates := []VehicleUpdate{}
+	for i, p := range positions {
+		updates = append(updates, VehicleUpdate{VehicleID: p.vehicleID, Lat: p.lat, Lng: "-73.6800", Created: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	expected := DetectArrivals([]Stop{union}, updates)
+	for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+		expected[i], expected[j] = expected[j], expected[i]
+	}
+	recent := NewRecentArrivals(union)
+	for i := len(updates) - 1; i >= 0; i-- {
+		recent.Add(updates[i])
+	}
+	if arrivals := recent.Arrivals(0); !reflect.DeepEqual(arrivals, expected) {
+		t.Errorf("Got %+v, expected %+v.", arrivals, expected)
+	}
+
+	// The two most recent arrivals are known without reading the first few updates.
+	recent = NewRecentArrivals(union)
+	read := 0
+	for i := len(updates) - 1; i >= 0 && !recent.Have(2); i-- {
+		recent.Add(updates[i])
+		read++
+	}
+	if arrivals := recent.Arrivals(2); !reflect.DeepEqual(arrivals, expected[:2]) {
+		t.Errorf("Got %+v, expected %+v.", arrivals, expected[:2])
+	}
+	if read == len(updates) {
+		t.Error("Expected to stop before reading every update.")
+	}
+}
+
+func TestAdherence(t *testing.T) {
+	day := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2017, 9, 1, hour, minute, second, 0, time.UTC)
+	}
+	stops := []Stop{{ID: "union"}, {ID: "sage"}, {ID: "unscheduled"}}
+	schedule := []ScheduledArrival{
+		{StopID: "union", Time: "08:00"},
+		{StopID: "union", Time: "08:30"},
+		{StopID: "union", Time: "09:00"},
+		{StopID: "union", Time: "12:00"},
+		{StopID: "sage", Time: "08:10"},
+	}
+	arrivals := []StopArrival{
+		{StopID: "union", Time: at(7, 57, 0)}, // 3 minutes early
+		{StopID: "union", Time: at(8, 32, 0)}, // 2 minutes late, on time
+		{StopID: "union", Time: at(9, 10, 0)}, // 10 minutes late
+		{StopID: "union", Time: at(10, 0, 0)}, // not near anything scheduled
+		{StopID: "sage", Time: at(8, 10, 30)}, // on time
+		{StopID: "unscheduled", Time: at(8, 0, 0)},
+	}
+
+	adherence, err := Adherence(stops, schedule, arrivals, day)
+	if err != nil {
+		t.Fatalf("Unable to compute adherence: %v", err)
+	}
+	if len(adherence) != 3 {
+		t.Fatalf("Got %d stops, expected 3.", len(adherence))
+	}
+
+	union := adherence[0]
+	if union.Scheduled != 4 || union.Early != 1 || union.OnTime != 1 || union.Late != 1 || union.Missed != 1 {
+		t.Errorf("Got %+v for union.", union)
+	}
+	// (-180 + 120 + 600) / 3
+	if union.AverageDelay == nil || *union.AverageDelay != 180 {
+		t.Errorf("Got average delay %v for union, expected 180.", union.AverageDelay)
+	}
+
+	sage := adherence[1]
+	if sage.Scheduled != 1 || sage.OnTime != 1 || sage.AverageDelay == nil || *sage.AverageDelay != 30 {
+		t.Errorf("Got %+v for sage.", sage)
+	}
+
+	unscheduled := adherence[2]
+	if unscheduled.Scheduled != 0 || unscheduled.AverageDelay != nil {
+		t.Errorf("Got %+v for unscheduled stop, expected no stats.", unscheduled)
+	}
+}
+
+func TestAdherenceInvalidTime(t *testing.T) {
+	schedule := []ScheduledArrival{{StopID: "union", Time: "8am"}}
+	if _, err := Adherence([]Stop{{ID: "union"}}, schedule, nil, time.Now()); err == nil {
+		t.Error("Expected error for invalid scheduled time.")
+	}
+}
+
+func TestServiceDay(t *testing.T) {
+	start := 3 * time.Hour
+	for _, testCase := range []struct {
+		t        time.Time
+		expected time.Time
+	}{
+		{time.Date(2017, 9, 1, 23, 59, 0, 0, time.UTC), time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC)},
+		// Just after midnight is still the previous service day.
+		{time.Date(2017, 9, 2, 0, 30, 0, 0, time.UTC), time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 9, 2, 2, 59, 0, 0, time.UTC), time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 9, 2, 3, 0, 0, 0, time.UTC), time.Date(2017, 9, 2, 3, 0, 0, 0, time.UTC)},
+	} {
+		if day := ServiceDay(testCase.t, start); !day.Equal(testCase.expected) {
+			t.Errorf("Got service day %v for %v, expected %v.", day, testCase.t, testCase.expected)
+		}
+	}
+
+	// Without a start, service days are calendar days.
+	midnight := time.Date(2017, 9, 2, 0, 0, 0, 0, time.UTC)
+	if day := ServiceDay(midnight.Add(30*time.Minute), 0); !day.Equal(midnight) {
+		t.Errorf("Got service day %v, expected %v.", day, midnight)
+	}
+}
+
+func TestAdherenceAfterMidnight(t *testing.T) {
+	day := time.Date(2017, 9, 1, 3, 0, 0, 0, time.UTC)
+	stops := []Stop{{ID: "union"}}
+	schedule := []ScheduledArrival{
+		{StopID: "union", Time: "23:50"},
+		// The last run of the service day, early the next calendar day.
+		{StopID: "union", Time: "00:20"},
+	}
+	arrivals := []StopArrival{
+		{StopID: "union", Time: time.Date(2017, 9, 1, 23, 51, 0, 0, time.UTC)},
+		{StopID: "union", Time: time.Date(2017, 9, 2, 0, 21, 0, 0, time.UTC)},
+	}
+
+	adherence, err := Adherence(stops, schedule, arrivals, day)
+	if err != nil {
+		t.Fatalf("Unable to compute adherence: %v", err)
+	}
+	if a := adherence[0]; a.OnTime != 2 || a.Missed != 0 {
+		t.Errorf("Got %+v, expected both arrivals on time.", a)
+	}
+}
+
+func TestHeadways(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	arrivals := []StopArrival{
+		{VehicleID: "2", StopID: "union", Time: start.Add(25 * time.Minute)},
+		{VehicleID: "1", StopID: "union", Time: start},
+		{VehicleID: "1", StopID: "union", Time: start.Add(10 * time.Minute)},
+	}
+	gaps := Headways(arrivals)
+	if len(gaps) != 2 || gaps[0] != 600 || gaps[1] != 900 {
+		t.Errorf("Got gaps %v, expected [600 900].", gaps)
+	}
+
+	if gaps := Headways(arrivals[:1]); len(gaps) != 0 {
+		t.Errorf("Got gaps %v for one arrival, expected none.", gaps)
+	}
+}
+
+func TestRouteScheduledToRun(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	route := Route{ServiceWindows: []RouteServiceWindow{{Days: weekdays, Start: "07:00", End: "11:00"}}}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		t        time.Time
+		expected bool
+	}{
+		// September 4, 2017 was a Monday.
+		{time.Date(2017, 9, 4, 8, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 4, 7, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 4, 6, 59, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 4, 11, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 4, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 9, 8, 0, 0, 0, time.UTC), false},
+		// The time of day is in t's location.
+		{time.Date(2017, 9, 4, 8, 0, 0, 0, ny), true},
+		{time.Date(2017, 9, 4, 8, 0, 0, 0, ny).UTC(), false},
+	} {
+		running, err := route.ScheduledToRun(testCase.t, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if running != testCase.expected {
+			t.Errorf("Got %v for %v, expected %v.", running, testCase.t, testCase.expected)
+		}
+	}
+
+	if running, _ := (Route{}).ScheduledToRun(time.Now(), 0); running {
+		t.Error("Got a route without service windows scheduled to run.")
+	}
+	invalid := Route{ServiceWindows: []RouteServiceWindow{{Days: weekdays, Start: "7am", End: "11:00"}}}
+	if _, err := invalid.ScheduledToRun(time.Date(2017, 9, 4, 8, 0, 0, 0, time.UTC), 0); err == nil {
+		t.Error("Expected an error for an invalid start time.")
+	}
+}
+
+func TestRouteScheduledToRunAfterMidnight(t *testing.T) {
+	// A late night window on Fridays runs into early Saturday.
+	route := Route{ServiceWindows: []RouteServiceWindow{{Days: []time.Weekday{time.Friday}, Start: "22:00", End: "02:00"}}}
+	for _, testCase := range []struct {
+		t        time.Time
+		expected bool
+	}{
+		{time.Date(2017, 9, 1, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 2, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 2, 2, 30, 0, 0, time.UTC), false},
+		// Early Friday morning continues Thursday's window, which doesn't exist.
+		{time.Date(2017, 9, 1, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 2, 23, 0, 0, 0, time.UTC), false},
+	} {
+		running, err := route.ScheduledToRun(testCase.t, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if running != testCase.expected {
+			t.Errorf("Got %v for %v, expected %v.", running, testCase.t, testCase.expected)
+		}
+	}
+}
+
+func TestRouteScheduledToRunBeforeServiceDayStart(t *testing.T) {
+	// With service days starting at 03:00, a window on Fridays from 00:30 runs early Saturday.
+	route := Route{ServiceWindows: []RouteServiceWindow{{Days: []time.Weekday{time.Friday}, Start: "00:30", End: "02:00"}}}
+	for _, testCase := range []struct {
+		t        time.Time
+		expected bool
+	}{
+		{time.Date(2017, 9, 2, 0, 30, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 2, 0, 0, 0, time.UTC), false},
+		// Early Friday morning is still Thursday's service day.
+		{time.Date(2017, 9, 1, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 1, 23, 0, 0, 0, time.UTC), false},
+	} {
+		running, err := route.ScheduledToRun(testCase.t, 3*time.Hour)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if running != testCase.expected {
+			t.Errorf("Got %v for %v, expected %v.", running, testCase.t, testCase.expected)
+		}
+	}
+
+	// A window crossing the start of the service day runs into the next one.
+	route = Route{ServiceWindows: []RouteServiceWindow{{Days: []time.Weekday{time.Friday}, Start: "02:00", End: "04:00"}}}
+	for _, testCase := range []struct {
+		t        time.Time
+		expected bool
+	}{
+		{time.Date(2017, 9, 2, 2, 30, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 3, 30, 0, 0, time.UTC), true},
+		{time.Date(2017, 9, 2, 4, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 9, 1, 2, 30, 0, 0, time.UTC), false},
+	} {
+		running, err := route.ScheduledToRun(testCase.t, 3*time.Hour)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if running != testCase.expected {
+			t.Errorf("Got %v for %v, expected %v.", running, testCase.t, testCase.expected)
+		}
+	}
+}
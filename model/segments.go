@@ -0,0 +1,115 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+// maxSpeedSampleGap is the longest time between two updates from a vehicle for the distance
+// between them to count toward a segment's speed. Longer gaps usually mean the vehicle went off
+// duty or lost its GPS fix.
+const maxSpeedSampleGap = 2 * time.Minute
+
+// SegmentSpeed is how fast vehicles travel on the part of a Route between two consecutive stops.
+type SegmentSpeed struct {
+	FromStopID string `json:"fromStopID"`
+	ToStopID   string `json:"toStopID"`
+	// Length is the distance along the route between the stops, in meters.
+	Length float64 `json:"length"`
+	// Samples is how many pairs of consecutive updates fell within the segment.
+	Samples int `json:"samples"`
+	// AverageSpeed is in mph, and includes time spent stopped. It is null if there were no samples.
+	AverageSpeed *float64 `json:"averageSpeed"`
+}
+
+// SegmentSpeeds divides the Route into segments between each of stops, which must be in the order
+// the Route serves them, and finds the average speed of updates within each one. Routes are loops,
+// so the last segment runs from the last stop back to the first. Consecutive updates from the
+// same vehicle are assigned to the segment containing the point halfway between them along the
+// Route. It returns no segments if the Route has no path or there are fewer than two stops.
+func SegmentSpeeds(r *Route, stops []Stop, updates []VehicleUpdate) []SegmentSpeed {
+	length := r.LengthMeters()
+	if len(stops) < 2 || length == 0 {
+		return []SegmentSpeed{}
+	}
+
+	// Each segment starts at its first stop's progress along the route.
+	starts := make([]float64, len(stops))
+	for i, stop := range stops {
+		projection, _ := r.Project(Coord{Lat: stop.Lat, Lng: stop.Lng})
+		starts[i] = projection.Progress
+	}
+	segments := make([]SegmentSpeed, len(stops))
+	distances := make([]float64, len(stops))
+	durations := make([]time.Duration, len(stops))
+	for i := range stops {
+		next := (i + 1) % len(stops)
+		segments[i] = SegmentSpeed{FromStopID: stops[i].ID, ToStopID: stops[next].ID, Length: wrapProgress(starts[next]-starts[i], length)}
+	}
+
+	sorted := make([]VehicleUpdate, len(updates))
+	copy(sorted, updates)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Created.Before(sorted[j].Created) })
+	type position struct {
+		progress float64
+		created  time.Time
+	}
+	last := map[VehicleKey]position{}
+	for _, update := range sorted {
+		c, err := update.Coord()
+		if err != nil {
+			continue
+		}
+		projection, _ := r.Project(c)
+		current := position{projection.Progress, update.Created}
+		prev, ok := last[update.Key()]
+		last[update.Key()] = current
+		elapsed := current.created.Sub(prev.created)
+		if !ok || elapsed <= 0 || elapsed > maxSpeedSampleGap {
+			continue
+		}
+
+		// Vehicles only travel forward, so moving back less than half the route is GPS noise
+		// around a stationary vehicle, and moving back more is passing the route's start.
+		distance := current.progress - prev.progress
+		if distance < -length/2 {
+			distance += length
+		} else if distance < 0 {
+			distance = 0
+		}
+		segment := segmentAt(starts, wrapProgress(prev.progress+distance/2, length), length)
+		distances[segment] += distance
+		durations[segment] += elapsed
+		segments[segment].Samples++
+	}
+
+	for i := range segments {
+		if durations[i] > 0 {
+			speed := distances[i] / MetersPerMile / durations[i].Hours()
+			segments[i].AverageSpeed = &speed
+		}
+	}
+	return segments
+}
+
+// segmentAt returns the index of the segment containing progress, given where each segment starts.
+func segmentAt(starts []float64, progress, length float64) int {
+	best, bestOffset := 0, length
+	for i, start := range starts {
+		if offset := wrapProgress(progress-start, length); offset < bestOffset {
+			best, bestOffset = i, offset
+		}
+	}
+	return best
+}
+
+// wrapProgress brings progress into [0, length).
+func wrapProgress(progress, length float64) float64 {
+	for progress < 0 {
+		progress += length
+	}
+	for progress >= length {
+		progress -= length
+	}
+	return progress
+}
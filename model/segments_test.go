@@ -0,0 +1,79 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSegmentSpeeds(t *testing.T) {
+	// Due north, with stops every 0.005 degrees of latitude (about 556 meters).
+	route := Route{Coords: []Coord{{Lat: 42.730, Lng: -73.680}, {Lat: 42.750, Lng: -73.680}}}
+	stops := []Stop{
+		{ID: "a", Lat: 42.730, Lng: -73.680},
+		{ID: "b", Lat: 42.735, Lng: -73.680},
+		{ID: "c", Lat: 42.740, Lng: -73.680},
+	}
+
+	// A vehicle reporting every 30 seconds crosses from a to b quickly, then crawls to c.
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	var updates []VehicleUpdate
+	lat := 42.730
+	for i := 0; lat < 42.740+1e-9; i++ {
+		updates = append(updates, VehicleUpdate{
+			VehicleID: "1",
+			Lat:       fmt.Sprintf("%.5f", lat),
+			Lng:       "-73.68000",
+			Created:   start.Add(time.Duration(i) * 30 * time.Second),
+		})
+		if lat < 42.735-1e-9 {
+			lat += 0.001
+		} else {
+			lat += 0.00025
+		}
+	}
+	// Another vehicle's updates are too far apart to count.
+	updates = append(updates,
+		VehicleUpdate{VehicleID: "2", Lat: "42.741", Lng: "-73.680", Created: start},
+		VehicleUpdate{VehicleID: "2", Lat: "42.749", Lng: "-73.680", Created: start.Add(time.Hour)},
+	)
+
+	segments := SegmentSpeeds(&route, stops, updates)
+	if len(segments) != 3 {
+		t.Fatalf("Got %d segments, expected 3.", len(segments))
+	}
+	for i, expected := range []struct {
+		from, to string
+		samples  int
+		speed    float64
+	}{
+		// 111 meters every 30 seconds.
+		{"a", "b", 5, 8.29},
+		// 28 meters every 30 seconds.
+		{"b", "c", 20, 2.07},
+	} {
+		segment := segments[i]
+		if segment.FromStopID != expected.from || segment.ToStopID != expected.to || segment.Samples != expected.samples {
+			t.Errorf("Got %+v, expected %d samples from %s to %s.", segment, expected.samples, expected.from, expected.to)
+		}
+		if segment.AverageSpeed == nil || math.Abs(*segment.AverageSpeed-expected.speed) > 0.05 {
+			t.Errorf("Got average speed %v from %s to %s, expected about %v.", segment.AverageSpeed, expected.from, expected.to, expected.speed)
+		}
+		if math.Abs(segment.Length-556) > 1 {
+			t.Errorf("Got length %v from %s to %s, expected about 556.", segment.Length, expected.from, expected.to)
+		}
+	}
+
+	// Nothing was recorded on the way back around from c to a.
+	if back := segments[2]; back.FromStopID != "c" || back.ToStopID != "a" || back.Samples != 0 || back.AverageSpeed != nil {
+		t.Errorf("Got %+v, expected no data from c to a.", back)
+	}
+}
+
+func TestSegmentSpeedsWithoutPath(t *testing.T) {
+	stops := []Stop{{ID: "a"}, {ID: "b"}}
+	if segments := SegmentSpeeds(&Route{}, stops, nil); len(segments) != 0 {
+		t.Errorf("Got %d segments, expected none.", len(segments))
+	}
+}
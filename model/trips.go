@@ -0,0 +1,127 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+// TripGap is how long a vehicle may go without reporting before its trip ends.
+const TripGap = 5 * time.Minute
+
+// Trip is a stretch of time that a vehicle spent reporting continuously on one route.
+type Trip struct {
+	// RouteID is empty if the vehicle wasn't on a route.
+	RouteID string
+	Start   time.Time
+	End     time.Time
+	// Distance is how far the vehicle traveled in meters.
+	Distance float64
+	// Coords is the vehicle's path, oldest first.
+	Coords []Coord
+}
+
+// Trips divides a vehicle's updates, which must be sorted oldest first, into trips. A new trip
+// begins whenever the vehicle changes routes or goes more than maxGap without reporting. Trips
+// with fewer than two positions have no path, so they are left out.
+func Trips(updates []VehicleUpdate, maxGap time.Duration) []Trip {
+	trips := []Trip{}
+	var trip *Trip
+	finish := func() {
+		if trip != nil && len(trip.Coords) >= 2 {
+			trips = append(trips, *trip)
+		}
+		trip = nil
+	}
+	for _, update := range updates {
+		c, err := update.Coord()
+		if err != nil {
+			continue
+		}
+		if trip != nil && (update.Route != trip.RouteID || update.Created.Sub(trip.End) > maxGap) {
+			finish()
+		}
+		if trip == nil {
+			trip = &Trip{RouteID: update.Route, Start: update.Created}
+		} else {
+			trip.Distance += DistanceMeters(trip.Coords[len(trip.Coords)-1], c)
+		}
+		trip.End = update.Created
+		trip.Coords = append(trip.Coords, c)
+	}
+	finish()
+	return trips
+}
+
+// FleetStats totals what every vehicle did during a period.
+type FleetStats struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Distance is how far vehicles traveled in meters.
+	Distance float64 `json:"distance"`
+	// ActiveHours is how long vehicles spent on trips.
+	ActiveHours float64 `json:"activeHours"`
+	Trips       int     `json:"trips"`
+	// PeakVehicles is the most vehicles that were on trips at once.
+	PeakVehicles int `json:"peakVehicles"`
+}
+
+// NewFleetStats totals the trips made by vehicles between from and to. updates holds each
+// vehicle's updates from that period, oldest first, by vehicle.
+func NewFleetStats(from, to time.Time, updates map[VehicleKey][]VehicleUpdate, maxGap time.Duration) FleetStats {
+	tally := NewFleetTally(from, to)
+	for _, vehicleUpdates := range updates {
+		tally.Add(vehicleUpdates, maxGap)
+	}
+	return tally.Stats()
+}
+
+// FleetTally totals the trips made by vehicles one vehicle at a time, so that every vehicle's
+// updates needn't be held at once.
+type FleetTally struct {
+	stats FleetStats
+	// events are when trips started (1) and ended (-1).
+	events []tripEvent
+}
+
+type tripEvent struct {
+	t     time.Time
+	delta int
+}
+
+// NewFleetTally creates a FleetTally for the period from from until to.
+func NewFleetTally(from, to time.Time) *FleetTally {
+	return &FleetTally{stats: FleetStats{From: from, To: to}}
+}
+
+// Add totals the trips made by one vehicle with updates from the period, oldest first.
+func (t *FleetTally) Add(updates []VehicleUpdate, maxGap time.Duration) {
+	for _, trip := range Trips(updates, maxGap) {
+		t.stats.Trips++
+		t.stats.Distance += trip.Distance
+		t.stats.ActiveHours += trip.End.Sub(trip.Start).Hours()
+		t.events = append(t.events, tripEvent{trip.Start, 1}, tripEvent{trip.End, -1})
+	}
+}
+
+// Stats returns the totals of the trips added so far.
+func (t *FleetTally) Stats() FleetStats {
+	stats := t.stats
+	events := make([]tripEvent, len(t.events))
+	copy(events, t.events)
+
+	// A trip ending just as another begins doesn't overlap it.
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].t.Equal(events[j].t) {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].t.Before(events[j].t)
+	})
+	vehicles := 0
+	for _, e := range events {
+		vehicles += e.delta
+		if vehicles > stats.PeakVehicles {
+			stats.PeakVehicles = vehicles
+		}
+	}
+	return stats
+}
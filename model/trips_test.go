@@ -0,0 +1,87 @@
+package model
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTrips(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int, lat, route string) VehicleUpdate {
+		return VehicleUpdate{Lat: lat, Lng: "-73.680", Route: route, Created: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	updates := []VehicleUpdate{
+		at(0, "42.730", "west"),
+		at(1, "42.731", "west"),
+		at(2, "42.732", "west"),
+		// Switching routes starts a new trip.
+		at(3, "42.733", "east"),
+		at(4, "42.734", "east"),
+		// So does going quiet.
+		at(20, "42.735", "east"),
+		at(21, "42.736", "east"),
+		// A lone position isn't a trip.
+		at(40, "42.737", "east"),
+	}
+
+	trips := Trips(updates, 5*time.Minute)
+	if len(trips) != 3 {
+		t.Fatalf("Got %d trips, expected 3.", len(trips))
+	}
+	first := trips[0]
+	if first.RouteID != "west" || !first.Start.Equal(start) || !first.End.Equal(start.Add(2*time.Minute)) || len(first.Coords) != 3 {
+		t.Errorf("Got %+v, expected three positions on west from 12:00 to 12:02.", first)
+	}
+	// Two thousandths of a degree of latitude.
+	if math.Abs(first.Distance-222.4) > 1 {
+		t.Errorf("Got distance %v, expected about 222.4.", first.Distance)
+	}
+	if trips[1].RouteID != "east" || len(trips[1].Coords) != 2 || len(trips[2].Coords) != 2 {
+		t.Errorf("Got %+v and %+v, expected two trips of two positions on east.", trips[1], trips[2])
+	}
+
+	if trips := Trips(nil, 5*time.Minute); trips == nil || len(trips) != 0 {
+		t.Errorf("Got %v, expected an empty list.", trips)
+	}
+}
+
+func TestNewFleetStats(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	at := func(minutes int, lat string) VehicleUpdate {
+		return VehicleUpdate{Lat: lat, Lng: "-73.680", Route: "west", Created: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	updates := map[VehicleKey][]VehicleUpdate{
+		// Two trips, thirty minutes apart.
+		{VehicleID: "1"}: {at(0, "42.730"), at(10, "42.731"), at(40, "42.732"), at(50, "42.733")},
+		// Out during vehicle 1's first trip.
+		{VehicleID: "2"}: {at(5, "42.730"), at(15, "42.732")},
+		// Starts just as vehicle 1's second trip ends.
+		{VehicleID: "3"}: {at(50, "42.730"), at(60, "42.731")},
+	}
+
+	stats := NewFleetStats(start, end, updates, 15*time.Minute)
+	if stats.Trips != 4 {
+		t.Errorf("Got %d trips, expected 4.", stats.Trips)
+	}
+	// Ten minutes for each trip.
+	if math.Abs(stats.ActiveHours-40.0/60) > 1e-9 {
+		t.Errorf("Got %v active hours, expected 2/3.", stats.ActiveHours)
+	}
+	// Five thousandths of a degree of latitude in all.
+	if math.Abs(stats.Distance-556.0) > 2 {
+		t.Errorf("Got distance %v, expected about 556.", stats.Distance)
+	}
+	if stats.PeakVehicles != 2 {
+		t.Errorf("Got peak of %d vehicles, expected 2.", stats.PeakVehicles)
+	}
+	if !stats.From.Equal(start) || !stats.To.Equal(end) {
+		t.Errorf("Got period %v to %v, expected %v to %v.", stats.From, stats.To, start, end)
+	}
+
+	empty := NewFleetStats(start, start, map[VehicleKey][]VehicleUpdate{}, 5*time.Minute)
+	if empty.Trips != 0 || empty.Distance != 0 || empty.ActiveHours != 0 || empty.PeakVehicles != 0 {
+		t.Errorf("Got %+v for an empty period, expected zeroes.", empty)
+	}
+}
@@ -0,0 +1,280 @@
+// Package mqtt publishes vehicle updates to an MQTT broker.
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+const (
+	// queueSize is how many updates may wait to be published. More are dropped.
+	queueSize = 256
+	// retryInterval is how long to wait before trying again to connect to the broker, and the
+	// longest paho waits between attempts to reconnect.
+	retryInterval = 10 * time.Second
+	// ioTimeout limits how long connecting to or writing to the broker may take.
+	ioTimeout = 10 * time.Second
+	// keepAlive is how often the client pings the broker when idle, so that a dropped connection is
+	// noticed even while there is nothing to publish.
+	keepAlive = 30 * time.Second
+	// disconnectQuiesce is how long in milliseconds Stop lets in-flight messages finish.
+	disconnectQuiesce = 250
+)
+
+// schemes maps the broker URL schemes that are accepted to the ones paho understands.
+var schemes = map[string]string{
+	"tcp":   "tcp",
+	"mqtt":  "tcp",
+	"ssl":   "ssl",
+	"tls":   "ssl",
+	"mqtts": "ssl",
+}
+
+// Config configures the Publisher.
+type Config struct {
+	// BrokerURL is the broker to publish to, like "tcp://localhost:1883", or "ssl://localhost:8883"
+	// over TLS. Nothing is published if empty.
+	BrokerURL string
+	// TopicPrefix comes before the vehicle ID in each update's topic.
+	TopicPrefix string
+	// ClientID identifies the publisher to the broker. Brokers disconnect a client when another
+	// connects with the same ID, so each instance sharing a broker needs its own.
+	ClientID string
+	// Username and Password authenticate the publisher to the broker, if set.
+	Username string
+	Password string
+	// TLSCAFile is a PEM file of certificate authorities to trust for a TLS broker, in place of the
+	// system's. The system's are used if empty.
+	TLSCAFile string
+}
+
+// NewConfig creates a Config with default values.
+func NewConfig(v *viper.Viper) *Config {
+	cfg := &Config{
+		TopicPrefix: "shuttles",
+		ClientID:    defaultClientID(),
+	}
+	v.SetDefault("mqtt.brokerurl", cfg.BrokerURL)
+	v.SetDefault("mqtt.topicprefix", cfg.TopicPrefix)
+	v.SetDefault("mqtt.clientid", cfg.ClientID)
+	v.SetDefault("mqtt.username", cfg.Username)
+	v.SetDefault("mqtt.password", cfg.Password)
+	v.SetDefault("mqtt.tlscafile", cfg.TLSCAFile)
+	return cfg
+}
+
+// defaultClientID returns a client ID made from the host name and process ID, so that it is unique
+// to this instance.
+func defaultClientID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("shuttletracker-%s-%d", host, os.Getpid())
+}
+
+// Publisher publishes each vehicle update as JSON to "{TopicPrefix}/{vehicleID}" with QoS 1, or to
+// "{TopicPrefix}/{feed}/{vehicleID}" if the update has a data feed, since vehicle IDs are only unique
+// within a feed. Publishing never blocks; if the broker can't keep up or is unreachable for long
+// enough that the queue fills, updates are dropped.
+type Publisher struct {
+	cfg    Config
+	client paho.Client
+	queue  chan message
+
+	// stop is closed by Stop, and done is closed when Run returns.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// message is an MQTT application message.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// New creates a Publisher. It doesn't connect to the broker until it is run.
+func New(cfg Config) (*Publisher, error) {
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+	scheme, ok := schemes[u.Scheme]
+	if !ok || u.Host == "" {
+		return nil, fmt.Errorf("unsupported MQTT broker URL %q", cfg.BrokerURL)
+	}
+	if u.Port() == "" {
+		if scheme == "ssl" {
+			u.Host += ":8883"
+		} else {
+			u.Host += ":1883"
+		}
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = defaultClientID()
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(scheme + "://" + u.Host).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetKeepAlive(keepAlive).
+		SetConnectTimeout(ioTimeout).
+		SetWriteTimeout(ioTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(retryInterval).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.WithError(err).Warn("Lost connection to MQTT broker; reconnecting.")
+		})
+	if scheme == "ssl" {
+		tlsConfig, err := newTLSConfig(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p := &Publisher{
+		cfg:    cfg,
+		client: paho.NewClient(opts),
+		queue:  make(chan message, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	return p, nil
+}
+
+// newTLSConfig returns a TLS config trusting the certificate authorities in caFile, or the system's
+// if caFile is empty.
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Publish queues update to be published.
+func (p *Publisher) Publish(update model.VehicleUpdate) {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		log.WithError(err).Error("Unable to encode update for MQTT.")
+		return
+	}
+	select {
+	case p.queue <- message{topic: p.topic(update), payload: payload}:
+	default:
+		log.Warnf("MQTT queue is full; dropping update for vehicle %s.", update.VehicleID)
+	}
+}
+
+// topic returns the topic to publish update to.
+func (p *Publisher) topic(update model.VehicleUpdate) string {
+	if update.Feed == "" {
+		return p.cfg.TopicPrefix + "/" + update.VehicleID
+	}
+	return p.cfg.TopicPrefix + "/" + update.Feed + "/" + update.VehicleID
+}
+
+// Run connects to the broker and publishes queued updates until Stop is called. Once connected,
+// paho reconnects on its own whenever the connection fails, and keeps unacknowledged updates to
+// send again afterward.
+func (p *Publisher) Run() {
+	defer close(p.done)
+	log.Debug("MQTT publisher started.")
+
+	for {
+		err := p.connect()
+		if err == nil {
+			break
+		}
+		log.WithError(err).Warn("Unable to connect to MQTT broker.")
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+	defer p.client.Disconnect(disconnectQuiesce)
+	log.Infof("Connected to MQTT broker at %s.", p.cfg.BrokerURL)
+
+	for {
+		select {
+		case <-p.stop:
+			log.Debug("MQTT publisher stopped.")
+			return
+		case msg := <-p.queue:
+			p.publish(msg)
+		}
+	}
+}
+
+// connect makes the first connection to the broker.
+func (p *Publisher) connect() error {
+	token := p.client.Connect()
+	if !p.wait(token) {
+		return errors.New("stopped while connecting to MQTT broker")
+	}
+	return token.Error()
+}
+
+// publish sends msg and waits for the broker to acknowledge it, or for Stop to be called. While
+// the client is reconnecting, paho holds on to msg and sends it once the connection is back.
+func (p *Publisher) publish(msg message) {
+	token := p.client.Publish(msg.topic, 1, false, msg.payload)
+	if !p.wait(token) {
+		return
+	}
+	if err := token.Error(); err != nil {
+		log.WithError(err).Warnf("Unable to publish update to MQTT topic %s.", msg.topic)
+	}
+}
+
+// wait waits for token to complete. It returns false if Stop is called first.
+func (p *Publisher) wait(token paho.Token) bool {
+	completed := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(completed)
+	}()
+	select {
+	case <-completed:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// Stop makes Run disconnect from the broker and return. Updates still queued are dropped; wait on
+// Done for Run to finish.
+func (p *Publisher) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// Done returns a channel that is closed once Run has returned.
+func (p *Publisher) Done() <-chan struct{} {
+	return p.done
+}
@@ -0,0 +1,252 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// mockBroker accepts connections and acknowledges what is published to it.
+type mockBroker struct {
+	listener net.Listener
+	// connects receives each CONNECT packet, and messages each message published.
+	connects chan *packets.ConnectPacket
+	messages chan message
+	// errs receives anything the broker didn't expect, since tests can't fail from its goroutines.
+	errs chan error
+	// dropFirst makes the broker close the first connection when it receives a PUBLISH, without
+	// acknowledging it.
+	dropFirst bool
+}
+
+// newMockBroker starts a broker listening on a local port.
+func newMockBroker(t *testing.T, dropFirst bool) *mockBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	b := &mockBroker{
+		listener:  listener,
+		connects:  make(chan *packets.ConnectPacket, 10),
+		messages:  make(chan message, 10),
+		errs:      make(chan error, 10),
+		dropFirst: dropFirst,
+	}
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, first && b.dropFirst)
+		}
+	}()
+	return b
+}
+
+// url returns the URL to reach the broker at.
+func (b *mockBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// serve handles packets on conn until the client disconnects. If drop is true, conn is closed on
+// the first PUBLISH.
+func (b *mockBroker) serve(conn net.Conn, drop bool) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.connects <- p
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			if drop {
+				return
+			}
+			if p.Qos != 1 {
+				b.errs <- fmt.Errorf("got PUBLISH with QoS %d, expected 1", p.Qos)
+				return
+			}
+			b.messages <- message{topic: p.TopicName, payload: p.Payload}
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.MessageID
+			reply = puback
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		default:
+			b.errs <- fmt.Errorf("got unexpected packet %v", packet)
+			return
+		}
+		if err := reply.Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+// receive returns the next message the broker receives.
+func (b *mockBroker) receive(t *testing.T) message {
+	select {
+	case msg := <-b.messages:
+		return msg
+	case err := <-b.errs:
+		t.Fatalf("Broker failed: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Broker didn't receive an update.")
+	}
+	return message{}
+}
+
+// stopPublisher stops p and waits for it to finish.
+func stopPublisher(t *testing.T, p *Publisher) {
+	p.Stop()
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Publisher didn't stop.")
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	broker := newMockBroker(t, false)
+	defer broker.listener.Close()
+
+	p, err := New(Config{
+		BrokerURL:   broker.url(),
+		TopicPrefix: "shuttles",
+		ClientID:    "staging",
+		Username:    "tracker",
+		Password:    "secret",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create publisher: %v", err)
+	}
+	go p.Run()
+	defer stopPublisher(t, p)
+
+	update := model.VehicleUpdate{VehicleID: "5", Lat: "42.73", Lng: "-73.68"}
+	p.Publish(update)
+
+	msg := broker.receive(t)
+	if msg.topic != "shuttles/5" {
+		t.Errorf("Got topic %q, expected shuttles/5.", msg.topic)
+	}
+	var published model.VehicleUpdate
+	if err := json.Unmarshal(msg.payload, &published); err != nil {
+		t.Fatalf("Unable to decode payload: %v", err)
+	}
+	if published.VehicleID != "5" || published.Lat != "42.73" || published.Lng != "-73.68" {
+		t.Errorf("Got %+v, expected vehicle 5's update.", published)
+	}
+
+	connect := <-broker.connects
+	if connect.ClientIdentifier != "staging" {
+		t.Errorf("Got client ID %q, expected staging.", connect.ClientIdentifier)
+	}
+	if connect.Username != "tracker" || string(connect.Password) != "secret" {
+		t.Errorf("Got credentials %q/%q, expected tracker/secret.", connect.Username, connect.Password)
+	}
+	if connect.Keepalive == 0 {
+		t.Error("Expected keep alive to be enabled.")
+	}
+}
+
+func TestPublisherResendsAfterReconnecting(t *testing.T) {
+	broker := newMockBroker(t, true)
+	defer broker.listener.Close()
+
+	p, err := New(Config{BrokerURL: broker.url(), TopicPrefix: "shuttles"})
+	if err != nil {
+		t.Fatalf("Unable to create publisher: %v", err)
+	}
+	go p.Run()
+	defer stopPublisher(t, p)
+
+	// The broker drops the connection instead of acknowledging this, so it must be sent again.
+	p.Publish(model.VehicleUpdate{VehicleID: "5"})
+	if msg := broker.receive(t); msg.topic != "shuttles/5" {
+		t.Errorf("Got topic %q, expected shuttles/5.", msg.topic)
+	}
+}
+
+func TestPublisherTopic(t *testing.T) {
+	p, err := New(Config{BrokerURL: "tcp://127.0.0.1:1", TopicPrefix: "shuttles"})
+	if err != nil {
+		t.Fatalf("Unable to create publisher: %v", err)
+	}
+	for _, testCase := range []struct {
+		update   model.VehicleUpdate
+		expected string
+	}{
+		{model.VehicleUpdate{VehicleID: "1"}, "shuttles/1"},
+		{model.VehicleUpdate{VehicleID: "1", Feed: "a"}, "shuttles/a/1"},
+		{model.VehicleUpdate{VehicleID: "1", Feed: "b"}, "shuttles/b/1"},
+	} {
+		if topic := p.topic(testCase.update); topic != testCase.expected {
+			t.Errorf("Got topic %q for %+v, expected %q.", topic, testCase.update, testCase.expected)
+		}
+	}
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	// Nothing is listening here, and the publisher isn't even running.
+	p, err := New(Config{BrokerURL: "tcp://127.0.0.1:1", TopicPrefix: "shuttles"})
+	if err != nil {
+		t.Fatalf("Unable to create publisher: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < queueSize*2; i++ {
+			p.Publish(model.VehicleUpdate{VehicleID: "1"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked.")
+	}
+}
+
+func TestStopWhileUnableToConnect(t *testing.T) {
+	// Nothing is listening here, so Run keeps waiting to try again.
+	p, err := New(Config{BrokerURL: "tcp://127.0.0.1:1", TopicPrefix: "shuttles"})
+	if err != nil {
+		t.Fatalf("Unable to create publisher: %v", err)
+	}
+	go p.Run()
+	stopPublisher(t, p)
+}
+
+func TestDefaultClientID(t *testing.T) {
+	// Instances left to the default don't share an ID with each other.
+	if id := defaultClientID(); id == "shuttletracker" || !strings.HasSuffix(id, fmt.Sprintf("-%d", os.Getpid())) {
+		t.Errorf("Got default client ID %q, expected one ending in the process ID.", id)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{BrokerURL: "http://localhost"},
+		{BrokerURL: "localhost:1883"},
+		{BrokerURL: "ssl://localhost", TLSCAFile: "does-not-exist.pem"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected error for %+v.", cfg)
+		}
+	}
+}
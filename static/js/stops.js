@@ -89,7 +89,7 @@ Vue.component('stops-panel', {
   },
   mounted(){
     var el = this;
-    $.get("/stops",function(data){
+    $.get("/stops?all=true",function(data){
       el.stopData = data;
       refresh = false;
     });
@@ -102,7 +102,7 @@ Vue.component('stops-panel', {
     });
     setInterval(function(){
       if(refresh){
-        $.get("/stops",function(data){
+        $.get("/stops?all=true",function(data){
           el.stopData = data;
           refresh = false;
         });
@@ -0,0 +1,124 @@
+package updater
+
+import (
+	"errors"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// ErrBackfillRunning indicates that a route backfill is already in progress.
+var ErrBackfillRunning = errors.New("route backfill is already running")
+
+// StartRouteBackfill guesses routes for stored updates that have none, such as those stored
+// before routes were guessed, in the background. Updates are examined oldest first in batches of
+// BackfillBatchSize, starting after cursor, or from the beginning if it's empty. Pass the cursor
+// from RouteBackfillProgress to resume a backfill that stopped.
+func (u *Updater) StartRouteBackfill(cursor string) error {
+	if u.cfg.BackfillBatchSize < 1 {
+		return errors.New("backfill batch size must be at least 1")
+	}
+	u.backfillMu.Lock()
+	defer u.backfillMu.Unlock()
+	if u.backfill.Running {
+		return ErrBackfillRunning
+	}
+	u.backfill = model.RouteBackfill{Running: true, Cursor: cursor}
+	go u.backfillRoutes(cursor)
+	return nil
+}
+
+// RouteBackfillProgress reports the progress of the latest route backfill.
+func (u *Updater) RouteBackfillProgress() model.RouteBackfill {
+	u.backfillMu.Lock()
+	defer u.backfillMu.Unlock()
+	return u.backfill
+}
+
+// backfillRoutes examines stored updates after cursor until there are no more, the updater is
+// stopped, or something fails. Each update without a route gets the route guessed from its
+// vehicle's updates during the routeGuessWindow before it, as it would have when it was stored.
+func (u *Updater) backfillRoutes(cursor string) {
+	log.Info("Route backfill started.")
+	// recent holds each vehicle's updates from the last routeGuessWindow, oldest first. A resumed
+	// backfill starts without them, so a vehicle's first few updates after cursor may go unguessed.
+	recent := make(map[model.VehicleKey][]model.VehicleUpdate)
+	for {
+		// Routes rarely change, so they're only fetched once per batch.
+		routes, err := u.db.GetRoutes()
+		if err != nil {
+			u.stopBackfill(err)
+			return
+		}
+		updates, next, err := u.db.GetUpdatesPage("", "", cursor, u.cfg.BackfillBatchSize)
+		if err != nil {
+			u.stopBackfill(err)
+			return
+		}
+
+		attributed := 0
+		for _, update := range updates {
+			window := append(recent[update.Key()], update)
+			for window[0].Created.Before(update.Created.Add(-routeGuessWindow)) {
+				window = window[1:]
+			}
+			recent[update.Key()] = window
+			if update.Route != "" {
+				continue
+			}
+
+			newestFirst := make([]model.VehicleUpdate, len(window))
+			for i := range window {
+				newestFirst[len(window)-1-i] = window[i]
+			}
+			ranked := u.rankRoutes(routes, update.VehicleID, newestFirst)
+			if len(ranked) == 0 {
+				continue
+			}
+			if err := u.db.SetRouteForUpdate(update.VehicleID, update.Feed, update.Created, ranked[0].Route.ID); err != nil {
+				u.stopBackfill(err)
+				return
+			}
+			window[len(window)-1].Route = ranked[0].Route.ID
+			attributed++
+		}
+
+		u.backfillMu.Lock()
+		u.backfill.Scanned += len(updates)
+		u.backfill.Attributed += attributed
+		if next == "" {
+			u.backfill.Running = false
+			u.backfill.Done = true
+			log.Infof("Route backfill finished. Attributed routes to %d of %d updates.", u.backfill.Attributed, u.backfill.Scanned)
+		} else {
+			u.backfill.Cursor = next
+		}
+		u.backfillMu.Unlock()
+		if next == "" {
+			return
+		}
+		cursor = next
+
+		select {
+		case <-u.ctx.Done():
+			u.stopBackfill(nil)
+			return
+		case <-time.After(u.backfillPause):
+		}
+	}
+}
+
+// stopBackfill records that the route backfill stopped before examining every update, because of
+// err if it isn't nil. The cursor is left where the backfill can be resumed.
+func (u *Updater) stopBackfill(err error) {
+	u.backfillMu.Lock()
+	defer u.backfillMu.Unlock()
+	u.backfill.Running = false
+	if err != nil {
+		u.backfill.Error = err.Error()
+		log.WithError(err).Error("Route backfill failed.")
+	} else {
+		log.Info("Route backfill stopped.")
+	}
+}
@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// waitForBackfill waits for the route backfill to stop running.
+func waitForBackfill(t *testing.T, u *Updater) model.RouteBackfill {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress := u.RouteBackfillProgress()
+		if !progress.Running {
+			return progress
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Route backfill didn't finish.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouteBackfill(t *testing.T) {
+	start := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	db := &mockDatabase{routes: []model.Route{
+		{ID: "west", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}}},
+	}}
+	for i := 0; i < 7; i++ {
+		created := start.Add(time.Duration(i) * 10 * time.Second)
+		// Vehicle 1 drives along the route, while vehicle 2 is far from it.
+		db.updates = append(db.updates,
+			model.VehicleUpdate{VehicleID: "1", Lat: "42.700", Lng: "-73.68", Created: created},
+			model.VehicleUpdate{VehicleID: "2", Lat: "42.900", Lng: "-73.68", Created: created},
+		)
+	}
+	// Already attributed, so it's left alone.
+	db.updates[12].Route = "east"
+
+	u, err := NewWithSource(Config{UpdateInterval: "10s", RouteGuessDecay: 0.9, BackfillBatchSize: 3, BackfillPause: "1ms"}, db, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	if err := u.StartRouteBackfill(""); err != nil {
+		t.Fatalf("Unable to start backfill: %v", err)
+	}
+	progress := waitForBackfill(t, u)
+	if !progress.Done || progress.Error != "" {
+		t.Fatalf("Got %+v, expected backfill to be done.", progress)
+	}
+	if progress.Scanned != 14 {
+		t.Errorf("Scanned %d updates, expected 14.", progress.Scanned)
+	}
+
+	// Routes can be guessed once a vehicle has five updates.
+	expected := []string{"", "", "", "", "west", "west", "east"}
+	for i, update := range db.updates {
+		if update.VehicleID == "1" && update.Route != expected[i/2] {
+			t.Errorf("Got route %q for update %d, expected %q.", update.Route, i/2, expected[i/2])
+		}
+		if update.VehicleID == "2" && update.Route != "" {
+			t.Errorf("Got route %q for off-route update %d, expected none.", update.Route, i/2)
+		}
+	}
+	if progress.Attributed != 2 {
+		t.Errorf("Attributed %d updates, expected 2.", progress.Attributed)
+	}
+
+	// Resuming from the end finds nothing left to do.
+	if err := u.StartRouteBackfill("14"); err != nil {
+		t.Fatalf("Unable to resume backfill: %v", err)
+	}
+	if progress := waitForBackfill(t, u); !progress.Done || progress.Scanned != 0 {
+		t.Errorf("Got %+v after resuming at the end, expected nothing scanned.", progress)
+	}
+}
+
+func TestRouteBackfillFailure(t *testing.T) {
+	db := &mockDatabase{routesErr: errors.New("database is down")}
+	u, err := NewWithSource(Config{UpdateInterval: "10s", BackfillBatchSize: 10}, db, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	if err := u.StartRouteBackfill("5"); err != nil {
+		t.Fatalf("Unable to start backfill: %v", err)
+	}
+	progress := waitForBackfill(t, u)
+	if progress.Done || progress.Error == "" || progress.Cursor != "5" {
+		t.Errorf("Got %+v, expected failed backfill that can be resumed at 5.", progress)
+	}
+}
@@ -0,0 +1,112 @@
+package updater
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// routeBoundsKey identifies a route's path for caching its bounding box. Routes are modified
+// whenever their path changes, but variants switch paths without a modification, so the ends and
+// length of the path tell variants apart.
+type routeBoundsKey struct {
+	id          string
+	updated     time.Time
+	coords      int
+	first, last model.Coord
+}
+
+func newRouteBoundsKey(route *model.Route) routeBoundsKey {
+	key := routeBoundsKey{id: route.ID, updated: route.Updated, coords: len(route.Coords)}
+	if len(route.Coords) > 0 {
+		key.first = route.Coords[0]
+		key.last = route.Coords[len(route.Coords)-1]
+	}
+	return key
+}
+
+// boundsForRoutes returns the bounding box of each route's path, computing only those that
+// aren't cached. Boxes for routes that aren't given are forgotten.
+func (u *Updater) boundsForRoutes(routes []model.Route) []model.BoundingBox {
+	u.routeBoundsMu.Lock()
+	defer u.routeBoundsMu.Unlock()
+
+	boxes := make([]model.BoundingBox, len(routes))
+	cached := make(map[routeBoundsKey]model.BoundingBox, len(routes))
+	for i := range routes {
+		key := newRouteBoundsKey(&routes[i])
+		box, ok := u.routeBounds[key]
+		if !ok {
+			box = routes[i].Bounds()
+		}
+		boxes[i] = box
+		cached[key] = box
+	}
+	u.routeBounds = cached
+	return boxes
+}
+
+// boxDistance returns how far in degrees c is from the nearest point of box, like routeDistance.
+// It is zero if c is inside the box and infinite if the box is empty.
+func boxDistance(box model.BoundingBox, c model.Coord) float64 {
+	if box.Empty() {
+		return math.Inf(1)
+	}
+	dLat := math.Max(0, math.Max(box.MinLat-c.Lat, c.Lat-box.MaxLat))
+	dLng := math.Max(0, math.Max(box.MinLng-c.Lng, c.Lng-box.MaxLng))
+	return math.Sqrt(dLat*dLat + dLng*dLng)
+}
+
+// nearbyRoutes leaves out the disabled routes and those whose bounding boxes aren't nearby any of
+// the updates, which are newest first, so that their paths needn't be compared against every
+// update. Such routes are too far from every update to be ranked anyway. If MaxGuessRoutes is set, only
+// that many routes remain, those nearest the newest update.
+func (u *Updater) nearbyRoutes(routes []model.Route, updates []model.VehicleUpdate) []model.Route {
+	positions := make([]model.Coord, 0, len(updates))
+	for _, update := range updates {
+		lat, err := strconv.ParseFloat(update.Lat, 64)
+		if err != nil {
+			continue
+		}
+		lng, err := strconv.ParseFloat(update.Lng, 64)
+		if err != nil {
+			continue
+		}
+		positions = append(positions, model.Coord{Lat: lat, Lng: lng})
+	}
+	if len(positions) < len(updates) {
+		// Unparseable updates are compared with every route, so no route can be ruled out.
+		return routes
+	}
+
+	type nearbyRoute struct {
+		route model.Route
+		// distance is how far the box is from the newest update.
+		distance float64
+	}
+	nearby := []nearbyRoute{}
+	for i, box := range u.boundsForRoutes(routes) {
+		if !routes[i].Enabled {
+			continue
+		}
+		for _, position := range positions {
+			if boxDistance(box, position) <= nearbyRouteDistance {
+				nearby = append(nearby, nearbyRoute{routes[i], boxDistance(box, positions[0])})
+				break
+			}
+		}
+	}
+
+	if u.cfg.MaxGuessRoutes > 0 && len(nearby) > u.cfg.MaxGuessRoutes {
+		sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].distance < nearby[j].distance })
+		nearby = nearby[:u.cfg.MaxGuessRoutes]
+	}
+	filtered := make([]model.Route, len(nearby))
+	for i := range nearby {
+		filtered[i] = nearby[i].route
+	}
+	return filtered
+}
@@ -0,0 +1,132 @@
+package updater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// gridRoutes returns n enabled routes, each a straight line of points running east along its own
+// latitude, a hundredth of a degree apart, starting at 42.70.
+func gridRoutes(n, points int) []model.Route {
+	routes := []model.Route{}
+	for i := 0; i < n; i++ {
+		lat := 42.70 + float64(i)*0.01
+		coords := []model.Coord{}
+		for j := 0; j < points; j++ {
+			coords = append(coords, model.Coord{Lat: lat, Lng: -73.70 + float64(j)*0.0005})
+		}
+		routes = append(routes, model.Route{ID: fmt.Sprintf("route%d", i), Enabled: true, Coords: coords})
+	}
+	return routes
+}
+
+// updatesAlong returns updates, newest first, for a vehicle driving east along lat.
+func updatesAlong(lat float64, n int) []model.VehicleUpdate {
+	now := time.Now()
+	updates := []model.VehicleUpdate{}
+	for i := 0; i < n; i++ {
+		updates = append(updates, model.VehicleUpdate{
+			VehicleID: "1",
+			Lat:       fmt.Sprintf("%f", lat),
+			Lng:       fmt.Sprintf("%f", -73.69-float64(i)*0.0005),
+			Created:   now.Add(time.Duration(-i) * 10 * time.Second),
+		})
+	}
+	return updates
+}
+
+func TestNearbyRoutesKeepsGuess(t *testing.T) {
+	routes := gridRoutes(20, 40)
+	// Just north of route7.
+	updates := updatesAlong(42.7705, 10)
+	u, err := New(Config{UpdateInterval: "10s", FlatRouteGuess: true}, &mockDatabase{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	nearby := u.nearbyRoutes(routes, updates)
+	if len(nearby) != 1 || nearby[0].ID != "route7" {
+		t.Errorf("Got %d nearby routes, expected only route7.", len(nearby))
+	}
+
+	// The closest of every route is the one that's guessed.
+	distances := u.averageRouteDistances(routes, updates)
+	closest := ""
+	for _, route := range routes {
+		if closest == "" || distances[route.ID] < distances[closest] {
+			closest = route.ID
+		}
+	}
+	ranked := u.rankRoutes(routes, "1", updates)
+	if len(ranked) == 0 || ranked[0].Route.ID != closest || closest != "route7" {
+		t.Errorf("Got ranking %+v, expected %s first.", ranked, closest)
+	}
+}
+
+func TestNearbyRoutesMaxGuessRoutes(t *testing.T) {
+	routes := gridRoutes(3, 40)
+	// Squeeze the routes together so that the vehicle is near all of them.
+	for i := range routes {
+		for j := range routes[i].Coords {
+			routes[i].Coords[j].Lat = 42.70 + float64(i)*0.001
+		}
+	}
+	updates := updatesAlong(42.7021, 10)
+
+	for max, expected := range map[int]int{0: 3, 1: 1, 2: 2, 5: 3} {
+		u, err := New(Config{UpdateInterval: "10s", MaxGuessRoutes: max}, &mockDatabase{})
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		nearby := u.nearbyRoutes(routes, updates)
+		if len(nearby) != expected {
+			t.Errorf("Got %d routes with a maximum of %d, expected %d.", len(nearby), max, expected)
+		}
+		if max == 1 && nearby[0].ID != "route2" {
+			t.Errorf("Got %s, expected the nearest route, route2.", nearby[0].ID)
+		}
+	}
+
+	if _, err := New(Config{UpdateInterval: "10s", MaxGuessRoutes: -1}, &mockDatabase{}); err == nil {
+		t.Error("Expected an error for a negative maximum.")
+	}
+}
+
+func TestBoundsForRoutesCache(t *testing.T) {
+	routes := gridRoutes(3, 4)
+	u, err := New(Config{UpdateInterval: "10s"}, &mockDatabase{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	boxes := u.boundsForRoutes(routes)
+	if boxes[1] != routes[1].Bounds() {
+		t.Errorf("Got %+v, expected %+v.", boxes[1], routes[1].Bounds())
+	}
+	// A route whose path changed gets a new box, and the old one is forgotten.
+	routes[1].Coords = routes[1].Coords[:2]
+	routes[1].Updated = time.Now()
+	boxes = u.boundsForRoutes(routes)
+	if boxes[1] != routes[1].Bounds() {
+		t.Errorf("Got %+v after modification, expected %+v.", boxes[1], routes[1].Bounds())
+	}
+	if len(u.routeBounds) != 3 {
+		t.Errorf("Got %d cached boxes, expected 3.", len(u.routeBounds))
+	}
+}
+
+func BenchmarkRankRoutes(b *testing.B) {
+	routes := gridRoutes(50, 200)
+	updates := updatesAlong(42.7705, 30)
+	u, err := New(Config{UpdateInterval: "10s", FlatRouteGuess: true, FullRouteGuess: true}, &mockDatabase{})
+	if err != nil {
+		b.Fatalf("Unable to create updater: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u.rankRoutes(routes, "1", updates)
+	}
+}
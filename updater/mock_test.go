@@ -0,0 +1,206 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/wtg/shuttletracker/database"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// mockDatabase implements database.Database for updater tests. Calling a method
+// that isn't defined here panics, since the embedded interface is nil.
+type mockDatabase struct {
+	database.Database
+
+	mu        sync.Mutex
+	vehicles  []model.Vehicle
+	routes    []model.Route
+	routesErr error
+	updates   []model.VehicleUpdate
+	deletes   int
+	archives  int
+	// capped and cappedSince are the most recent arguments to DeleteUpdatesExceedingCountPerVehicle.
+	capped      int
+	cappedSince time.Time
+}
+
+func (db *mockDatabase) GetVehicle(vehicleID string, feed string) (model.Vehicle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, vehicle := range db.vehicles {
+		if vehicle.VehicleID == vehicleID && vehicle.Feed == feed {
+			return vehicle, nil
+		}
+	}
+	return model.Vehicle{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) SetVehicleHeartbeat(vehicleID string, feed string, heartbeat time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := range db.vehicles {
+		if db.vehicles[i].VehicleID == vehicleID && db.vehicles[i].Feed == feed {
+			db.vehicles[i].LastHeartbeat = heartbeat
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) GetEnabledVehicles() ([]model.Vehicle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	vehicles := []model.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		if vehicle.Enabled {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	return vehicles, nil
+}
+
+func (db *mockDatabase) SetVehiclesEnabled(vehicles []model.VehicleKey, enabled bool) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	matched := 0
+	for i := range db.vehicles {
+		for _, vehicle := range vehicles {
+			if db.vehicles[i].Key() == vehicle {
+				db.vehicles[i].Enabled = enabled
+				db.vehicles[i].Updated = time.Now()
+				matched++
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (db *mockDatabase) GetRoutes() ([]model.Route, error) {
+	return db.routes, db.routesErr
+}
+
+func (db *mockDatabase) GetRoute(routeID string) (model.Route, error) {
+	for _, route := range db.routes {
+		if route.ID == routeID {
+			return route, nil
+		}
+	}
+	return model.Route{}, mgo.ErrNotFound
+}
+
+func (db *mockDatabase) CreateUpdate(update *model.VehicleUpdate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.updates = append(db.updates, *update)
+	return nil
+}
+
+func (db *mockDatabase) GetLastUpdateForVehicle(vehicleID string, feed string) (model.VehicleUpdate, error) {
+	updates, _ := db.GetUpdatesForVehicleSince(vehicleID, feed, time.Time{})
+	if len(updates) == 0 {
+		return model.VehicleUpdate{}, mgo.ErrNotFound
+	}
+	return updates[0], nil
+}
+
+// GetUpdatesForVehicleSince returns updates newest first, like MongoDB.
+func (db *mockDatabase) GetUpdatesForVehicleSince(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	updates := []model.VehicleUpdate{}
+	for i := len(db.updates) - 1; i >= 0; i-- {
+		update := db.updates[i]
+		if update.VehicleID == vehicleID && update.Feed == feed && update.Created.After(since) {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+func (db *mockDatabase) GetUpdatesForVehicleSinceAscending(vehicleID string, feed string, since time.Time) ([]model.VehicleUpdate, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	updates := []model.VehicleUpdate{}
+	for _, update := range db.updates {
+		if update.VehicleID == vehicleID && update.Feed == feed && update.Created.After(since) {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+// GetUpdatesPage pages through updates in the order they were stored. Cursors are indexes.
+func (db *mockDatabase) GetUpdatesPage(vehicleID string, feed string, cursor string, limit int) ([]model.VehicleUpdate, string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil {
+			return nil, "", database.ErrInvalidCursor
+		}
+	}
+	end := start + limit
+	if end >= len(db.updates) {
+		return append([]model.VehicleUpdate{}, db.updates[start:]...), "", nil
+	}
+	return append([]model.VehicleUpdate{}, db.updates[start:end]...), strconv.Itoa(end), nil
+}
+
+func (db *mockDatabase) SetRouteForUpdate(vehicleID string, feed string, created time.Time, routeID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := range db.updates {
+		if db.updates[i].VehicleID == vehicleID && db.updates[i].Feed == feed && db.updates[i].Created.Equal(created) {
+			db.updates[i].Route = routeID
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *mockDatabase) DeleteUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	db.deletes++
+	return 0, nil
+}
+
+func (db *mockDatabase) DeleteUpdatesExceedingCountPerVehicle(max int, since time.Time) (int, error) {
+	db.capped, db.cappedSince = max, since
+	return 0, nil
+}
+
+func (db *mockDatabase) ArchiveUpdatesBeforePerVehicle(before time.Time) (int, error) {
+	db.archives++
+	return 0, nil
+}
+
+// feedLine formats a vehicle's position the way iTrak does.
+func feedLine(vehicleID string, lat, lng float64, time string) string {
+	return fmt.Sprintf("Vehicle ID:%s lat:%f lon:%f dir:90 spd:20 lck:1 time:%s date:09012017 trig:0 eof", vehicleID, lat, lng, time)
+}
+
+// newFeedServer returns a server that responds with lines as an iTrak data feed.
+func newFeedServer(lines ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(lines, ""))
+	}))
+}
+
+// fakeSource is a FeedSource that returns fixed updates, or an error.
+type fakeSource struct {
+	updates []model.VehicleUpdate
+	err     error
+}
+
+func (s *fakeSource) Fetch(ctx context.Context) ([]model.VehicleUpdate, error) {
+	return s.updates, s.err
+}
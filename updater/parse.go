@@ -0,0 +1,137 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedFields are the canonical names of the fields in each vehicle's data from the feed.
+var feedFields = []string{"id", "lat", "lng", "heading", "speed", "lock", "time", "date", "status"}
+
+// optionalFeedFields are the canonical names of fields that only some feeds report. iTrak reports
+// none of them, so they are only read once they're given an alias.
+var optionalFeedFields = []string{"occupancy"}
+
+// defaultFieldAliases maps each canonical field name to the name iTrak uses for it.
+var defaultFieldAliases = map[string]string{
+	"id":      "Vehicle ID",
+	"lat":     "lat",
+	"lng":     "lon",
+	"heading": "dir",
+	"speed":   "spd",
+	"lock":    "lck",
+	"time":    "time",
+	"date":    "date",
+	"status":  "trig",
+}
+
+// tokenRegexp matches "name:value" tokens. Names may contain spaces (as in "Vehicle ID"), but values may not.
+var tokenRegexp = regexp.MustCompile(`(?:^|\s)([A-Za-z][A-Za-z ]*?):(\S*)`)
+
+// fieldAliases merges configured aliases over the defaults and makes sure every required field has one.
+func fieldAliases(configured map[string]string) (map[string]string, error) {
+	aliases := make(map[string]string, len(defaultFieldAliases)+len(optionalFeedFields))
+	for field, alias := range defaultFieldAliases {
+		aliases[field] = alias
+	}
+	for _, field := range optionalFeedFields {
+		aliases[field] = ""
+	}
+	for field, alias := range configured {
+		field = strings.ToLower(field)
+		if _, ok := aliases[field]; !ok {
+			return nil, fmt.Errorf("unknown feed field %q", field)
+		}
+		aliases[field] = alias
+	}
+	for _, field := range feedFields {
+		if aliases[field] == "" {
+			return nil, fmt.Errorf("feed field %q is not mapped", field)
+		}
+	}
+	return aliases, nil
+}
+
+// parseVehicleData extracts each field from one vehicle's data in the feed. Fields
+// may appear in any order, but all of them must be present. Optional fields are
+// extracted if they have an alias and are present.
+func (s *itrakSource) parseVehicleData(data string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, match := range tokenRegexp.FindAllStringSubmatch(data, -1) {
+		tokens[match[1]] = match[2]
+	}
+
+	result := make(map[string]string, len(feedFields))
+	for _, field := range feedFields {
+		value, ok := tokens[s.fieldAliases[field]]
+		if !ok {
+			return nil, fmt.Errorf("missing %q for %s", s.fieldAliases[field], field)
+		}
+		result[field] = value
+	}
+	for _, field := range optionalFeedFields {
+		if s.fieldAliases[field] == "" {
+			continue
+		}
+		if value, ok := tokens[s.fieldAliases[field]]; ok {
+			result[field] = value
+		}
+	}
+	return result, nil
+}
+
+// generateTimestamp parses the date (MMDDYYYY) and time (HHMMSS, UTC) reported by the feed. iTrak
+// might send a one-digit month for January through September, making the date seven digits long.
+// That's only accepted if SingleDigitMonths is set, since otherwise the date would be misread.
+func (s *itrakSource) generateTimestamp(date, clock string) (time.Time, error) {
+	if !isDigits(date) || !isDigits(clock) {
+		return time.Time{}, fmt.Errorf("date %q and time %q must be numeric", date, clock)
+	}
+	if len(clock) != 6 {
+		return time.Time{}, fmt.Errorf("time %q must be HHMMSS", clock)
+	}
+
+	var monthDigits int
+	switch {
+	case len(date) == 8:
+		monthDigits = 2
+	case len(date) == 7 && s.singleDigitMonths:
+		monthDigits = 1
+	case len(date) == 7:
+		return time.Time{}, fmt.Errorf("date %q has a one-digit month, but SingleDigitMonths isn't set", date)
+	default:
+		return time.Time{}, fmt.Errorf("date %q must be MMDDYYYY", date)
+	}
+	if monthDigits == 1 && date[0] == '0' {
+		return time.Time{}, fmt.Errorf("date %q has an invalid month", date)
+	}
+
+	month, _ := strconv.Atoi(date[:monthDigits])
+	day, _ := strconv.Atoi(date[monthDigits : monthDigits+2])
+	year, _ := strconv.Atoi(date[monthDigits+2:])
+	hour, _ := strconv.Atoi(clock[0:2])
+	minute, _ := strconv.Atoi(clock[2:4])
+	second, _ := strconv.Atoi(clock[4:6])
+
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	// time.Date normalizes out-of-range values, so make sure none were.
+	if t.Month() != time.Month(month) || t.Day() != day || t.Hour() != hour || t.Minute() != minute || t.Second() != second {
+		return time.Time{}, errInvalidTimestamp
+	}
+	return t, nil
+}
+
+var errInvalidTimestamp = errors.New("date or time is out of range")
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,96 @@
+package updater
+
+import (
+	"math"
+	"sort"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// RouteGuessPreview explains which route the updater would guess for a vehicle with some updates,
+// and why, so that the guessing thresholds can be tuned against real tracks.
+type RouteGuessPreview struct {
+	// RouteID is the route that would be guessed. It is empty if the vehicle isn't on any route.
+	RouteID string `json:"routeID"`
+	// Reason is "too-few-updates" if there weren't enough updates to guess, "obvious" if the
+	// latest update was squarely on one route, "closest" if the route was the closest of those
+	// within MaxDistance, or "off-route" if every route was too far away.
+	Reason string `json:"reason"`
+	// Updates is how many updates the guess was based on.
+	Updates int `json:"updates"`
+	// MaxDistance is how far a route's Distance may be for the vehicle to be on it.
+	MaxDistance float64                  `json:"maxDistance"`
+	Routes      []RouteGuessPreviewRoute `json:"routes"`
+}
+
+// RouteGuessPreviewRoute is how one route fared in a RouteGuessPreview.
+type RouteGuessPreviewRoute struct {
+	RouteID string `json:"routeID"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Distance is the weighted average distance in degrees of the updates from the route, with
+	// updates that weren't near it counted as 50 degrees further. It is null for disabled routes,
+	// and for every route when the guess didn't need distances.
+	Distance *float64 `json:"distance"`
+	// Confidence is between 0 and 1, and zero for routes the vehicle can't be on.
+	Confidence float64 `json:"confidence"`
+}
+
+// PreviewRouteGuess guesses the route of a vehicle with updates, which may be in any order, and
+// reports how each route fared.
+func (u *Updater) PreviewRouteGuess(updates []model.VehicleUpdate) (RouteGuessPreview, error) {
+	preview := RouteGuessPreview{Updates: len(updates), MaxDistance: u.maxRouteDistance(len(updates)), Routes: []RouteGuessPreviewRoute{}}
+	routes, err := u.db.GetRoutes()
+	if err != nil {
+		return preview, err
+	}
+
+	// Guessing expects the newest update first.
+	sorted := make([]model.VehicleUpdate, len(updates))
+	copy(sorted, updates)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Created.After(sorted[j].Created) })
+
+	ranked := u.rankRoutes(routes, "Preview", sorted)
+	if len(sorted) > 0 {
+		routes = u.routesAt(routes, sorted[0].Created)
+	}
+	confidences := make(map[string]float64, len(ranked))
+	for _, candidate := range ranked {
+		confidences[candidate.Route.ID] = candidate.Confidence
+	}
+	if len(ranked) > 0 {
+		preview.RouteID = ranked[0].Route.ID
+	}
+
+	obvious := false
+	if !u.cfg.FullRouteGuess && len(sorted) >= minRouteGuessUpdates {
+		_, obvious = obviousRoute(routes, &sorted[0])
+	}
+	var distances map[string]float64
+	switch {
+	case len(sorted) < minRouteGuessUpdates:
+		preview.Reason = "too-few-updates"
+	case obvious:
+		preview.Reason = "obvious"
+	case len(ranked) == 0:
+		preview.Reason = "off-route"
+		distances = u.averageRouteDistances(routes, sorted)
+	default:
+		preview.Reason = "closest"
+		distances = u.averageRouteDistances(routes, sorted)
+	}
+
+	for _, route := range routes {
+		previewRoute := RouteGuessPreviewRoute{
+			RouteID:    route.ID,
+			Name:       route.Name,
+			Enabled:    route.Enabled,
+			Confidence: confidences[route.ID],
+		}
+		if distance, ok := distances[route.ID]; ok && !math.IsInf(distance, 0) {
+			previewRoute.Distance = &distance
+		}
+		preview.Routes = append(preview.Routes, previewRoute)
+	}
+	return preview, nil
+}
@@ -0,0 +1,75 @@
+package updater
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestPreviewRouteGuess(t *testing.T) {
+	routes := []model.Route{
+		{ID: "north", Name: "North", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}}},
+		{ID: "loop", Name: "Loop", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}, {Lat: 42.702, Lng: -73.67}}},
+		{ID: "far", Name: "Far", Enabled: true, Coords: []model.Coord{{Lat: 42.800, Lng: -73.68}, {Lat: 42.800, Lng: -73.67}}},
+		{ID: "disabled", Name: "Disabled", Coords: []model.Coord{{Lat: 42.702, Lng: -73.67}}},
+	}
+	u, err := NewWithSource(Config{UpdateInterval: "10s", RouteGuessDecay: 0.9}, &mockDatabase{routes: routes}, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	// Past the end of North, oldest first.
+	now := time.Now()
+	updates := []model.VehicleUpdate{}
+	for i := 0; i < 10; i++ {
+		updates = append(updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.702", Lng: "-73.67", Created: now.Add(time.Duration(i-10) * 10 * time.Second)})
+	}
+	preview, err := u.PreviewRouteGuess(updates)
+	if err != nil {
+		t.Fatalf("Unable to preview route guess: %v", err)
+	}
+	if preview.RouteID != "loop" || preview.Reason != "closest" || preview.Updates != 10 || preview.MaxDistance != u.maxRouteDistance(10) {
+		t.Errorf("Got %+v, expected loop as the closest route over 10 updates.", preview)
+	}
+	if len(preview.Routes) != len(routes) {
+		t.Fatalf("Got %d routes, expected %d.", len(preview.Routes), len(routes))
+	}
+	byID := map[string]RouteGuessPreviewRoute{}
+	for _, route := range preview.Routes {
+		byID[route.RouteID] = route
+	}
+	loop, north, far := byID["loop"], byID["north"], byID["far"]
+	if loop.Distance == nil || north.Distance == nil || far.Distance == nil {
+		t.Fatalf("Got %+v, expected distances for every enabled route.", preview.Routes)
+	}
+	// The vehicle is right on Loop, 0.002 degrees from North, and off Far entirely.
+	if *loop.Distance > 1e-9 || math.Abs(*north.Distance-0.002) > 1e-6 || *far.Distance <= preview.MaxDistance {
+		t.Errorf("Got distances %v, %v, and %v, expected about 0, 0.002, and over %v.", *loop.Distance, *north.Distance, *far.Distance, preview.MaxDistance)
+	}
+	if math.Abs(loop.Confidence-0.95) > 0.01 || math.Abs(north.Confidence-0.05) > 0.01 || far.Confidence != 0 {
+		t.Errorf("Got confidences %v, %v, and %v, expected 0.95, 0.05, and 0.", loop.Confidence, north.Confidence, far.Confidence)
+	}
+	if disabled := byID["disabled"]; disabled.Distance != nil || disabled.Enabled {
+		t.Errorf("Got %+v, expected no distance for the disabled route.", disabled)
+	}
+
+	preview, err = u.PreviewRouteGuess(updates[:4])
+	if err != nil {
+		t.Fatalf("Unable to preview route guess: %v", err)
+	}
+	if preview.RouteID != "" || preview.Reason != "too-few-updates" {
+		t.Errorf("Got %+v, expected too few updates to guess.", preview)
+	}
+
+	// Squarely on Far at the end, after wandering.
+	updates = append(updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.800", Lng: "-73.68", Created: now})
+	preview, err = u.PreviewRouteGuess(updates)
+	if err != nil {
+		t.Fatalf("Unable to preview route guess: %v", err)
+	}
+	if preview.RouteID != "far" || preview.Reason != "obvious" {
+		t.Errorf("Got %+v, expected far to be obvious.", preview)
+	}
+}
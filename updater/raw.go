@@ -0,0 +1,72 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rawFeedPrefix and rawFeedExt surround the timestamp in each raw feed response's file name.
+const (
+	rawFeedPrefix = "feed-"
+	rawFeedExt    = ".txt"
+)
+
+// rawFeedStore keeps the most recent raw responses from the data feed as files in a directory,
+// so that problems parsing them can be reproduced.
+type rawFeedStore struct {
+	dir string
+	// retention is how many responses are kept. Older ones are removed.
+	retention int
+}
+
+func newRawFeedStore(dir string, retention int) (*rawFeedStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &rawFeedStore{dir: dir, retention: retention}, nil
+}
+
+// save writes a response received at t, then removes responses beyond the retention limit.
+func (s *rawFeedStore) save(body []byte, t time.Time) error {
+	// Names sort in the order the responses were received.
+	name := rawFeedPrefix + t.UTC().Format("20060102T150405.000000000Z") + rawFeedExt
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), body, 0644); err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+// prune removes all but the most recent retention responses.
+func (s *rawFeedStore) prune() error {
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.retention {
+		if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// names returns the file names of the stored responses, oldest first.
+func (s *rawFeedStore) names() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), rawFeedPrefix) && strings.HasSuffix(file.Name(), rawFeedExt) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package updater
+
+import (
+	"os"
+	"syscall"
+)
+
+// pollSignals make the updater fetch the feed immediately when PollOnSignal is set.
+var pollSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package updater
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+// countingSource is a FeedSource that reports each fetch.
+type countingSource struct {
+	fetches chan struct{}
+}
+
+func (s *countingSource) Fetch(ctx context.Context) ([]model.VehicleUpdate, error) {
+	s.fetches <- struct{}{}
+	return nil, nil
+}
+
+func TestPollOnSignal(t *testing.T) {
+	source := &countingSource{fetches: make(chan struct{}, 1)}
+	u, err := NewWithSource(Config{UpdateInterval: "1h", PollOnSignal: true}, &mockDatabase{}, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	go u.Run()
+	defer u.Stop()
+
+	wait := func() {
+		select {
+		case <-source.fetches:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Feed wasn't fetched.")
+		}
+	}
+	// The initial update happens once Run is listening for signals.
+	wait()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Unable to send signal: %v", err)
+	}
+	wait()
+}
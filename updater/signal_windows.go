@@ -0,0 +1,8 @@
+package updater
+
+import (
+	"os"
+)
+
+// pollSignals is empty, since Windows has no SIGUSR1 to poll on.
+var pollSignals []os.Signal
@@ -0,0 +1,229 @@
+package updater
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wtg/shuttletracker/log"
+	"github.com/wtg/shuttletracker/model"
+)
+
+// FeedSource provides the latest vehicle updates from a data feed.
+type FeedSource interface {
+	// Fetch returns the latest update reported for each vehicle. Updates have the vehicle ID used
+	// by the feed, speed in mph, and date and time as MMDDYYYY and HHMMSS in UTC. Vehicles whose
+	// data can't be understood are left out; an error means the feed itself couldn't be fetched.
+	Fetch(ctx context.Context) ([]model.VehicleUpdate, error)
+}
+
+// itrakSource fetches vehicle updates from an iTrak data feed over HTTP.
+type itrakSource struct {
+	url               string
+	fieldAliases      map[string]string
+	singleDigitMonths bool
+	timestampFallback bool
+	// header is sent with each request for the feed.
+	header http.Header
+	client http.Client
+	// raw stores each response if RawFeedDir is set.
+	raw *rawFeedStore
+}
+
+func newITrakSource(cfg Config) (*itrakSource, error) {
+	aliases, err := fieldAliases(cfg.FieldAliases)
+	if err != nil {
+		return nil, err
+	}
+	source := &itrakSource{
+		url:               cfg.DataFeed,
+		fieldAliases:      aliases,
+		singleDigitMonths: cfg.SingleDigitMonths,
+		timestampFallback: cfg.TimestampFallback,
+		header:            http.Header{},
+		client:            http.Client{Timeout: time.Second * 5},
+	}
+	if cfg.FeedUserAgent != "" {
+		source.header.Set("User-Agent", cfg.FeedUserAgent)
+	}
+	for name, value := range cfg.FeedHeaders {
+		source.header.Set(name, value)
+	}
+	if cfg.RawFeedDir != "" {
+		if cfg.RawFeedRetention < 1 {
+			return nil, errors.New("raw feed retention must be at least 1")
+		}
+		source.raw, err = newRawFeedStore(cfg.RawFeedDir, cfg.RawFeedRetention)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+// Fetch requests the iTrak data feed and parses each vehicle's data from it.
+func (s *itrakSource) Fetch(ctx context.Context) ([]model.VehicleUpdate, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The body is parsed as it arrives, so it's only kept whole if it's going to be stored.
+	var body io.Reader = resp.Body
+	if s.raw != nil {
+		raw := &bytes.Buffer{}
+		body = io.TeeReader(resp.Body, raw)
+		defer func() {
+			if err := s.raw.save(raw.Bytes(), time.Now()); err != nil {
+				log.WithError(err).Warn("Unable to store raw data feed response.")
+			}
+		}()
+	}
+	if resp.StatusCode != http.StatusOK {
+		if s.raw != nil {
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), maxVehicleDataSize)
+	scanner.Split(splitVehicleData)
+	updates := []model.VehicleUpdate{}
+	vehicles := 0
+	for scanner.Scan() {
+		vehicles++
+		update, err := s.parseUpdate(scanner.Text())
+		if err != nil {
+			log.WithError(err).Warn("Unable to parse vehicle data.")
+			continue
+		}
+		updates = append(updates, update)
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		// This is no vehicle's data, e.g. an error page. Keep what was parsed before it, and read
+		// the rest so that it's stored whole.
+		log.Warnf("Found more than %d bytes without '%s'; ignoring the rest of the feed.", maxVehicleDataSize, vehicleDelim)
+		if s.raw != nil {
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// TODO: Figure out if this handles == 1 vehicle correctly or always assumes > 1.
+	if vehicles <= 1 {
+		log.Warnf("Found no vehicles delineated by '%s'.", vehicleDelim)
+	}
+	return updates, nil
+}
+
+// maxVehicleDataSize is the most data read for a single vehicle while looking for vehicleDelim. A
+// vehicle's data is usually a few hundred bytes, so anything longer isn't vehicle data.
+const maxVehicleDataSize = 64 * 1024
+
+// vehicleDelim ends each vehicle's data in the iTrak data feed.
+var vehicleDelim = []byte("eof")
+
+// splitVehicleData is a bufio.SplitFunc that splits the iTrak data feed into each vehicle's data.
+// Anything after the last delimiter is incomplete and is dropped.
+func splitVehicleData(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.Index(data, vehicleDelim); i >= 0 {
+		return i + len(vehicleDelim), data[:i], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	// Wait for more of the body.
+	return 0, nil, nil
+}
+
+// parseUpdate creates an update from one vehicle's data in the feed.
+func (s *itrakSource) parseUpdate(vehicleData string) (model.VehicleUpdate, error) {
+	result, err := s.parseVehicleData(vehicleData)
+	if err != nil {
+		return model.VehicleUpdate{}, err
+	}
+
+	// Any token is accepted as a value, so make sure the numeric fields are numbers.
+	for _, field := range []string{"lat", "lng"} {
+		if _, err := parseFiniteFloat(result[field]); err != nil {
+			return model.VehicleUpdate{}, fmt.Errorf("invalid %s for vehicle %s: %v", field, result["id"], err)
+		}
+	}
+
+	// convert KPH to MPH
+	speedKMH, err := parseFiniteFloat(result["speed"])
+	if err != nil {
+		return model.VehicleUpdate{}, fmt.Errorf("invalid speed for vehicle %s: %v", result["id"], err)
+	}
+	speedMPH := kphToMPH(speedKMH)
+
+	var occupancy *int
+	if value, ok := result["occupancy"]; ok {
+		riders, err := strconv.Atoi(value)
+		if err != nil || riders < 0 {
+			return model.VehicleUpdate{}, fmt.Errorf("invalid occupancy %q for vehicle %s", value, result["id"])
+		}
+		occupancy = &riders
+	}
+
+	clock := result["time"]
+	synthesized := false
+	reported, err := s.generateTimestamp(result["date"], clock)
+	if err != nil && !s.timestampFallback {
+		return model.VehicleUpdate{}, fmt.Errorf("invalid timestamp for vehicle %s: %v", result["id"], err)
+	} else if err != nil {
+		log.WithError(err).Warnf("Invalid timestamp for vehicle %s; using the current time.", result["id"])
+		reported = time.Now().UTC()
+		clock = reported.Format("150405")
+		synthesized = true
+	}
+
+	return model.VehicleUpdate{
+		VehicleID: result["id"],
+		Lat:       result["lat"],
+		Lng:       result["lng"],
+		Heading:   result["heading"],
+		Speed:     strconv.FormatFloat(speedMPH, 'f', 5, 64),
+		Lock:      result["lock"],
+		Time:      clock,
+		// Store dates consistently, even if the feed dropped a leading zero.
+		Date:            reported.Format("01022006"),
+		Status:          result["status"],
+		Occupancy:       occupancy,
+		SynthesizedTime: synthesized,
+	}, nil
+}
+
+// parseFiniteFloat parses a number from the feed, which must be finite.
+func parseFiniteFloat(value string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%q is not finite", value)
+	}
+	return f, nil
+}
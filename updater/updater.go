@@ -1,12 +1,15 @@
 package updater
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
 	"math"
-	"net/http"
-	"regexp"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -18,22 +21,170 @@ import (
 	"github.com/wtg/shuttletracker/model"
 )
 
-// Updater handles periodically grabbing the latest vehicle location data from iTrak.
+// Updater handles periodically grabbing the latest vehicle location data from a feed source, iTrak by default.
 type Updater struct {
 	cfg            Config
 	updateInterval time.Duration
 	db             database.Database
-	dataRegexp     *regexp.Regexp
+	source         FeedSource
+
+	// updateMu keeps update cycles started by Run and UpdateNow from overlapping.
+	updateMu sync.Mutex
+
+	// failures is the number of consecutive times the data feed couldn't be fetched, and
+	// lastFetched is when it was last fetched. Both are guarded by failuresMu.
+	failures    int
+	lastFetched time.Time
+	failuresMu  sync.Mutex
+
+	// ctx is canceled when the updater is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed when Run returns.
+	done chan struct{}
+
+	// backfill is the progress of the latest route backfill. It is guarded by backfillMu.
+	backfill      model.RouteBackfill
+	backfillMu    sync.Mutex
+	backfillPause time.Duration
+
+	// lastCapped is when vehicles were last limited to MaxUpdatesPerVehicle updates. Only vehicles
+	// that have reported since then need to be limited again. It is guarded by updateMu.
+	lastCapped time.Time
+
+	// disableSilentAfter is the parsed DisableSilentAfter, or zero if it isn't set.
+	disableSilentAfter time.Duration
+
+	// loc is the location of Timezone, and serviceDayStart is how long after midnight
+	// ServiceDayStart is.
+	loc             *time.Location
+	serviceDayStart time.Duration
+
+	// routeBounds caches the bounding box of each route's path. It is guarded by routeBoundsMu.
+	routeBounds   map[routeBoundsKey]model.BoundingBox
+	routeBoundsMu sync.Mutex
+
+	// subscribers are called with each update after it is stored.
+	subscribers   []func(model.VehicleUpdate)
+	subscribersMu sync.RWMutex
 }
 
 type Config struct {
 	DataFeed       string
+	DataFeedID     string
 	UpdateInterval string
+	UpdateJitter   float64
+	// MaxPlausibleSpeed is the fastest (in mph) a vehicle could really travel. Updates implying
+	// faster travel are dropped. Zero disables the check.
+	MaxPlausibleSpeed float64
+	ArchiveUpdates    bool
+	// MaxUpdatesPerVehicle limits how many updates are kept for each vehicle. Zero means no limit.
+	MaxUpdatesPerVehicle int
+	// FieldAliases maps canonical field names (id, lat, lng, heading, speed, lock, time, date, status)
+	// to the names the feed uses for them, overriding iTrak's names.
+	FieldAliases map[string]string
+	// RouteGuessDecay is how much less each update counts than the next most recent one when
+	// guessing a vehicle's route, so that route changes are noticed sooner. It must be between 0 and 1.
+	// Zero means the default of 0.9.
+	RouteGuessDecay float64
+	// FlatRouteGuess counts every recent update equally when guessing a vehicle's route.
+	FlatRouteGuess bool
+	// FullRouteGuess always ranks routes over all of a vehicle's recent updates, even when its
+	// latest update is obviously on one route.
+	FullRouteGuess bool
+	// FeedFailureThreshold is how many consecutive times the data feed may fail to be fetched
+	// before the feed is considered down.
+	FeedFailureThreshold int
+	// SkipStationaryUpdates stores no update when a vehicle hasn't moved since its last one. The
+	// vehicle's heartbeat is still recorded.
+	SkipStationaryUpdates bool
+	// SingleDigitMonths accepts feed dates whose month has no leading zero, like "9012017".
+	SingleDigitMonths bool
+	// TimestampFallback keeps updates whose date or time is malformed, marked as having a
+	// synthesized time and using when they were fetched instead, rather than dropping them.
+	TimestampFallback bool
+	// RawFeedDir is a directory to store each raw response from the data feed in, for debugging.
+	// Responses aren't stored if it's empty.
+	RawFeedDir string
+	// RawFeedRetention is how many of the most recent raw responses are kept.
+	RawFeedRetention int
+	// MinLock is the lowest GPS lock value an update may report and still be stored, since
+	// positions without a good fix are unreliable. Zero stores updates regardless of lock.
+	MinLock int
+	// BackfillBatchSize is how many stored updates a route backfill examines at a time.
+	BackfillBatchSize int
+	// BackfillPause is how long a route backfill waits between batches, like "1s", so that it
+	// doesn't overwhelm the database.
+	BackfillPause string
+	// PollOnSignal fetches the feed whenever the process receives SIGUSR1, in addition to every
+	// UpdateInterval. It has no effect on Windows.
+	PollOnSignal bool
+	// FeedUserAgent is the User-Agent header sent when fetching the data feed.
+	FeedUserAgent string
+	// FeedHeaders are extra headers sent when fetching the data feed, such as an API key that the
+	// feed requires. They override FeedUserAgent if they include a User-Agent.
+	FeedHeaders map[string]string
+	// MaxUpdatesPerCycle is the most vehicle updates that are stored from a single fetch of the
+	// data feed. The feed never reports anywhere near this many vehicles unless it is corrupt or
+	// malicious, so the rest are dropped rather than each getting a goroutine. Zero means no limit.
+	MaxUpdatesPerCycle int
+	// DisableSilentAfter is how long an enabled vehicle may go without reporting, like "168h",
+	// before it is disabled so that the updater stops trying to match it. Re-enabling the vehicle
+	// gives it another full period. Vehicles are never disabled automatically if it's empty.
+	DisableSilentAfter string
+	// DuplicateVehicles decides which report is stored when the data feed reports a vehicle more
+	// than once in a single response: "last" (the default) or "first".
+	DuplicateVehicles string
+	// RequireHTTPSFeed refuses to start unless DataFeed is an HTTPS URL, since vehicles' positions
+	// would otherwise be sent unencrypted. A plain HTTP feed is only warned about if it's false,
+	// for feeds on a trusted network that don't offer HTTPS.
+	RequireHTTPSFeed bool
+	// MaxGuessRoutes is how many routes a vehicle's updates are compared against when guessing
+	// its route. Only the routes that pass nearest to the vehicle's latest position are compared.
+	// Zero compares every route that is near any of the updates.
+	MaxGuessRoutes int
+	// Timezone and ServiceDayStart are the API's, so that route variants run on the same service
+	// days that it reports. Variants' days are in UTC starting at midnight if they're empty.
+	Timezone        string
+	ServiceDayStart string
 }
 
-// New creates an Updater.
+// New creates an Updater that fetches from the iTrak data feed at DataFeed.
 func New(cfg Config, db database.Database) (*Updater, error) {
-	updater := &Updater{cfg: cfg, db: db}
+	if err := checkFeedScheme(cfg); err != nil {
+		return nil, err
+	}
+	source, err := newITrakSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithSource(cfg, db, source)
+}
+
+// checkFeedScheme makes sure that DataFeed is fetched over HTTPS if cfg requires it, and warns if
+// it isn't otherwise.
+func checkFeedScheme(cfg Config) error {
+	if cfg.DataFeed == "" && !cfg.RequireHTTPSFeed {
+		return nil
+	}
+	feedURL, err := url.Parse(cfg.DataFeed)
+	if err != nil {
+		return err
+	}
+	if feedURL.Scheme == "https" {
+		return nil
+	}
+	if cfg.RequireHTTPSFeed {
+		return errors.New("data feed must be an HTTPS URL")
+	}
+	log.Warn("Data feed isn't an HTTPS URL, so vehicle positions are sent unencrypted.")
+	return nil
+}
+
+// NewWithSource creates an Updater that fetches from source.
+func NewWithSource(cfg Config, db database.Database, source FeedSource) (*Updater, error) {
+	updater := &Updater{cfg: cfg, db: db, source: source, done: make(chan struct{})}
+	updater.ctx, updater.cancel = context.WithCancel(context.Background())
 
 	interval, err := time.ParseDuration(cfg.UpdateInterval)
 	if err != nil {
@@ -41,149 +192,404 @@ func New(cfg Config, db database.Database) (*Updater, error) {
 	}
 	updater.updateInterval = interval
 
-	// Match each API field with any number (+)
-	//   of the previous expressions (\d digit, \. escaped period, - negative number)
-	//   Specify named capturing groups to store each field from data feed
-	updater.dataRegexp = regexp.MustCompile(`(?P<id>Vehicle ID:([\d\.]+)) (?P<lat>lat:([\d\.-]+)) (?P<lng>lon:([\d\.-]+)) (?P<heading>dir:([\d\.-]+)) (?P<speed>spd:([\d\.-]+)) (?P<lock>lck:([\d\.-]+)) (?P<time>time:([\d]+)) (?P<date>date:([\d]+)) (?P<status>trig:([\d]+))`)
+	if cfg.UpdateJitter < 0 || cfg.UpdateJitter >= 1 {
+		return nil, errors.New("update jitter must be at least 0 and less than 1")
+	}
+
+	if cfg.MaxGuessRoutes < 0 {
+		return nil, errors.New("max guess routes must not be negative")
+	}
+
+	if cfg.RouteGuessDecay < 0 || cfg.RouteGuessDecay > 1 {
+		return nil, errors.New("route guess decay must be between 0 and 1")
+	}
+	if cfg.RouteGuessDecay == 0 {
+		updater.cfg.RouteGuessDecay = defaultRouteGuessDecay
+	}
+
+	if cfg.BackfillPause != "" {
+		updater.backfillPause, err = time.ParseDuration(cfg.BackfillPause)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.DuplicateVehicles {
+	case "", "last", "first":
+	default:
+		return nil, errors.New(`duplicate vehicles must be "first" or "last"`)
+	}
+
+	if cfg.DisableSilentAfter != "" {
+		updater.disableSilentAfter, err = time.ParseDuration(cfg.DisableSilentAfter)
+		if err != nil {
+			return nil, err
+		}
+		if updater.disableSilentAfter <= 0 {
+			return nil, errors.New("disable silent after must be positive")
+		}
+	}
+
+	updater.loc, err = time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ServiceDayStart != "" {
+		start, err := time.Parse("15:04", cfg.ServiceDayStart)
+		if err != nil {
+			return nil, err
+		}
+		updater.serviceDayStart = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	}
 
 	return updater, nil
 }
 
 func NewConfig(v *viper.Viper) *Config {
 	cfg := &Config{
-		UpdateInterval: "10s",
+		UpdateInterval:       "10s",
+		RouteGuessDecay:      defaultRouteGuessDecay,
+		FeedFailureThreshold: 3,
+		RawFeedRetention:     100,
+		BackfillBatchSize:    500,
+		BackfillPause:        "1s",
+		FeedUserAgent:        "shuttletracker (+https://github.com/wtg/shuttletracker)",
+		MaxUpdatesPerCycle:   1000,
+		DuplicateVehicles:    "last",
 	}
 	v.SetDefault("updater.updateinterval", cfg.UpdateInterval)
 	v.SetDefault("updater.datafeed", cfg.DataFeed)
+	v.SetDefault("updater.datafeedid", cfg.DataFeedID)
+	v.SetDefault("updater.updatejitter", cfg.UpdateJitter)
+	v.SetDefault("updater.maxplausiblespeed", cfg.MaxPlausibleSpeed)
+	v.SetDefault("updater.archiveupdates", cfg.ArchiveUpdates)
+	v.SetDefault("updater.maxupdatespervehicle", cfg.MaxUpdatesPerVehicle)
+	v.SetDefault("updater.fieldaliases", cfg.FieldAliases)
+	v.SetDefault("updater.routeguessdecay", cfg.RouteGuessDecay)
+	v.SetDefault("updater.flatrouteguess", cfg.FlatRouteGuess)
+	v.SetDefault("updater.fullrouteguess", cfg.FullRouteGuess)
+	v.SetDefault("updater.feedfailurethreshold", cfg.FeedFailureThreshold)
+	v.SetDefault("updater.skipstationaryupdates", cfg.SkipStationaryUpdates)
+	v.SetDefault("updater.singledigitmonths", cfg.SingleDigitMonths)
+	v.SetDefault("updater.timestampfallback", cfg.TimestampFallback)
+	v.SetDefault("updater.rawfeeddir", cfg.RawFeedDir)
+	v.SetDefault("updater.rawfeedretention", cfg.RawFeedRetention)
+	v.SetDefault("updater.minlock", cfg.MinLock)
+	v.SetDefault("updater.backfillbatchsize", cfg.BackfillBatchSize)
+	v.SetDefault("updater.backfillpause", cfg.BackfillPause)
+	v.SetDefault("updater.pollonsignal", cfg.PollOnSignal)
+	v.SetDefault("updater.feeduseragent", cfg.FeedUserAgent)
+	v.SetDefault("updater.feedheaders", cfg.FeedHeaders)
+	v.SetDefault("updater.maxupdatespercycle", cfg.MaxUpdatesPerCycle)
+	v.SetDefault("updater.disablesilentafter", cfg.DisableSilentAfter)
+	v.SetDefault("updater.duplicatevehicles", cfg.DuplicateVehicles)
+	v.SetDefault("updater.requirehttpsfeed", cfg.RequireHTTPSFeed)
+	v.SetDefault("updater.maxguessroutes", cfg.MaxGuessRoutes)
 	return cfg
 }
 
-// Run updater forever.
+// Run updater until it is stopped.
 func (u *Updater) Run() {
+	defer close(u.done)
 	log.Debug("Updater started.")
-	ticker := time.Tick(u.updateInterval)
+
+	// Listen for signals asking for an update. The channel stays nil otherwise, so it never fires.
+	var polls chan os.Signal
+	if u.cfg.PollOnSignal && len(pollSignals) > 0 {
+		polls = make(chan os.Signal, 1)
+		signal.Notify(polls, pollSignals...)
+		defer signal.Stop(polls)
+	}
 
 	// Do one initial update.
 	u.update()
 
-	// Call update() every updateInterval.
-	for range ticker {
-		u.update()
+	// Call update() every updateInterval, give or take any configured jitter, and whenever
+	// we're signaled.
+	for {
+		select {
+		case <-u.ctx.Done():
+			log.Debug("Updater stopped.")
+			return
+		case <-time.After(u.nextInterval()):
+			u.update()
+		case sig := <-polls:
+			log.Debugf("Received %s; updating now.", sig)
+			u.update()
+		}
+	}
+}
+
+// UpdateNow fetches the feed and stores updates immediately instead of waiting for the next
+// interval. It waits for any update already in progress to finish first.
+func (u *Updater) UpdateNow() {
+	u.update()
+}
+
+// Stop makes Run return, canceling any fetch from the feed source that is in progress. Updates
+// that have already been fetched are still stored; wait on Done for Run to finish.
+func (u *Updater) Stop() {
+	u.cancel()
+}
+
+// Done returns a channel that is closed once Run has returned, after its last update cycle has
+// finished storing updates.
+func (u *Updater) Done() <-chan struct{} {
+	return u.done
+}
+
+// nextInterval returns how long to wait before the next update. With jitter configured,
+// updateInterval is randomly lengthened or shortened by up to that fraction of itself so that
+// multiple instances don't all hit the data feed at the same instant.
+func (u *Updater) nextInterval() time.Duration {
+	if u.cfg.UpdateJitter == 0 {
+		return u.updateInterval
+	}
+	jitter := (rand.Float64()*2 - 1) * u.cfg.UpdateJitter
+	return time.Duration(float64(u.updateInterval) * (1 + jitter))
+}
+
+// feedFailed records a failure to fetch the data feed. Occasional failures are expected, so
+// they're only logged as errors once there have been more in a row than FeedFailureThreshold.
+func (u *Updater) feedFailed(err error, msg string) {
+	u.failuresMu.Lock()
+	u.failures++
+	failures := u.failures
+	u.failuresMu.Unlock()
+
+	entry := log.WithError(err).WithField("failures", failures)
+	if failures > u.cfg.FeedFailureThreshold {
+		entry.Error(msg)
+	} else {
+		entry.Warn(msg)
 	}
 }
 
-// Send a request to iTrak API, get updated shuttle info,
+// feedSucceeded records that the data feed was fetched.
+func (u *Updater) feedSucceeded() {
+	u.failuresMu.Lock()
+	defer u.failuresMu.Unlock()
+	if u.failures > u.cfg.FeedFailureThreshold {
+		log.Infof("Data feed recovered after %d failures.", u.failures)
+	}
+	u.failures = 0
+	u.lastFetched = time.Now()
+}
+
+// FeedHealthy reports whether the data feed has failed more than FeedFailureThreshold times in a row.
+func (u *Updater) FeedHealthy() bool {
+	u.failuresMu.Lock()
+	defer u.failuresMu.Unlock()
+	return u.failures <= u.cfg.FeedFailureThreshold
+}
+
+// LastFetched returns when the data feed was last fetched, or the zero time if it never has been.
+func (u *Updater) LastFetched() time.Time {
+	u.failuresMu.Lock()
+	defer u.failuresMu.Unlock()
+	return u.lastFetched
+}
+
+// Fetch updated shuttle info from the feed source,
 // store updated records in the database, and remove old records.
 func (u *Updater) update() {
-	// Make request to iTrak data feed
-	client := http.Client{Timeout: time.Second * 5}
-	resp, err := client.Get(u.cfg.DataFeed)
-	if err != nil {
-		log.WithError(err).Error("Could not get data feed.")
+	u.updateMu.Lock()
+	defer u.updateMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(u.ctx, u.updateInterval)
+	defer cancel()
+	updates, err := u.source.Fetch(ctx)
+	if u.ctx.Err() != nil {
+		// Stopped; this isn't the feed's fault.
 		return
 	}
-
-	// Read response body content
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.WithError(err).Error("Could not read data feed.")
+		u.feedFailed(err, "Could not fetch data feed.")
 		return
 	}
-	resp.Body.Close()
+	u.feedSucceeded()
 
-	delim := "eof"
-	// split the body of response by delimiter
-	vehiclesData := strings.Split(string(body), delim)
-	vehiclesData = vehiclesData[:len(vehiclesData)-1] // last element is EOF
+	// Storing two reports of the same vehicle at once would race on checking whether each is new.
+	updates = dedupeVehicles(updates, u.cfg.DuplicateVehicles == "first")
 
-	// TODO: Figure out if this handles == 1 vehicle correctly or always assumes > 1.
-	if len(vehiclesData) <= 1 {
-		log.Warnf("Found no vehicles delineated by '%s'.", delim)
+	if max := u.cfg.MaxUpdatesPerCycle; max > 0 && len(updates) > max {
+		log.Errorf("Data feed returned %d vehicle updates; only storing the first %d.", len(updates), max)
+		updates = updates[:max]
 	}
 
 	wg := sync.WaitGroup{}
-	// for parsed data, update each vehicle
-	for _, vehicleData := range vehiclesData {
+	// for fetched updates, update each vehicle
+	for _, update := range updates {
 		wg.Add(1)
-		go func(vehicleData string) {
+		go func(update model.VehicleUpdate) {
 			defer wg.Done()
-			match := u.dataRegexp.FindAllStringSubmatch(vehicleData, -1)[0]
-			// Store named capturing group and matching expression as a key value pair
-			result := map[string]string{}
-			for i, item := range match {
-				result[u.dataRegexp.SubexpNames()[i]] = item
-			}
+			u.store(update)
+		}(update)
+	}
+	wg.Wait()
+	log.Debugf("Updated vehicles.")
 
-			// Create new vehicle update & insert update into database
+	u.prune()
+	u.disableSilentVehicles(time.Now())
+}
 
-			// convert KPH to MPH
-			speedKMH, err := strconv.ParseFloat(strings.Replace(result["speed"], "spd:", "", -1), 64)
-			if err != nil {
-				log.Error(err)
-				return
-			}
-			speedMPH := kphToMPH(speedKMH)
-			speedMPHString := strconv.FormatFloat(speedMPH, 'f', 5, 64)
-
-			route := model.Route{}
-
-			vehicleID := strings.Replace(result["id"], "Vehicle ID:", "", -1)
-			vehicle, err := u.db.GetVehicle(vehicleID)
-			if err == mgo.ErrNotFound {
-				log.Warnf("Unknown vehicle ID \"%s\" returned by iTrak. Make sure all vehicles have been added.", vehicleID)
-				return
-			} else if err != nil {
-				log.WithError(err).Error("Unable to fetch vehicle.")
-				return
-			}
+// dedupeVehicles keeps one update for each vehicle, either its first or its last, in the order
+// the kept updates were reported.
+func dedupeVehicles(updates []model.VehicleUpdate, keepFirst bool) []model.VehicleUpdate {
+	keep := make(map[string]int, len(updates))
+	for i, update := range updates {
+		if _, ok := keep[update.VehicleID]; ok && keepFirst {
+			continue
+		}
+		keep[update.VehicleID] = i
+	}
+	if len(keep) == len(updates) {
+		return updates
+	}
 
-			// determine if this is a new update from itrak by comparing timestamps
-			lastUpdate, err := u.db.GetLastUpdateForVehicle(vehicle.VehicleID)
-			if err != nil && err != mgo.ErrNotFound {
-				log.WithError(err).Error("Unable to retrieve last update.")
-				return
-			}
-			itrakTime := strings.Replace(result["time"], "time:", "", -1)
-			itrakDate := strings.Replace(result["date"], "date:", "", -1)
-			if err == nil {
-				if lastUpdate.Time == itrakTime && lastUpdate.Date == itrakDate {
-					// Timestamp is not new; don't store update.
-					return
-				}
-			}
-			log.Debugf("Updating %s.", vehicle.VehicleName)
+	deduped := make([]model.VehicleUpdate, 0, len(keep))
+	for i, update := range updates {
+		if keep[update.VehicleID] == i {
+			deduped = append(deduped, update)
+		}
+	}
+	log.Warnf("Data feed reported %d vehicles more than once.", len(updates)-len(deduped))
+	return deduped
+}
 
-			// vehicle found and no error
-			route, err = u.GuessRouteForVehicle(&vehicle)
-			if err != nil {
-				log.WithError(err).Error("Unable to guess route for vehicle.")
-				return
-			}
+// store saves an update fetched from the feed source if it is new and plausible, after
+// determining the vehicle's route and direction.
+func (u *Updater) store(update model.VehicleUpdate) {
+	route := model.Route{}
 
-			update := model.VehicleUpdate{
-				VehicleID: strings.Replace(result["id"], "Vehicle ID:", "", -1),
-				Lat:       strings.Replace(result["lat"], "lat:", "", -1),
-				Lng:       strings.Replace(result["lng"], "lon:", "", -1),
-				Heading:   strings.Replace(result["heading"], "dir:", "", -1),
-				Speed:     speedMPHString,
-				Lock:      strings.Replace(result["lock"], "lck:", "", -1),
-				Time:      itrakTime,
-				Date:      itrakDate,
-				Status:    strings.Replace(result["status"], "trig:", "", -1),
-				Created:   time.Now(),
-				Route:     route.ID,
-			}
+	vehicle, err := u.db.GetVehicle(update.VehicleID, u.cfg.DataFeedID)
+	if err == mgo.ErrNotFound {
+		log.Warnf("Unknown vehicle ID \"%s\" returned by the data feed. Make sure all vehicles have been added to this feed.", update.VehicleID)
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Unable to fetch vehicle.")
+		return
+	}
+
+	// Vehicle IDs are only unique within a feed, so updates are kept apart by their feed.
+	update.Feed = vehicle.Feed
+
+	// determine if this is a new update from the feed by comparing timestamps
+	lastUpdate, err := u.db.GetLastUpdateForVehicle(vehicle.VehicleID, vehicle.Feed)
+	if err != nil && err != mgo.ErrNotFound {
+		log.WithError(err).Error("Unable to retrieve last update.")
+		return
+	}
+	update.Created = time.Now()
+	hasLastUpdate := err == nil
+	if hasLastUpdate && lastUpdate.Time == update.Time && lastUpdate.Date == update.Date {
+		// Timestamp is not new; don't store update.
+		return
+	}
+
+	// The vehicle is alive, whether or not it has moved.
+	if err := u.db.SetVehicleHeartbeat(vehicle.VehicleID, vehicle.Feed, update.Created); err != nil {
+		log.WithError(err).Error("Unable to record vehicle heartbeat.")
+	}
 
-			if err := u.db.CreateUpdate(&update); err != nil {
-				log.WithError(err).Errorf("Could not insert vehicle update.")
+	if !u.locked(&update) {
+		log.Debugf("%s has a poor GPS lock.", vehicle.VehicleName)
+		return
+	}
+
+	if hasLastUpdate {
+		if u.cfg.SkipStationaryUpdates && lastUpdate.Lat == update.Lat && lastUpdate.Lng == update.Lng {
+			log.Debugf("%s hasn't moved.", vehicle.VehicleName)
+			return
+		}
+		if !u.plausible(&lastUpdate, &update) {
+			// GPS is misbehaving; don't let it pollute the vehicle's trail.
+			return
+		}
+	}
+	log.Debugf("Updating %s.", vehicle.VehicleName)
+
+	// vehicle found and no error
+	ranked, err := u.RankRoutesForVehicle(&vehicle)
+	if err != nil {
+		log.WithError(err).Error("Unable to guess route for vehicle.")
+		return
+	}
+	if len(ranked) > 0 {
+		route = ranked[0].Route
+	}
+	for _, candidate := range ranked {
+		update.RouteCandidates = append(update.RouteCandidates, model.RouteCandidate{
+			RouteID:    candidate.Route.ID,
+			Confidence: candidate.Confidence,
+		})
+	}
+
+	update.Route = route.ID
+	if route.ID != "" {
+		update.Direction, err = u.inferDirection(&route, &update)
+		if err != nil {
+			log.WithError(err).Error("Unable to infer direction of vehicle.")
+		}
+	}
+
+	if err := u.db.CreateUpdate(&update); err != nil {
+		log.WithError(err).Errorf("Could not insert vehicle update.")
+		return
+	}
+	u.notify(update)
+}
+
+// Subscribe registers f to be called with each update after it is stored. f is called from the
+// updater's goroutines, so it must not block.
+func (u *Updater) Subscribe(f func(model.VehicleUpdate)) {
+	u.subscribersMu.Lock()
+	defer u.subscribersMu.Unlock()
+	u.subscribers = append(u.subscribers, f)
+}
+
+// notify calls each subscriber with update.
+func (u *Updater) notify(update model.VehicleUpdate) {
+	u.subscribersMu.RLock()
+	defer u.subscribersMu.RUnlock()
+	for _, f := range u.subscribers {
+		f(update)
+	}
+}
+
+// prune removes updates older than one month, or older than a vehicle's own retention period.
+// They are moved to the archive instead if ArchiveUpdates is set. Vehicles are also limited to their
+// most recent MaxUpdatesPerVehicle updates if it is set, which only needs checking for vehicles
+// that have reported since the last time.
+func (u *Updater) prune() {
+	if u.cfg.MaxUpdatesPerVehicle > 0 {
+		capped := time.Now()
+		deleted, err := u.db.DeleteUpdatesExceedingCountPerVehicle(u.cfg.MaxUpdatesPerVehicle, u.lastCapped)
+		if err != nil {
+			log.WithError(err).Error("Unable to remove excess updates.")
+		} else {
+			u.lastCapped = capped
+			if deleted > 0 {
+				log.Debugf("Removed %d excess updates.", deleted)
 			}
-		}(vehicleData)
+		}
 	}
-	wg.Wait()
-	log.Debugf("Updated vehicles.")
 
-	// Prune updates older than one month
-	deleted, err := u.db.DeleteUpdatesBefore(time.Now().AddDate(0, -1, 0))
+	before := time.Now().AddDate(0, -1, 0)
+
+	if u.cfg.ArchiveUpdates {
+		archived, err := u.db.ArchiveUpdatesBeforePerVehicle(before)
+		if err != nil {
+			log.WithError(err).Error("Unable to archive old updates.")
+			return
+		}
+		if archived > 0 {
+			log.Debugf("Archived %d old updates.", archived)
+		}
+		return
+	}
+
+	deleted, err := u.db.DeleteUpdatesBeforePerVehicle(before)
 	if err != nil {
 		log.WithError(err).Error("Unable to remove old updates.")
 		return
@@ -193,32 +599,333 @@ func (u *Updater) update() {
 	}
 }
 
+// disableSilentVehicles disables enabled vehicles that haven't reported for DisableSilentAfter as
+// of now. A vehicle that was enabled or edited more recently than that is left alone, so that
+// re-enabling a silent vehicle sticks.
+func (u *Updater) disableSilentVehicles(now time.Time) {
+	if u.disableSilentAfter == 0 {
+		return
+	}
+	vehicles, err := u.db.GetEnabledVehicles()
+	if err != nil {
+		log.WithError(err).Error("Unable to get enabled vehicles.")
+		return
+	}
+
+	cutoff := now.Add(-u.disableSilentAfter)
+	silent := []model.VehicleKey{}
+	for _, vehicle := range vehicles {
+		lastSeen := vehicle.LastHeartbeat
+		if vehicle.Updated.After(lastSeen) {
+			lastSeen = vehicle.Updated
+		}
+		if lastSeen.IsZero() || !lastSeen.Before(cutoff) {
+			continue
+		}
+		log.Infof("Disabling vehicle %s, which hasn't reported since %s.", vehicle.VehicleID, lastSeen.Format(time.RFC3339))
+		silent = append(silent, vehicle.Key())
+	}
+	if len(silent) == 0 {
+		return
+	}
+	if _, err := u.db.SetVehiclesEnabled(silent, false); err != nil {
+		log.WithError(err).Error("Unable to disable silent vehicles.")
+	}
+}
+
+// obviousRoute returns the route an update is squarely on, if it is within onRouteDistance of
+// exactly one enabled route and no other enabled route is nearby. This saves ranking routes over
+// all of a vehicle's recent updates in the common case.
+func obviousRoute(routes []model.Route, update *model.VehicleUpdate) (model.Route, bool) {
+	lat, err := strconv.ParseFloat(update.Lat, 64)
+	if err != nil {
+		return model.Route{}, false
+	}
+	lng, err := strconv.ParseFloat(update.Lng, 64)
+	if err != nil {
+		return model.Route{}, false
+	}
+
+	var obvious *model.Route
+	for i := range routes {
+		if !routes[i].Enabled {
+			continue
+		}
+		distance := routeDistance(&routes[i], lat, lng)
+		if distance > nearbyRouteDistance {
+			continue
+		}
+		if distance > onRouteDistance || obvious != nil {
+			// Another route is too close to be sure.
+			return model.Route{}, false
+		}
+		obvious = &routes[i]
+	}
+	if obvious == nil {
+		return model.Route{}, false
+	}
+	return *obvious, true
+}
+
+// routeDistance returns the distance in degrees from a point to the nearest of a route's coordinates.
+func routeDistance(route *model.Route, lat, lng float64) float64 {
+	nearestDistance := math.Inf(0)
+	for _, coord := range route.Coords {
+		distance := math.Sqrt(math.Pow(lat-coord.Lat, 2) + math.Pow(lng-coord.Lng, 2))
+		if distance < nearestDistance {
+			nearestDistance = distance
+		}
+	}
+	return nearestDistance
+}
+
 // Convert kmh to mph
 func kphToMPH(kmh float64) float64 {
 	return kmh * 0.621371192
 }
 
+// locked reports whether an update's GPS lock is at least MinLock. Lock values that can't be
+// parsed count as no lock.
+func (u *Updater) locked(update *model.VehicleUpdate) bool {
+	if u.cfg.MinLock == 0 {
+		return true
+	}
+	lock, err := strconv.Atoi(update.Lock)
+	return err == nil && lock >= u.cfg.MinLock
+}
+
+// plausible reports whether a vehicle could really have produced update after prev. Updates that
+// report, or imply by their distance from prev, a speed above MaxPlausibleSpeed are not.
+func (u *Updater) plausible(prev, update *model.VehicleUpdate) bool {
+	if u.cfg.MaxPlausibleSpeed <= 0 {
+		return true
+	}
+
+	speed, err := strconv.ParseFloat(update.Speed, 64)
+	if err == nil && speed > u.cfg.MaxPlausibleSpeed {
+		log.Warnf("Dropping update for vehicle %s reporting implausible speed of %.1f mph.", update.VehicleID, speed)
+		return false
+	}
+
+	implied, err := impliedSpeed(prev, update)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to determine implied speed of vehicle %s.", update.VehicleID)
+		return true
+	}
+	if implied > u.cfg.MaxPlausibleSpeed {
+		log.Warnf("Dropping update for vehicle %s implying implausible speed of %.1f mph.", update.VehicleID, implied)
+		return false
+	}
+	return true
+}
+
+// impliedSpeed returns the speed in mph needed to travel between the positions of two updates in the time between them.
+func impliedSpeed(prev, update *model.VehicleUpdate) (float64, error) {
+	from, err := prev.Coord()
+	if err != nil {
+		return 0, err
+	}
+	to, err := update.Coord()
+	if err != nil {
+		return 0, err
+	}
+
+	miles := model.DistanceMeters(from, to) / model.MetersPerMile
+	hours := update.Created.Sub(prev.Created).Hours()
+	if miles == 0 {
+		return 0, nil
+	}
+	if hours <= 0 {
+		return math.Inf(1), nil
+	}
+	return miles / hours, nil
+}
+
+// directionWindow is how far back to look at a vehicle's updates when inferring its direction.
+const directionWindow = 2 * time.Minute
+
+// inferDirection determines which way a vehicle is traveling along a route from its recent
+// updates and the update that is about to be stored.
+func (u *Updater) inferDirection(route *model.Route, update *model.VehicleUpdate) (string, error) {
+	updates, err := u.db.GetUpdatesForVehicleSinceAscending(update.VehicleID, update.Feed, update.Created.Add(-directionWindow))
+	if err != nil {
+		return "", err
+	}
+
+	updates = append(updates, *update)
+	progress := make([]float64, 0, len(updates))
+	for i := range updates {
+		coord, err := updates[i].Coord()
+		if err != nil {
+			continue
+		}
+		if projection, ok := route.Project(coord); ok {
+			progress = append(progress, projection.Progress)
+		}
+	}
+	return model.InferDirection(progress), nil
+}
+
+// defaultRouteGuessDecay is the RouteGuessDecay used when none is configured.
+const defaultRouteGuessDecay = 0.9
+
+// routeGuessWeight returns how much the update at index i, counting back from the most recent,
+// contributes to a route guess.
+func (u *Updater) routeGuessWeight(i int) float64 {
+	if u.cfg.FlatRouteGuess {
+		return 1
+	}
+	return math.Pow(u.cfg.RouteGuessDecay, float64(i))
+}
+
+// RankedRoute is a route that a vehicle might be on.
+type RankedRoute struct {
+	Route model.Route
+	// Confidence is between 0 and 1. The confidences of all of a vehicle's RankedRoutes add up to 1.
+	Confidence float64
+}
+
+// awayRoutePenalty is added to the distance in degrees of each update that isn't near a route.
+const awayRoutePenalty = 50
+
+// maxAwayShare is the largest share of a vehicle's recent updates, by weight, that may be away
+// from a route for the vehicle to be on it.
+const maxAwayShare = 0.1
+
+// maxRouteDistance returns the furthest the weighted average distance of a vehicle's n recent
+// updates from a route can be for the vehicle to be on it. Updates away from a route are penalized
+// by awayRoutePenalty, so this is exceeded once more than maxAwayShare of the updates' weight was
+// away from the route. When newer updates count more, the newest one alone can carry more than
+// that, so the route is then only ruled out once the newest two updates' worth was away from it
+// and a single stray reading isn't enough.
+func (u *Updater) maxRouteDistance(n int) float64 {
+	share := maxAwayShare
+	if !u.cfg.FlatRouteGuess && n > 1 {
+		totalWeight := 0.0
+		for i := 0; i < n; i++ {
+			totalWeight += u.routeGuessWeight(i)
+		}
+		share = math.Max(share, (u.routeGuessWeight(0)+u.routeGuessWeight(1))/totalWeight)
+	}
+	return awayRoutePenalty * share
+}
+
+// confidenceEpsilon keeps confidences finite for vehicles exactly on a route's path. It's roughly
+// ten meters in degrees.
+const confidenceEpsilon = 0.0001
+
+// onRouteDistance is how close in degrees (roughly 20 meters) a vehicle's latest update must be
+// to a route for the vehicle to obviously be on it, as long as no other route is nearby.
+const onRouteDistance = 0.0002
+
+// minRouteGuessUpdates is how many recent updates a vehicle needs for its route to be guessed.
+const minRouteGuessUpdates = 5
+
+// routeGuessWindow is how far back a vehicle's updates are used to guess its route.
+const routeGuessWindow = 15 * time.Minute
+
+// nearbyRouteDistance is how close in degrees a route must be to an update to be nearby.
+// Updates further than this from a route count against it when ranking routes.
+const nearbyRouteDistance = .003
+
 // GuessRouteForVehicle returns a guess at what route the vehicle is on.
 // It may return an empty route if it does not believe a vehicle is on any route.
-func (u *Updater) GuessRouteForVehicle(vehicle *model.Vehicle) (route model.Route, err error) {
+func (u *Updater) GuessRouteForVehicle(vehicle *model.Vehicle) (model.Route, error) {
+	ranked, err := u.RankRoutesForVehicle(vehicle)
+	if err != nil || len(ranked) == 0 {
+		return model.Route{}, err
+	}
+	return ranked[0].Route, nil
+}
+
+// RankRoutesForVehicle returns the routes the vehicle might be on, most likely first. Where routes
+// overlap, a vehicle may plausibly be on several. It returns no routes if it does not believe the
+// vehicle is on any route.
+func (u *Updater) RankRoutesForVehicle(vehicle *model.Vehicle) ([]RankedRoute, error) {
 	routes, err := u.db.GetRoutes()
 	if err != nil {
-		log.Error(err)
+		return nil, err
 	}
+	updates, err := u.db.GetUpdatesForVehicleSince(vehicle.VehicleID, vehicle.Feed, time.Now().Add(-routeGuessWindow))
+	if err != nil {
+		return nil, err
+	}
+	return u.rankRoutes(routes, vehicle.VehicleName, updates), nil
+}
 
+// rankRoutes ranks routes by how likely it is that a vehicle with the given recent updates, newest
+// first, is on each of them.
+func (u *Updater) rankRoutes(routes []model.Route, vehicleName string, updates []model.VehicleUpdate) []RankedRoute {
+	if len(updates) < minRouteGuessUpdates {
+		// Can't make a guess with fewer than 5 updates.
+		log.Debugf("%v has too few recent updates (%d) to guess route.", vehicleName, len(updates))
+		return nil
+	}
+	routes = u.nearbyRoutes(u.routesAt(routes, updates[0].Created), updates)
+
+	if !u.cfg.FullRouteGuess {
+		if route, ok := obviousRoute(routes, &updates[0]); ok {
+			log.Debugf("%v obviously on %s route.", vehicleName, route.Name)
+			return []RankedRoute{{Route: route, Confidence: 1}}
+		}
+	}
+
+	// Routes the vehicle has strayed too far from are out of the running. Closer routes are
+	// more likely, in inverse proportion to their distance.
+	distances := u.averageRouteDistances(routes, updates)
+	maxDistance := u.maxRouteDistance(len(updates))
+	ranked := []RankedRoute{}
+	totalScore := 0.0
+	for _, route := range routes {
+		distance := distances[route.ID]
+		if !(distance <= maxDistance) {
+			continue
+		}
+		score := 1 / (distance + confidenceEpsilon)
+		totalScore += score
+		ranked = append(ranked, RankedRoute{Route: route, Confidence: score})
+	}
+	for i := range ranked {
+		ranked[i].Confidence /= totalScore
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return distances[ranked[i].Route.ID] < distances[ranked[j].Route.ID]
+	})
+
+	// not on a route
+	if len(ranked) == 0 {
+		log.Debugf("%v not on route.", vehicleName)
+		return ranked
+	}
+	log.Debugf("%v on %s route.", vehicleName, ranked[0].Route.Name)
+	return ranked
+}
+
+// routesAt returns routes as they run at t, so that vehicles are compared against the path of
+// whichever variant of each route is running.
+func (u *Updater) routesAt(routes []model.Route, t time.Time) []model.Route {
+	running := make([]model.Route, len(routes))
+	for i, route := range routes {
+		running[i] = route.AtTime(t.In(u.loc), u.serviceDayStart)
+	}
+	return running
+}
+
+// averageRouteDistances returns the weighted average distance of updates, newest first, from each
+// route. Updates that aren't near a route count heavily against it, and disabled routes are
+// infinitely far away.
+func (u *Updater) averageRouteDistances(routes []model.Route, updates []model.VehicleUpdate) map[string]float64 {
 	routeDistances := make(map[string]float64)
 	for _, route := range routes {
 		routeDistances[route.ID] = 0
 	}
 
-	updates, err := u.db.GetUpdatesForVehicleSince(vehicle.VehicleID, time.Now().Add(time.Minute*-15))
-	if len(updates) < 5 {
-		// Can't make a guess with fewer than 5 updates.
-		log.Debugf("%v has too few recent updates (%d) to guess route.", vehicle.VehicleName, len(updates))
-		return
-	}
+	// Updates are newest first, so each one is weighted less than the one before it.
+	totalWeight := 0.0
+	for i, update := range updates {
+		weight := u.routeGuessWeight(i)
+		totalWeight += weight
 
-	for _, update := range updates {
 		updateLatitude, err := strconv.ParseFloat(update.Lat, 64)
 		if err != nil {
 			log.Error(err)
@@ -232,47 +939,16 @@ func (u *Updater) GuessRouteForVehicle(vehicle *model.Vehicle) (route model.Rout
 			if !route.Enabled {
 				routeDistances[route.ID] += math.Inf(0)
 			}
-			nearestDistance := math.Inf(0)
-			for _, coord := range route.Coords {
-				distance := math.Sqrt(math.Pow(updateLatitude-coord.Lat, 2) +
-					math.Pow(updateLongitude-coord.Lng, 2))
-				if distance < nearestDistance {
-					nearestDistance = distance
-
-				}
+			nearestDistance := routeDistance(&route, updateLatitude, updateLongitude)
+			if nearestDistance > nearbyRouteDistance {
+				nearestDistance += awayRoutePenalty
 			}
-			if nearestDistance > .003 {
-				nearestDistance += 50
-			}
-			routeDistances[route.ID] += nearestDistance
+			routeDistances[route.ID] += nearestDistance * weight
 		}
 	}
 
-	minDistance := math.Inf(0)
-	var minRouteID string
 	for id := range routeDistances {
-		distance := routeDistances[id] / float64(len(updates))
-		if distance < minDistance {
-			minDistance = distance
-			minRouteID = id
-			// If more than ~5% of the last 100 samples were far away from a route, say the shuttle is not on a route
-			// This is extremely aggressive and requires a shuttle to be on a route for ~5 minutes before it registers as on the route
-			if minDistance > 5 {
-				minRouteID = ""
-			}
-		}
-	}
-
-	// not on a route
-	if minRouteID == "" {
-		log.Debugf("%v not on route; distance from nearest: %v", vehicle.VehicleName, minDistance)
-		return model.Route{}, nil
-	}
-
-	route, err = u.db.GetRoute(minRouteID)
-	if err != nil {
-		return route, err
+		routeDistances[id] /= totalWeight
 	}
-	log.Debugf("%v on %s route.", vehicle.VehicleName, route.Name)
-	return route, err
+	return routeDistances
 }
@@ -0,0 +1,1197 @@
+package updater
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wtg/shuttletracker/model"
+)
+
+func TestNextIntervalWithoutJitter(t *testing.T) {
+	u, err := New(Config{UpdateInterval: "10s"}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if interval := u.nextInterval(); interval != 10*time.Second {
+			t.Fatalf("Got %v, expected %v.", interval, 10*time.Second)
+		}
+	}
+}
+
+func TestNextIntervalWithJitter(t *testing.T) {
+	u, err := New(Config{UpdateInterval: "10s", UpdateJitter: 0.2}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	min := 8 * time.Second
+	max := 12 * time.Second
+	varied := false
+	for i := 0; i < 1000; i++ {
+		interval := u.nextInterval()
+		if interval < min || interval > max {
+			t.Fatalf("Got %v, expected between %v and %v.", interval, min, max)
+		}
+		if interval != 10*time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Error("Expected jitter to vary the interval.")
+	}
+}
+
+func TestNewRejectsInvalidJitter(t *testing.T) {
+	for _, jitter := range []float64{-0.1, 1, 1.5} {
+		if _, err := New(Config{UpdateInterval: "10s", UpdateJitter: jitter}, nil); err == nil {
+			t.Errorf("Expected error for jitter %v.", jitter)
+		}
+	}
+}
+
+func TestPlausible(t *testing.T) {
+	u, err := New(Config{UpdateInterval: "10s", MaxPlausibleSpeed: 100}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	now := time.Now()
+	prev := model.VehicleUpdate{Lat: "42.7300", Lng: "-73.6800", Speed: "20", Created: now.Add(-10 * time.Second)}
+
+	// About 111 meters in 10 seconds is roughly 25 mph.
+	sane := model.VehicleUpdate{Lat: "42.7310", Lng: "-73.6800", Speed: "25", Created: now}
+	if !u.plausible(&prev, &sane) {
+		t.Error("Expected sane update to be plausible.")
+	}
+
+	// About 11 kilometers in 10 seconds is not.
+	jump := model.VehicleUpdate{Lat: "42.8300", Lng: "-73.6800", Speed: "25", Created: now}
+	if u.plausible(&prev, &jump) {
+		t.Error("Expected update implying teleportation to be implausible.")
+	}
+
+	fast := model.VehicleUpdate{Lat: "42.7310", Lng: "-73.6800", Speed: "400", Created: now}
+	if u.plausible(&prev, &fast) {
+		t.Error("Expected update reporting absurd speed to be implausible.")
+	}
+
+	u.cfg.MaxPlausibleSpeed = 0
+	if !u.plausible(&prev, &jump) {
+		t.Error("Expected check to be disabled.")
+	}
+}
+
+func TestUpdateUsesVehiclesFromFeed(t *testing.T) {
+	feed := newFeedServer(feedLine("1", 42.73, -73.68, "120000"))
+	defer feed.Close()
+
+	for _, testCase := range []struct {
+		feedID   string
+		expected int
+	}{
+		{"", 0},
+		{"other", 1},
+	} {
+		db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", VehicleName: "Other feed's vehicle", Feed: "other"}}}
+		u, err := New(Config{DataFeed: feed.URL, DataFeedID: testCase.feedID, UpdateInterval: "10s"}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		u.update()
+		if len(db.updates) != testCase.expected {
+			t.Errorf("Feed %q stored %d updates, expected %d.", testCase.feedID, len(db.updates), testCase.expected)
+		}
+	}
+}
+
+func TestUpdateKeepsFeedsApart(t *testing.T) {
+	// Both vendors' feeds report a vehicle 1 at the same time.
+	feed := newFeedServer(feedLine("1", 42.73, -73.68, "120000"))
+	defer feed.Close()
+
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", Feed: "a"}, {VehicleID: "1", Feed: "b"}}}
+	for _, feedID := range []string{"a", "b"} {
+		u, err := New(Config{DataFeed: feed.URL, DataFeedID: feedID, UpdateInterval: "10s"}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		u.update()
+	}
+
+	// The second feed's update isn't mistaken for a repeat of the first's.
+	if len(db.updates) != 2 {
+		t.Fatalf("Stored %d updates, expected 2.", len(db.updates))
+	}
+	for i, feedID := range []string{"a", "b"} {
+		if db.updates[i].Feed != feedID {
+			t.Errorf("Got feed %q for update %d, expected %q.", db.updates[i].Feed, i, feedID)
+		}
+	}
+}
+
+func TestUpdateWithFieldAliases(t *testing.T) {
+	// Fields are renamed and reordered relative to iTrak's feed.
+	feed := newFeedServer("Bus:1 hdg:90 latitude:42.730000 longitude:-73.680000 speed:20 lck:1 trig:0 date:09012017 time:120000 eof")
+	defer feed.Close()
+
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}}}
+	aliases := map[string]string{"id": "Bus", "lat": "latitude", "lng": "longitude", "heading": "hdg", "speed": "speed"}
+	u, err := New(Config{DataFeed: feed.URL, UpdateInterval: "10s", FieldAliases: aliases}, db)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	u.update()
+	if len(db.updates) != 1 {
+		t.Fatalf("Stored %d updates, expected 1.", len(db.updates))
+	}
+	if update := db.updates[0]; update.Lat != "42.730000" || update.Heading != "90" {
+		t.Errorf("Got lat %s and heading %s, expected 42.730000 and 90.", update.Lat, update.Heading)
+	}
+}
+
+func TestUpdateStoresFromSource(t *testing.T) {
+	source := &fakeSource{updates: []model.VehicleUpdate{
+		{VehicleID: "1", Lat: "42.730000", Lng: "-73.680000", Speed: "12.42742", Time: "120000", Date: "09012017"},
+		{VehicleID: "2", Lat: "42.731000", Lng: "-73.681000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+		// Not a known vehicle, so it's ignored.
+		{VehicleID: "3", Lat: "42.732000", Lng: "-73.682000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+	}}
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}}}
+	u, err := NewWithSource(Config{UpdateInterval: "10s"}, db, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	notified := make(chan model.VehicleUpdate, 10)
+	u.Subscribe(func(update model.VehicleUpdate) { notified <- update })
+
+	u.update()
+	if len(db.updates) != 2 {
+		t.Fatalf("Stored %d updates, expected 2.", len(db.updates))
+	}
+	if len(notified) != 2 {
+		t.Errorf("Subscriber was notified of %d updates, expected 2.", len(notified))
+	}
+	for _, update := range db.updates {
+		if update.Created.IsZero() {
+			t.Errorf("Update for vehicle %s has no created time.", update.VehicleID)
+		}
+	}
+
+	// The same reports again aren't new.
+	u.update()
+	if len(db.updates) != 2 {
+		t.Errorf("Stored %d updates after repeated reports, expected 2.", len(db.updates))
+	}
+
+	source.err = errors.New("feed is down")
+	u.update()
+	if len(db.updates) != 2 {
+		t.Errorf("Stored %d updates after a failed fetch, expected 2.", len(db.updates))
+	}
+	if u.failures != 1 {
+		t.Errorf("Got %d failures, expected 1.", u.failures)
+	}
+}
+
+func TestUpdateMaxUpdatesPerCycle(t *testing.T) {
+	// A corrupt feed reporting far more vehicles than exist.
+	source := &fakeSource{}
+	db := &mockDatabase{}
+	for i := 0; i < 5000; i++ {
+		id := fmt.Sprint(i)
+		source.updates = append(source.updates, model.VehicleUpdate{VehicleID: id, Lat: "42.730000", Lng: "-73.680000", Speed: "0.00000", Time: "120000", Date: "09012017"})
+		db.vehicles = append(db.vehicles, model.Vehicle{VehicleID: id})
+	}
+	u, err := NewWithSource(Config{UpdateInterval: "10s", MaxUpdatesPerCycle: 100}, db, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	u.update()
+	if len(db.updates) != 100 {
+		t.Errorf("Stored %d updates, expected 100.", len(db.updates))
+	}
+}
+
+func TestUpdateDuplicateVehicles(t *testing.T) {
+	for _, testCase := range []struct {
+		duplicateVehicles string
+		expectedLat       string
+	}{
+		{"", "42.731000"},
+		{"last", "42.731000"},
+		{"first", "42.730000"},
+	} {
+		source := &fakeSource{updates: []model.VehicleUpdate{
+			{VehicleID: "1", Lat: "42.730000", Lng: "-73.680000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+			{VehicleID: "2", Lat: "42.740000", Lng: "-73.680000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+			{VehicleID: "1", Lat: "42.731000", Lng: "-73.680000", Speed: "0.00000", Time: "120005", Date: "09012017"},
+		}}
+		db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}}}
+		u, err := NewWithSource(Config{UpdateInterval: "10s", DuplicateVehicles: testCase.duplicateVehicles}, db, source)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+
+		u.update()
+		stored := 0
+		for _, update := range db.updates {
+			if update.VehicleID == "1" {
+				stored++
+				if update.Lat != testCase.expectedLat {
+					t.Errorf("Got latitude %s keeping %q, expected %s.", update.Lat, testCase.duplicateVehicles, testCase.expectedLat)
+				}
+			}
+		}
+		if stored != 1 || len(db.updates) != 2 {
+			t.Errorf("Stored %d updates for the repeated vehicle and %d in all keeping %q, expected 1 and 2.", stored, len(db.updates), testCase.duplicateVehicles)
+		}
+	}
+
+	if _, err := NewWithSource(Config{UpdateInterval: "10s", DuplicateVehicles: "both"}, &mockDatabase{}, &fakeSource{}); err == nil {
+		t.Error("Expected an error for an unknown duplicate vehicles setting.")
+	}
+}
+
+func TestDisableSilentVehicles(t *testing.T) {
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	db := &mockDatabase{vehicles: []model.Vehicle{
+		{VehicleID: "reporting", Enabled: true, LastHeartbeat: now},
+		{VehicleID: "decommissioned", Enabled: true, LastHeartbeat: now.Add(-2 * 24 * time.Hour)},
+		// Silent as long, but re-enabled since.
+		{VehicleID: "reenabled", Enabled: true, LastHeartbeat: now.Add(-2 * 24 * time.Hour), Updated: now},
+		{VehicleID: "disabled", LastHeartbeat: now.Add(-2 * 24 * time.Hour)},
+	}}
+	u, err := NewWithSource(Config{UpdateInterval: "10s", DisableSilentAfter: week.String()}, db, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	// Nothing has been silent for a week yet.
+	u.disableSilentVehicles(now)
+	for _, vehicle := range db.vehicles[:3] {
+		if !vehicle.Enabled {
+			t.Errorf("Vehicle %s was disabled too soon.", vehicle.VehicleID)
+		}
+	}
+
+	// Six days later, the decommissioned vehicle has been silent for eight days.
+	u.disableSilentVehicles(now.Add(6 * 24 * time.Hour))
+	enabled := map[string]bool{}
+	for _, vehicle := range db.vehicles {
+		enabled[vehicle.VehicleID] = vehicle.Enabled
+	}
+	expected := map[string]bool{"reporting": true, "decommissioned": false, "reenabled": true, "disabled": false}
+	if !reflect.DeepEqual(enabled, expected) {
+		t.Errorf("Got enabled vehicles %v, expected %v.", enabled, expected)
+	}
+}
+
+func TestDisableSilentVehiclesOff(t *testing.T) {
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1", Enabled: true, LastHeartbeat: time.Now().AddDate(-1, 0, 0)}}}
+	u, err := NewWithSource(Config{UpdateInterval: "10s"}, db, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	u.disableSilentVehicles(time.Now())
+	if !db.vehicles[0].Enabled {
+		t.Error("Vehicle was disabled without DisableSilentAfter set.")
+	}
+}
+
+func TestStop(t *testing.T) {
+	u, err := NewWithSource(Config{UpdateInterval: "1h"}, &mockDatabase{}, &fakeSource{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	go u.Run()
+
+	u.Stop()
+	select {
+	case <-u.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after Stop.")
+	}
+}
+
+// blockingSource returns from Fetch only once release is closed, even if it's canceled.
+type blockingSource struct {
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingSource) Fetch(ctx context.Context) ([]model.VehicleUpdate, error) {
+	close(s.fetching)
+	<-s.release
+	return nil, nil
+}
+
+func TestStopWaitsForUpdate(t *testing.T) {
+	source := &blockingSource{fetching: make(chan struct{}), release: make(chan struct{})}
+	u, err := NewWithSource(Config{UpdateInterval: "1h"}, &mockDatabase{}, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	go u.Run()
+	<-source.fetching
+
+	u.Stop()
+	select {
+	case <-u.Done():
+		t.Fatal("Done was closed while an update was in progress.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(source.release)
+	select {
+	case <-u.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done wasn't closed after the update finished.")
+	}
+}
+
+// TestConcurrentUpdates runs the ticker, manual updates, and status reads at once so that
+// "go test -race" can catch unsynchronized access to the updater's state.
+func TestConcurrentUpdates(t *testing.T) {
+	source := &fakeSource{updates: []model.VehicleUpdate{
+		{VehicleID: "1", Lat: "42.730000", Lng: "-73.680000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+		{VehicleID: "2", Lat: "42.731000", Lng: "-73.681000", Speed: "0.00000", Time: "120000", Date: "09012017"},
+	}}
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}}}
+	u, err := NewWithSource(Config{UpdateInterval: "1ms"}, db, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	u.Subscribe(func(model.VehicleUpdate) {})
+
+	stopped := make(chan struct{})
+	go func() {
+		u.Run()
+		close(stopped)
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				u.UpdateNow()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				u.FeedHealthy()
+				u.LastFetched()
+			}
+		}()
+	}
+	wg.Wait()
+	u.Stop()
+	<-stopped
+
+	if u.LastFetched().IsZero() {
+		t.Error("Expected the feed to have been fetched.")
+	}
+	// Updates are only stored once, however many cycles see them.
+	if len(db.updates) != 2 {
+		t.Errorf("Stored %d updates, expected 2.", len(db.updates))
+	}
+}
+
+func TestNewRejectsInvalidFieldAliases(t *testing.T) {
+	for _, aliases := range []map[string]string{
+		{"altitude": "alt"},
+		{"lat": ""},
+	} {
+		if _, err := New(Config{UpdateInterval: "10s", FieldAliases: aliases}, nil); err == nil {
+			t.Errorf("Expected error for aliases %v.", aliases)
+		}
+	}
+}
+
+func TestParseVehicleDataMissingField(t *testing.T) {
+	source, err := newITrakSource(Config{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if _, err := source.parseVehicleData("Vehicle ID:1 lat:42.73 lon:-73.68"); err == nil {
+		t.Error("Expected error for vehicle data missing fields.")
+	}
+}
+
+func TestParseUpdateInvalidNumbers(t *testing.T) {
+	source, err := newITrakSource(Config{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	for _, data := range []string{
+		"Vehicle ID:1 lat:garbage lon:-73.680000 dir:90 spd:20 lck:1 time:120000 date:09012017 trig:0",
+		"Vehicle ID:1 lat:42.730000 lon:-73.68W dir:90 spd:20 lck:1 time:120000 date:09012017 trig:0",
+		"Vehicle ID:1 lat:NaN lon:-73.680000 dir:90 spd:20 lck:1 time:120000 date:09012017 trig:0",
+		"Vehicle ID:1 lat:42.730000 lon:-73.680000 dir:90 spd:fast lck:1 time:120000 date:09012017 trig:0",
+	} {
+		if update, err := source.parseUpdate(data); err == nil {
+			t.Errorf("Got %+v for %q, expected the update to be dropped.", update, data)
+		}
+	}
+}
+
+func TestParseUpdateOccupancy(t *testing.T) {
+	data := "Vehicle ID:1 lat:42.730000 lon:-73.680000 dir:90 spd:20 lck:1 time:120000 date:09012017 trig:0 riders:%s"
+
+	// Occupancy isn't read unless it's given an alias.
+	source, err := newITrakSource(Config{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	update, err := source.parseUpdate(fmt.Sprintf(data, "14"))
+	if err != nil {
+		t.Fatalf("Unable to parse update: %v", err)
+	}
+	if update.Occupancy != nil {
+		t.Errorf("Got occupancy %d, expected none.", *update.Occupancy)
+	}
+
+	source, err = newITrakSource(Config{FieldAliases: map[string]string{"occupancy": "riders"}})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	update, err = source.parseUpdate(fmt.Sprintf(data, "14"))
+	if err != nil {
+		t.Fatalf("Unable to parse update: %v", err)
+	}
+	if update.Occupancy == nil || *update.Occupancy != 14 {
+		t.Errorf("Got %+v, expected an occupancy of 14.", update)
+	}
+
+	// It's still optional for each vehicle.
+	update, err = source.parseUpdate("Vehicle ID:1 lat:42.730000 lon:-73.680000 dir:90 spd:20 lck:1 time:120000 date:09012017 trig:0")
+	if err != nil {
+		t.Fatalf("Unable to parse update: %v", err)
+	}
+	if update.Occupancy != nil {
+		t.Errorf("Got occupancy %d, expected none.", *update.Occupancy)
+	}
+
+	for _, riders := range []string{"many", "-3"} {
+		if update, err := source.parseUpdate(fmt.Sprintf(data, riders)); err == nil {
+			t.Errorf("Got %+v for occupancy %q, expected the update to be dropped.", update, riders)
+		}
+	}
+}
+
+func TestFeedHealthy(t *testing.T) {
+	// failing is read by the feed's handler goroutine.
+	var failing atomic.Value
+	failing.Store(true)
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load().(bool) {
+			http.Error(w, "feed is down", http.StatusBadGateway)
+		}
+	}))
+	defer feed.Close()
+
+	u, err := New(Config{DataFeed: feed.URL, UpdateInterval: "10s", FeedFailureThreshold: 2}, &mockDatabase{})
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		u.update()
+		if healthy := u.FeedHealthy(); healthy != (i <= 2) {
+			t.Errorf("Got healthy %v after %d failures, expected %v.", healthy, i, i <= 2)
+		}
+	}
+
+	failing.Store(false)
+	u.update()
+	if !u.FeedHealthy() {
+		t.Error("Expected feed to be healthy after a successful fetch.")
+	}
+}
+
+func TestFeedHeaders(t *testing.T) {
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "Campus Shuttles" || r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "go away", http.StatusForbidden)
+		}
+	}))
+	defer feed.Close()
+
+	source, err := newITrakSource(Config{DataFeed: feed.URL})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if _, err := source.Fetch(context.Background()); err == nil {
+		t.Error("Expected an error without the right headers.")
+	}
+
+	cfg := Config{
+		DataFeed:      feed.URL,
+		FeedUserAgent: "Campus Shuttles",
+		// Viper lowercases keys.
+		FeedHeaders: map[string]string{"x-api-key": "secret"},
+	}
+	source, err = newITrakSource(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	// Headers must be sent on every fetch, not just the first.
+	for i := 0; i < 2; i++ {
+		if _, err := source.Fetch(context.Background()); err != nil {
+			t.Errorf("Unable to fetch with the right headers: %v", err)
+		}
+	}
+}
+
+func TestUpdateParkedVehicleHeartbeat(t *testing.T) {
+	// The vehicle reports a new time on each request, but never moves.
+	reports := 0
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reports++
+		fmt.Fprint(w, feedLine("1", 42.73, -73.68, fmt.Sprintf("1200%02d", reports)))
+	}))
+	defer feed.Close()
+
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}}}
+	u, err := New(Config{DataFeed: feed.URL, UpdateInterval: "10s", SkipStationaryUpdates: true}, db)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	var lastHeartbeat time.Time
+	for i := 0; i < 3; i++ {
+		u.update()
+		heartbeat := db.vehicles[0].LastHeartbeat
+		if !heartbeat.After(lastHeartbeat) {
+			t.Errorf("Heartbeat didn't advance on report %d.", i+1)
+		}
+		lastHeartbeat = heartbeat
+	}
+	if len(db.updates) != 1 {
+		t.Errorf("Stored %d updates, expected 1.", len(db.updates))
+	}
+}
+
+func TestUpdateMinLock(t *testing.T) {
+	source := &fakeSource{updates: []model.VehicleUpdate{
+		{VehicleID: "1", Lat: "42.730000", Lng: "-73.680000", Speed: "0.00000", Lock: "0", Time: "120000", Date: "09012017"},
+		{VehicleID: "2", Lat: "42.731000", Lng: "-73.681000", Speed: "0.00000", Lock: "1", Time: "120000", Date: "09012017"},
+		{VehicleID: "3", Lat: "42.732000", Lng: "-73.682000", Speed: "0.00000", Lock: "", Time: "120000", Date: "09012017"},
+	}}
+	db := &mockDatabase{vehicles: []model.Vehicle{{VehicleID: "1"}, {VehicleID: "2"}, {VehicleID: "3"}}}
+	u, err := NewWithSource(Config{UpdateInterval: "10s", MinLock: 1}, db, source)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	u.update()
+	if len(db.updates) != 1 || db.updates[0].VehicleID != "2" {
+		t.Fatalf("Got updates %+v, expected only the update with a good lock.", db.updates)
+	}
+	if db.updates[0].Lock != "1" {
+		t.Errorf("Got lock %q, expected it to be stored.", db.updates[0].Lock)
+	}
+	if db.vehicles[0].LastHeartbeat.IsZero() {
+		t.Error("Expected heartbeat for vehicle with a poor lock.")
+	}
+}
+
+func TestGenerateTimestamp(t *testing.T) {
+	table := []struct {
+		date              string
+		clock             string
+		singleDigitMonths bool
+		expected          time.Time
+		valid             bool
+	}{
+		{"01152017", "120000", false, time.Date(2017, 1, 15, 12, 0, 0, 0, time.UTC), true},
+		{"11152017", "235959", false, time.Date(2017, 11, 15, 23, 59, 59, 0, time.UTC), true},
+		{"1152017", "120000", true, time.Date(2017, 1, 15, 12, 0, 0, 0, time.UTC), true},
+		{"01152017", "120000", true, time.Date(2017, 1, 15, 12, 0, 0, 0, time.UTC), true},
+		// A one-digit month would otherwise be misread.
+		{"1152017", "120000", false, time.Time{}, false},
+		{"0152017", "120000", true, time.Time{}, false},
+		{"13152017", "120000", false, time.Time{}, false},
+		{"00152017", "120000", false, time.Time{}, false},
+		{"02302017", "120000", false, time.Time{}, false},
+		{"1x152017", "120000", false, time.Time{}, false},
+		{"152017", "120000", true, time.Time{}, false},
+		{"01152017", "1200", false, time.Time{}, false},
+		{"01152017", "250000", false, time.Time{}, false},
+	}
+
+	for _, testCase := range table {
+		source, err := newITrakSource(Config{SingleDigitMonths: testCase.singleDigitMonths})
+		if err != nil {
+			t.Fatalf("Unable to create source: %v", err)
+		}
+		timestamp, err := source.generateTimestamp(testCase.date, testCase.clock)
+		if (err == nil) != testCase.valid {
+			t.Errorf("Got error %v for %s %s, expected valid %v.", err, testCase.date, testCase.clock, testCase.valid)
+		}
+		if !timestamp.Equal(testCase.expected) {
+			t.Errorf("Got %v for %s %s, expected %v.", timestamp, testCase.date, testCase.clock, testCase.expected)
+		}
+	}
+}
+
+func TestParseUpdateTimestampFallback(t *testing.T) {
+	garbled := "Vehicle ID:1 lat:42.730000 lon:-73.680000 dir:90 spd:20 lck:1 time:12??00 date:09012017 trig:0"
+
+	strict, err := newITrakSource(Config{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if update, err := strict.parseUpdate(garbled); err == nil {
+		t.Errorf("Got %+v, expected the update to be dropped.", update)
+	}
+
+	fallback, err := newITrakSource(Config{TimestampFallback: true})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	before := time.Now().UTC().Truncate(time.Second)
+	update, err := fallback.parseUpdate(garbled)
+	if err != nil {
+		t.Fatalf("Unable to parse update: %v", err)
+	}
+	if !update.SynthesizedTime || update.Lat != "42.730000" || update.Lng != "-73.680000" {
+		t.Errorf("Got %+v, expected the position with a synthesized time.", update)
+	}
+	reported, err := time.Parse("01022006150405", update.Date+update.Time)
+	if err != nil || reported.Before(before) || reported.After(time.Now().UTC()) {
+		t.Errorf("Got date %s and time %s, expected the current time.", update.Date, update.Time)
+	}
+
+	// Well-formed timestamps are used as they are.
+	update, err = fallback.parseUpdate(feedLine("1", 42.73, -73.68, "120000"))
+	if err != nil {
+		t.Fatalf("Unable to parse update: %v", err)
+	}
+	if update.SynthesizedTime || update.Time != "120000" || update.Date != "09012017" {
+		t.Errorf("Got %+v, expected the feed's timestamp.", update)
+	}
+}
+
+func TestGuessRouteForVehicleRoutesError(t *testing.T) {
+	routesErr := errors.New("database is down")
+	db := &mockDatabase{routesErr: routesErr}
+	u, err := New(Config{UpdateInterval: "10s"}, db)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+
+	if _, err := u.GuessRouteForVehicle(&model.Vehicle{VehicleID: "1"}); err != routesErr {
+		t.Errorf("Got error %v, expected %v.", err, routesErr)
+	}
+}
+
+func TestGuessRouteForVehicleFavorsRecentUpdates(t *testing.T) {
+	routes := []model.Route{
+		{ID: "old", Enabled: true, Coords: []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.70, Lng: -73.67}}},
+		{ID: "new", Enabled: true, Coords: []model.Coord{{Lat: 42.80, Lng: -73.68}, {Lat: 42.80, Lng: -73.67}}},
+	}
+	// The vehicle spent a few minutes on the old route, then moved to the new one.
+	now := time.Now()
+	updates := []model.VehicleUpdate{}
+	for i := 0; i < 30; i++ {
+		lat := "42.70"
+		if i >= 15 {
+			lat = "42.80"
+		}
+		updates = append(updates, model.VehicleUpdate{VehicleID: "1", Lat: lat, Lng: "-73.68", Created: now.Add(time.Duration(i-30) * 10 * time.Second)})
+	}
+
+	for _, testCase := range []struct {
+		flat     bool
+		expected string
+	}{
+		{true, ""},
+		{false, "new"},
+	} {
+		db := &mockDatabase{routes: routes, updates: updates}
+		u, err := New(Config{UpdateInterval: "10s", RouteGuessDecay: 0.8, FlatRouteGuess: testCase.flat, FullRouteGuess: true}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		route, err := u.GuessRouteForVehicle(&model.Vehicle{VehicleID: "1"})
+		if err != nil {
+			t.Fatalf("Unable to guess route: %v", err)
+		}
+		if route.ID != testCase.expected {
+			t.Errorf("Flat %v guessed route %q, expected %q.", testCase.flat, route.ID, testCase.expected)
+		}
+	}
+}
+
+func TestGuessRouteForVehicleStrayUpdates(t *testing.T) {
+	routes := []model.Route{{ID: "west", Enabled: true, Coords: []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.70, Lng: -73.67}}}}
+	for _, testCase := range []struct {
+		strays   int
+		expected string
+	}{
+		{0, "west"},
+		{1, "west"},
+		{2, ""},
+	} {
+		// The vehicle has been on the route, except for its newest few updates.
+		now := time.Now()
+		updates := []model.VehicleUpdate{}
+		for i := 0; i < 30; i++ {
+			lat := "42.70"
+			if i >= 30-testCase.strays {
+				lat = "42.75"
+			}
+			updates = append(updates, model.VehicleUpdate{VehicleID: "1", Lat: lat, Lng: "-73.68", Created: now.Add(time.Duration(i-30) * 10 * time.Second)})
+		}
+
+		db := &mockDatabase{routes: routes, updates: updates}
+		u, err := New(Config{UpdateInterval: "10s"}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		route, err := u.GuessRouteForVehicle(&model.Vehicle{VehicleID: "1"})
+		if err != nil {
+			t.Fatalf("Unable to guess route: %v", err)
+		}
+		if route.ID != testCase.expected {
+			t.Errorf("Guessed route %q with %d stray updates, expected %q.", route.ID, testCase.strays, testCase.expected)
+		}
+	}
+}
+
+func TestGuessRouteForVehicleActiveVariant(t *testing.T) {
+	// The vehicle is driving the route's detour, well away from its usual path.
+	now := time.Now()
+	updates := []model.VehicleUpdate{}
+	for i := 0; i < 10; i++ {
+		updates = append(updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.80", Lng: "-73.68", Created: now.Add(time.Duration(i-10) * 10 * time.Second)})
+	}
+	route := model.Route{
+		ID:       "west",
+		Enabled:  true,
+		Coords:   []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.70, Lng: -73.67}},
+		Variants: []model.RouteVariant{{ID: "detour", Coords: []model.Coord{{Lat: 42.80, Lng: -73.68}, {Lat: 42.80, Lng: -73.67}}}},
+	}
+
+	for _, testCase := range []struct {
+		active   string
+		expected string
+	}{
+		{"", ""},
+		{"detour", "west"},
+	} {
+		route.ActiveVariant = testCase.active
+		db := &mockDatabase{routes: []model.Route{route}, updates: updates}
+		u, err := New(Config{UpdateInterval: "10s"}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		guessed, err := u.GuessRouteForVehicle(&model.Vehicle{VehicleID: "1"})
+		if err != nil {
+			t.Fatalf("Unable to guess route: %v", err)
+		}
+		if guessed.ID != testCase.expected {
+			t.Errorf("Active variant %q guessed route %q, expected %q.", testCase.active, guessed.ID, testCase.expected)
+		}
+	}
+}
+
+func TestRoutesAtServiceDay(t *testing.T) {
+	weekend := []model.Coord{{Lat: 42.80, Lng: -73.68}, {Lat: 42.80, Lng: -73.67}}
+	route := model.Route{
+		ID:       "west",
+		Coords:   []model.Coord{{Lat: 42.70, Lng: -73.68}, {Lat: 42.70, Lng: -73.67}},
+		Variants: []model.RouteVariant{{ID: "weekend", Coords: weekend, Days: []time.Weekday{time.Saturday, time.Sunday}}},
+	}
+	// 1:00 UTC on Saturday, September 2, 2017 is still Friday evening in New York.
+	saturdayUTC := time.Date(2017, 9, 2, 1, 0, 0, 0, time.UTC)
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		timezone        string
+		serviceDayStart string
+		t               time.Time
+		weekend         bool
+	}{
+		{"", "", saturdayUTC, true},
+		{"America/New_York", "", saturdayUTC, false},
+		{"America/New_York", "", time.Date(2017, 9, 2, 2, 0, 0, 0, ny), true},
+		// Before the service day starts, it's still Friday's service.
+		{"America/New_York", "03:00", time.Date(2017, 9, 2, 2, 0, 0, 0, ny), false},
+		{"America/New_York", "03:00", time.Date(2017, 9, 2, 4, 0, 0, 0, ny), true},
+	} {
+		u, err := NewWithSource(Config{UpdateInterval: "10s", Timezone: testCase.timezone, ServiceDayStart: testCase.serviceDayStart}, &mockDatabase{}, &fakeSource{})
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		running := u.routesAt([]model.Route{route}, testCase.t)[0]
+		if isWeekend := running.Coords[0] == weekend[0]; isWeekend != testCase.weekend {
+			t.Errorf("Got weekend variant %v at %v in %q starting at %q, expected %v.", isWeekend, testCase.t, testCase.timezone, testCase.serviceDayStart, testCase.weekend)
+		}
+	}
+
+	if _, err := NewWithSource(Config{UpdateInterval: "10s", ServiceDayStart: "3am"}, &mockDatabase{}, &fakeSource{}); err == nil {
+		t.Error("Expected an error for an invalid service day start.")
+	}
+}
+
+func TestRankRoutesForVehicleOverlappingRoutes(t *testing.T) {
+	// North and Loop share a stretch of road. Loop also heads north, and Far is nowhere near.
+	routes := []model.Route{
+		{ID: "north", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}}},
+		{ID: "loop", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}, {Lat: 42.702, Lng: -73.67}}},
+		{ID: "far", Enabled: true, Coords: []model.Coord{{Lat: 42.800, Lng: -73.68}, {Lat: 42.800, Lng: -73.67}}},
+	}
+
+	for _, testCase := range []struct {
+		lat      string
+		lng      string
+		expected map[string]float64
+	}{
+		// On the shared stretch, both routes are equally likely.
+		{"42.700", "-73.68", map[string]float64{"north": 0.5, "loop": 0.5}},
+		// Past the end of North, Loop is much more likely, though North is still nearby.
+		{"42.702", "-73.67", map[string]float64{"loop": 0.95, "north": 0.05}},
+	} {
+		now := time.Now()
+		db := &mockDatabase{routes: routes}
+		for i := 0; i < 10; i++ {
+			db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: testCase.lat, Lng: testCase.lng, Created: now.Add(time.Duration(i-10) * 10 * time.Second)})
+		}
+		u, err := New(Config{UpdateInterval: "10s", RouteGuessDecay: 0.9}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+
+		ranked, err := u.RankRoutesForVehicle(&model.Vehicle{VehicleID: "1"})
+		if err != nil {
+			t.Fatalf("Unable to rank routes: %v", err)
+		}
+		if len(ranked) != len(testCase.expected) {
+			t.Fatalf("Got %d candidates at %s, %s, expected %d.", len(ranked), testCase.lat, testCase.lng, len(testCase.expected))
+		}
+		total := 0.0
+		for i, candidate := range ranked {
+			expected, ok := testCase.expected[candidate.Route.ID]
+			if !ok || math.Abs(candidate.Confidence-expected) > 0.01 {
+				t.Errorf("Got confidence %v for %s, expected %v.", candidate.Confidence, candidate.Route.ID, expected)
+			}
+			if i > 0 && candidate.Confidence > ranked[i-1].Confidence {
+				t.Errorf("Candidates aren't ranked: %+v", ranked)
+			}
+			total += candidate.Confidence
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Errorf("Confidences add up to %v, expected 1.", total)
+		}
+	}
+}
+
+func TestRankRoutesForVehicleObviousRoute(t *testing.T) {
+	routes := []model.Route{
+		{ID: "west", Enabled: true, Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}, {Lat: 42.700, Lng: -73.67}}},
+		{ID: "east", Enabled: true, Coords: []model.Coord{{Lat: 42.800, Lng: -73.68}, {Lat: 42.800, Lng: -73.67}}},
+		{ID: "beside", Enabled: true, Coords: []model.Coord{{Lat: 42.802, Lng: -73.68}}},
+		{ID: "disabled", Coords: []model.Coord{{Lat: 42.700, Lng: -73.68}}},
+	}
+
+	for _, testCase := range []struct {
+		latest   string
+		flat     bool
+		full     bool
+		expected []string
+	}{
+		// Squarely on West, after a while on East. Averaging over every update wouldn't pick West.
+		{"42.700", false, false, []string{"west"}},
+		// Counting updates equally doesn't affect the short-circuit.
+		{"42.700", true, false, []string{"west"}},
+		// Unless it's turned off.
+		{"42.700", false, true, []string{"east", "beside"}},
+		// Squarely on East, but Beside is nearby, so all recent updates are considered.
+		{"42.800", false, false, []string{"east", "beside"}},
+	} {
+		now := time.Now()
+		db := &mockDatabase{routes: routes}
+		for i := 0; i < 9; i++ {
+			db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: "42.800", Lng: "-73.68", Created: now.Add(time.Duration(i-10) * 10 * time.Second)})
+		}
+		db.updates = append(db.updates, model.VehicleUpdate{VehicleID: "1", Lat: testCase.latest, Lng: "-73.68", Created: now})
+		u, err := New(Config{UpdateInterval: "10s", RouteGuessDecay: 0.9, FlatRouteGuess: testCase.flat, FullRouteGuess: testCase.full}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+
+		ranked, err := u.RankRoutesForVehicle(&model.Vehicle{VehicleID: "1"})
+		if err != nil {
+			t.Fatalf("Unable to rank routes: %v", err)
+		}
+		ids := []string{}
+		for _, candidate := range ranked {
+			ids = append(ids, candidate.Route.ID)
+		}
+		if !reflect.DeepEqual(ids, testCase.expected) {
+			t.Errorf("Got routes %v at %s with flat %v and full %v, expected %v.", ids, testCase.latest, testCase.flat, testCase.full, testCase.expected)
+		}
+		if len(testCase.expected) == 1 && len(ranked) == 1 && ranked[0].Confidence != 1 {
+			t.Errorf("Got confidence %v, expected 1.", ranked[0].Confidence)
+		}
+	}
+}
+
+func TestNewRejectsInvalidRouteGuessDecay(t *testing.T) {
+	for _, decay := range []float64{-0.1, 1.5} {
+		if _, err := New(Config{UpdateInterval: "10s", RouteGuessDecay: decay}, nil); err == nil {
+			t.Errorf("Expected error for decay %v.", decay)
+		}
+	}
+}
+
+func TestNewDefaultsRouteGuessDecay(t *testing.T) {
+	u, err := New(Config{UpdateInterval: "10s"}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	if u.cfg.RouteGuessDecay != defaultRouteGuessDecay {
+		t.Errorf("Got decay %v, expected %v.", u.cfg.RouteGuessDecay, defaultRouteGuessDecay)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		db := &mockDatabase{}
+		u, err := New(Config{UpdateInterval: "10s", ArchiveUpdates: archive}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		u.prune()
+
+		expectedDeletes, expectedArchives := 1, 0
+		if archive {
+			expectedDeletes, expectedArchives = 0, 1
+		}
+		if db.deletes != expectedDeletes || db.archives != expectedArchives {
+			t.Errorf("With archiving %v, got %d deletes and %d archives, expected %d and %d.",
+				archive, db.deletes, db.archives, expectedDeletes, expectedArchives)
+		}
+	}
+}
+
+func TestPruneMaxUpdatesPerVehicle(t *testing.T) {
+	for _, max := range []int{0, 10000} {
+		db := &mockDatabase{}
+		u, err := New(Config{UpdateInterval: "10s", MaxUpdatesPerVehicle: max}, db)
+		if err != nil {
+			t.Fatalf("Unable to create updater: %v", err)
+		}
+		u.prune()
+		if db.capped != max {
+			t.Errorf("Got cap of %d, expected %d.", db.capped, max)
+		}
+	}
+
+	// After the first prune, only vehicles that have reported since the previous one are checked.
+	db := &mockDatabase{}
+	u, err := New(Config{UpdateInterval: "10s", MaxUpdatesPerVehicle: 100}, db)
+	if err != nil {
+		t.Fatalf("Unable to create updater: %v", err)
+	}
+	u.prune()
+	if !db.cappedSince.IsZero() {
+		t.Errorf("Got first prune since %v, expected every vehicle to be checked.", db.cappedSince)
+	}
+	before := time.Now()
+	u.prune()
+	if db.cappedSince.After(before) || time.Since(db.cappedSince) > time.Minute {
+		t.Errorf("Got second prune since %v, expected the time of the first.", db.cappedSince)
+	}
+}
+
+func TestRequireHTTPSFeed(t *testing.T) {
+	for _, testCase := range []struct {
+		feed     string
+		require  bool
+		expected bool
+	}{
+		{"http://itrak.example.com/feed", false, true},
+		{"http://itrak.example.com/feed", true, false},
+		{"https://itrak.example.com/feed", true, true},
+		{"itrak.example.com/feed", true, false},
+		{"", true, false},
+		{"", false, true},
+	} {
+		_, err := New(Config{DataFeed: testCase.feed, UpdateInterval: "10s", RequireHTTPSFeed: testCase.require}, &mockDatabase{})
+		if (err == nil) != testCase.expected {
+			t.Errorf("Feed %q with RequireHTTPSFeed %v: got error %v.", testCase.feed, testCase.require, err)
+		}
+	}
+}
+
+func TestFetchStoresRawFeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttletracker")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	responses := 0
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responses++
+		fmt.Fprint(w, feedLine("1", 42.73, -73.68, fmt.Sprintf("1200%02d", responses)))
+	}))
+	defer feed.Close()
+
+	source, err := newITrakSource(Config{DataFeed: feed.URL, RawFeedDir: dir, RawFeedRetention: 2})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := source.Fetch(context.Background()); err != nil {
+			t.Fatalf("Unable to fetch: %v", err)
+		}
+	}
+
+	// Only the two most recent responses are kept.
+	names, err := source.raw.names()
+	if err != nil {
+		t.Fatalf("Unable to list raw responses: %v", err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("Got %d raw responses, expected 2.", len(names))
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, names[1]))
+	if err != nil {
+		t.Fatalf("Unable to read raw response: %v", err)
+	}
+	if expected := feedLine("1", 42.73, -73.68, "120003"); string(body) != expected {
+		t.Errorf("Got raw response %q, expected %q.", body, expected)
+	}
+}
+
+func TestFetchChunked(t *testing.T) {
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := feedLine("1", 42.73, -73.68, "120000") + "\n" + feedLine("2", 42.74, -73.69, "120000") + "\nVehicle ID:3 lat:42.75"
+		// Write the body a few bytes at a time, so that vehicles and delimiters are split across chunks.
+		for len(body) > 0 {
+			n := 7
+			if n > len(body) {
+				n = len(body)
+			}
+			fmt.Fprint(w, body[:n])
+			w.(http.Flusher).Flush()
+			body = body[n:]
+		}
+	}))
+	defer feed.Close()
+
+	source, err := newITrakSource(Config{DataFeed: feed.URL})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	updates, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to fetch: %v", err)
+	}
+	// The incomplete third vehicle after the last delimiter is dropped.
+	if len(updates) != 2 || updates[0].VehicleID != "1" || updates[1].VehicleID != "2" {
+		t.Errorf("Got updates %+v, expected vehicles 1 and 2.", updates)
+	}
+}
+
+func TestFetchOversizedVehicleData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttletracker")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An error page served as if it were the feed, after one vehicle's data.
+	body := feedLine("1", 42.73, -73.68, "120000") + "<html>" + strings.Repeat("x", maxVehicleDataSize) + "</html>"
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer feed.Close()
+
+	source, err := newITrakSource(Config{DataFeed: feed.URL, RawFeedDir: dir, RawFeedRetention: 1})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	updates, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to fetch: %v", err)
+	}
+	if len(updates) != 1 || updates[0].VehicleID != "1" {
+		t.Errorf("Got updates %+v, expected vehicle 1.", updates)
+	}
+
+	// The whole response is still stored.
+	names, err := source.raw.names()
+	if err != nil {
+		t.Fatalf("Unable to list raw responses: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("Got %d raw responses, expected 1.", len(names))
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatalf("Unable to read raw response: %v", err)
+	}
+	if string(raw) != body {
+		t.Errorf("Got raw response of %d bytes, expected %d.", len(raw), len(body))
+	}
+}
+
+func TestSplitVehicleData(t *testing.T) {
+	for body, expected := range map[string][]string{
+		"a eofb eof":   {"a ", "b "},
+		"a eofb eof\n": {"a ", "b "},
+		"a eofb":       {"a "},
+		"":             nil,
+		"no delimiter": nil,
+		"eofeof":       {"", ""},
+	} {
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		scanner.Split(splitVehicleData)
+		var tokens []string
+		for scanner.Scan() {
+			tokens = append(tokens, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("Got error %v for %q.", err, body)
+		}
+		if !reflect.DeepEqual(tokens, expected) {
+			t.Errorf("Got %q for %q, expected %q.", tokens, body, expected)
+		}
+	}
+}
+
+func TestFetchWithoutRawFeedDir(t *testing.T) {
+	source, err := newITrakSource(Config{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if source.raw != nil {
+		t.Error("Expected raw responses not to be stored by default.")
+	}
+}